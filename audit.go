@@ -0,0 +1,68 @@
+package quotacontrol
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/0xsequence/authcontrol"
+	"github.com/0xsequence/quotacontrol/proto"
+)
+
+var errNoAuditStore = proto.ErrMethodNotFound.WithCausef("audit store not configured")
+
+// ListAuditEvents returns the changes made to the project and its access keys, oldest first.
+// The interval is unbounded at the start and ends now by default.
+func (s server) ListAuditEvents(ctx context.Context, projectID uint64, from, to *time.Time) ([]*proto.AuditEvent, error) {
+	if s.store.AuditStore == nil {
+		return nil, errNoAuditStore
+	}
+
+	var min, max time.Time
+	if from != nil {
+		min = *from
+	}
+	if to != nil {
+		max = *to
+	} else {
+		max = time.Now().UTC()
+	}
+
+	events, err := s.store.AuditStore.ListAuditEvents(ctx, projectID, min, max)
+	if err != nil {
+		return nil, fmt.Errorf("list audit events: %w", err)
+	}
+	return events, nil
+}
+
+// audit records a change of the project, and of the access key if before or after are set.
+// The change is already done, so a failure is only logged.
+func (s server) audit(ctx context.Context, rpc string, projectID uint64, before, after *proto.AccessKey) {
+	s.auditEvent(ctx, proto.AuditEvent{ProjectID: projectID, RPC: rpc, Before: before, After: after})
+}
+
+// auditEvent records the change described by event, setting its actor and time.
+func (s server) auditEvent(ctx context.Context, event proto.AuditEvent) {
+	if s.store.AuditStore == nil {
+		return
+	}
+
+	event.Actor = auditActor(ctx)
+	event.CreatedAt = time.Now().UTC()
+	if err := s.store.AuditStore.InsertAuditEvent(ctx, &event); err != nil {
+		s.log.Error("insert audit event", slog.String("rpc", event.RPC), slog.Uint64("projectId", event.ProjectID), slog.Any("error", err))
+	}
+}
+
+// auditActor identifies the caller by its session type, followed by its account or service if any.
+func auditActor(ctx context.Context) string {
+	session, _ := authcontrol.GetSessionType(ctx)
+	if account, ok := authcontrol.GetAccount(ctx); ok {
+		return session.String() + ":" + account
+	}
+	if service, ok := authcontrol.GetService(ctx); ok {
+		return session.String() + ":" + service
+	}
+	return session.String()
+}
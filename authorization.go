@@ -0,0 +1,316 @@
+package quotacontrol
+
+import (
+	"context"
+	"time"
+
+	"github.com/0xsequence/authcontrol"
+	authproto "github.com/0xsequence/authcontrol/proto"
+	"github.com/0xsequence/quotacontrol/proto"
+)
+
+// policy is who can call a method, besides the admins that can call all of them.
+type policy struct {
+	// service lets the services call the method.
+	service bool
+	// perm is the permission the users need on the project, users can't call the method if it's UNAUTHORIZED.
+	perm proto.UserPermission
+}
+
+var (
+	adminOnly    = policy{}
+	serviceOnly  = policy{service: true}
+	projectRead  = policy{perm: proto.UserPermission_READ}
+	projectWrite = policy{perm: proto.UserPermission_READ_WRITE}
+	// usageRead is used by the clients to load the usage, and by the users to show it.
+	usageRead = policy{service: true, perm: proto.UserPermission_READ}
+)
+
+// NewAuthorizedServer wraps the server with the authorization of the callers, read from their authcontrol session:
+//   - admins can call all the methods.
+//   - services can call the methods used by Client, that read the quotas and sync the usage.
+//   - users can read the status, keys and usage of the projects where they have READ permission in PermissionStore,
+//     and manage the keys of the ones where they have READ_WRITE permission.
+//
+// The other callers are rejected with ErrPermissionDenied.
+func NewAuthorizedServer(server proto.QuotaControlServer, perms PermissionStore) proto.QuotaControlServer {
+	return &authorizedServer{next: server, perms: perms}
+}
+
+// authorizedServer doesn't embed the server, so each new method needs a policy.
+type authorizedServer struct {
+	next  proto.QuotaControlServer
+	perms PermissionStore
+}
+
+var _ proto.QuotaControlServer = (*authorizedServer)(nil)
+
+// trusted reports whether the caller can call the method regardless of the project.
+func (s *authorizedServer) trusted(ctx context.Context, p policy) bool {
+	session, _ := authcontrol.GetSessionType(ctx)
+	return session == authproto.SessionType_Admin || (p.service && session == authproto.SessionType_S2S)
+}
+
+// authorize checks that the caller can call the method on the project.
+func (s *authorizedServer) authorize(ctx context.Context, p policy, projectID uint64) error {
+	if s.trusted(ctx, p) {
+		return nil
+	}
+	session, _ := authcontrol.GetSessionType(ctx)
+	if p.perm == proto.UserPermission_UNAUTHORIZED {
+		return proto.ErrPermissionDenied.WithCausef("%s session not allowed", session)
+	}
+	account, ok := authcontrol.GetAccount(ctx)
+	if !ok {
+		return proto.ErrPermissionDenied.WithCausef("%s session has no account", session)
+	}
+	// a token of a project can't be used for another one
+	if id, ok := authcontrol.GetProjectID(ctx); ok && id != projectID {
+		return proto.ErrPermissionDenied.WithCausef("session of project %d", id)
+	}
+	// a failed lookup is denied like a missing permission, so the callers can't tell which projects exist
+	perm, _, err := s.perms.GetUserPermission(ctx, projectID, account)
+	if err != nil || !perm.CanAccess(p.perm) {
+		return proto.ErrPermissionDenied.WithCausef("%s permission required on project %d", p.perm, projectID)
+	}
+	return nil
+}
+
+// authorizeKey checks that the caller can call the method on the project of the access key.
+// The callers that are not trusted get the same error whether the key exists or not, and whatever its project is.
+func (s *authorizedServer) authorizeKey(ctx context.Context, p policy, accessKey string) error {
+	if s.trusted(ctx, p) {
+		return nil
+	}
+	denied := proto.ErrPermissionDenied.WithCausef("%s permission required on the project of the access key", p.perm)
+	k, err := s.next.GetAccessKey(ctx, accessKey)
+	if err != nil {
+		return denied
+	}
+	if err := s.authorize(ctx, p, k.ProjectID); err != nil {
+		return denied
+	}
+	return nil
+}
+
+func (s *authorizedServer) Ping(ctx context.Context) (string, error) {
+	return s.next.Ping(ctx)
+}
+
+func (s *authorizedServer) GetProjectStatus(ctx context.Context, projectID uint64) (*proto.ProjectStatus, error) {
+	if err := s.authorize(ctx, projectRead, projectID); err != nil {
+		return nil, err
+	}
+	return s.next.GetProjectStatus(ctx, projectID)
+}
+
+func (s *authorizedServer) GetAccessKey(ctx context.Context, accessKey string) (*proto.AccessKey, error) {
+	if err := s.authorizeKey(ctx, projectRead, accessKey); err != nil {
+		return nil, err
+	}
+	return s.next.GetAccessKey(ctx, accessKey)
+}
+
+func (s *authorizedServer) CreateAccessKey(ctx context.Context, projectID uint64, displayName string, requireOrigin bool, allowedOrigins []string, allowedServices []proto.Service, serviceLimit map[string]*proto.ServiceLimit, allowedChainIDs []uint64) (*proto.AccessKey, error) {
+	if err := s.authorize(ctx, projectWrite, projectID); err != nil {
+		return nil, err
+	}
+	return s.next.CreateAccessKey(ctx, projectID, displayName, requireOrigin, allowedOrigins, allowedServices, serviceLimit, allowedChainIDs)
+}
+
+func (s *authorizedServer) UpdateAccessKey(ctx context.Context, accessKey string, displayName *string, requireOrigin *bool, allowedOrigins []string, allowedServices []proto.Service, serviceLimit map[string]*proto.ServiceLimit, allowedChainIDs []uint64) (*proto.AccessKey, error) {
+	if err := s.authorizeKey(ctx, projectWrite, accessKey); err != nil {
+		return nil, err
+	}
+	return s.next.UpdateAccessKey(ctx, accessKey, displayName, requireOrigin, allowedOrigins, allowedServices, serviceLimit, allowedChainIDs)
+}
+
+func (s *authorizedServer) ListAccessKeys(ctx context.Context, projectID uint64, active *bool, service *proto.Service) ([]*proto.AccessKey, error) {
+	if err := s.authorize(ctx, projectRead, projectID); err != nil {
+		return nil, err
+	}
+	return s.next.ListAccessKeys(ctx, projectID, active, service)
+}
+
+func (s *authorizedServer) RotateAccessKey(ctx context.Context, accessKey string, gracePeriod *uint32) (*proto.AccessKey, error) {
+	if err := s.authorizeKey(ctx, projectWrite, accessKey); err != nil {
+		return nil, err
+	}
+	return s.next.RotateAccessKey(ctx, accessKey, gracePeriod)
+}
+
+func (s *authorizedServer) DisableAccessKey(ctx context.Context, accessKey string) (bool, error) {
+	if err := s.authorizeKey(ctx, projectWrite, accessKey); err != nil {
+		return false, err
+	}
+	return s.next.DisableAccessKey(ctx, accessKey)
+}
+
+func (s *authorizedServer) GetDefaultAccessKey(ctx context.Context, projectID uint64) (*proto.AccessKey, error) {
+	if err := s.authorize(ctx, projectRead, projectID); err != nil {
+		return nil, err
+	}
+	return s.next.GetDefaultAccessKey(ctx, projectID)
+}
+
+func (s *authorizedServer) SetDefaultAccessKey(ctx context.Context, projectID uint64, accessKey string) (bool, error) {
+	// the server checks that the key belongs to the project, and denies the missing keys the same way
+	if err := s.authorize(ctx, projectWrite, projectID); err != nil {
+		return false, err
+	}
+	return s.next.SetDefaultAccessKey(ctx, projectID, accessKey)
+}
+
+func (s *authorizedServer) GetProjectQuota(ctx context.Context, projectID uint64, now time.Time) (*proto.AccessQuota, error) {
+	if err := s.authorize(ctx, serviceOnly, projectID); err != nil {
+		return nil, err
+	}
+	return s.next.GetProjectQuota(ctx, projectID, now)
+}
+
+func (s *authorizedServer) GetAccessQuota(ctx context.Context, accessKey string, now time.Time) (*proto.AccessQuota, error) {
+	if err := s.authorize(ctx, serviceOnly, 0); err != nil {
+		return nil, err
+	}
+	return s.next.GetAccessQuota(ctx, accessKey, now)
+}
+
+func (s *authorizedServer) ClearAccessQuotaCache(ctx context.Context, projectID uint64) (bool, error) {
+	if err := s.authorize(ctx, adminOnly, projectID); err != nil {
+		return false, err
+	}
+	return s.next.ClearAccessQuotaCache(ctx, projectID)
+}
+
+func (s *authorizedServer) GrantCredits(ctx context.Context, projectID uint64, service proto.Service, amount int64, expiresAt time.Time, description *string) (*proto.CreditGrant, error) {
+	if err := s.authorize(ctx, adminOnly, projectID); err != nil {
+		return nil, err
+	}
+	return s.next.GrantCredits(ctx, projectID, service, amount, expiresAt, description)
+}
+
+func (s *authorizedServer) ListCreditGrants(ctx context.Context, projectID uint64, service *proto.Service, active *bool) ([]*proto.CreditGrant, error) {
+	if err := s.authorize(ctx, projectRead, projectID); err != nil {
+		return nil, err
+	}
+	return s.next.ListCreditGrants(ctx, projectID, service, active)
+}
+
+func (s *authorizedServer) RevokeCreditGrant(ctx context.Context, projectID uint64, id uint64) (bool, error) {
+	if err := s.authorize(ctx, adminOnly, projectID); err != nil {
+		return false, err
+	}
+	return s.next.RevokeCreditGrant(ctx, projectID, id)
+}
+
+func (s *authorizedServer) GetCreditUsage(ctx context.Context, projectID uint64, service *proto.Service, from, to *time.Time) (int64, error) {
+	if err := s.authorize(ctx, projectRead, projectID); err != nil {
+		return 0, err
+	}
+	return s.next.GetCreditUsage(ctx, projectID, service, from, to)
+}
+
+func (s *authorizedServer) ListAuditEvents(ctx context.Context, projectID uint64, from, to *time.Time) ([]*proto.AuditEvent, error) {
+	if err := s.authorize(ctx, projectRead, projectID); err != nil {
+		return nil, err
+	}
+	return s.next.ListAuditEvents(ctx, projectID, from, to)
+}
+
+func (s *authorizedServer) GetUsage(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, from, to *time.Time) (int64, error) {
+	if err := s.authorize(ctx, usageRead, projectID); err != nil {
+		return 0, err
+	}
+	return s.next.GetUsage(ctx, projectID, accessKey, service, from, to)
+}
+
+func (s *authorizedServer) GetUsageBreakdown(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, from, to *time.Time) (*proto.UsageBreakdown, error) {
+	if err := s.authorize(ctx, projectRead, projectID); err != nil {
+		return nil, err
+	}
+	return s.next.GetUsageBreakdown(ctx, projectID, accessKey, service, from, to)
+}
+
+func (s *authorizedServer) GetUsageHistory(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, from, to *time.Time, granularity proto.UsageGranularity, groupBy []proto.UsageGroupBy) ([]*proto.UsagePoint, error) {
+	if err := s.authorize(ctx, projectRead, projectID); err != nil {
+		return nil, err
+	}
+	return s.next.GetUsageHistory(ctx, projectID, accessKey, service, from, to, granularity, groupBy)
+}
+
+func (s *authorizedServer) ClearUsage(ctx context.Context, projectID uint64, service *proto.Service, now time.Time) (bool, error) {
+	if err := s.authorize(ctx, adminOnly, projectID); err != nil {
+		return false, err
+	}
+	return s.next.ClearUsage(ctx, projectID, service, now)
+}
+
+func (s *authorizedServer) SyncProjectUsage(ctx context.Context, service proto.Service, now time.Time, usage map[uint64]int64, batchID *string, breakdown map[uint64]*proto.UsageBreakdown) (map[uint64]bool, error) {
+	if err := s.authorize(ctx, serviceOnly, 0); err != nil {
+		return nil, err
+	}
+	return s.next.SyncProjectUsage(ctx, service, now, usage, batchID, breakdown)
+}
+
+func (s *authorizedServer) SyncAccessKeyUsage(ctx context.Context, service proto.Service, now time.Time, usage map[string]int64, batchID *string, breakdown map[string]*proto.UsageBreakdown) (map[string]bool, error) {
+	if err := s.authorize(ctx, serviceOnly, 0); err != nil {
+		return nil, err
+	}
+	return s.next.SyncAccessKeyUsage(ctx, service, now, usage, batchID, breakdown)
+}
+
+func (s *authorizedServer) NotifyEvent(ctx context.Context, projectID uint64, service proto.Service, eventType proto.EventType) (bool, error) {
+	if err := s.authorize(ctx, serviceOnly, projectID); err != nil {
+		return false, err
+	}
+	return s.next.NotifyEvent(ctx, projectID, service, eventType)
+}
+
+func (s *authorizedServer) GetUserPermission(ctx context.Context, projectID uint64, userID string) (proto.UserPermission, *proto.ResourceAccess, error) {
+	if err := s.authorize(ctx, serviceOnly, projectID); err != nil {
+		return proto.UserPermission_UNAUTHORIZED, nil, err
+	}
+	return s.next.GetUserPermission(ctx, projectID, userID)
+}
+
+func (s *authorizedServer) GetAccountUsage(ctx context.Context, projectID uint64, service *proto.Service, from, to *time.Time) (*proto.AccessUsage, error) {
+	if err := s.authorize(ctx, projectRead, projectID); err != nil {
+		return nil, err
+	}
+	return s.next.GetAccountUsage(ctx, projectID, service, from, to)
+}
+
+func (s *authorizedServer) GetAccessKeyUsage(ctx context.Context, accessKey string, service *proto.Service, from, to *time.Time) (*proto.AccessUsage, error) {
+	if err := s.authorizeKey(ctx, projectRead, accessKey); err != nil {
+		return nil, err
+	}
+	return s.next.GetAccessKeyUsage(ctx, accessKey, service, from, to)
+}
+
+func (s *authorizedServer) GetAsyncUsage(ctx context.Context, projectID uint64, service *proto.Service, from, to *time.Time) (*proto.AccessUsage, error) {
+	if err := s.authorize(ctx, projectRead, projectID); err != nil {
+		return nil, err
+	}
+	return s.next.GetAsyncUsage(ctx, projectID, service, from, to)
+}
+
+func (s *authorizedServer) UpdateProjectUsage(ctx context.Context, service proto.Service, now time.Time, usage map[uint64]*proto.AccessUsage) (map[uint64]bool, error) {
+	if err := s.authorize(ctx, serviceOnly, 0); err != nil {
+		return nil, err
+	}
+	return s.next.UpdateProjectUsage(ctx, service, now, usage)
+}
+
+func (s *authorizedServer) UpdateKeyUsage(ctx context.Context, service proto.Service, now time.Time, usage map[string]*proto.AccessUsage) (map[string]bool, error) {
+	if err := s.authorize(ctx, serviceOnly, 0); err != nil {
+		return nil, err
+	}
+	return s.next.UpdateKeyUsage(ctx, service, now, usage)
+}
+
+func (s *authorizedServer) PrepareUsage(ctx context.Context, projectID uint64, service *proto.Service, cycle *proto.Cycle, now time.Time) (bool, error) {
+	if err := s.authorize(ctx, serviceOnly, projectID); err != nil {
+		return false, err
+	}
+	return s.next.PrepareUsage(ctx, projectID, service, cycle, now)
+}
@@ -0,0 +1,117 @@
+package quotacontrol_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/authcontrol"
+	authproto "github.com/0xsequence/authcontrol/proto"
+	"github.com/0xsequence/quotacontrol"
+	"github.com/0xsequence/quotacontrol/mock"
+	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizedServer(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	now := time.Now()
+	from, to := now.Add(-time.Hour), now
+	otherProjectID := ProjectID + 1
+
+	limit := proto.Limit{}
+	limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 100, FreeMax: 10, OverMax: 20})
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+	require.NoError(t, server.Store.SetAccessLimit(ctx, otherProjectID, &limit))
+	require.NoError(t, server.Store.SetUserPermission(ctx, ProjectID, WalletAddress, proto.UserPermission_READ_WRITE, proto.ResourceAccess{ProjectID: ProjectID}))
+	require.NoError(t, server.Store.SetUserPermission(ctx, ProjectID, UserAddress, proto.UserPermission_READ, proto.ResourceAccess{ProjectID: ProjectID}))
+
+	authorized := quotacontrol.NewAuthorizedServer(server, server.Store)
+
+	admin := authcontrol.WithSessionType(ctx, authproto.SessionType_Admin)
+	service := authcontrol.WithService(authcontrol.WithSessionType(ctx, authproto.SessionType_S2S), ServiceName)
+	writer := authcontrol.WithAccount(authcontrol.WithSessionType(ctx, authproto.SessionType_User), WalletAddress)
+	reader := authcontrol.WithAccount(authcontrol.WithSessionType(ctx, authproto.SessionType_User), UserAddress)
+
+	otherKey, err := authorized.CreateAccessKey(admin, otherProjectID, "other", false, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	// everybody can ping
+	_, err = authorized.Ping(ctx)
+	require.NoError(t, err)
+	_, err = authorized.GetProjectStatus(ctx, ProjectID)
+	require.ErrorIs(t, err, proto.ErrPermissionDenied)
+
+	t.Run("User", func(t *testing.T) {
+		key, err := authorized.CreateAccessKey(writer, ProjectID, "key", false, nil, nil, nil, nil)
+		require.NoError(t, err)
+		_, err = authorized.UpdateAccessKey(writer, key.AccessKey, proto.Ptr("renamed"), nil, nil, nil, nil, nil)
+		require.NoError(t, err)
+
+		// the keys of the project can be read, but not managed, with READ permission
+		keys, err := authorized.ListAccessKeys(reader, ProjectID, nil, nil)
+		require.NoError(t, err)
+		assert.Len(t, keys, 1)
+		_, err = authorized.CreateAccessKey(reader, ProjectID, "key", false, nil, nil, nil, nil)
+		require.ErrorIs(t, err, proto.ErrPermissionDenied)
+		_, err = authorized.DisableAccessKey(reader, key.AccessKey)
+		require.ErrorIs(t, err, proto.ErrPermissionDenied)
+
+		// the other projects can't be accessed
+		_, err = authorized.ListAccessKeys(writer, otherProjectID, nil, nil)
+		require.ErrorIs(t, err, proto.ErrPermissionDenied)
+		_, err = authorized.UpdateAccessKey(writer, otherKey.AccessKey, proto.Ptr("renamed"), nil, nil, nil, nil, nil)
+		require.ErrorIs(t, err, proto.ErrPermissionDenied)
+		_, err = authorized.SetDefaultAccessKey(writer, otherProjectID, otherKey.AccessKey)
+		require.ErrorIs(t, err, proto.ErrPermissionDenied)
+
+		// an unknown key can't be told apart from the key of another project
+		unknownKey := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), otherProjectID+1)
+		_, unknownErr := authorized.GetAccessKey(writer, unknownKey)
+		require.ErrorIs(t, unknownErr, proto.ErrPermissionDenied)
+		_, foreignErr := authorized.GetAccessKey(writer, otherKey.AccessKey)
+		require.ErrorIs(t, foreignErr, proto.ErrPermissionDenied)
+		assert.Equal(t, unknownErr.Error(), foreignErr.Error())
+		_, unknownErr = authorized.SetDefaultAccessKey(writer, ProjectID, unknownKey)
+		require.ErrorIs(t, unknownErr, proto.ErrPermissionDenied)
+		_, foreignErr = authorized.SetDefaultAccessKey(writer, ProjectID, otherKey.AccessKey)
+		require.ErrorIs(t, foreignErr, proto.ErrPermissionDenied)
+		assert.Equal(t, unknownErr.Error(), foreignErr.Error())
+
+		// the usage is synced by the services and cleared by the admins
+		_, err = authorized.SyncProjectUsage(writer, Service, now, map[uint64]int64{ProjectID: 1}, nil, nil)
+		require.ErrorIs(t, err, proto.ErrPermissionDenied)
+		_, err = authorized.ClearUsage(writer, ProjectID, &Service, now)
+		require.ErrorIs(t, err, proto.ErrPermissionDenied)
+		_, err = authorized.GetUsage(reader, ProjectID, nil, &Service, &from, &to)
+		require.NoError(t, err)
+	})
+
+	t.Run("Service", func(t *testing.T) {
+		_, err := authorized.GetProjectQuota(service, ProjectID, now)
+		require.NoError(t, err)
+		_, err = authorized.GetUsage(service, ProjectID, nil, &Service, &from, &to)
+		require.NoError(t, err)
+		_, err = authorized.SyncProjectUsage(service, Service, now, map[uint64]int64{ProjectID: 1}, nil, nil)
+		require.NoError(t, err)
+
+		_, err = authorized.CreateAccessKey(service, ProjectID, "key", false, nil, nil, nil, nil)
+		require.ErrorIs(t, err, proto.ErrPermissionDenied)
+		_, err = authorized.ClearUsage(service, ProjectID, &Service, now)
+		require.ErrorIs(t, err, proto.ErrPermissionDenied)
+	})
+
+	t.Run("Admin", func(t *testing.T) {
+		_, err := authorized.UpdateAccessKey(admin, otherKey.AccessKey, proto.Ptr("renamed"), nil, nil, nil, nil, nil)
+		require.NoError(t, err)
+		_, err = authorized.ClearUsage(admin, ProjectID, &Service, now)
+		require.NoError(t, err)
+		_, err = authorized.SyncProjectUsage(admin, Service, now, map[uint64]int64{ProjectID: 1}, nil, nil)
+		require.NoError(t, err)
+	})
+}
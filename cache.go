@@ -5,12 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log/slog"
+	"strconv"
 	"time"
 
+	"github.com/0xsequence/quotacontrol/metrics"
 	"github.com/0xsequence/quotacontrol/proto"
-	"github.com/go-chi/httprate"
-	httprateredis "github.com/go-chi/httprate-redis"
 	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/redis/go-redis/v9"
 )
@@ -22,13 +21,31 @@ type QuotaCache interface {
 	GetAccessQuota(ctx context.Context, accessKey string) (*proto.AccessQuota, error)
 	SetAccessQuota(ctx context.Context, quota *proto.AccessQuota) error
 	DeleteAccessQuota(ctx context.Context, accessKey string) error
+	// SetProjectNotFound caches for ttl that the project doesn't exist, GetProjectQuota returns ErrCachedNotFound meanwhile.
+	SetProjectNotFound(ctx context.Context, projectID uint64, ttl time.Duration) error
+	// SetAccessNotFound caches for ttl that the access key doesn't exist, GetAccessQuota returns ErrCachedNotFound meanwhile.
+	SetAccessNotFound(ctx context.Context, accessKey string, ttl time.Duration) error
 }
 
 type UsageCache interface {
-	SetUsage(ctx context.Context, key string, amount int64) error
+	// SetUsage sets the usage for ttl, the default TTL of the cache is used if it's not positive.
+	SetUsage(ctx context.Context, key string, amount int64, ttl time.Duration) error
 	ClearUsage(ctx context.Context, key string) (bool, error)
+	// PeekUsage returns the usage, errCacheReady if it's missing and errCacheWait if it's being loaded.
 	PeekUsage(ctx context.Context, key string) (int64, error)
-	SpendUsage(ctx context.Context, key string, amount, limit int64) (int64, error)
+	// LockUsage locks the missing usage for ttl, so the caller can load it. It returns the fence of the lock, or errCacheWait if it's locked already.
+	LockUsage(ctx context.Context, key string, ttl time.Duration) (fence string, err error)
+	// InitUsage sets the usage loaded by the holder of the lock and wakes the waiters.
+	// It returns false if the lock was lost, because it expired or the usage was set or cleared meanwhile.
+	InitUsage(ctx context.Context, key, fence string, amount int64, ttl time.Duration) (bool, error)
+	// UnlockUsage releases the lock, if still held, when the usage can't be loaded.
+	UnlockUsage(ctx context.Context, key, fence string) error
+	// WaitUsage blocks until the usage being loaded is set, or its lock is released or expires.
+	WaitUsage(ctx context.Context, key string) error
+	// SpendUsage atomically checks the usage against the limit and spends the amount.
+	// It returns the usage before and after the spend; the usage never goes above the limit.
+	// A negative amount gives the usage back, without going below zero.
+	SpendUsage(ctx context.Context, key string, amount, limit int64) (before, after int64, err error)
 }
 
 type PermissionCache interface {
@@ -37,6 +54,14 @@ type PermissionCache interface {
 	DeleteUserPermission(ctx context.Context, projectID uint64, userID string) error
 }
 
+// EventCache keeps track of the dispatched events.
+type EventCache interface {
+	// MarkEvent marks the event key for ttl, it returns false if it was already marked.
+	MarkEvent(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// UnmarkEvent removes the mark of the event key, so that it can be marked again.
+	UnmarkEvent(ctx context.Context, key string) error
+}
+
 type CacheResponse uint8
 
 var (
@@ -44,6 +69,9 @@ var (
 	errCacheWait  = errors.New("quotacontrol: cache wait")
 )
 
+// ErrCachedNotFound is returned by QuotaCache when the project or access key is known not to exist.
+var ErrCachedNotFound = errors.New("quotacontrol: cached not found")
+
 const (
 	redisRLPrefix = "rl:"
 )
@@ -52,44 +80,26 @@ var (
 	_ QuotaCache = (*RedisCache)(nil)
 	_ QuotaCache = (*LRU)(nil)
 	_ UsageCache = (*RedisCache)(nil)
+	_ EventCache = (*RedisCache)(nil)
 )
 
-func NewLimitCounter(svc proto.Service, cfg RedisConfig, logger *slog.Logger) httprate.LimitCounter {
-	if !cfg.Enabled {
-		return nil
-	}
-
-	prefix := redisRLPrefix
-	if s := svc.String(); s != "" {
-		prefix = fmt.Sprintf("%s%s:", redisRLPrefix, s)
-	}
-
-	return httprateredis.NewCounter(&httprateredis.Config{
-		Host:      cfg.Host,
-		Port:      cfg.Port,
-		MaxIdle:   cfg.MaxIdle,
-		MaxActive: cfg.MaxActive,
-		DBIndex:   cfg.DBIndex,
-		PrefixKey: prefix,
-		OnError: func(err error) {
-			if logger != nil {
-				logger.Error("redis counter error", slog.Any("error", err))
-			}
-		},
-		OnFallbackChange: func(fallback bool) {
-			if logger != nil {
-				logger.Warn("redis counter fallback", slog.Bool("fallback", fallback))
-			}
-		},
-	})
-}
-
 const (
-	defaultExpRedis = time.Hour
-	defaultExpLRU   = time.Minute
-	cacheVersion    = "v2"
+	defaultExpRedis    = time.Hour
+	defaultExpLRU      = time.Minute
+	defaultExpNotFound = 10 * time.Second
+	defaultUsageWait   = 5 * time.Second
+	cacheVersion       = "v2"
+
+	// usageGrace keeps the usage after the end of the cycle, which is the start of its last day or of the next cycle,
+	// for the requests and the syncs that are late.
+	usageGrace = 48 * time.Hour
 )
 
+// usageTTL returns the TTL of the usage of the cycle, that lasts until its end plus a grace period.
+func usageTTL(cycle *proto.Cycle, now time.Time) time.Duration {
+	return cycle.GetEnd(now).Add(usageGrace).Sub(now)
+}
+
 // usageKey returns the redis key for storing usage amount.
 // It does not include version because usage is just a number, and it's safe to share across versions.
 func usageKey(key string) string {
@@ -108,19 +118,26 @@ func permissionKey(projectID uint64, userID string) string {
 	return fmt.Sprintf("perm:%s:project:%d:user:%s", cacheVersion, projectID, userID)
 }
 
-func NewRedisCache(redisClient *redis.Client, ttl time.Duration) *RedisCache {
+// eventKey returns the redis key for marking a dispatched event.
+func eventKey(key string) string {
+	return fmt.Sprintf("event:%s", key)
+}
+
+func NewRedisCache(redisClient redis.UniversalClient, ttl time.Duration) *RedisCache {
 	if ttl <= 0 {
 		ttl = defaultExpRedis
 	}
 	return &RedisCache{
-		client: redisClient,
-		ttl:    ttl,
+		client:  redisClient,
+		ttl:     ttl,
+		waiters: newUsageWaiters(redisClient),
 	}
 }
 
 type RedisCache struct {
-	client *redis.Client
-	ttl    time.Duration
+	client  redis.UniversalClient
+	ttl     time.Duration
+	waiters *usageWaiters
 }
 
 func (s *RedisCache) GetAccessQuota(ctx context.Context, accessKey string) (*proto.AccessQuota, error) {
@@ -147,6 +164,17 @@ func (s *RedisCache) SetProjectQuota(ctx context.Context, quota *proto.AccessQuo
 	return s.setQuota(ctx, getProjectKey(quota.AccessKey.ProjectID), quota)
 }
 
+func (s *RedisCache) SetProjectNotFound(ctx context.Context, projectID uint64, ttl time.Duration) error {
+	return s.setNotFound(ctx, getProjectKey(projectID), ttl)
+}
+
+func (s *RedisCache) SetAccessNotFound(ctx context.Context, accessKey string, ttl time.Duration) error {
+	return s.setNotFound(ctx, accessKey, ttl)
+}
+
+// notFoundValue is the value of the quota keys that are known not to exist, it's not valid JSON for an AccessQuota.
+const notFoundValue = "-"
+
 func (s *RedisCache) getQuota(ctx context.Context, key string) (*proto.AccessQuota, error) {
 	raw, err := s.client.Get(ctx, quotaKey(key)).Bytes()
 	if err != nil {
@@ -155,6 +183,9 @@ func (s *RedisCache) getQuota(ctx context.Context, key string) (*proto.AccessQuo
 		}
 		return nil, fmt.Errorf("get quota: %w", err)
 	}
+	if string(raw) == notFoundValue {
+		return nil, ErrCachedNotFound
+	}
 	var quota proto.AccessQuota
 	if err := json.Unmarshal(raw, &quota); err != nil {
 		return nil, fmt.Errorf("unmarshal quota: %w", err)
@@ -180,13 +211,30 @@ func (s *RedisCache) setQuota(ctx context.Context, key string, quota *proto.Acce
 	return nil
 }
 
-func (s *RedisCache) SetUsage(ctx context.Context, key string, amount int64) error {
-	if err := s.client.Set(ctx, usageKey(key), amount, s.ttl).Err(); err != nil {
+func (s *RedisCache) setNotFound(ctx context.Context, key string, ttl time.Duration) error {
+	if err := s.client.Set(ctx, quotaKey(key), notFoundValue, ttl).Err(); err != nil {
+		return fmt.Errorf("set not found: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisCache) SetUsage(ctx context.Context, key string, amount int64, ttl time.Duration) error {
+	pipe := s.client.Pipeline()
+	pipe.Set(ctx, usageKey(key), amount, s.usageTTL(ttl))
+	pipe.Publish(ctx, usageChannel, key)
+	if _, err := pipe.Exec(ctx); err != nil {
 		return fmt.Errorf("set usage: %w", err)
 	}
 	return nil
 }
 
+func (s *RedisCache) usageTTL(ttl time.Duration) time.Duration {
+	if ttl > 0 {
+		return ttl
+	}
+	return s.ttl
+}
+
 func (s *RedisCache) ClearUsage(ctx context.Context, key string) (bool, error) {
 	count, err := s.client.Del(ctx, usageKey(key)).Result()
 	if err != nil {
@@ -196,44 +244,90 @@ func (s *RedisCache) ClearUsage(ctx context.Context, key string) (bool, error) {
 }
 
 func (s *RedisCache) PeekUsage(ctx context.Context, key string) (int64, error) {
-	const SpecialValue = -1
-	cacheKey := usageKey(key)
-
-	v, err := s.client.Get(ctx, cacheKey).Int64()
-	if err == nil {
-		if v == SpecialValue {
-			return 0, errCacheWait
+	v, err := s.client.Get(ctx, usageKey(key)).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return 0, errCacheReady
 		}
-		return v, nil
-	}
-	if !errors.Is(err, redis.Nil) {
 		return 0, fmt.Errorf("peek usage - get: %w", err)
 	}
-	ok, err := s.client.SetNX(ctx, cacheKey, SpecialValue, time.Second*2).Result()
-	if err != nil {
-		return 0, fmt.Errorf("peek usage - setnx: %w", err)
-	}
-	if !ok {
+	if isUsageLock(v) {
 		return 0, errCacheWait
 	}
-	return 0, errCacheReady
-}
+	usage, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("peek usage - parse: %w", err)
+	}
+	return usage, nil
+}
+
+// spendUsageScript checks and spends the usage in a single atomic operation.
+// It mirrors PeekUsage when the key is missing or locked, otherwise
+// it returns {status, before, after}, capping the usage to the limit.
+// A negative amount is given back regardless of the limit, flooring the usage at zero.
+var spendUsageScript = redis.NewScript(`
+local v = redis.call("GET", KEYS[1])
+if not v then
+	return {0, 0, 0}
+end
+v = tonumber(v)
+if v == nil then
+	return {1, 0, 0}
+end
+local amount, limit = tonumber(ARGV[1]), tonumber(ARGV[2])
+local total
+if amount < 0 then
+	total = math.max(0, v + amount)
+else
+	if v >= limit then
+		return {2, v, v}
+	end
+	total = math.min(v + amount, limit)
+end
+redis.call("INCRBY", KEYS[1], total - v)
+return {3, v, total}
+`)
+
+const (
+	spendStatusReady = iota
+	spendStatusWait
+	spendStatusExceeded
+	spendStatusSpent
+)
 
-func (s *RedisCache) SpendUsage(ctx context.Context, key string, amount, limit int64) (int64, error) {
-	// NOTE: don't use usageKey yet, PeekUsage is doing that
-	v, err := s.PeekUsage(ctx, key)
+func (s *RedisCache) SpendUsage(ctx context.Context, key string, amount, limit int64) (int64, int64, error) {
+	res, err := spendUsageScript.Run(ctx, s.client, []string{usageKey(key)}, amount, limit).Int64Slice()
 	if err != nil {
-		return 0, fmt.Errorf("spend usage - peek: %w", err)
+		return 0, 0, fmt.Errorf("spend usage - script: %w", err)
+	}
+	if len(res) != 3 {
+		return 0, 0, fmt.Errorf("spend usage - unexpected script result: %v", res)
 	}
-	if v >= limit {
-		return v, proto.ErrQuotaExceeded
+	before, after := res[1], res[2]
+	switch res[0] {
+	case spendStatusReady:
+		return 0, 0, fmt.Errorf("spend usage: %w", errCacheReady)
+	case spendStatusWait:
+		return 0, 0, fmt.Errorf("spend usage: %w", errCacheWait)
+	case spendStatusExceeded:
+		return before, after, proto.ErrQuotaExceeded
 	}
+	return before, after, nil
+}
 
-	value, err := s.client.IncrBy(ctx, usageKey(key), amount).Result()
+func (s *RedisCache) MarkEvent(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	ok, err := s.client.SetNX(ctx, eventKey(key), time.Now().Unix(), ttl).Result()
 	if err != nil {
-		return v, fmt.Errorf("spend usage - incrby: %w", err)
+		return false, fmt.Errorf("mark event: %w", err)
+	}
+	return ok, nil
+}
+
+func (s *RedisCache) UnmarkEvent(ctx context.Context, key string) error {
+	if err := s.client.Del(ctx, eventKey(key)).Err(); err != nil {
+		return fmt.Errorf("unmark event: %w", err)
 	}
-	return value, nil
+	return nil
 }
 
 type cacheUserPermission struct {
@@ -277,9 +371,13 @@ func (s *RedisCache) DeleteUserPermission(ctx context.Context, projectID uint64,
 type LRU struct {
 	// mem is in-memory lru cache layer
 	mem *expirable.LRU[string, *proto.AccessQuota]
+	// notFound keeps the expiration of the keys that are known not to exist
+	notFound *expirable.LRU[string, time.Time]
 
 	// backend is pluggable QuotaCache layer, which usually is redis
 	backend QuotaCache
+
+	metrics metrics.Collector
 }
 
 func NewLRU(cacheBackend QuotaCache, size int, ttl time.Duration) *LRU {
@@ -288,8 +386,10 @@ func NewLRU(cacheBackend QuotaCache, size int, ttl time.Duration) *LRU {
 	}
 	lruCache := expirable.NewLRU[string, *proto.AccessQuota](size, nil, ttl)
 	return &LRU{
-		mem:     lruCache,
-		backend: cacheBackend,
+		mem:      lruCache,
+		notFound: expirable.NewLRU[string, time.Time](size, nil, ttl),
+		backend:  cacheBackend,
+		metrics:  metrics.Noop{},
 	}
 }
 
@@ -317,10 +417,29 @@ func (s *LRU) DeleteProjectQuota(ctx context.Context, projectID uint64) error {
 	return s.deleteQuota(ctx, getProjectKey(projectID))
 }
 
+func (s *LRU) SetProjectNotFound(ctx context.Context, projectID uint64, ttl time.Duration) error {
+	s.notFound.Add(getProjectKey(projectID), time.Now().Add(ttl))
+	return s.backend.SetProjectNotFound(ctx, projectID, ttl)
+}
+
+func (s *LRU) SetAccessNotFound(ctx context.Context, accessKey string, ttl time.Duration) error {
+	s.notFound.Add(accessKey, time.Now().Add(ttl))
+	return s.backend.SetAccessNotFound(ctx, accessKey, ttl)
+}
+
 func (s *LRU) getQuota(ctx context.Context, key string) (*proto.AccessQuota, error) {
 	if quota, ok := s.mem.Get(key); ok {
+		s.metrics.CacheLookup("lru", metrics.CacheHit)
 		return quota, nil
 	}
+	if exp, ok := s.notFound.Get(key); ok {
+		if time.Now().Before(exp) {
+			s.metrics.CacheLookup("lru", metrics.CacheHit)
+			return nil, ErrCachedNotFound
+		}
+		s.notFound.Remove(key)
+	}
+	s.metrics.CacheLookup("lru", metrics.CacheMiss)
 
 	quota, err := s.backend.GetAccessQuota(ctx, key)
 	if err != nil {
@@ -331,12 +450,14 @@ func (s *LRU) getQuota(ctx context.Context, key string) (*proto.AccessQuota, err
 }
 
 func (s *LRU) setQuota(ctx context.Context, key string, quota *proto.AccessQuota) error {
+	s.notFound.Remove(key)
 	s.mem.Add(key, quota)
 	return s.backend.SetAccessQuota(ctx, quota)
 }
 
 func (s *LRU) deleteQuota(ctx context.Context, key string) error {
 	s.mem.Remove(key)
+	s.notFound.Remove(key)
 	return s.backend.DeleteAccessQuota(ctx, key)
 }
 
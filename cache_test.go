@@ -2,12 +2,17 @@ package quotacontrol_test
 
 import (
 	"context"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/0xsequence/quotacontrol"
 	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type mockCache struct {
@@ -39,6 +44,14 @@ func (s *mockCache) DeleteProjectQuota(context.Context, uint64) error {
 	return nil
 }
 
+func (s *mockCache) SetProjectNotFound(context.Context, uint64, time.Duration) error {
+	return nil
+}
+
+func (s *mockCache) SetAccessNotFound(context.Context, string, time.Duration) error {
+	return nil
+}
+
 func TestLRU(t *testing.T) {
 	baseCache := mockCache{}
 
@@ -53,4 +66,196 @@ func TestLRU(t *testing.T) {
 	assert.NoError(t, err)
 
 	assert.Equal(t, int32(1), baseCache.count)
+
+	// the keys cached as not found don't reach the backend until they expire
+	require.NoError(t, lru.SetAccessNotFound(ctx, "b", 50*time.Millisecond))
+	_, err = lru.GetAccessQuota(ctx, "b")
+	assert.ErrorIs(t, err, quotacontrol.ErrCachedNotFound)
+	assert.Equal(t, int32(1), baseCache.count)
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = lru.GetAccessQuota(ctx, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), baseCache.count)
+}
+
+func TestRedisCacheAuth(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("secret")
+
+	client, err := quotacontrol.NewRedisClient(quotacontrol.RedisConfig{Addrs: []string{mr.Addr()}})
+	require.NoError(t, err)
+	cache := quotacontrol.NewRedisCache(client, time.Minute)
+	require.Error(t, cache.SetUsage(context.Background(), "project:1:auth", 1, 0))
+
+	client, err = quotacontrol.NewRedisClient(quotacontrol.RedisConfig{Addrs: []string{mr.Addr()}, Password: "secret"})
+	require.NoError(t, err)
+	cache = quotacontrol.NewRedisCache(client, time.Minute)
+	require.NoError(t, cache.SetUsage(context.Background(), "project:1:auth", 1, 0))
+	usage, err := cache.PeekUsage(context.Background(), "project:1:auth")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), usage)
+}
+
+func TestSpendUsageConcurrency(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cache := quotacontrol.NewRedisCache(redis.NewClient(&redis.Options{Addr: mr.Addr()}), time.Minute)
+
+	const (
+		key      = "project:1:concurrency"
+		limit    = 100
+		cost     = 3
+		requests = 200
+	)
+
+	ctx := context.Background()
+	require.NoError(t, cache.SetUsage(ctx, key, 0, 0))
+
+	var (
+		wg       sync.WaitGroup
+		spent    int64
+		exceeded int64
+	)
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			before, after, err := cache.SpendUsage(ctx, key, cost, limit)
+			if err != nil {
+				assert.ErrorIs(t, err, proto.ErrQuotaExceeded)
+				assert.Equal(t, before, after)
+				atomic.AddInt64(&exceeded, 1)
+				return
+			}
+			assert.LessOrEqual(t, after, int64(limit))
+			atomic.AddInt64(&spent, after-before)
+		}()
+	}
+	wg.Wait()
+
+	usage, err := cache.PeekUsage(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(limit), usage)
+	assert.Equal(t, int64(limit), spent)
+	assert.Equal(t, int64(requests-(limit+cost-1)/cost), exceeded)
+}
+
+func TestSpendUsageNotReady(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cache := quotacontrol.NewRedisCache(redis.NewClient(&redis.Options{Addr: mr.Addr()}), time.Minute)
+
+	ctx := context.Background()
+	const key = "project:1:not-ready"
+
+	// the key is missing until it's initialized
+	_, _, err := cache.SpendUsage(ctx, key, 1, 10)
+	assert.Error(t, err)
+	_, _, err = cache.SpendUsage(ctx, key, 1, 10)
+	assert.Error(t, err)
+
+	require.NoError(t, cache.SetUsage(ctx, key, 9, 0))
+	before, after, err := cache.SpendUsage(ctx, key, 5, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), before)
+	assert.Equal(t, int64(10), after)
+
+	// a negative amount is given back at the limit too, but never below zero
+	before, after, err = cache.SpendUsage(ctx, key, -3, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), before)
+	assert.Equal(t, int64(7), after)
+	_, after, err = cache.SpendUsage(ctx, key, -10, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), after)
+}
+
+func TestUsageLock(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cache := quotacontrol.NewRedisCache(redis.NewClient(&redis.Options{Addr: mr.Addr()}), time.Minute)
+
+	ctx := context.Background()
+	const key = "project:1:lock"
+
+	fence, err := cache.LockUsage(ctx, key, time.Second)
+	require.NoError(t, err)
+	_, err = cache.LockUsage(ctx, key, time.Second)
+	require.Error(t, err)
+	_, err = cache.PeekUsage(ctx, key)
+	require.Error(t, err)
+
+	// the waiters are woken as soon as the usage is set
+	start := time.Now()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ok, err := cache.InitUsage(ctx, key, fence, 7, 0)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}()
+	require.NoError(t, cache.WaitUsage(ctx, key))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	usage, err := cache.PeekUsage(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), usage)
+
+	// a stale fence can't overwrite the usage
+	ok, err := cache.InitUsage(ctx, key, fence, 3, 0)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	usage, err = cache.PeekUsage(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), usage)
+
+	// nor a newer lock
+	_, err = cache.ClearUsage(ctx, key)
+	require.NoError(t, err)
+	newFence, err := cache.LockUsage(ctx, key, time.Second)
+	require.NoError(t, err)
+	ok, err = cache.InitUsage(ctx, key, fence, 3, 0)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	require.NoError(t, cache.UnlockUsage(ctx, key, fence))
+	_, err = cache.LockUsage(ctx, key, time.Second)
+	require.Error(t, err)
+
+	// the waiters are woken when the lock is released
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, cache.UnlockUsage(ctx, key, newFence))
+	}()
+	require.NoError(t, cache.WaitUsage(ctx, key))
+	_, err = cache.LockUsage(ctx, key, time.Second)
+	require.NoError(t, err)
+}
+
+func TestUsageWaitCanceled(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cache := quotacontrol.NewRedisCache(redis.NewClient(&redis.Options{Addr: mr.Addr()}), time.Minute)
+
+	ctx := context.Background()
+	const key = "project:1:lock"
+
+	// the lock outlasts the test, so the waiters are woken only by the usage that is set
+	fence, err := cache.LockUsage(ctx, key, time.Minute)
+	require.NoError(t, err)
+
+	// the first waiter gives up, the subscription it started is kept for the others
+	canceled, cancel := context.WithCancel(ctx)
+	first := make(chan error, 1)
+	go func() { first <- cache.WaitUsage(canceled, key) }()
+	time.Sleep(time.Millisecond)
+	waited := make(chan error, 1)
+	go func() { waited <- cache.WaitUsage(ctx, key) }()
+	cancel()
+	require.ErrorIs(t, <-first, context.Canceled)
+
+	time.Sleep(100 * time.Millisecond)
+	ok, err := cache.InitUsage(ctx, key, fence, 7, 0)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	select {
+	case err := <-waited:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("waiter not woken")
+	}
 }
@@ -10,10 +10,14 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/0xsequence/quotacontrol/internal/flight"
 	"github.com/0xsequence/quotacontrol/internal/usage"
+	"github.com/0xsequence/quotacontrol/metrics"
 	"github.com/0xsequence/quotacontrol/middleware"
 	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/0xsequence/quotacontrol/tracing"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/0xsequence/authcontrol"
 	authproto "github.com/0xsequence/authcontrol/proto"
@@ -28,12 +32,24 @@ type Notifier interface {
 // - service is the service name.
 // - cfg is the configuration.
 // - if qc is not nil, it will be used instead of the proto client.
+// An invalid redis configuration falls back to a single node connection, and a usage journal that can't be opened
+// leaves the usage in memory only, both are logged; call Config.Validate at startup to fail instead.
 func NewClient(log *slog.Logger, service proto.Service, cfg Config, qc proto.QuotaControlClient) *Client {
-	backend := NewRedisCache(redis.NewClient(&redis.Options{
-		Addr:         fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port),
-		DB:           cfg.Redis.DBIndex,
-		MaxIdleConns: cfg.Redis.MaxIdle,
-	}), cfg.Redis.KeyTTL)
+	redisClient, err := NewRedisClient(cfg.Redis)
+	if err != nil {
+		log.Error("invalid redis config, using a single node connection", slog.Any("error", err))
+		redisClient = redis.NewClient(&redis.Options{
+			Addr:         cfg.Redis.addrs()[0],
+			DB:           cfg.Redis.DBIndex,
+			MaxIdleConns: cfg.Redis.MaxIdle,
+		})
+	}
+	backend := NewRedisCache(redisClient, cfg.Redis.KeyTTL)
+
+	collector, err := cfg.Metrics.collector()
+	if err != nil {
+		log.Error("metrics disabled", slog.Any("error", err))
+	}
 
 	cache := Cache{
 		UsageCache:      backend,
@@ -42,28 +58,61 @@ func NewClient(log *slog.Logger, service proto.Service, cfg Config, qc proto.Quo
 	}
 	// LRU cache for Quota
 	if cfg.LRUSize > 0 {
-		cache.QuotaCache = NewLRU(backend, cfg.LRUSize, cfg.LRUExpiration)
+		lru := NewLRU(backend, cfg.LRUSize, cfg.LRUExpiration)
+		lru.metrics = collector
+		cache.QuotaCache = lru
 	}
 
+	tracer := cfg.Tracing.tracer()
+
 	if qc == nil {
+		var transport http.RoundTripper = bearerToken(cfg.AuthToken)
+		if cfg.Tracing.enabled() {
+			// the quota server continues the trace of the request
+			transport = tracing.Transport(tracer, cfg.Tracing.Propagator, transport)
+		}
 		qc = proto.NewQuotaControlClient(cfg.URL, &http.Client{
-			Transport: bearerToken(cfg.AuthToken),
+			Transport: transport,
 		})
 	}
+	resilient := NewResilientClient(qc, cfg.Resilience)
+	resilient.metrics = collector
+	collector.BreakerState(BreakerClosed.String())
 
 	tick := time.Minute * 5
 	if cfg.UpdateFreq > 0 {
 		tick = cfg.UpdateFreq
 	}
 
+	logger := log.With(slog.String("qc-version", proto.WebRPCSchemaVersion()))
+
+	// the LRU is evicted by the invalidations published by the server
+	var invalidator Invalidator
+	if cfg.LRUSize > 0 {
+		invalidator = NewRedisInvalidator(redisClient, logger)
+	}
+
+	tracker := usage.NewTracker()
+	if cfg.UsageJournal != "" {
+		t, err := usage.NewJournaledTracker(cfg.UsageJournal, logger)
+		if err != nil {
+			logger.Error("usage journal disabled", slog.String("path", cfg.UsageJournal), slog.Any("error", err))
+		} else {
+			tracker = t
+		}
+	}
+
 	return &Client{
 		cfg:         cfg,
 		service:     service,
-		usage:       usage.NewTracker(),
+		usage:       tracker,
 		cache:       cache,
-		quotaClient: qc,
+		quotaClient: resilient,
+		invalidator: invalidator,
+		metrics:     collector,
+		tracer:      tracer,
 		ticker:      time.NewTicker(tick),
-		logger:      log.With(slog.String("qc-version", proto.WebRPCSchemaVersion())),
+		logger:      logger,
 	}
 }
 
@@ -75,6 +124,16 @@ type Client struct {
 	usage       *usage.Tracker
 	cache       Cache
 	quotaClient proto.QuotaControlClient
+	invalidator Invalidator
+	metrics     metrics.Collector
+	tracer      trace.Tracer
+
+	flight struct {
+		quota      flight.Group[*proto.AccessQuota]
+		permission flight.Group[permissionResult]
+	}
+	stats  clientStats
+	active activeProjects
 
 	running int32
 	ticker  *time.Ticker
@@ -101,6 +160,67 @@ func (c *Client) GetDefaultUsage() int64 {
 	return 1
 }
 
+// usageWaitTimeout returns how long EnsureUsage waits for the usage to be loaded.
+func (c *Client) usageWaitTimeout() time.Duration {
+	if c.cfg.UsageWaitTimeout > 0 {
+		return c.cfg.UsageWaitTimeout
+	}
+	return defaultUsageWait
+}
+
+// flightContext detaches a shared call from the caller that started it, so that its cancellation doesn't fail the callers that joined.
+// The call is bounded by the time the resilient client can take with all its retries.
+func (c *Client) flightContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout, retries := c.cfg.Resilience.Timeout, c.cfg.Resilience.Retries
+	if timeout <= 0 {
+		timeout = defaultCallTimeout
+	}
+	if retries == 0 {
+		retries = defaultRetries
+	}
+	return context.WithTimeout(context.WithoutCancel(ctx), timeout*time.Duration(max(retries, 0)+1))
+}
+
+// notFoundTTL returns how long the unknown projects and access keys are cached, 0 if disabled.
+func (c *Client) notFoundTTL() time.Duration {
+	switch {
+	case c.cfg.NotFoundTTL < 0:
+		return 0
+	case c.cfg.NotFoundTTL == 0:
+		return defaultExpNotFound
+	}
+	return c.cfg.NotFoundTTL
+}
+
+// Stats returns the counters of the calls to the quota server.
+func (c *Client) Stats() ClientStats {
+	return ClientStats{
+		QuotaFetches:        c.stats.quotaFetches.Load(),
+		QuotaCoalesced:      c.stats.quotaCoalesced.Load(),
+		PermissionFetches:   c.stats.permissionFetches.Load(),
+		PermissionCoalesced: c.stats.permissionCoalesced.Load(),
+		Breaker:             c.breakerState(),
+	}
+}
+
+// Metrics returns the collector of the client, to be used in middleware.Options.
+func (c *Client) Metrics() metrics.Collector {
+	return c.metrics
+}
+
+// Tracer returns the tracer of the client, to be used in middleware.Options.
+func (c *Client) Tracer() trace.Tracer {
+	return c.tracer
+}
+
+// breakerState returns the state of the circuit breaker of the quota server client.
+func (c *Client) breakerState() BreakerState {
+	if rc, ok := c.quotaClient.(*ResilientClient); ok {
+		return rc.State()
+	}
+	return BreakerClosed
+}
+
 // GetService returns the client service.
 func (c *Client) GetService() proto.Service {
 	if c == nil {
@@ -110,60 +230,109 @@ func (c *Client) GetService() proto.Service {
 }
 
 // FetchProjectQuota fetches the project quota from cache or from the quota server.
-func (c *Client) FetchProjectQuota(ctx context.Context, projectID uint64, chainIDs []uint64, now time.Time) (*proto.AccessQuota, error) {
+func (c *Client) FetchProjectQuota(ctx context.Context, projectID uint64, chainIDs []uint64, now time.Time) (quota *proto.AccessQuota, err error) {
+	ctx, span := c.tracer.Start(ctx, "Client.FetchProjectQuota", trace.WithAttributes(tracing.ProjectID(projectID), tracing.Service(c.service)))
+	defer func() { tracing.End(span, err) }()
+
 	// fetch access quota
-	quota, err := c.cache.QuotaCache.GetProjectQuota(ctx, projectID)
+	quota, err = c.cache.QuotaCache.GetProjectQuota(ctx, projectID)
+	result := lookupResult(err, proto.ErrAccessKeyNotFound, proto.ErrProjectNotFound)
+	c.metrics.CacheLookup("quota", result)
+	span.SetAttributes(tracing.CacheKey.String(result))
 	if err != nil {
 		logger := c.logger.With(
 			slog.String("op", "fetch_project_quota"),
 			slog.Uint64("projectId", projectID),
 		)
+		if errors.Is(err, ErrCachedNotFound) {
+			return nil, proto.ErrProjectNotFound
+		}
 		if !errors.Is(err, proto.ErrAccessKeyNotFound) && !errors.Is(err, proto.ErrProjectNotFound) {
 			logger.Warn("unexpected cache error", slog.Any("error", err))
 			return nil, nil
 		}
-		if quota, err = c.quotaClient.GetProjectQuota(ctx, projectID, now); err != nil {
+		// the concurrent misses of the project share the same call
+		quota, err = c.doQuota(ctx, getProjectKey(projectID), func(ctx context.Context) (*proto.AccessQuota, error) {
+			quota, err := c.quotaClient.GetProjectQuota(ctx, projectID, now)
+			if err != nil {
+				if ttl := c.notFoundTTL(); ttl > 0 && errors.Is(err, proto.ErrProjectNotFound) {
+					if err := c.cache.QuotaCache.SetProjectNotFound(ctx, projectID, ttl); err != nil {
+						logger.Warn("failed to cache project not found", slog.Any("error", err))
+					}
+				}
+				return nil, err
+			}
+			if err := c.cache.QuotaCache.SetProjectQuota(ctx, quota); err != nil {
+				logger.Warn("failed to cache project quota", slog.Any("error", err))
+			}
+			return quota, nil
+		})
+		if err != nil {
 			if !errors.Is(err, proto.ErrAccessKeyNotFound) && !errors.Is(err, proto.ErrProjectNotFound) {
 				logger.Warn("unexpected client error", slog.Any("error", err))
 				return nil, nil
 			}
 			return nil, err
 		}
-		if err := c.cache.QuotaCache.SetProjectQuota(ctx, quota); err != nil {
-			logger.Warn("failed to cache project quota", slog.Any("error", err))
-		}
 	}
-	if err := quota.Info.ValidateChains(chainIDs); err != nil {
+	if err := quota.ValidateChains(chainIDs); err != nil {
 		return quota, proto.ErrInvalidChain.WithCause(err)
 	}
 	return quota, nil
 }
 
 // FetchKeyQuota fetches and validates the accessKey from cache or from the quota server.
-func (c *Client) FetchKeyQuota(ctx context.Context, accessKey, origin string, chainIDs []uint64, now time.Time) (*proto.AccessQuota, error) {
+func (c *Client) FetchKeyQuota(ctx context.Context, accessKey, origin string, chainIDs []uint64, now time.Time) (quota *proto.AccessQuota, err error) {
+	projectID, _ := authcontrol.GetProjectIDFromAccessKey(accessKey)
+	ctx, span := c.tracer.Start(ctx, "Client.FetchKeyQuota", trace.WithAttributes(tracing.ProjectID(projectID), tracing.Service(c.service)))
+	defer func() { tracing.End(span, err) }()
+
 	logger := c.logger.With(
 		slog.String("op", "fetch_key_quota"),
 		slog.String("access_key", accessKey),
 	)
 	// fetch access quota
-	quota, err := c.cache.QuotaCache.GetAccessQuota(ctx, accessKey)
+	quota, err = c.cache.QuotaCache.GetAccessQuota(ctx, accessKey)
+	// the quota of a key past its grace period is a miss, so the server disables the key
+	if err == nil && quota.AccessKey.Active && quota.AccessKey.IsExpired(time.Now()) {
+		quota, err = nil, proto.ErrAccessKeyNotFound
+	}
+	result := lookupResult(err, proto.ErrAccessKeyNotFound)
+	c.metrics.CacheLookup("quota", result)
+	span.SetAttributes(tracing.CacheKey.String(result))
 	if err != nil {
+		if errors.Is(err, ErrCachedNotFound) {
+			return nil, proto.ErrAccessKeyNotFound
+		}
 		if !errors.Is(err, proto.ErrAccessKeyNotFound) {
 			logger.Error("unexpected cache error", slog.Any("error", err))
 			return nil, nil
 		}
-		if quota, err = c.quotaClient.GetAccessQuota(ctx, accessKey, now); err != nil {
+		// the concurrent misses of the key share the same call
+		quota, err = c.doQuota(ctx, accessKey, func(ctx context.Context) (*proto.AccessQuota, error) {
+			quota, err := c.quotaClient.GetAccessQuota(ctx, accessKey, now)
+			if err != nil {
+				if ttl := c.notFoundTTL(); ttl > 0 && errors.Is(err, proto.ErrAccessKeyNotFound) {
+					if err := c.cache.QuotaCache.SetAccessNotFound(ctx, accessKey, ttl); err != nil {
+						logger.Warn("failed to cache access key not found", slog.Any("error", err))
+					}
+				}
+				return nil, err
+			}
+			if err := c.cache.QuotaCache.SetAccessQuota(ctx, quota); err != nil {
+				logger.Warn("failed to cache access quota", slog.Any("error", err))
+			}
+			return quota, nil
+		})
+		if err != nil {
 			if !errors.Is(err, proto.ErrAccessKeyNotFound) && !errors.Is(err, proto.ErrProjectNotFound) {
 				logger.Error("unexpected client error", slog.Any("error", err))
 				return nil, nil
 			}
 			return nil, err
 		}
-		if err := c.cache.QuotaCache.SetAccessQuota(ctx, quota); err != nil {
-			logger.Warn("failed to cache access quota", slog.Any("error", err))
-		}
 	}
-	if err := quota.Info.ValidateChains(chainIDs); err != nil {
+	if err := quota.ValidateChains(chainIDs); err != nil {
 		return quota, proto.ErrInvalidChain.WithCause(err)
 	}
 	// validate access key
@@ -189,36 +358,96 @@ func (c *Client) FetchUsage(ctx context.Context, quota *proto.AccessQuota, now t
 	return usage, nil
 }
 
-func (c *Client) EnsureUsage(ctx context.Context, projectID uint64, cycle *proto.Cycle, now time.Time) (int64, error) {
-	key := cacheKeyQuota(projectID, cycle, &c.service, now)
-	for i := range 3 {
+// EnsureUsage returns the usage of the project in the cycle, loading it from the server if it's not cached.
+// A single caller across all the instances loads it, the others wait for it up to the usage wait timeout.
+func (c *Client) EnsureUsage(ctx context.Context, projectID uint64, cycle *proto.Cycle, now time.Time) (_ int64, err error) {
+	ctx, span := c.tracer.Start(ctx, "Client.EnsureUsage", trace.WithAttributes(tracing.ProjectID(projectID), tracing.Service(c.service)))
+	defer func() { tracing.End(span, err) }()
+
+	c.active.see(projectID, cycle, now)
+	return c.ensureUsage(ctx, projectID, "", cycle, now)
+}
+
+// ensureKeyUsage returns the usage of the access key in the cycle, it's kept only for the keys with a usage limit.
+func (c *Client) ensureKeyUsage(ctx context.Context, access *proto.AccessKey, cycle *proto.Cycle, now time.Time) (_ int64, err error) {
+	ctx, span := c.tracer.Start(ctx, "Client.EnsureKeyUsage", trace.WithAttributes(tracing.ProjectID(access.ProjectID), tracing.Service(c.service)))
+	defer func() { tracing.End(span, err) }()
+
+	return c.ensureUsage(ctx, access.ProjectID, access.AccessKey, cycle, now)
+}
+
+// ensureUsage returns the usage of the project, or of the access key if set, loading it from the server if it's not cached.
+func (c *Client) ensureUsage(ctx context.Context, projectID uint64, accessKey string, cycle *proto.Cycle, now time.Time) (int64, error) {
+	span := trace.SpanFromContext(ctx)
+	key := c.usageCacheKey(projectID, accessKey, cycle, now)
+	ctx, cancel := context.WithTimeout(ctx, c.usageWaitTimeout())
+	defer cancel()
+
+	for {
 		usage, err := c.cache.UsageCache.PeekUsage(ctx, key)
-		if err != nil {
-			// Some other client is updating the cache, wait and retry.
-			if errors.Is(err, errCacheWait) {
-				time.Sleep(time.Millisecond * 100 * time.Duration(i+1))
-				continue
+		switch {
+		case err == nil:
+			return usage, nil
+		case errors.Is(err, errCacheReady):
+			span.AddEvent("load usage")
+			usage, ok, err := c.loadUsage(ctx, projectID, accessKey, cycle, now, usageTTL(cycle, now))
+			if err != nil {
+				return 0, c.usageErr(ctx, err)
 			}
-			// PeekUsage found nil and set the cache to -1, expecting the client to set the usage.
-			if errors.Is(err, errCacheReady) {
-				min, max := cycle.GetStart(now), cycle.GetEnd(now)
-				usage, err := c.quotaClient.GetUsage(ctx, projectID, nil, &c.service, &min, &max)
-				if err != nil {
-					return 0, fmt.Errorf("get account usage: %w", err)
-				}
-
-				if err := c.cache.SetUsage(ctx, key, usage); err != nil {
-					return 0, fmt.Errorf("set usage cache: %w", err)
-				}
+			if ok {
 				return usage, nil
 			}
+		case errors.Is(err, errCacheWait):
+			// some other client is loading the usage
+			span.AddEvent("wait usage")
+			if err := c.cache.UsageCache.WaitUsage(ctx, key); err != nil {
+				return 0, c.usageErr(ctx, err)
+			}
+		default:
+			return 0, c.usageErr(ctx, fmt.Errorf("peek usage cache: %w", err))
+		}
+	}
+}
+
+// loadUsage locks the usage of the cycle, of the project or of the access key if set, gets it from the server and sets it in the cache for ttl.
+// It returns false if another client holds the lock, or if the lock was lost meanwhile.
+func (c *Client) loadUsage(ctx context.Context, projectID uint64, accessKey string, cycle *proto.Cycle, now time.Time, ttl time.Duration) (int64, bool, error) {
+	key := c.usageCacheKey(projectID, accessKey, cycle, now)
+	fence, err := c.cache.UsageCache.LockUsage(ctx, key, c.usageWaitTimeout())
+	if err != nil {
+		if errors.Is(err, errCacheWait) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("lock usage cache: %w", err)
+	}
 
-			return 0, fmt.Errorf("peek usage cache: %w", err)
+	min, max := cycle.GetStart(now), cycle.GetEnd(now)
+	var keyFilter *string
+	if accessKey != "" {
+		keyFilter = &accessKey
+	}
+	usage, err := c.quotaClient.GetUsage(ctx, projectID, keyFilter, &c.service, &min, &max)
+	if err != nil {
+		// let the waiters try, without waiting for the lock to expire
+		if err := c.cache.UsageCache.UnlockUsage(context.WithoutCancel(ctx), key, fence); err != nil {
+			c.logger.Error("unlock usage cache", slog.Any("error", err))
 		}
-		return usage, nil
+		return 0, false, fmt.Errorf("get account usage: %w", err)
 	}
 
-	return 0, proto.ErrTimeout
+	ok, err := c.cache.UsageCache.InitUsage(ctx, key, fence, usage, ttl)
+	if err != nil {
+		return 0, false, fmt.Errorf("set usage cache: %w", err)
+	}
+	return usage, ok, nil
+}
+
+// usageErr returns ErrTimeout if the usage wasn't available in time.
+func (c *Client) usageErr(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return proto.ErrTimeout.WithCause(err)
+	}
+	return err
 }
 
 func (c *Client) CheckPermission(ctx context.Context, projectID uint64, minPermission proto.UserPermission) (bool, error) {
@@ -234,7 +463,10 @@ func (c *Client) CheckPermission(ctx context.Context, projectID uint64, minPermi
 
 // FetchPermission fetches the user permission from cache or from the quota server.
 // If an error occurs, it returns nil.
-func (c *Client) FetchPermission(ctx context.Context, projectID uint64) (proto.UserPermission, *proto.ResourceAccess, error) {
+func (c *Client) FetchPermission(ctx context.Context, projectID uint64) (perm proto.UserPermission, access *proto.ResourceAccess, err error) {
+	ctx, span := c.tracer.Start(ctx, "Client.FetchPermission", trace.WithAttributes(tracing.ProjectID(projectID), tracing.Service(c.service)))
+	defer func() { tracing.End(span, err) }()
+
 	userID, _ := authcontrol.GetAccount(ctx)
 	logger := c.logger.With(
 		slog.String("op", "fetch_permission"),
@@ -242,30 +474,76 @@ func (c *Client) FetchPermission(ctx context.Context, projectID uint64) (proto.U
 		slog.String("user_id", userID),
 	)
 	// Check short-lived cache if requested. Note using the cache TTL from config (default 1m).
-	perm, access, err := c.cache.PermissionCache.GetUserPermission(ctx, projectID, userID)
+	perm, access, err = c.cache.PermissionCache.GetUserPermission(ctx, projectID, userID)
+	result := metrics.CacheMiss
 	if err != nil {
 		// log the error, but don't stop
 		logger.Error("unexpected cache error", slog.Any("error", err))
+		result = metrics.CacheError
+	} else if perm != proto.UserPermission_UNAUTHORIZED {
+		result = metrics.CacheHit
 	}
+	c.metrics.CacheLookup("permission", result)
+	span.SetAttributes(tracing.CacheKey.String(result))
 	if perm != proto.UserPermission_UNAUTHORIZED {
 		return perm, access, nil
 	}
 
-	// Ask quotacontrol server via client
-	perm, access, err = c.quotaClient.GetUserPermission(ctx, projectID, userID)
+	// Ask quotacontrol server via client, the concurrent misses of the user share the same call
+	res, err, joined := c.flight.permission.Do(permissionKey(projectID, userID), func() (permissionResult, error) {
+		ctx, cancel := c.flightContext(ctx)
+		defer cancel()
+		perm, access, err := c.quotaClient.GetUserPermission(ctx, projectID, userID)
+		if err != nil {
+			return permissionResult{}, err
+		}
+		if !perm.Is(proto.UserPermission_UNAUTHORIZED) {
+			if err := c.cache.PermissionCache.SetUserPermission(ctx, projectID, userID, perm, access); err != nil {
+				c.logger.Warn("set user perm in cache", slog.Any("error", err))
+			}
+		}
+		return permissionResult{perm: perm, access: access}, nil
+	})
+	c.countFetch("permission", &c.stats.permissionFetches, &c.stats.permissionCoalesced, joined)
 	if err != nil {
 		logger.Error("unexpected client error", slog.Any("error", err))
 		return proto.UserPermission_UNAUTHORIZED, nil, fmt.Errorf("get user permission from quotacontrol server: %w", err)
 	}
-	if !perm.Is(proto.UserPermission_UNAUTHORIZED) {
-		if err := c.cache.PermissionCache.SetUserPermission(ctx, projectID, userID, perm, access); err != nil {
-			c.logger.Warn("set user perm in cache", slog.Any("error", err))
-		}
+	return res.perm, res.access, nil
+}
+
+// doQuota calls fn once for the concurrent cache misses of the same key.
+func (c *Client) doQuota(ctx context.Context, key string, fn func(ctx context.Context) (*proto.AccessQuota, error)) (*proto.AccessQuota, error) {
+	quota, err, joined := c.flight.quota.Do(key, func() (*proto.AccessQuota, error) {
+		ctx, cancel := c.flightContext(ctx)
+		defer cancel()
+		return fn(ctx)
+	})
+	c.countFetch("quota", &c.stats.quotaFetches, &c.stats.quotaCoalesced, joined)
+	return quota, err
+}
+
+func (c *Client) SpendQuota(ctx context.Context, quota *proto.AccessQuota, cost int64, now time.Time) (bool, int64, error) {
+	ctx, span := c.tracer.Start(ctx, "Client.SpendQuota", trace.WithAttributes(tracing.Service(c.service)))
+	if quota != nil {
+		span.SetAttributes(tracing.ProjectID(quota.GetProjectID()))
 	}
-	return perm, access, nil
+
+	start := time.Now()
+	spent, total, err := c.spendQuota(ctx, quota, cost, now)
+	result := spendResult(spent, err)
+	c.metrics.SpendQuota(c.service.GetName(), result, time.Since(start))
+
+	span.SetAttributes(tracing.Decision(result))
+	if result == metrics.SpendError {
+		tracing.End(span, err)
+	} else {
+		span.End()
+	}
+	return spent, total, err
 }
 
-func (c *Client) SpendQuota(ctx context.Context, quota *proto.AccessQuota, cost int64, now time.Time) (spent bool, total int64, err error) {
+func (c *Client) spendQuota(ctx context.Context, quota *proto.AccessQuota, cost int64, now time.Time) (spent bool, total int64, err error) {
 	// quota is nil only on unexpected errors from quota fetch
 	if quota == nil || cost == 0 {
 		return false, 0, nil
@@ -291,25 +569,49 @@ func (c *Client) SpendQuota(ctx context.Context, quota *proto.AccessQuota, cost
 		logger.Error("ensure usage", slog.Any("error", err))
 		return false, 0, err
 	}
-	if total >= cfg.OverMax {
+	// prepaid credits are spent after the free usage, moving the overage forward
+	credits := quota.GetCredits(c.service)
+	if total >= cfg.OverMax+credits {
+		c.trackUsage(projectID, accessKey, now, proto.UsageBreakdown{Limited: cost})
 		return false, total, proto.ErrQuotaExceeded
 	}
 
+	// the access key can cap its own usage, the cost that doesn't fit in it is limited
+	amount, keyAmount := cost, int64(0)
+	if keyCfg, ok := quota.AccessKey.GetSettings(c.service); ok && keyCfg.OverMax > 0 {
+		if keyAmount, err = c.spendKeyUsage(ctx, quota, cost, keyCfg.OverMax, now); err != nil {
+			logger.Error("spend key usage", slog.Any("error", err))
+			return false, 0, err
+		}
+		if keyAmount == 0 {
+			c.trackUsage(projectID, accessKey, now, proto.UsageBreakdown{Limited: cost})
+			return false, total, proto.ErrQuotaExceeded
+		}
+		amount = keyAmount
+	}
+
 	key := cacheKeyQuota(projectID, quota.Cycle, &c.service, now)
 
 	// spend compute units
-	if total, err = c.cache.UsageCache.SpendUsage(ctx, key, cost, cfg.OverMax); err != nil {
+	before, total, err := c.cache.UsageCache.SpendUsage(ctx, key, amount, cfg.OverMax+credits)
+	if keyAmount > 0 && (err != nil || total-before < keyAmount) {
+		// the key gives back what the project didn't allow
+		c.refundKeyUsage(ctx, quota, keyAmount-(total-before), now)
+	}
+	if err != nil {
+		if errors.Is(err, proto.ErrQuotaExceeded) {
+			c.trackUsage(projectID, accessKey, now, proto.UsageBreakdown{Limited: cost})
+			return false, total, err
+		}
 		logger.Error("unexpected cache error", slog.Any("error", err))
 		return false, 0, err
 	}
 
-	usage, event := cfg.GetSpendResult(cost, total)
-	if accessKey == "" {
-		c.usage.AddProjectUsage(projectID, now, usage)
-	} else {
-		c.usage.AddKeyUsage(accessKey, now, usage)
-	}
-	if usage < cost {
+	usage, event := cfg.GetSpendBuckets(total-before, total, credits)
+	// the cost that doesn't fit in the limit is rejected
+	usage.Limited = cost - usage.Total()
+	c.trackUsage(projectID, accessKey, now, usage)
+	if usage.Limited > 0 {
 		return false, total, proto.ErrQuotaExceeded
 	}
 	if event != nil {
@@ -320,6 +622,45 @@ func (c *Client) SpendQuota(ctx context.Context, quota *proto.AccessQuota, cost
 	return true, total, nil
 }
 
+// spendKeyUsage spends the cost from the usage limit of the access key, it returns the part of the cost that fits in it.
+// The part is then spent from the project, what the project doesn't allow is given back with refundKeyUsage.
+func (c *Client) spendKeyUsage(ctx context.Context, quota *proto.AccessQuota, cost, limit int64, now time.Time) (int64, error) {
+	usage, err := c.ensureKeyUsage(ctx, quota.AccessKey, quota.Cycle, now)
+	if err != nil {
+		return 0, fmt.Errorf("ensure key usage: %w", err)
+	}
+	if usage >= limit {
+		return 0, nil
+	}
+
+	key := cacheKeyAccessKey(quota.AccessKey.AccessKey, quota.Cycle, &c.service, now)
+	before, after, err := c.cache.UsageCache.SpendUsage(ctx, key, cost, limit)
+	if err != nil {
+		if errors.Is(err, proto.ErrQuotaExceeded) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return after - before, nil
+}
+
+// refundKeyUsage gives the amount back to the usage of the access key.
+func (c *Client) refundKeyUsage(ctx context.Context, quota *proto.AccessQuota, amount int64, now time.Time) {
+	key := cacheKeyAccessKey(quota.AccessKey.AccessKey, quota.Cycle, &c.service, now)
+	if _, _, err := c.cache.UsageCache.SpendUsage(ctx, key, -amount, 0); err != nil {
+		c.logger.Error("refund key usage", slog.String("op", "spend_quota"), slog.Uint64("projectId", quota.AccessKey.ProjectID), slog.Any("error", err))
+	}
+}
+
+// trackUsage adds the usage to the tracker, by access key or by project if the key is empty.
+func (c *Client) trackUsage(projectID uint64, accessKey string, now time.Time, usage proto.UsageBreakdown) {
+	if accessKey == "" {
+		c.usage.AddProjectUsage(projectID, now, usage)
+	} else {
+		c.usage.AddKeyUsage(accessKey, now, usage)
+	}
+}
+
 func (c *Client) ClearQuotaCacheByProjectID(ctx context.Context, projectID uint64) error {
 	return c.cache.QuotaCache.DeleteProjectQuota(ctx, projectID)
 }
@@ -329,7 +670,8 @@ func (c *Client) ClearQuotaCacheByAccessKey(ctx context.Context, accessKey strin
 }
 
 func (c *Client) validateAccessKey(access *proto.AccessKey, origin string) (err error) {
-	if !access.Active {
+	// the expiry uses the clock, the time of the request can be truncated to the day
+	if !access.Active || access.IsExpired(time.Now()) {
 		return proto.ErrAccessKeyNotFound
 	}
 	if !access.ValidateOrigin(origin) {
@@ -358,9 +700,21 @@ func (c *Client) Run(ctx context.Context) error {
 		c.Stop(context.Background())
 	}()
 
+	if lru, ok := c.cache.QuotaCache.(*LRU); ok && c.invalidator != nil {
+		if err := lru.Subscribe(ctx, c.invalidator); err != nil {
+			// without the invalidations the LRU serves stale quotas until they expire
+			logger.Error("subscribe to invalidations", slog.Any("error", err))
+			go lru.resubscribe(ctx, c.invalidator, logger)
+		}
+	}
+
+	if window := c.prewarmWindow(); window > 0 {
+		go c.runPrewarm(ctx, window)
+	}
+
 	// Start the sync
 	for range c.ticker.C {
-		if err := c.usage.SyncUsage(ctx, c.quotaClient, c.service); err != nil {
+		if err := c.syncUsage(ctx); err != nil {
 			logger.Error("sync usage", slog.Any("error", err))
 			continue
 		}
@@ -381,12 +735,22 @@ func (c *Client) Stop(timeoutCtx context.Context) {
 
 	c.ticker.Stop()
 
-	if err := c.usage.SyncUsage(timeoutCtx, c.quotaClient, c.service); err != nil {
+	if err := c.syncUsage(timeoutCtx); err != nil {
 		logger.Error("sync usage", slog.Any("error", err))
 	}
+	if err := c.usage.Close(); err != nil {
+		logger.Error("close usage journal", slog.Any("error", err))
+	}
 	logger.Info("stopped.")
 }
 
+// syncUsage syncs the usage with the server and records the result.
+func (c *Client) syncUsage(ctx context.Context) error {
+	err := c.usage.SyncUsage(ctx, c.quotaClient, c.service)
+	c.metrics.UsageSync(c.service.GetName(), err != nil, c.usage.Backlog())
+	return err
+}
+
 func (c *Client) isRunning() bool {
 	return atomic.LoadInt32(&c.running) == 1
 }
@@ -402,6 +766,20 @@ func (t bearerToken) RoundTrip(req *http.Request) (*http.Response, error) {
 	return http.DefaultTransport.RoundTrip(req)
 }
 
+// usageCacheKey returns the key of the usage of the project in the cycle, or of the access key if set.
+func (c *Client) usageCacheKey(projectID uint64, accessKey string, cycle *proto.Cycle, now time.Time) string {
+	if accessKey != "" {
+		return cacheKeyAccessKey(accessKey, cycle, &c.service, now)
+	}
+	return cacheKeyQuota(projectID, cycle, &c.service, now)
+}
+
+// cacheKeyAccessKey returns the key of the usage of the access key in the cycle, counted for its usage limit.
+func cacheKeyAccessKey(accessKey string, cycle *proto.Cycle, service *proto.Service, now time.Time) string {
+	start, end := cycle.GetStart(now), cycle.GetEnd(now)
+	return fmt.Sprintf("key:%s:%s:%s:%s", accessKey, service.GetName(), start.Format("2006-01-02"), end.Format("2006-01-02"))
+}
+
 func cacheKeyQuota(projectID uint64, cycle *proto.Cycle, service *proto.Service, now time.Time) string {
 	start, end := cycle.GetStart(now), cycle.GetEnd(now)
 	if service == nil {
@@ -1,9 +1,17 @@
 package quotacontrol
 
 import (
+	"fmt"
+	"os"
 	"time"
 
+	"github.com/0xsequence/quotacontrol/metrics"
 	"github.com/0xsequence/quotacontrol/middleware"
+	"github.com/0xsequence/quotacontrol/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Config struct {
@@ -16,19 +24,128 @@ type Config struct {
 	DefaultUsage  *int64          `toml:"default_usage"`
 	LRUSize       int             `toml:"lru_size"`
 	LRUExpiration time.Duration   `toml:"lru_expiration"`
+	// NotFoundTTL is how long unknown projects and access keys are cached, 0 uses the default of 10 seconds and a negative value disables it.
+	NotFoundTTL time.Duration `toml:"not_found_ttl"`
+	// UsageWaitTimeout is how long a request waits for the usage of the cycle to be loaded, 5 seconds by default.
+	UsageWaitTimeout time.Duration `toml:"usage_wait_timeout"`
+	// PrewarmWindow is how long before the end of the cycle the usage of the next one is loaded for the active projects,
+	// 0 uses the default of 10 minutes and a negative value disables it.
+	PrewarmWindow time.Duration `toml:"prewarm_window"`
+	// UsageJournal is the path of the file where the unsynced usage is kept, empty to keep it only in memory.
+	UsageJournal string `toml:"usage_journal"`
+
+	// Resilience configures the timeouts, retries and circuit breaker of the calls to the quota server.
+	Resilience ResilienceConfig `toml:"resilience"`
+	// Fail is the behaviour of the middlewares when the quota can't be verified, it's meant for middleware.Options.
+	Fail FailConfig `toml:"fail"`
+	// Metrics configures the metrics of the client, they're meant for middleware.Options too.
+	Metrics MetricsConfig `toml:"metrics"`
+	// Tracing configures the spans of the client, they're meant for middleware.Options too.
+	Tracing TracingConfig `toml:"tracing"`
 
 	// DangerMode is used for debugging
 	DangerMode bool `toml:"danger_mode"`
 }
 
+// Validate checks the redis configuration and that the usage journal can be opened.
+// NewClient logs these errors and runs degraded, call it at startup to fail instead.
+func (cfg Config) Validate() error {
+	if err := cfg.Redis.Validate(); err != nil {
+		return fmt.Errorf("invalid redis config: %w", err)
+	}
+	if cfg.UsageJournal != "" {
+		f, err := os.OpenFile(cfg.UsageJournal, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("usage journal %q: %w", cfg.UsageJournal, err)
+		}
+		f.Close()
+	}
+	return nil
+}
+
 type RateLimitConfig = middleware.RateLimitConfig
 
+type FailConfig = middleware.FailConfig
+
+type MetricsConfig struct {
+	// Enabled registers the Prometheus metrics in the default registerer.
+	Enabled bool `toml:"enabled"`
+	// Namespace of the Prometheus metrics, metrics.DefaultNamespace if empty.
+	Namespace string `toml:"namespace"`
+	// Collector is used instead of the Prometheus one, if set.
+	Collector metrics.Collector `toml:"-"`
+}
+
+// collector returns the collector of the configuration, a no-op one if disabled.
+func (cfg MetricsConfig) collector() (metrics.Collector, error) {
+	if cfg.Collector != nil {
+		return cfg.Collector, nil
+	}
+	if !cfg.Enabled {
+		return metrics.Noop{}, nil
+	}
+	p, err := metrics.NewPrometheus(prometheus.DefaultRegisterer, cfg.Namespace)
+	if err != nil {
+		return metrics.Noop{}, fmt.Errorf("register metrics: %w", err)
+	}
+	return p, nil
+}
+
+type TracingConfig struct {
+	// Enabled creates the spans with the global tracer provider and propagator of otel.
+	Enabled bool `toml:"enabled"`
+	// Provider is used instead of the global tracer provider, if set.
+	Provider trace.TracerProvider `toml:"-"`
+	// Propagator is used instead of the global propagator, if set.
+	Propagator propagation.TextMapPropagator `toml:"-"`
+}
+
+// enabled reports whether the spans are created.
+func (cfg TracingConfig) enabled() bool {
+	return cfg.Enabled || cfg.Provider != nil
+}
+
+// tracer returns the tracer of the configuration, a no-op one if disabled.
+func (cfg TracingConfig) tracer() trace.Tracer {
+	switch {
+	case cfg.Provider != nil:
+		return cfg.Provider.Tracer(tracing.TracerName)
+	case cfg.Enabled:
+		return otel.Tracer(tracing.TracerName)
+	}
+	return tracing.Noop()
+}
+
 type RedisConfig struct {
 	Enabled   bool          `toml:"enabled"`
 	Host      string        `toml:"host"`
 	Port      uint16        `toml:"port"`
-	DBIndex   int           `toml:"db_index"`   // default 0
+	DBIndex   int           `toml:"db_index"`   // default 0, ignored by cluster
 	MaxIdle   int           `toml:"max_idle"`   // default 4
 	MaxActive int           `toml:"max_active"` // default 8
 	KeyTTL    time.Duration `toml:"key_ttl"`    // default 1 day
+
+	// Addrs are the host:port of the cluster nodes or of the sentinels, Host and Port are used if empty.
+	Addrs []string `toml:"addrs"`
+	// Cluster connects to a Redis Cluster.
+	Cluster bool `toml:"cluster"`
+	// MasterName is the name of the master monitored by the sentinels, it enables the sentinel failover.
+	MasterName       string `toml:"master_name"`
+	SentinelUsername string `toml:"sentinel_username"`
+	SentinelPassword string `toml:"sentinel_password"`
+
+	Username string         `toml:"username"`
+	Password string         `toml:"password"`
+	TLS      RedisTLSConfig `toml:"tls"`
+}
+
+type RedisTLSConfig struct {
+	Enabled bool `toml:"enabled"`
+	// CAFile is the PEM file of the certificate authorities, the system ones are used if empty.
+	CAFile string `toml:"ca_file"`
+	// CertFile and KeyFile are the PEM files of the client certificate, if required by the server.
+	CertFile           string `toml:"cert_file"`
+	KeyFile            string `toml:"key_file"`
+	ServerName         string `toml:"server_name"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`
 }
@@ -0,0 +1,285 @@
+package quotacontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/0xsequence/quotacontrol/middleware"
+	"github.com/0xsequence/quotacontrol/proto"
+)
+
+var errNoCreditStore = proto.ErrMethodNotFound.WithCausef("credit store not configured")
+
+// ErrCreditsExhausted is returned by the CreditStore when a grant doesn't have the credits left for a spend.
+var ErrCreditsExhausted = errors.New("quotacontrol: credits exhausted")
+
+// CreditSpend is an amount of credits spent from a grant.
+type CreditSpend struct {
+	GrantID uint64
+	Amount  int64
+}
+
+func (s server) GrantCredits(ctx context.Context, projectID uint64, service proto.Service, amount int64, expiresAt time.Time, description *string) (*proto.CreditGrant, error) {
+	if s.store.CreditStore == nil {
+		return nil, errNoCreditStore
+	}
+
+	// the grant is created on the clock of GetCreditUsage, its expiry is checked against the current time
+	now := middleware.GetTime(ctx).UTC()
+	if amount <= 0 {
+		return nil, proto.ErrWebrpcBadRequest.WithCausef("amount must be > 0")
+	}
+	if !expiresAt.After(time.Now()) {
+		return nil, proto.ErrWebrpcBadRequest.WithCausef("expiresAt must be in the future")
+	}
+	if _, err := s.store.ProjectInfoStore.GetProjectInfo(ctx, projectID, now); err != nil {
+		if errors.Is(err, proto.ErrProjectNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("get project info: %w", err)
+	}
+
+	grant := proto.CreditGrant{
+		ProjectID: projectID,
+		Service:   service,
+		Amount:    amount,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	if description != nil {
+		grant.Description = *description
+	}
+	if err := s.store.CreditStore.InsertCreditGrant(ctx, &grant); err != nil {
+		return nil, fmt.Errorf("insert credit grant: %w", err)
+	}
+	s.auditEvent(ctx, proto.AuditEvent{ProjectID: projectID, RPC: "GrantCredits", CreditGrant: &grant})
+
+	if _, err := s.ClearAccessQuotaCache(ctx, projectID); err != nil {
+		s.log.Error("clear access quota cache", slog.Any("error", err))
+	}
+	return &grant, nil
+}
+
+func (s server) ListCreditGrants(ctx context.Context, projectID uint64, service *proto.Service, active *bool) ([]*proto.CreditGrant, error) {
+	if s.store.CreditStore == nil {
+		return nil, errNoCreditStore
+	}
+
+	grants, err := s.store.CreditStore.ListCreditGrants(ctx, projectID, service)
+	if err != nil {
+		return nil, fmt.Errorf("list credit grants: %w", err)
+	}
+	if active == nil {
+		return grants, nil
+	}
+
+	now := time.Now()
+	return slices.DeleteFunc(grants, func(g *proto.CreditGrant) bool {
+		return g.IsActive(now) != *active
+	}), nil
+}
+
+func (s server) RevokeCreditGrant(ctx context.Context, projectID uint64, id uint64) (bool, error) {
+	if s.store.CreditStore == nil {
+		return false, errNoCreditStore
+	}
+
+	ok, err := s.store.CreditStore.RevokeCreditGrant(ctx, projectID, id, time.Now().UTC())
+	if err != nil {
+		return false, fmt.Errorf("revoke credit grant: %w", err)
+	}
+	if !ok {
+		return false, proto.ErrCreditGrantNotFound
+	}
+	s.auditEvent(ctx, proto.AuditEvent{ProjectID: projectID, RPC: "RevokeCreditGrant", CreditGrant: s.revokedCreditGrant(ctx, projectID, id)})
+
+	if _, err := s.ClearAccessQuotaCache(ctx, projectID); err != nil {
+		s.log.Error("clear access quota cache", slog.Any("error", err))
+	}
+	return true, nil
+}
+
+// revokedCreditGrant returns the grant for the audit of its revocation, only its ID if it can't be read.
+func (s server) revokedCreditGrant(ctx context.Context, projectID, id uint64) *proto.CreditGrant {
+	grants, err := s.store.CreditStore.ListCreditGrants(ctx, projectID, nil)
+	if err != nil {
+		s.log.Error("list credit grants", slog.Any("error", err))
+	}
+	for _, g := range grants {
+		if g.ID == id {
+			return g
+		}
+	}
+	return &proto.CreditGrant{ID: id, ProjectID: projectID}
+}
+
+func (s server) GetCreditUsage(ctx context.Context, projectID uint64, service *proto.Service, from, to *time.Time) (int64, error) {
+	if s.store.CreditStore == nil {
+		return 0, errNoCreditStore
+	}
+
+	start, end, err := s.getInterval(ctx, projectID, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	usage, err := s.store.CreditStore.GetCreditUsage(ctx, projectID, service, start, end)
+	if err != nil {
+		return 0, fmt.Errorf("get credit usage: %w", err)
+	}
+	return usage, nil
+}
+
+// getCredits returns the credits of each service in the cycle.
+// They are the remaining credits of the active grants plus the ones spent in the cycle, since the usage of the cycle includes them.
+// The spent credits are added even if their grant is not active anymore, the usage they paid for is still in the cycle.
+func (s server) getCredits(ctx context.Context, projectID uint64, cycle *proto.Cycle, now time.Time) (map[string]int64, error) {
+	if s.store.CreditStore == nil {
+		return nil, nil
+	}
+
+	grants, err := s.store.CreditStore.ListCreditGrants(ctx, projectID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("list credit grants: %w", err)
+	}
+
+	credits := make(map[proto.Service]int64)
+	for _, g := range grants {
+		var remaining int64
+		if g.IsActive(now) {
+			remaining = g.Remaining()
+		}
+		credits[g.Service] += remaining
+	}
+
+	var m map[string]int64
+	for svc, v := range credits {
+		spent, err := s.store.CreditStore.GetCreditUsage(ctx, projectID, &svc, cycle.GetStart(now), cycle.GetEnd(now))
+		if err != nil {
+			return nil, fmt.Errorf("get credit usage: %w", err)
+		}
+		if v+spent == 0 {
+			continue
+		}
+		if m == nil {
+			m = make(map[string]int64, len(credits))
+		}
+		m[svc.String()] = v + spent
+	}
+	return m, nil
+}
+
+// attributeUsage returns the usage split by bucket, and the credits it spends from the grants of the project.
+// The breakdown of the client is used if it adds up to the usage, otherwise the usage is split with the limits of the project.
+// The grants that expire first are spent first, the credits that the grants can't cover are billed as overage.
+func (s server) attributeUsage(ctx context.Context, projectID uint64, service proto.Service, now time.Time, usage int64, breakdown *proto.UsageBreakdown) (proto.UsageBreakdown, []CreditSpend, error) {
+	var grants []*proto.CreditGrant
+	if s.store.CreditStore != nil {
+		list, err := s.store.CreditStore.ListCreditGrants(ctx, projectID, &service)
+		if err != nil {
+			return proto.UsageBreakdown{}, nil, fmt.Errorf("list credit grants: %w", err)
+		}
+		grants = slices.DeleteFunc(list, func(g *proto.CreditGrant) bool {
+			return !g.IsActive(now) || g.Remaining() == 0
+		})
+		slices.SortFunc(grants, func(a, b *proto.CreditGrant) int {
+			return a.ExpiresAt.Compare(b.ExpiresAt)
+		})
+	}
+
+	var result proto.UsageBreakdown
+	if breakdown != nil && validBreakdown(*breakdown, usage) {
+		result = *breakdown
+	} else {
+		r, err := s.splitUsage(ctx, projectID, service, now, usage, grants)
+		if err != nil {
+			return proto.UsageBreakdown{}, nil, err
+		}
+		// the buckets are billed, so a breakdown that doesn't add up to the usage is split again
+		if breakdown != nil {
+			s.log.Warn("invalid usage breakdown", slog.String("op", "attribute_usage"), slog.Uint64("projectId", projectID),
+				slog.Int64("usage", usage), slog.Int64("total", breakdown.Total()))
+			r.Limited = max(0, breakdown.Limited)
+		}
+		result = r
+	}
+
+	var spends []CreditSpend
+	amount := result.Credit
+	for _, g := range grants {
+		if amount == 0 {
+			break
+		}
+		v := min(amount, g.Remaining())
+		spends = append(spends, CreditSpend{GrantID: g.ID, Amount: v})
+		amount -= v
+	}
+	// the client may have spent credits that are not available anymore
+	result.Credit -= amount
+	result.Overage += amount
+	return result, spends, nil
+}
+
+// validBreakdown checks that the buckets of the breakdown are not negative and that they add up to the usage.
+func validBreakdown(b proto.UsageBreakdown, usage int64) bool {
+	if b.Free < 0 || b.Credit < 0 || b.Overage < 0 || b.Limited < 0 {
+		return false
+	}
+	return b.Total() == usage
+}
+
+// splitUsage splits the allowed usage by bucket, using the limits, the usage and the credits of the project in the cycle.
+// The usage of projects without limits for the service is free.
+func (s server) splitUsage(ctx context.Context, projectID uint64, service proto.Service, now time.Time, usage int64, grants []*proto.CreditGrant) (proto.UsageBreakdown, error) {
+	if usage == 0 {
+		return proto.UsageBreakdown{}, nil
+	}
+
+	info, err := s.store.ProjectInfoStore.GetProjectInfo(ctx, projectID, now)
+	if err != nil {
+		if errors.Is(err, proto.ErrProjectNotFound) {
+			return proto.UsageBreakdown{Free: usage}, nil
+		}
+		return proto.UsageBreakdown{}, fmt.Errorf("get project info: %w", err)
+	}
+	limit, err := s.store.LimitStore.GetAccessLimit(ctx, projectID, info.Cycle)
+	if err != nil {
+		if errors.Is(err, proto.ErrProjectNotFound) || errors.Is(err, proto.ErrAccessKeyNotFound) {
+			return proto.UsageBreakdown{Free: usage}, nil
+		}
+		return proto.UsageBreakdown{}, fmt.Errorf("get access limit: %w", err)
+	}
+	cfg, ok := limit.GetSettings(service)
+	if !ok {
+		return proto.UsageBreakdown{Free: usage}, nil
+	}
+
+	from, to := info.Cycle.GetStart(now), info.Cycle.GetEnd(now)
+	before, err := s.store.UsageStore.GetAccountUsage(ctx, projectID, &service, from, to)
+	if err != nil {
+		return proto.UsageBreakdown{}, fmt.Errorf("get account usage: %w", err)
+	}
+
+	// the credits spent in the cycle count even if their grant is not active anymore
+	var credits int64
+	if s.store.CreditStore != nil {
+		spent, err := s.store.CreditStore.GetCreditUsage(ctx, projectID, &service, from, to)
+		if err != nil {
+			return proto.UsageBreakdown{}, fmt.Errorf("get credit usage: %w", err)
+		}
+		credits = spent
+		for _, g := range grants {
+			credits += g.Remaining()
+		}
+	}
+
+	result, _ := cfg.GetSpendBuckets(usage, before+usage, credits)
+	// the usage has been allowed by the client, what is over the limit is billed as overage
+	result.Overage += result.Limited
+	result.Limited = 0
+	return result, nil
+}
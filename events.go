@@ -0,0 +1,139 @@
+package quotacontrol
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/0xsequence/quotacontrol/proto"
+)
+
+// Event is a usage threshold crossed by a project for a service in a cycle.
+type Event struct {
+	ProjectID uint64          `json:"projectId"`
+	Service   proto.Service   `json:"service"`
+	Type      proto.EventType `json:"type"`
+	Cycle     *proto.Cycle    `json:"cycle"`
+	Time      time.Time       `json:"time"`
+}
+
+// key returns the key used to de-duplicate the event, one per project, service, type and cycle.
+func (e Event) key() string {
+	return fmt.Sprintf("project:%d:%s:%s:%d", e.ProjectID, e.Service, e.Type, e.Cycle.GetStart(e.Time).Unix())
+}
+
+// notifierKey returns the key used to track the delivery of the event to the i-th notifier of the dispatcher.
+func (e Event) notifierKey(i int) string {
+	return fmt.Sprintf("%s:notifier:%d", e.key(), i)
+}
+
+// EventNotifier delivers events to a destination.
+type EventNotifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+const (
+	defaultNotifyTimeout = time.Minute
+	eventGracePeriod     = 24 * time.Hour
+)
+
+// NewDispatcher returns a dispatcher that sends events to the notifiers.
+// If cache is not nil, it's used to send each event once per cycle, even across replicas.
+func NewDispatcher(log *slog.Logger, cache EventCache, notifiers ...EventNotifier) *Dispatcher {
+	if log == nil {
+		log = slog.Default()
+	}
+	return &Dispatcher{
+		log:       log,
+		cache:     cache,
+		notifiers: notifiers,
+		Timeout:   defaultNotifyTimeout,
+	}
+}
+
+// Dispatcher de-duplicates events and sends them to the registered notifiers.
+type Dispatcher struct {
+	log       *slog.Logger
+	cache     EventCache
+	notifiers []EventNotifier
+	wg        sync.WaitGroup
+
+	// Timeout is the maximum time a notifier has to deliver an event.
+	Timeout time.Duration
+}
+
+// Dispatch sends the event to the notifiers in the background.
+// It returns false if all the notifiers already got the event in the same cycle.
+// Each notifier is tracked on its own: the ones that don't deliver it are unmarked, so that they get it when it's dispatched again.
+func (d *Dispatcher) Dispatch(ctx context.Context, event Event) (bool, error) {
+	logger := d.log.With(
+		slog.String("op", "dispatch"),
+		slog.Uint64("projectId", event.ProjectID),
+		slog.String("service", event.Service.GetName()),
+		slog.String("eventType", event.Type.String()),
+	)
+
+	pending := make(map[int]bool, len(d.notifiers))
+	for i := range d.notifiers {
+		if d.cache == nil {
+			pending[i] = false
+			continue
+		}
+		// keep the mark until the cycle is over
+		ttl := event.Cycle.GetEnd(event.Time).Sub(event.Time) + eventGracePeriod
+		ok, err := d.cache.MarkEvent(ctx, event.notifierKey(i), ttl)
+		if err != nil {
+			// better a duplicate than a lost event
+			logger.Error("mark event", slog.Any("error", err))
+			pending[i] = false
+			continue
+		}
+		if ok {
+			pending[i] = true
+		}
+	}
+	if len(d.notifiers) > 0 && len(pending) == 0 {
+		return false, nil
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.deliver(ctx, logger, event, pending)
+	}()
+	return true, nil
+}
+
+// deliver sends the event to the pending notifiers, the marked ones that fail are unmarked.
+func (d *Dispatcher) deliver(ctx context.Context, logger *slog.Logger, event Event, pending map[int]bool) {
+	var wg sync.WaitGroup
+	for i, marked := range pending {
+		n := d.notifiers[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			notifyCtx, cancel := context.WithTimeout(ctx, d.Timeout)
+			defer cancel()
+			err := n.Notify(notifyCtx, event)
+			if err == nil {
+				return
+			}
+			logger.Error("notify event", slog.String("notifier", fmt.Sprintf("%T", n)), slog.Any("error", err))
+			if !marked {
+				return
+			}
+			if err := d.cache.UnmarkEvent(ctx, event.notifierKey(i)); err != nil {
+				logger.Error("unmark event", slog.Any("error", err))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Wait blocks until all the pending notifications are done.
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
@@ -0,0 +1,252 @@
+package quotacontrol_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/quotacontrol"
+	"github.com/0xsequence/quotacontrol/mock"
+	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	const secret = "secret"
+
+	var calls int32
+	received := make(chan quotacontrol.Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first attempts to trigger the retries
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		signature := quotacontrol.WebhookSignature(secret, r.Header.Get(quotacontrol.HeaderWebhookTimestamp), body)
+		if r.Header.Get(quotacontrol.HeaderWebhookSignature) != signature {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event quotacontrol.Event
+		require.NoError(t, json.Unmarshal(body, &event))
+		received <- event
+	}))
+	defer srv.Close()
+
+	webhook := quotacontrol.NewWebhookNotifier(srv.URL, secret)
+	webhook.Backoff = time.Millisecond
+
+	event := quotacontrol.Event{ProjectID: 1, Service: proto.Service_Indexer, Type: proto.EventType_FreeMax, Time: time.Now().UTC()}
+	require.NoError(t, webhook.Notify(context.Background(), event))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	got := <-received
+	assert.Equal(t, event.ProjectID, got.ProjectID)
+	assert.Equal(t, event.Service, got.Service)
+	assert.Equal(t, event.Type, got.Type)
+
+	t.Run("WrongSecret", func(t *testing.T) {
+		webhook := quotacontrol.NewWebhookNotifier(srv.URL, "wrong")
+		assert.Error(t, webhook.Notify(context.Background(), event))
+	})
+
+	t.Run("MaxRetries", func(t *testing.T) {
+		atomic.StoreInt32(&calls, 0)
+		webhook.MaxRetries = 1
+		assert.Error(t, webhook.Notify(context.Background(), event))
+		assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+}
+
+func TestDispatcherDedup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	events := make(chan quotacontrol.Event, 10)
+	// two dispatchers sharing the same cache, like two server replicas
+	dispatchers := []*quotacontrol.Dispatcher{
+		quotacontrol.NewDispatcher(nil, quotacontrol.NewRedisCache(client, time.Minute), quotacontrol.ChannelNotifier(events)),
+		quotacontrol.NewDispatcher(nil, quotacontrol.NewRedisCache(client, time.Minute), quotacontrol.ChannelNotifier(events)),
+	}
+
+	ctx := context.Background()
+	now := time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC)
+	cycle := &proto.Cycle{Start: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC)}
+	event := quotacontrol.Event{ProjectID: 1, Service: proto.Service_Indexer, Type: proto.EventType_FreeMax, Cycle: cycle, Time: now}
+
+	var sent int
+	for _, d := range dispatchers {
+		for range 3 {
+			ok, err := d.Dispatch(ctx, event)
+			require.NoError(t, err)
+			if ok {
+				sent++
+			}
+		}
+	}
+	assert.Equal(t, 1, sent)
+
+	// different type, service or cycle are different events
+	others := []quotacontrol.Event{
+		{ProjectID: 1, Service: proto.Service_Indexer, Type: proto.EventType_OverMax, Cycle: cycle, Time: now},
+		{ProjectID: 1, Service: proto.Service_NodeGateway, Type: proto.EventType_FreeMax, Cycle: cycle, Time: now},
+		{ProjectID: 1, Service: proto.Service_Indexer, Type: proto.EventType_FreeMax, Time: now.AddDate(0, 1, 0)},
+	}
+	for _, e := range others {
+		ok, err := dispatchers[0].Dispatch(ctx, e)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	for _, d := range dispatchers {
+		d.Wait()
+	}
+	assert.Len(t, events, 1+len(others))
+}
+
+func TestDispatcherRedeliver(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	cache := quotacontrol.NewRedisCache(client, time.Minute)
+
+	ctx := context.Background()
+	now := time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC)
+	cycle := &proto.Cycle{Start: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC)}
+	event := quotacontrol.Event{ProjectID: 1, Service: proto.Service_Indexer, Type: proto.EventType_FreeMax, Cycle: cycle, Time: now}
+
+	// nobody receives the event, so the notifier times out
+	blocked := quotacontrol.NewDispatcher(nil, cache, quotacontrol.ChannelNotifier(make(chan quotacontrol.Event)))
+	blocked.Timeout = 10 * time.Millisecond
+	ok, err := blocked.Dispatch(ctx, event)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	blocked.Wait()
+
+	// the event wasn't delivered, so it's sent again
+	events := make(chan quotacontrol.Event, 10)
+	dispatcher := quotacontrol.NewDispatcher(nil, cache, quotacontrol.ChannelNotifier(events))
+	ok, err = dispatcher.Dispatch(ctx, event)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	dispatcher.Wait()
+	assert.Len(t, events, 1)
+
+	ok, err = dispatcher.Dispatch(ctx, event)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestDispatcherRedeliverFailed(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	cache := quotacontrol.NewRedisCache(client, time.Minute)
+
+	ctx := context.Background()
+	now := time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC)
+	cycle := &proto.Cycle{Start: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC)}
+	event := quotacontrol.Event{ProjectID: 1, Service: proto.Service_Indexer, Type: proto.EventType_FreeMax, Cycle: cycle, Time: now}
+
+	// the first notifier delivers the event, nobody receives it from the second one so it times out
+	delivered, blocked := make(chan quotacontrol.Event, 10), make(chan quotacontrol.Event)
+	dispatcher := quotacontrol.NewDispatcher(nil, cache, quotacontrol.ChannelNotifier(delivered), quotacontrol.ChannelNotifier(blocked))
+	dispatcher.Timeout = 10 * time.Millisecond
+	ok, err := dispatcher.Dispatch(ctx, event)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	dispatcher.Wait()
+	assert.Len(t, delivered, 1)
+
+	// only the notifier that failed gets it again
+	dispatcher.Timeout = time.Second
+	received := make(chan quotacontrol.Event, 1)
+	go func() { received <- <-blocked }()
+	ok, err = dispatcher.Dispatch(ctx, event)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	dispatcher.Wait()
+	assert.Len(t, delivered, 1)
+	assert.Len(t, received, 1)
+
+	ok, err = dispatcher.Dispatch(ctx, event)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestServerNotifyEvent(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	cache := quotacontrol.NewRedisCache(client, time.Minute)
+
+	store := mock.NewMemoryStore()
+	const projectID = 1
+	require.NoError(t, store.SetProjectInfo(context.Background(), projectID, &proto.ProjectInfo{ID: projectID}))
+
+	events := make(chan quotacontrol.Event, 10)
+	dispatcher := quotacontrol.NewDispatcher(nil, cache, quotacontrol.ChannelNotifier(events))
+	qc := quotacontrol.NewServer(quotacontrol.RedisConfig{}, slog.Default(), quotacontrol.Cache{
+		QuotaCache:      cache,
+		UsageCache:      cache,
+		PermissionCache: cache,
+	}, quotacontrol.Store{
+		ProjectInfoStore: store,
+		LimitStore:       store,
+		AccessKeyStore:   store,
+		UsageStore:       store,
+		PermissionStore:  store,
+	}, quotacontrol.WithDispatcher(dispatcher))
+
+	ctx := context.Background()
+	ok, err := qc.NotifyEvent(ctx, projectID, proto.Service_Indexer, proto.EventType_FreeWarn)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = qc.NotifyEvent(ctx, projectID, proto.Service_Indexer, proto.EventType_FreeWarn)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	dispatcher.Wait()
+	require.Len(t, events, 1)
+	event := <-events
+	assert.Equal(t, uint64(projectID), event.ProjectID)
+	assert.Equal(t, proto.EventType_FreeWarn, event.Type)
+}
+
+func TestServerNotifyEventDefault(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	cache := quotacontrol.NewRedisCache(client, time.Minute)
+
+	store := mock.NewMemoryStore()
+	const projectID = 1
+	require.NoError(t, store.SetProjectInfo(context.Background(), projectID, &proto.ProjectInfo{ID: projectID}))
+
+	// without a dispatcher the events are de-duplicated with the server cache
+	qc := quotacontrol.NewServer(quotacontrol.RedisConfig{}, slog.Default(), quotacontrol.Cache{
+		QuotaCache:      cache,
+		UsageCache:      cache,
+		PermissionCache: cache,
+	}, quotacontrol.Store{
+		ProjectInfoStore: store,
+		LimitStore:       store,
+		AccessKeyStore:   store,
+		UsageStore:       store,
+		PermissionStore:  store,
+	})
+
+	ctx := context.Background()
+	ok, err := qc.NotifyEvent(ctx, projectID, proto.Service_Indexer, proto.EventType_FreeWarn)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = qc.NotifyEvent(ctx, projectID, proto.Service_Indexer, proto.EventType_FreeWarn)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,43 @@
+// Package flight collapses the concurrent calls with the same key into one.
+package flight
+
+import "sync"
+
+type call[V any] struct {
+	wg  sync.WaitGroup
+	val V
+	err error
+}
+
+// Group runs one call per key at a time, the callers that arrive meanwhile share its result.
+type Group[V any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[V]
+}
+
+// Do calls fn unless a call with the same key is in flight, in which case it waits for it and returns its result.
+// joined reports whether the result comes from the call of another caller.
+func (g *Group[V]) Do(key string, fn func() (V, error)) (v V, err error, joined bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call[V])
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+	c := &call[V]{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err, false
+}
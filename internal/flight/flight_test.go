@@ -0,0 +1,49 @@
+package flight_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/quotacontrol/internal/flight"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroup(t *testing.T) {
+	var (
+		g      flight.Group[int]
+		calls  int32
+		joined int32
+		wg     sync.WaitGroup
+	)
+	release := make(chan struct{})
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err, ok := g.Do("key", func() (int, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return 42, nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, 42, v)
+			if ok {
+				atomic.AddInt32(&joined, 1)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls)
+	assert.Equal(t, int32(9), joined)
+
+	// the key is free once the call is done
+	errFailed := errors.New("failed")
+	_, err, ok := g.Do("key", func() (int, error) { return 0, errFailed })
+	assert.ErrorIs(t, err, errFailed)
+	assert.False(t, ok)
+}
@@ -0,0 +1,176 @@
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/0xsequence/quotacontrol/proto"
+)
+
+// entry is a line of the journal, AccessKey is nil for project usage.
+// Batch is set for the usage that is part of a batch being synced.
+type entry struct {
+	Batch     string                `json:"b,omitempty"`
+	Time      time.Time             `json:"t"`
+	AccessKey *string               `json:"k,omitempty"`
+	ProjectID uint64                `json:"p,omitempty"`
+	Breakdown *proto.UsageBreakdown `json:"ub,omitempty"`
+}
+
+func (e entry) usage() proto.UsageBreakdown {
+	return *e.Breakdown
+}
+
+// journal is an append-only file of usage entries, one JSON object per line.
+type journal struct {
+	path string
+	file *os.File
+}
+
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{path: path, file: f}, nil
+}
+
+// readJournal reads the entries of the journal at path.
+// A truncated last line, left by a crash during a write, is ignored.
+// Any other invalid line is skipped and logged, so the entries after it are kept.
+func readJournal(path string, log *slog.Logger) ([]entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		entries []entry
+		// invalid is the error of the previous line, it's logged only if it's not the last one
+		invalid error
+		line    int
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if invalid != nil && log != nil {
+			log.Error("skip invalid usage journal line", slog.Int("line", line), slog.Any("error", invalid))
+		}
+		line++
+
+		var e entry
+		invalid = json.Unmarshal(scanner.Bytes(), &e)
+		if invalid == nil && e.Breakdown == nil {
+			invalid = errors.New("missing usage")
+		}
+		if invalid == nil {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (j *journal) append(e entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(b, '\n'))
+	return err
+}
+
+// sync commits the appended entries to disk, they're written without it to keep the requests fast.
+func (j *journal) sync() error {
+	return j.file.Sync()
+}
+
+// rewrite replaces the content of the journal with the entries of usage and of the pending batches.
+// The new journal is written to a temporary file and renamed, so a crash leaves either version intact.
+func (j *journal) rewrite(usage map[time.Time]Record, pending []*batch) error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for now, record := range usage {
+		if err := encodeRecord(enc, "", now, record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for _, b := range pending {
+		if err := encodeRecord(enc, b.ID, b.Time, b.Record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	// the rename is durable once the directory is synced
+	if err := syncDir(filepath.Dir(j.path)); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+
+	// reopen the new file, the old descriptor points to the replaced one
+	next, err := openJournal(j.path)
+	if err != nil {
+		return fmt.Errorf("reopen: %w", err)
+	}
+	j.file.Close()
+	j.file = next.file
+	return nil
+}
+
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func encodeRecord(enc *json.Encoder, batchID string, now time.Time, record Record) error {
+	for accessKey, v := range record.ByAccessKey {
+		if err := enc.Encode(entry{Batch: batchID, Time: now, AccessKey: &accessKey, Breakdown: &v}); err != nil {
+			return err
+		}
+	}
+	for projectID, v := range record.ByProjectID {
+		if err := enc.Encode(entry{Batch: batchID, Time: now, ProjectID: projectID, Breakdown: &v}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
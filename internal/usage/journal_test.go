@@ -0,0 +1,163 @@
+package usage_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/quotacontrol/internal/usage"
+	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type updater struct {
+	err     error
+	keys    map[string]int64
+	project map[uint64]int64
+	limited int64
+	batches []string
+}
+
+func (u *updater) SyncAccessKeyUsage(ctx context.Context, service proto.Service, now time.Time, usage map[string]int64, batchID *string, breakdown map[string]*proto.UsageBreakdown) (map[string]bool, error) {
+	u.batches = append(u.batches, *batchID)
+	if u.err != nil {
+		return nil, u.err
+	}
+	m := make(map[string]bool, len(usage))
+	for k, v := range usage {
+		u.keys[k] += v
+		u.limited += breakdown[k].Limited
+		m[k] = true
+	}
+	return m, nil
+}
+
+func (u *updater) SyncProjectUsage(ctx context.Context, service proto.Service, now time.Time, usage map[uint64]int64, batchID *string, breakdown map[uint64]*proto.UsageBreakdown) (map[uint64]bool, error) {
+	u.batches = append(u.batches, *batchID)
+	if u.err != nil {
+		return nil, u.err
+	}
+	m := make(map[uint64]bool, len(usage))
+	for k, v := range usage {
+		u.project[k] += v
+		m[k] = true
+	}
+	return m, nil
+}
+
+func TestJournal(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "usage.journal")
+	now := time.Now().UTC().Truncate(24 * time.Hour)
+
+	tracker, err := usage.NewJournaledTracker(path, nil)
+	require.NoError(t, err)
+	tracker.AddKeyUsage("abc", now, proto.UsageBreakdown{Free: 1})
+	tracker.AddKeyUsage("abc", now, proto.UsageBreakdown{Overage: 2, Limited: 4})
+	tracker.AddProjectUsage(1, now, proto.UsageBreakdown{Free: 10})
+
+	// a failed sync keeps the journal
+	u := &updater{err: errors.New("unavailable"), keys: map[string]int64{}, project: map[uint64]int64{}}
+	assert.Error(t, tracker.SyncUsage(ctx, u, proto.Service_Indexer))
+
+	// simulate a crash, with a partial line at the end of the journal
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"t":"`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// the usage is replayed on restart
+	tracker, err = usage.NewJournaledTracker(path, nil)
+	require.NoError(t, err)
+	tracker.AddKeyUsage("def", now, proto.UsageBreakdown{Free: 5})
+
+	u.err = nil
+	require.NoError(t, tracker.SyncUsage(ctx, u, proto.Service_Indexer))
+	assert.Equal(t, map[string]int64{"abc": 3, "def": 5}, u.keys)
+	assert.Equal(t, map[uint64]int64{1: 10}, u.project)
+	assert.Equal(t, int64(4), u.limited)
+	// the failed batch is retried with the same ID, the new usage goes in a new batch
+	require.Len(t, u.batches, 5)
+	assert.Equal(t, u.batches[0], u.batches[1])
+	assert.Contains(t, u.batches[2:], u.batches[0])
+
+	// the journal is compacted after a successful sync
+	tracker.AddKeyUsage("ghi", now, proto.UsageBreakdown{Free: 7})
+	require.NoError(t, tracker.Close())
+
+	tracker, err = usage.NewJournaledTracker(path, nil)
+	require.NoError(t, err)
+	updates := tracker.GetUpdates()
+	require.Len(t, updates, 1)
+	assert.Equal(t, map[string]proto.UsageBreakdown{"ghi": {Free: 7}}, updates[now].ByAccessKey)
+	assert.Empty(t, updates[now].ByProjectID)
+	require.NoError(t, tracker.Close())
+}
+
+func TestJournalInvalidLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.journal")
+	now := time.Now().UTC().Truncate(24 * time.Hour)
+
+	tracker, err := usage.NewJournaledTracker(path, nil)
+	require.NoError(t, err)
+	tracker.AddKeyUsage("abc", now, proto.UsageBreakdown{Free: 1})
+	require.NoError(t, tracker.Close())
+
+	// a corrupt line in the middle, followed by valid entries and a truncated last line
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString("not json\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	tracker, err = usage.NewJournaledTracker(path, nil)
+	require.NoError(t, err)
+	tracker.AddKeyUsage("def", now, proto.UsageBreakdown{Free: 2})
+	require.NoError(t, tracker.Close())
+
+	f, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"t":"`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// only the invalid lines are dropped
+	tracker, err = usage.NewJournaledTracker(path, nil)
+	require.NoError(t, err)
+	updates := tracker.GetUpdates()
+	require.Len(t, updates, 1)
+	assert.Equal(t, map[string]proto.UsageBreakdown{"abc": {Free: 1}, "def": {Free: 2}}, updates[now].ByAccessKey)
+	require.NoError(t, tracker.Close())
+}
+
+func TestBacklogDuringSync(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(24 * time.Hour)
+
+	tracker, err := usage.NewJournaledTracker(filepath.Join(t.TempDir(), "usage.journal"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { tracker.Close() })
+
+	// the backlog is read while the synced batches are cleared, run with -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			tracker.Backlog()
+		}
+	}()
+	u := &updater{keys: map[string]int64{}, project: map[uint64]int64{}}
+	for i := range 10 {
+		tracker.AddKeyUsage("abc", now, proto.UsageBreakdown{Free: 1})
+		tracker.AddProjectUsage(uint64(i), now, proto.UsageBreakdown{Free: 1})
+		require.NoError(t, tracker.SyncUsage(ctx, u, proto.Service_Indexer))
+	}
+	<-done
+	assert.Equal(t, 0, tracker.Backlog())
+	assert.Equal(t, map[string]int64{"abc": 10}, u.keys)
+}
@@ -2,7 +2,11 @@ package usage
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"log/slog"
 	"sync"
 	"time"
 
@@ -11,20 +15,34 @@ import (
 
 // UsageUpdater is an interface that allows to update the usage of a service
 type UsageUpdater interface {
-	SyncAccessKeyUsage(ctx context.Context, service proto.Service, now time.Time, usage map[string]int64) (map[string]bool, error)
-	SyncProjectUsage(ctx context.Context, service proto.Service, now time.Time, usage map[uint64]int64) (map[uint64]bool, error)
+	SyncAccessKeyUsage(ctx context.Context, service proto.Service, now time.Time, usage map[string]int64, batchID *string, breakdown map[string]*proto.UsageBreakdown) (map[string]bool, error)
+	SyncProjectUsage(ctx context.Context, service proto.Service, now time.Time, usage map[uint64]int64, batchID *string, breakdown map[uint64]*proto.UsageBreakdown) (map[uint64]bool, error)
 }
 
 func NewRecord() Record {
 	return Record{
-		ByProjectID: make(map[uint64]int64),
-		ByAccessKey: make(map[string]int64),
+		ByProjectID: make(map[uint64]proto.UsageBreakdown),
+		ByAccessKey: make(map[string]proto.UsageBreakdown),
 	}
 }
 
+// Record is the usage by project and access key, split by bucket.
 type Record struct {
-	ByProjectID map[uint64]int64
-	ByAccessKey map[string]int64
+	ByProjectID map[uint64]proto.UsageBreakdown
+	ByAccessKey map[string]proto.UsageBreakdown
+}
+
+// batch is the usage of a sync, it keeps its ID until it's synced so the server can ignore replays.
+type batch struct {
+	ID   string
+	Time time.Time
+	Record
+}
+
+func newBatchID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 func NewTracker() *Tracker {
@@ -33,6 +51,46 @@ func NewTracker() *Tracker {
 	}
 }
 
+// NewJournaledTracker returns a tracker that appends the usage to a journal at path.
+// The usage left in the journal by a previous run is replayed, so it's synced again.
+func NewJournaledTracker(path string, log *slog.Logger) (*Tracker, error) {
+	entries, err := readJournal(path, log)
+	if err != nil {
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+	j, err := openJournal(path)
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+
+	u := NewTracker()
+	u.journal, u.log = j, log
+	batches := make(map[string]*batch)
+	for _, e := range entries {
+		if e.Batch == "" {
+			if e.AccessKey != nil {
+				u.addKeyUsage(*e.AccessKey, e.Time, e.usage())
+			} else {
+				u.addProjectUsage(e.ProjectID, e.Time, e.usage())
+			}
+			continue
+		}
+		// usage of a batch that was being synced, it's retried with the same ID
+		b, ok := batches[e.Batch]
+		if !ok {
+			b = &batch{ID: e.Batch, Time: e.Time, Record: NewRecord()}
+			batches[e.Batch] = b
+			u.pending = append(u.pending, b)
+		}
+		if e.AccessKey != nil {
+			b.ByAccessKey[*e.AccessKey] = b.ByAccessKey[*e.AccessKey].Add(e.usage())
+		} else {
+			b.ByProjectID[e.ProjectID] = b.ByProjectID[e.ProjectID].Add(e.usage())
+		}
+	}
+	return u, nil
+}
+
 // UsageChanges keeps track of the usage of a service
 type Tracker struct {
 	// Mutex used for usage data
@@ -41,26 +99,101 @@ type Tracker struct {
 	syncMutex sync.Mutex
 
 	usage map[time.Time]Record
+	// pending are the batches that failed to sync
+	pending []*batch
+
+	// journal is optional, it keeps the unsynced usage on disk
+	journal *journal
+	log     *slog.Logger
 }
 
 // AddUsage adds the usage of a access key.
-func (u *Tracker) AddKeyUsage(accessKey string, now time.Time, usage int64) {
+func (u *Tracker) AddKeyUsage(accessKey string, now time.Time, usage proto.UsageBreakdown) {
 	u.dataMutex.Lock()
-	if _, ok := u.usage[now]; !ok {
-		u.usage[now] = NewRecord()
-	}
-	u.usage[now].ByAccessKey[accessKey] += usage
+	u.addKeyUsage(accessKey, now, usage)
+	u.appendJournal(entry{Time: now, AccessKey: &accessKey, Breakdown: &usage})
 	u.dataMutex.Unlock()
 }
 
 // AddUsage adds the usage of a access key.
-func (u *Tracker) AddProjectUsage(projectID uint64, now time.Time, usage int64) {
+func (u *Tracker) AddProjectUsage(projectID uint64, now time.Time, usage proto.UsageBreakdown) {
 	u.dataMutex.Lock()
+	u.addProjectUsage(projectID, now, usage)
+	u.appendJournal(entry{Time: now, ProjectID: projectID, Breakdown: &usage})
+	u.dataMutex.Unlock()
+}
+
+func (u *Tracker) addKeyUsage(accessKey string, now time.Time, usage proto.UsageBreakdown) {
 	if _, ok := u.usage[now]; !ok {
 		u.usage[now] = NewRecord()
 	}
-	u.usage[now].ByProjectID[projectID] += usage
-	u.dataMutex.Unlock()
+	u.usage[now].ByAccessKey[accessKey] = u.usage[now].ByAccessKey[accessKey].Add(usage)
+}
+
+func (u *Tracker) addProjectUsage(projectID uint64, now time.Time, usage proto.UsageBreakdown) {
+	if _, ok := u.usage[now]; !ok {
+		u.usage[now] = NewRecord()
+	}
+	u.usage[now].ByProjectID[projectID] = u.usage[now].ByProjectID[projectID].Add(usage)
+}
+
+func (u *Tracker) appendJournal(e entry) {
+	if u.journal == nil {
+		return
+	}
+	if err := u.journal.append(e); err != nil && u.log != nil {
+		u.log.Error("append usage journal", slog.Any("error", err))
+	}
+}
+
+// syncJournal flushes the appended entries of the journal to disk.
+func (u *Tracker) syncJournal() error {
+	if u.journal == nil {
+		return nil
+	}
+	u.dataMutex.Lock()
+	defer u.dataMutex.Unlock()
+	if err := u.journal.sync(); err != nil {
+		return fmt.Errorf("sync journal: %w", err)
+	}
+	return nil
+}
+
+// compactJournal rewrites the journal with the usage that is not synced yet.
+func (u *Tracker) compactJournal() error {
+	if u.journal == nil {
+		return nil
+	}
+	u.dataMutex.Lock()
+	defer u.dataMutex.Unlock()
+	if err := u.journal.rewrite(u.usage, u.pending); err != nil {
+		return fmt.Errorf("compact journal: %w", err)
+	}
+	return nil
+}
+
+// Close closes the journal, if any.
+func (u *Tracker) Close() error {
+	if u.journal == nil {
+		return nil
+	}
+	u.dataMutex.Lock()
+	defer u.dataMutex.Unlock()
+	return u.journal.close()
+}
+
+// Backlog returns the number of project and access key entries that are not synced yet.
+func (u *Tracker) Backlog() int {
+	u.dataMutex.Lock()
+	defer u.dataMutex.Unlock()
+	var n int
+	for _, r := range u.usage {
+		n += len(r.ByProjectID) + len(r.ByAccessKey)
+	}
+	for _, b := range u.pending {
+		n += len(b.ByProjectID) + len(b.ByAccessKey)
+	}
+	return n
 }
 
 // GetUpdates returns the usage of a service and clears the usage
@@ -72,36 +205,98 @@ func (u *Tracker) GetUpdates() map[time.Time]Record {
 	return result
 }
 
-// SyncUsage syncs the usage of a service with the UsageUpdater
+// SyncUsage syncs the usage of a service with the UsageUpdater.
+// The usage is sent in batches, a failed batch is retried with the same ID in the next sync.
 func (u *Tracker) SyncUsage(ctx context.Context, updater UsageUpdater, service proto.Service) error {
 	u.syncMutex.Lock()
 	defer u.syncMutex.Unlock()
+
+	u.dataMutex.Lock()
+	for now, record := range u.usage {
+		u.pending = append(u.pending, &batch{ID: newBatchID(), Time: now, Record: record})
+	}
+	u.usage = make(map[time.Time]Record)
+	pending := u.pending
+	u.dataMutex.Unlock()
+
 	var errList []error
-	for now, usages := range u.GetUpdates() {
-		keyResult, err := updater.SyncAccessKeyUsage(ctx, service, now, usages.ByAccessKey)
-		if err != nil {
-			errList = append(errList, err)
-		}
-		// add back to the counter failed updates
-		for accessKey, v := range keyResult {
-			if v {
-				continue
+	// the entries appended since the last sync are flushed to disk, even if the compaction fails
+	if err := u.syncJournal(); err != nil {
+		errList = append(errList, err)
+	}
+	// the batch IDs are stored before syncing, so they are reused if the process crashes
+	if err := u.compactJournal(); err != nil {
+		errList = append(errList, err)
+	}
+
+	var failed []*batch
+	for _, b := range pending {
+		if len(b.ByAccessKey) > 0 {
+			usage, breakdown := splitUsage(b.ByAccessKey)
+			keyResult, err := updater.SyncAccessKeyUsage(ctx, service, b.Time, usage, &b.ID, breakdown)
+			if err != nil {
+				errList = append(errList, err)
+			} else {
+				// add back to the counter rejected updates
+				for accessKey, v := range keyResult {
+					if v {
+						continue
+					}
+					u.dataMutex.Lock()
+					u.addKeyUsage(accessKey, b.Time, b.ByAccessKey[accessKey])
+					u.dataMutex.Unlock()
+				}
+				// the pending batches are read by Backlog and by the compaction
+				u.dataMutex.Lock()
+				b.ByAccessKey = nil
+				u.dataMutex.Unlock()
 			}
-			u.AddKeyUsage(accessKey, now, usages.ByAccessKey[accessKey])
 		}
 
-		projectResult, err := updater.SyncProjectUsage(ctx, service, now, usages.ByProjectID)
-		if err != nil {
-			errList = append(errList, err)
-		}
-		// add back to the counter failed updates
-		for projectID, v := range projectResult {
-			if v {
-				continue
+		if len(b.ByProjectID) > 0 {
+			usage, breakdown := splitUsage(b.ByProjectID)
+			projectResult, err := updater.SyncProjectUsage(ctx, service, b.Time, usage, &b.ID, breakdown)
+			if err != nil {
+				errList = append(errList, err)
+			} else {
+				// add back to the counter rejected updates
+				for projectID, v := range projectResult {
+					if v {
+						continue
+					}
+					u.dataMutex.Lock()
+					u.addProjectUsage(projectID, b.Time, b.ByProjectID[projectID])
+					u.dataMutex.Unlock()
+				}
+				u.dataMutex.Lock()
+				b.ByProjectID = nil
+				u.dataMutex.Unlock()
 			}
-			u.AddProjectUsage(projectID, now, usages.ByProjectID[projectID])
 		}
 
+		if len(b.ByAccessKey) > 0 || len(b.ByProjectID) > 0 {
+			failed = append(failed, b)
+		}
+	}
+
+	u.dataMutex.Lock()
+	u.pending = failed
+	u.dataMutex.Unlock()
+
+	// drop from the journal what has been synced
+	if err := u.compactJournal(); err != nil {
+		errList = append(errList, err)
 	}
 	return errors.Join(errList...)
 }
+
+// splitUsage returns the allowed usage and the breakdown of each entry, as expected by the sync methods.
+func splitUsage[K comparable](m map[K]proto.UsageBreakdown) (map[K]int64, map[K]*proto.UsageBreakdown) {
+	usage := make(map[K]int64, len(m))
+	breakdown := make(map[K]*proto.UsageBreakdown, len(m))
+	for k, v := range m {
+		usage[k] = v.Total()
+		breakdown[k] = &v
+	}
+	return usage, breakdown
+}
@@ -0,0 +1,133 @@
+package quotacontrol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// invalidationChannel is the redis channel where the invalidations are published.
+const invalidationChannel = "quotacontrol:" + cacheVersion + ":invalidate"
+
+const (
+	// subscribeBackoff is the wait before the first retry of a failed subscription, it doubles up to maxSubscribeBackoff.
+	subscribeBackoff    = time.Second
+	maxSubscribeBackoff = time.Minute
+)
+
+// Invalidation identifies the cached quotas that are stale.
+// A project invalidation covers the quota of the project and the ones of all its access keys.
+type Invalidation struct {
+	ProjectID uint64 `json:"projectId,omitempty"`
+	AccessKey string `json:"accessKey,omitempty"`
+}
+
+// Invalidator broadcasts the invalidations to all the instances, so they can evict their in-memory caches.
+type Invalidator interface {
+	// Publish sends the invalidation to all the subscribers.
+	Publish(ctx context.Context, inv Invalidation) error
+	// Subscribe calls fn for each invalidation received until the context is done.
+	// It returns once the subscription is active.
+	Subscribe(ctx context.Context, fn func(Invalidation)) error
+}
+
+var _ Invalidator = (*RedisInvalidator)(nil)
+
+// NewRedisInvalidator returns an Invalidator that uses redis pub/sub.
+func NewRedisInvalidator(client redis.UniversalClient, logger *slog.Logger) *RedisInvalidator {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &RedisInvalidator{client: client, logger: logger}
+}
+
+type RedisInvalidator struct {
+	client redis.UniversalClient
+	logger *slog.Logger
+}
+
+func (s *RedisInvalidator) Publish(ctx context.Context, inv Invalidation) error {
+	raw, err := json.Marshal(inv)
+	if err != nil {
+		return fmt.Errorf("marshal invalidation: %w", err)
+	}
+	return s.client.Publish(ctx, invalidationChannel, raw).Err()
+}
+
+func (s *RedisInvalidator) Subscribe(ctx context.Context, fn func(Invalidation)) error {
+	sub := s.client.Subscribe(ctx, invalidationChannel)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return fmt.Errorf("subscribe: %w", err)
+	}
+
+	go func() {
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var inv Invalidation
+				if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+					s.logger.Error("unmarshal invalidation", slog.Any("error", err))
+					continue
+				}
+				fn(inv)
+			}
+		}
+	}()
+	return nil
+}
+
+// invalidate evicts the quotas of the invalidation from the in-memory cache, without touching the backend.
+func (s *LRU) invalidate(inv Invalidation) {
+	if inv.AccessKey != "" {
+		s.mem.Remove(inv.AccessKey)
+		s.notFound.Remove(inv.AccessKey)
+	}
+	if inv.ProjectID == 0 {
+		return
+	}
+	s.mem.Remove(getProjectKey(inv.ProjectID))
+	s.notFound.Remove(getProjectKey(inv.ProjectID))
+	for _, key := range s.mem.Keys() {
+		if quota, ok := s.mem.Peek(key); ok && quota.GetProjectID() == inv.ProjectID {
+			s.mem.Remove(key)
+		}
+	}
+}
+
+// Subscribe evicts the quotas from the in-memory cache as soon as the invalidations are received.
+func (s *LRU) Subscribe(ctx context.Context, invalidator Invalidator) error {
+	return invalidator.Subscribe(ctx, s.invalidate)
+}
+
+// resubscribe retries the subscription with backoff until it succeeds or the context is done.
+// The invalidations sent meanwhile are lost, so the in-memory cache is emptied once subscribed.
+func (s *LRU) resubscribe(ctx context.Context, invalidator Invalidator, logger *slog.Logger) {
+	backoff := subscribeBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		err := s.Subscribe(ctx, invalidator)
+		if err == nil {
+			s.mem.Purge()
+			s.notFound.Purge()
+			return
+		}
+		backoff = min(backoff*2, maxSubscribeBackoff)
+		logger.Error("subscribe to invalidations", slog.Duration("retryIn", backoff), slog.Any("error", err))
+	}
+}
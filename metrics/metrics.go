@@ -0,0 +1,87 @@
+// Package metrics collects the metrics of the quota control client, middlewares and server.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/0xsequence/quotacontrol/proto"
+)
+
+// Lookup results of CacheLookup.
+const (
+	CacheHit   = "hit"
+	CacheMiss  = "miss"
+	CacheError = "error"
+)
+
+// Results of SpendQuota.
+const (
+	SpendSpent    = "spent"
+	SpendExceeded = "exceeded"
+	SpendSkipped  = "skipped"
+	SpendError    = "error"
+)
+
+// Collector collects the metrics, all the methods must be safe for concurrent use.
+type Collector interface {
+	// CacheLookup counts a lookup in a cache ("quota", "lru" or "permission") with its result.
+	// A key known not to exist is a hit.
+	CacheLookup(cache, result string)
+	// ServerFetch counts a cache miss ("quota" or "permission") sent to the quota server, or coalesced with a call in flight.
+	ServerFetch(kind string, coalesced bool)
+	// BreakerState sets the state of the circuit breaker of the calls to the quota server.
+	BreakerState(state string)
+	// SpendQuota observes a SpendQuota call of the service with its result.
+	SpendQuota(service, result string, d time.Duration)
+	// UsageSync counts a sync of the usage of the service, and sets the number of entries left to sync.
+	UsageSync(service string, failed bool, backlog int)
+	// Denial counts a request rejected by a middleware, with the HTTP status of the error.
+	Denial(middleware, service string, status int)
+	// RPC observes a call handled by the quota server, with its HTTP status.
+	RPC(method string, status int, d time.Duration)
+}
+
+// Noop is a Collector that discards the metrics.
+type Noop struct{}
+
+var _ Collector = Noop{}
+
+func (Noop) CacheLookup(cache, result string)                   {}
+func (Noop) ServerFetch(kind string, coalesced bool)            {}
+func (Noop) BreakerState(state string)                          {}
+func (Noop) SpendQuota(service, result string, d time.Duration) {}
+func (Noop) UsageSync(service string, failed bool, backlog int) {}
+func (Noop) Denial(middleware, service string, status int)      {}
+func (Noop) RPC(method string, status int, d time.Duration)     {}
+
+// Handler wraps the handler of the quota server to observe the RPC calls.
+func Handler(c Collector, next http.Handler) http.Handler {
+	methods := proto.WebrpcMethods()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(&sw, r)
+
+		// the unknown paths share a label, so they don't grow the cardinality
+		name := "unknown"
+		if m, ok := methods[r.URL.Path]; ok {
+			name = m.Name()
+		}
+		c.RPC(name, sw.status, time.Since(start))
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,153 @@
+package metrics
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultNamespace is the namespace of the Prometheus metrics when none is set.
+const DefaultNamespace = "quotacontrol"
+
+var breakerStates = []string{"closed", "open", "half-open"}
+
+// Prometheus is a Collector that exposes the metrics to Prometheus.
+type Prometheus struct {
+	cacheLookups     *prometheus.CounterVec
+	serverFetches    *prometheus.CounterVec
+	breakerState     *prometheus.GaugeVec
+	spendQuota       *prometheus.HistogramVec
+	usageSyncs       *prometheus.CounterVec
+	usageBacklog     *prometheus.GaugeVec
+	middlewareDenied *prometheus.CounterVec
+	rpcDuration      *prometheus.HistogramVec
+}
+
+var _ Collector = (*Prometheus)(nil)
+
+// NewPrometheus registers the metrics in reg, with the namespace or DefaultNamespace.
+// The metrics registered already by another instance are shared, so several clients can use the same registry.
+func NewPrometheus(reg prometheus.Registerer, namespace string) (*Prometheus, error) {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+
+	p := Prometheus{
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_lookups_total",
+			Help:      "Lookups in the quota and permission caches, by result.",
+		}, []string{"cache", "result"}),
+		serverFetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "server_fetches_total",
+			Help:      "Cache misses sent to the quota server, or coalesced with a call in flight.",
+		}, []string{"kind", "coalesced"}),
+		breakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "breaker_state",
+			Help:      "State of the circuit breaker of the calls to the quota server, 1 for the current one.",
+		}, []string{"state"}),
+		spendQuota: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "spend_quota_duration_seconds",
+			Help:      "Duration of the SpendQuota calls, by result.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"service", "result"}),
+		usageSyncs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "usage_syncs_total",
+			Help:      "Syncs of the usage to the quota server, by result.",
+		}, []string{"service", "result"}),
+		usageBacklog: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "usage_backlog",
+			Help:      "Usage entries waiting to be synced to the quota server.",
+		}, []string{"service"}),
+		middlewareDenied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "middleware_denials_total",
+			Help:      "Requests rejected by the middlewares, by HTTP status.",
+		}, []string{"middleware", "service", "status"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "rpc_duration_seconds",
+			Help:      "Duration of the calls handled by the quota server, by method and HTTP status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "status"}),
+	}
+
+	var err error
+	p.cacheLookups = register(reg, p.cacheLookups, &err)
+	p.serverFetches = register(reg, p.serverFetches, &err)
+	p.breakerState = register(reg, p.breakerState, &err)
+	p.spendQuota = register(reg, p.spendQuota, &err)
+	p.usageSyncs = register(reg, p.usageSyncs, &err)
+	p.usageBacklog = register(reg, p.usageBacklog, &err)
+	p.middlewareDenied = register(reg, p.middlewareDenied, &err)
+	p.rpcDuration = register(reg, p.rpcDuration, &err)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// register registers c, or returns the collector already registered with the same description.
+// The first error is kept in err.
+func register[T prometheus.Collector](reg prometheus.Registerer, c T, err *error) T {
+	regErr := reg.Register(c)
+	if regErr == nil {
+		return c
+	}
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(regErr, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+	if *err == nil {
+		*err = regErr
+	}
+	return c
+}
+
+func (p *Prometheus) CacheLookup(cache, result string) {
+	p.cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+func (p *Prometheus) ServerFetch(kind string, coalesced bool) {
+	p.serverFetches.WithLabelValues(kind, strconv.FormatBool(coalesced)).Inc()
+}
+
+func (p *Prometheus) BreakerState(state string) {
+	for _, s := range breakerStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		p.breakerState.WithLabelValues(s).Set(v)
+	}
+}
+
+func (p *Prometheus) SpendQuota(service, result string, d time.Duration) {
+	p.spendQuota.WithLabelValues(service, result).Observe(d.Seconds())
+}
+
+func (p *Prometheus) UsageSync(service string, failed bool, backlog int) {
+	result := "ok"
+	if failed {
+		result = "error"
+	}
+	p.usageSyncs.WithLabelValues(service, result).Inc()
+	p.usageBacklog.WithLabelValues(service).Set(float64(backlog))
+}
+
+func (p *Prometheus) Denial(middleware, service string, status int) {
+	p.middlewareDenied.WithLabelValues(middleware, service, strconv.Itoa(status)).Inc()
+}
+
+func (p *Prometheus) RPC(method string, status int, d time.Duration) {
+	p.rpcDuration.WithLabelValues(method, strconv.Itoa(status)).Observe(d.Seconds())
+}
@@ -0,0 +1,68 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/quotacontrol/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	p, err := metrics.NewPrometheus(reg, "")
+	require.NoError(t, err)
+
+	// another instance shares the metrics of the registry
+	other, err := metrics.NewPrometheus(reg, "")
+	require.NoError(t, err)
+
+	p.CacheLookup("quota", metrics.CacheHit)
+	other.CacheLookup("quota", metrics.CacheHit)
+	p.Denial("rate_limit", "API", http.StatusTooManyRequests)
+	p.UsageSync("API", true, 3)
+	p.BreakerState("open")
+	p.SpendQuota("API", metrics.SpendSpent, time.Millisecond)
+
+	assert.Equal(t, 2.0, value(t, reg, "quotacontrol_cache_lookups_total", "quota"))
+	assert.Equal(t, 1.0, value(t, reg, "quotacontrol_middleware_denials_total", "429"))
+	assert.Equal(t, 1.0, value(t, reg, "quotacontrol_usage_syncs_total", "error"))
+	assert.Equal(t, 3.0, value(t, reg, "quotacontrol_usage_backlog", "API"))
+	assert.Equal(t, 1.0, value(t, reg, "quotacontrol_breaker_state", "open"))
+	assert.Equal(t, 0.0, value(t, reg, "quotacontrol_breaker_state", "closed"))
+	assert.Equal(t, 1, testutil.CollectAndCount(reg, "quotacontrol_spend_quota_duration_seconds"))
+
+	// the RPC calls are observed by method, the unknown paths share a label
+	handler := metrics.Handler(p, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	for _, path := range []string{"/rpc/QuotaControl/GetUsage", "/a", "/b"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, nil))
+	}
+	assert.Equal(t, 2, testutil.CollectAndCount(reg, "quotacontrol_rpc_duration_seconds"))
+}
+
+// value returns the value of the counter or gauge that has a label with the given value.
+func value(t *testing.T, reg *prometheus.Registry, name, label string) float64 {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetValue() == label {
+					return m.GetCounter().GetValue() + m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	t.Fatalf("metric %s with label %q not found", name, label)
+	return 0
+}
@@ -2,11 +2,15 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/0xsequence/quotacontrol/metrics"
 	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/0xsequence/quotacontrol/tracing"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -51,6 +55,14 @@ type Options struct {
 	ChainFunc ChainFunc
 	// ErrHandler is the error handler to use when an error occurs.
 	ErrHandler func(r *http.Request, w http.ResponseWriter, err error)
+	// Fail is the behaviour when the quota can't be verified, FailOpen by default.
+	Fail FailConfig
+	// OnDegraded is called with each decision taken by the fail policy.
+	OnDegraded func(r *http.Request, d Degradation)
+	// Metrics collects the requests rejected by the middlewares, e.g. Client.Metrics().
+	Metrics metrics.Collector
+	// Tracer creates the spans of the middlewares, e.g. Client.Tracer().
+	Tracer trace.Tracer
 }
 
 func (o *Options) ApplyDefaults() {
@@ -63,6 +75,29 @@ func (o *Options) ApplyDefaults() {
 	if o.BaseRequestCost < 1 {
 		o.BaseRequestCost = 1
 	}
+	if o.Metrics == nil {
+		o.Metrics = metrics.Noop{}
+	}
+	if o.Tracer == nil {
+		o.Tracer = tracing.Noop()
+	}
+}
+
+// instrument wraps ErrHandler to count the requests rejected by the middleware, and to record them in its span.
+func (o *Options) instrument(middleware string, service proto.Service) {
+	handler := o.ErrHandler
+	o.ErrHandler = func(r *http.Request, w http.ResponseWriter, err error) {
+		status := http.StatusInternalServerError
+		var rpcErr proto.WebRPCError
+		if errors.As(err, &rpcErr) {
+			status = rpcErr.HTTPStatus
+		}
+		o.Metrics.Denial(middleware, service.GetName(), status)
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(tracing.Decision(tracing.Denied))
+		tracing.Error(span, err)
+		handler(r, w, err)
+	}
 }
 
 // Client is the interface that wraps the basic FetchKeyQuota, GetUsage and SpendQuota methods.
@@ -70,6 +105,7 @@ type Client interface {
 	IsEnabled() bool
 	GetDefaultUsage() int64
 	GetService() proto.Service
+	// FetchProjectQuota and FetchKeyQuota return a nil quota and error when the quota can't be verified.
 	FetchProjectQuota(ctx context.Context, projectID uint64, chainIDs []uint64, now time.Time) (*proto.AccessQuota, error)
 	FetchKeyQuota(ctx context.Context, accessKey, origin string, chainIDs []uint64, now time.Time) (*proto.AccessQuota, error)
 	FetchUsage(ctx context.Context, quota *proto.AccessQuota, now time.Time) (int64, error)
@@ -85,7 +121,7 @@ func VerifyChains(ctx context.Context, chainIDs ...uint64) error {
 	if !ok {
 		return nil
 	}
-	if err := quota.Info.ValidateChains(chainIDs); err != nil {
+	if err := quota.ValidateChains(chainIDs); err != nil {
 		return proto.ErrInvalidChain.WithCause(err)
 	}
 	return nil
@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/0xsequence/quotacontrol/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HeaderQuotaDegraded is set to the FailPolicy used when the quota of the request can't be verified.
+const HeaderQuotaDegraded = "Quota-Degraded"
+
+// DefaultDegradedRate is the requests per minute allowed by FailDegraded when DegradedRPM is not set.
+const DefaultDegradedRate = 600
+
+// FailPolicy is what the middlewares do when the quota can't be verified, because the cache or the quota server are unavailable.
+type FailPolicy uint8
+
+const (
+	// FailOpen lets the request through without quota.
+	FailOpen FailPolicy = iota
+	// FailClosed rejects the request with ErrQuotaUnavailable.
+	FailClosed
+	// FailDegraded lets the request through without quota, up to a local rate limit per access key or project.
+	FailDegraded
+)
+
+var failPolicyNames = map[FailPolicy]string{
+	FailOpen:     "open",
+	FailClosed:   "closed",
+	FailDegraded: "degraded",
+}
+
+func (p FailPolicy) String() string {
+	return failPolicyNames[p]
+}
+
+func (p FailPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *FailPolicy) UnmarshalText(b []byte) error {
+	for k, v := range failPolicyNames {
+		if strings.EqualFold(v, string(b)) {
+			*p = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown fail policy %q", b)
+}
+
+// FailConfig is the configuration of the behaviour on quota outages.
+type FailConfig struct {
+	// Policy is FailOpen by default.
+	Policy FailPolicy `toml:"policy"`
+	// DegradedRPM is the requests per minute of each access key or project allowed by FailDegraded on each instance.
+	DegradedRPM int `toml:"degraded_requests_per_minute"`
+}
+
+// Degradation is a decision taken by the FailPolicy for a request whose quota can't be verified.
+type Degradation struct {
+	Policy FailPolicy
+	// Key is the access key of the request, or the project ID if it has none.
+	Key string
+	// Allowed reports whether the request was let through.
+	Allowed bool
+}
+
+// failHandler applies the FailPolicy of the options.
+type failHandler struct {
+	cfg        FailConfig
+	onDegraded func(r *http.Request, d Degradation)
+	limiter    *RateLimiter
+}
+
+func newFailHandler(o Options) *failHandler {
+	h := failHandler{cfg: o.Fail, onDegraded: o.OnDegraded}
+	if h.cfg.Policy == FailDegraded {
+		if h.cfg.DegradedRPM <= 0 {
+			h.cfg.DegradedRPM = DefaultDegradedRate
+		}
+		h.limiter = NewRateLimiter(nil)
+	}
+	return &h
+}
+
+// allow takes the decision for the request, it sets the header and calls the hook.
+func (h *failHandler) allow(w http.ResponseWriter, r *http.Request, key string) bool {
+	d := Degradation{Policy: h.cfg.Policy, Key: key}
+	switch h.cfg.Policy {
+	case FailOpen:
+		d.Allowed = true
+	case FailDegraded:
+		windows := []RateWindow{{Limit: h.cfg.DegradedRPM, Window: time.Minute}}
+		res, err := h.limiter.Allow(r.Context(), "degraded:"+key, proto.RateAlgorithm_SlidingWindow, windows, 1)
+		d.Allowed = err == nil && res.Allowed
+	}
+
+	w.Header().Set(HeaderQuotaDegraded, h.cfg.Policy.String())
+	trace.SpanFromContext(r.Context()).SetAttributes(tracing.DegradedKey.String(h.cfg.Policy.String()))
+	if h.onDegraded != nil {
+		h.onDegraded(r, d)
+	}
+	return d.Allowed
+}
+
+// err returns the error of the requests that are not allowed.
+func (h *failHandler) err() error {
+	if h.cfg.Policy == FailDegraded {
+		return proto.ErrQuotaRateLimit.WithCausef("quota unavailable, degraded limit of %d requests per minute", h.cfg.DegradedRPM)
+	}
+	return proto.ErrQuotaUnavailable
+}
@@ -9,8 +9,9 @@ import (
 // EnsurePermission middleware that checks if the session type has the required permission.
 func EnsurePermission(client Client, minPermission proto.UserPermission, o Options) func(next http.Handler) http.Handler {
 	o.ApplyDefaults()
+	o.instrument("ensure_permission", client.GetService())
 
-	return func(next http.Handler) http.Handler {
+	return o.traced("EnsurePermission", client.GetService(), func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if !client.IsEnabled() {
 				next.ServeHTTP(w, r)
@@ -38,5 +39,5 @@ func EnsurePermission(client Client, minPermission proto.UserPermission, o Optio
 
 			next.ServeHTTP(w, r)
 		})
-	}
+	})
 }
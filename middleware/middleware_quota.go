@@ -10,11 +10,16 @@ import (
 	"github.com/getsentry/sentry-go"
 )
 
+// HeaderAccessKeyDeprecated is set to the expiry of an access key that was rotated with a grace period.
+const HeaderAccessKeyDeprecated = "Access-Key-Deprecated"
+
 // VerifyQuota middleware fetches and verify the quota from access key or project ID.
 func VerifyQuota(client Client, o Options) func(next http.Handler) http.Handler {
 	o.ApplyDefaults()
+	o.instrument("verify_quota", client.GetService())
+	fail := newFailHandler(o)
 
-	return func(next http.Handler) http.Handler {
+	return o.traced("VerifyQuota", client.GetService(), func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 			now := GetTime(ctx)
@@ -25,6 +30,8 @@ func VerifyQuota(client Client, o Options) func(next http.Handler) http.Handler
 				projectID uint64
 				quota     *proto.AccessQuota
 				chainIDs  []uint64
+				// degraded is the key of the fail policy, set if a quota can't be fetched
+				degraded string
 			)
 
 			if o.ChainFunc != nil {
@@ -45,24 +52,25 @@ func VerifyQuota(client Client, o Options) func(next http.Handler) http.Handler
 					o.ErrHandler(r, w, err)
 					return
 				}
+				if q == nil {
+					degraded = strconv.FormatUint(projectID, 10)
+				}
 
-				if q != nil {
-					if _, ok := authcontrol.GetAccount(ctx); ok {
-						// if the jwt has an account, check if the account permission
-						if ok, err := client.CheckPermission(ctx, projectID, proto.UserPermission_READ); !ok {
-							if err == nil {
-								err = proto.ErrUnauthorizedUser.WithCausef("verify quota: no read permission")
-							}
-							o.ErrHandler(r, w, err)
-							return
+				if _, ok := authcontrol.GetAccount(ctx); ok {
+					// if the jwt has an account, check if the account permission, even without quota
+					if ok, err := client.CheckPermission(ctx, projectID, proto.UserPermission_READ); !ok {
+						if err == nil {
+							err = proto.ErrUnauthorizedUser.WithCausef("verify quota: no read permission")
 						}
-					} else if _, ok := authcontrol.GetAccessKey(ctx); !ok {
-						// otherwise make sure the request has an access key
-						o.ErrHandler(r, w, proto.ErrUnauthorizedUser.WithCausef("verify quota: no access key found in context"))
+						o.ErrHandler(r, w, err)
 						return
 					}
-					quota = q
+				} else if _, ok := authcontrol.GetAccessKey(ctx); !ok {
+					// otherwise make sure the request has an access key
+					o.ErrHandler(r, w, proto.ErrUnauthorizedUser.WithCausef("verify quota: no access key found in context"))
+					return
 				}
+				quota = q
 			}
 
 			// fetch and verify access key quota
@@ -87,6 +95,9 @@ func VerifyQuota(client Client, o Options) func(next http.Handler) http.Handler
 					o.ErrHandler(r, w, err)
 					return
 				}
+				if q == nil {
+					degraded = accessKey
+				}
 				if q != nil {
 					if !q.IsActive() {
 						o.ErrHandler(r, w, proto.ErrAccessKeyNotFound)
@@ -96,10 +107,19 @@ func VerifyQuota(client Client, o Options) func(next http.Handler) http.Handler
 						o.ErrHandler(r, w, proto.ErrAccessKeyMismatch)
 						return
 					}
+					if expiresAt := q.AccessKey.ExpiresAt; expiresAt != nil {
+						w.Header().Set(HeaderAccessKeyDeprecated, expiresAt.UTC().Format(http.TimeFormat))
+					}
 					quota = q
 				}
 			}
 
+			// the fail policy is applied once, even if both quotas are missing
+			if degraded != "" && !fail.allow(w, r, degraded) {
+				o.ErrHandler(r, w, fail.err())
+				return
+			}
+
 			if quota != nil {
 				svc := client.GetService()
 				cfg, ok := quota.Limit.GetSettings(svc)
@@ -121,5 +141,5 @@ func VerifyQuota(client Client, o Options) func(next http.Handler) http.Handler
 			}
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
-	}
+	})
 }
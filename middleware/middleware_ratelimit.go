@@ -4,11 +4,17 @@ import (
 	"cmp"
 	"context"
 	"fmt"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/0xsequence/quotacontrol/tracing"
 	"github.com/go-chi/httprate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/0xsequence/authcontrol"
 )
@@ -18,6 +24,7 @@ const (
 	HeaderRateLimit     = "Credits-Rate-Limit"
 	HeaderRateReset     = "Credits-Rate-Reset"
 	HeaderRateCost      = "Credits-Rate-Cost"
+	HeaderRateWindow    = "Credits-Rate-Window"
 	HeaderRetryAfter    = "Retry-After"
 )
 
@@ -39,9 +46,16 @@ type RateLimitConfig struct {
 	AccountRPM int `toml:"user_requests_per_minute"`
 	// ServiceRPM is the rate limit for Service sessions expressed as number of requests per minute.
 	ServiceRPM int `toml:"service_requests_per_minute"`
+	// Algorithm is the rate limiting algorithm, SlidingWindow by default. It can be overridden by ServiceLimit.RateAlgorithm.
+	Algorithm proto.RateAlgorithm `toml:"algorithm"`
+	// Burst is the bucket size of the TokenBucket algorithm, it defaults to the rate limit.
+	Burst int `toml:"burst"`
 }
 
-// RateLimit is a middleware that limits the number of requests per minute.
+// RateLimit is a middleware that limits the number of requests per minute, and in the additional windows of the service limit.
+// The access keys with their own rate limit for the service are limited by it too, with a counter of their own.
+// The counter is used by the window algorithms, if it implements TokenBucketCounter it's used for the buckets too.
+// A nil counter, or one without buckets, falls back to in-memory counters.
 func RateLimit(client Client, cfg RateLimitConfig, counter httprate.LimitCounter, o Options) func(next http.Handler) http.Handler {
 	if !cfg.Enabled {
 		return func(next http.Handler) http.Handler {
@@ -50,80 +64,140 @@ func RateLimit(client Client, cfg RateLimitConfig, counter httprate.LimitCounter
 	}
 
 	o.ApplyDefaults()
+	o.instrument("rate_limit", client.GetService())
 
 	cfg.PublicRPM = cmp.Or(cfg.PublicRPM, DefaultPublicRate)
 	cfg.AccountRPM = cmp.Or(cfg.AccountRPM, DefaultAccountRate)
 	cfg.ServiceRPM = cmp.Or(cfg.ServiceRPM, DefaultServiceRate)
 
-	options := []httprate.Option{
-		httprate.WithLimitCounter(counter),
-		httprate.WithResponseHeaders(httprate.ResponseHeaders{
-			Limit:      HeaderRateLimit,
-			Remaining:  HeaderRateRemaining,
-			Increment:  HeaderRateCost,
-			Reset:      HeaderRateReset,
-			RetryAfter: HeaderRetryAfter,
-		}),
-		httprate.WithKeyFuncs(func(r *http.Request) (string, error) {
-			ctx := r.Context()
-			if _, ok := authcontrol.GetService(ctx); ok {
-				return "", nil
-			}
-			if project, ok := GetProjectID(ctx); ok {
-				return ProjectRateKey(project), nil
-			}
-			if q, ok := GetAccessQuota(ctx); ok {
-				return ProjectRateKey(q.GetProjectID()), nil
-			}
-			if account, ok := authcontrol.GetAccount(ctx); ok {
-				return AccountRateKey(account), nil
-			}
-			return PublicRateKey(r)
-		}),
-		httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
-			err := proto.ErrRateLimited
-			if _, ok := GetAccessQuota(r.Context()); ok {
-				err = proto.ErrQuotaRateLimit
-			}
-			o.ErrHandler(r, w, err)
-		}),
-	}
+	limiter := NewRateLimiter(counter)
 
-	limiter := httprate.NewRateLimiter(cfg.PublicRPM, rateLimitWindow, options...)
-
-	return func(next http.Handler) http.Handler {
+	return o.traced("RateLimit", client.GetService(), func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 
 			svc := client.GetService()
 
-			// if the rate limit is 0 or less, skip the rate limiter
-			limit, ok := getRateLimit(ctx, cfg, svc, o.BaseRequestCost)
+			// if all the rate limits are 0 or less, skip the rate limiter
+			rate, ok := getRateLimit(ctx, cfg, svc, o.BaseRequestCost)
 			if !ok {
 				o.ErrHandler(r, w, proto.ErrAborted.WithCausef("rate limit not found for service %s", svc.GetName()))
 				return
 			}
-			if limit <= 0 {
+			keyRate, keyRateKey, hasKeyRate := getKeyRateLimit(ctx, svc, rate.Algorithm, o.BaseRequestCost)
+			if len(rate.Windows) == 0 && !hasKeyRate {
 				next.ServeHTTP(w, r)
 				return
 			}
 
 			// if the cost is set to 0, skip the rate limiter
-			if cost, ok := getCost(ctx); ok && cost == 0 {
+			cost, ok := getCost(ctx)
+			if ok && cost == 0 {
 				next.ServeHTTP(w, r)
 				return
 			}
+			if !ok {
+				cost = 1
+			}
 
-			ctx = httprate.WithRequestLimit(ctx, limit)
-			limiter.Handler(next).ServeHTTP(w, r.WithContext(ctx))
+			key, err := rateLimitKey(r)
+			if err != nil {
+				o.ErrHandler(r, w, proto.ErrAborted.WithCausef("rate limit key: %w", err))
+				return
+			}
+
+			// the key is checked first, so the requests it rejects aren't counted by the project,
+			// and the requests the project rejects are given back to the key
+			result, resultRate := RateResult{}, keyRate
+			if hasKeyRate {
+				if result, err = allowRate(ctx, o.Tracer, limiter, keyRateKey+":", keyRate, int(cost)); err != nil {
+					o.ErrHandler(r, w, proto.ErrAborted.WithCausef("rate limit: %w", err))
+					return
+				}
+			}
+			if (!hasKeyRate || result.Allowed) && len(rate.Windows) > 0 {
+				projectResult, err := allowRate(ctx, o.Tracer, limiter, key+":", rate, int(cost))
+				if hasKeyRate && (err != nil || !projectResult.Allowed) {
+					limiter.refund(ctx, keyRateKey+":", keyRate.Algorithm, keyRate.Windows, int(cost))
+				}
+				if err != nil {
+					o.ErrHandler(r, w, proto.ErrAborted.WithCausef("rate limit: %w", err))
+					return
+				}
+				// the headers show the tightest of the two limits
+				if !hasKeyRate || !projectResult.Allowed || projectResult.Remaining < result.Remaining {
+					result, resultRate = projectResult, rate
+				}
+			}
+
+			limit := result.Limit
+			if resultRate.Algorithm == proto.RateAlgorithm_TokenBucket {
+				limit = result.Burst
+			}
+			w.Header().Set(HeaderRateLimit, strconv.Itoa(limit))
+			w.Header().Set(HeaderRateRemaining, strconv.Itoa(result.Remaining))
+			w.Header().Set(HeaderRateReset, strconv.FormatInt(result.Reset.Unix(), 10))
+			w.Header().Set(HeaderRateWindow, strconv.Itoa(int(result.Window.Seconds())))
+			if cost > 1 {
+				w.Header().Set(HeaderRateCost, strconv.FormatInt(cost, 10))
+			}
+
+			if !result.Allowed {
+				w.Header().Set(HeaderRetryAfter, strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+				err := proto.ErrRateLimited
+				if _, ok := GetAccessQuota(ctx); ok {
+					err = proto.ErrQuotaRateLimit
+				}
+				o.ErrHandler(r, w, err)
+				return
+			}
+
+			next.ServeHTTP(w, r)
 		})
+	})
+}
+
+// allowRate counts the cost with the limiter in a span, as it calls the counter.
+func allowRate(ctx context.Context, tracer trace.Tracer, limiter *RateLimiter, key string, rate rateLimit, cost int) (result RateResult, err error) {
+	ctx, span := tracer.Start(ctx, "RateLimiter.Allow", trace.WithAttributes(
+		attribute.String("quotacontrol.rate_algorithm", rate.Algorithm.String()),
+		attribute.Int("quotacontrol.cost", cost),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	result, err = limiter.Allow(ctx, key, rate.Algorithm, rate.Windows, cost)
+	if err == nil && !result.Allowed {
+		span.SetAttributes(tracing.Decision(tracing.Denied))
 	}
+	return result, err
+}
+
+// rateLimitKey returns the key of the rate limit counter for the request.
+func rateLimitKey(r *http.Request) (string, error) {
+	ctx := r.Context()
+	if _, ok := authcontrol.GetService(ctx); ok {
+		return "", nil
+	}
+	if project, ok := GetProjectID(ctx); ok {
+		return ProjectRateKey(project), nil
+	}
+	if q, ok := GetAccessQuota(ctx); ok {
+		return ProjectRateKey(q.GetProjectID()), nil
+	}
+	if account, ok := authcontrol.GetAccount(ctx); ok {
+		return AccountRateKey(account), nil
+	}
+	return PublicRateKey(r)
 }
 
 func PublicRateKey(r *http.Request) (string, error) {
 	return httprate.KeyByRealIP(r)
 }
 
+func KeyRateKey(accessKey string) string {
+	return fmt.Sprintf("rl:key:%s", accessKey)
+}
+
 func ProjectRateKey(projectID uint64) string {
 	return fmt.Sprintf("rl:project:%d", projectID)
 }
@@ -132,20 +206,75 @@ func AccountRateKey(account string) string {
 	return fmt.Sprintf("rl:account:%s", account)
 }
 
-func getRateLimit(ctx context.Context, r RateLimitConfig, svc proto.Service, baseRequestCost int) (int, bool) {
+// rateLimit is the rate limit that applies to a request.
+type rateLimit struct {
+	Algorithm proto.RateAlgorithm
+	Windows   []RateWindow
+}
+
+func getRateLimit(ctx context.Context, r RateLimitConfig, svc proto.Service, baseRequestCost int) (rateLimit, bool) {
+	window := RateWindow{Window: rateLimitWindow, Burst: r.Burst * baseRequestCost}
 	// service has highest priority; service session + access key = access key quota + service rate limit
 	if _, ok := authcontrol.GetService(ctx); ok {
-		return r.ServiceRPM * baseRequestCost, true
-	}
-	if q, ok := GetAccessQuota(ctx); ok {
+		window.Limit = r.ServiceRPM * baseRequestCost
+	} else if q, ok := GetAccessQuota(ctx); ok {
 		cfg, ok := q.Limit.GetSettings(svc)
 		if !ok {
-			return 0, false
+			return rateLimit{}, false
+		}
+		rate := rateLimit{Algorithm: r.Algorithm}
+		if cfg.RateAlgorithm != proto.RateAlgorithm_Default {
+			rate.Algorithm = cfg.RateAlgorithm
 		}
-		return int(cfg.RateLimit) * baseRequestCost, true
+		rate.Windows = enabledWindows(ServiceRateWindows(cfg, baseRequestCost))
+		return rate, true
+	} else if _, ok := authcontrol.GetAccount(ctx); ok {
+		window.Limit = r.AccountRPM * baseRequestCost
+	} else {
+		window.Limit = r.PublicRPM * baseRequestCost
 	}
-	if _, ok := authcontrol.GetAccount(ctx); ok {
-		return r.AccountRPM * baseRequestCost, true
+	return rateLimit{Algorithm: r.Algorithm, Windows: enabledWindows([]RateWindow{window})}, true
+}
+
+// getKeyRateLimit returns the rate limit of the access key of the request and the key of its counter, if the key has one for the service.
+// The algorithm of the project is used if the key doesn't set one.
+func getKeyRateLimit(ctx context.Context, svc proto.Service, algorithm proto.RateAlgorithm, baseRequestCost int) (rateLimit, string, bool) {
+	if _, ok := authcontrol.GetService(ctx); ok {
+		return rateLimit{}, "", false
+	}
+	q, ok := GetAccessQuota(ctx)
+	if !ok || q.AccessKey == nil || q.AccessKey.AccessKey == "" {
+		return rateLimit{}, "", false
+	}
+	cfg, ok := q.AccessKey.GetSettings(svc)
+	if !ok {
+		return rateLimit{}, "", false
+	}
+	rate := rateLimit{Algorithm: algorithm, Windows: enabledWindows(ServiceRateWindows(cfg, baseRequestCost))}
+	if len(rate.Windows) == 0 {
+		return rateLimit{}, "", false
+	}
+	if cfg.RateAlgorithm != proto.RateAlgorithm_Default {
+		rate.Algorithm = cfg.RateAlgorithm
+	}
+	return rate, KeyRateKey(q.AccessKey.AccessKey), true
+}
+
+// enabledWindows returns the windows with a limit, a limit of 0 or less disables its window only.
+func enabledWindows(windows []RateWindow) []RateWindow {
+	return slices.DeleteFunc(windows, func(w RateWindow) bool { return w.Limit <= 0 })
+}
+
+// ServiceRateWindows returns the rate windows of the service limit, with the limits multiplied by baseRequestCost.
+func ServiceRateWindows(cfg proto.ServiceLimit, baseRequestCost int) []RateWindow {
+	var windows []RateWindow
+	for i, w := range cfg.GetRateWindows() {
+		window := RateWindow{Limit: int(w.Limit) * baseRequestCost, Window: w.Duration()}
+		// the burst applies to the requests/minute limit
+		if i == 0 {
+			window.Burst = int(cfg.RateBurst) * baseRequestCost
+		}
+		windows = append(windows, window)
 	}
-	return r.PublicRPM * baseRequestCost, true
+	return windows
 }
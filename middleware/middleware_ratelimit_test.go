@@ -1,6 +1,7 @@
 package middleware_test
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"log/slog"
@@ -8,12 +9,15 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/0xsequence/quotacontrol"
 	"github.com/0xsequence/quotacontrol/middleware"
 	"github.com/0xsequence/quotacontrol/proto"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func makeIP(ipv6 bool) net.IP {
@@ -83,3 +87,107 @@ func TestRateLimiter(t *testing.T) {
 	}
 
 }
+
+func TestRateLimiterAlgorithms(t *testing.T) {
+	client := quotacontrol.NewClient(slog.Default(), proto.Service_API, quotacontrol.Config{}, nil)
+
+	tests := []struct {
+		Algorithm  proto.RateAlgorithm
+		Burst      int
+		Allowed    int
+		RetryAfter string
+	}{
+		{Algorithm: proto.RateAlgorithm_SlidingWindow, Allowed: 10},
+		{Algorithm: proto.RateAlgorithm_FixedWindow, Allowed: 10},
+		// 10 tokens per minute, 1 token every 6 seconds
+		{Algorithm: proto.RateAlgorithm_TokenBucket, Burst: 5, Allowed: 5, RetryAfter: "6"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.Algorithm.String(), func(t *testing.T) {
+			rl := middleware.RateLimit(client, middleware.RateLimitConfig{
+				Enabled:   true,
+				PublicRPM: 10,
+				Algorithm: tt.Algorithm,
+				Burst:     tt.Burst,
+			}, nil, middleware.Options{})
+			handler := rl(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			ipAddress := makeIP(false).String()
+			for i := 0; i < 20; i++ {
+				req, _ := http.NewRequest("GET", "/", nil)
+				req.RemoteAddr = ipAddress
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				if i < tt.Allowed {
+					assert.Equal(t, http.StatusOK, w.Code, "request %d", i)
+					assert.Equal(t, strconv.Itoa(tt.Allowed-i-1), w.Header().Get(middleware.HeaderRateRemaining))
+					continue
+				}
+				assert.Equal(t, http.StatusTooManyRequests, w.Code, "request %d", i)
+				if tt.RetryAfter != "" {
+					assert.Equal(t, tt.RetryAfter, w.Header().Get(middleware.HeaderRetryAfter))
+				}
+			}
+		})
+	}
+}
+
+func TestLocalTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	buckets := middleware.NewLocalTokenBucket()
+
+	const window = 100 * time.Millisecond
+	// 10 tokens per window with a burst of 5
+	for i := 0; i < 5; i++ {
+		_, ok, err := buckets.TakeTokens(ctx, "key", 10, 5, window, 1)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+	_, ok, err := buckets.TakeTokens(ctx, "key", 10, 5, window, 1)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// other keys have their own bucket
+	_, ok, err = buckets.TakeTokens(ctx, "other", 10, 5, window, 5)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// the bucket is refilled, but never over the burst
+	time.Sleep(window)
+	remaining, ok, err := buckets.TakeTokens(ctx, "key", 10, 5, window, 0)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, float64(5), remaining)
+
+	// the tokens given back never fill the bucket over the burst
+	_, ok, err = buckets.TakeTokens(ctx, "key", 10, 5, window, 2)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	remaining, ok, err = buckets.TakeTokens(ctx, "key", 10, 5, window, -5)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, float64(5), remaining)
+}
+
+func TestRateLimiterTokenBucketWindows(t *testing.T) {
+	ctx := context.Background()
+	limiter := middleware.NewRateLimiter(nil)
+
+	// 10 tokens per minute and 2 per hour, the hourly bucket empties first
+	windows := []middleware.RateWindow{{Limit: 10, Window: time.Minute}, {Limit: 2, Window: time.Hour}}
+	for i := 0; i < 2; i++ {
+		result, err := limiter.Allow(ctx, "key", proto.RateAlgorithm_TokenBucket, windows, 1)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+	}
+	result, err := limiter.Allow(ctx, "key", proto.RateAlgorithm_TokenBucket, windows, 1)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, time.Hour, result.Window)
+
+	// the rejected request didn't take any token from the minute bucket
+	results, err := limiter.Status(ctx, "key", proto.RateAlgorithm_TokenBucket, windows)
+	require.NoError(t, err)
+	assert.Equal(t, 8, results[0].Remaining)
+}
@@ -13,13 +13,15 @@ const (
 	HeaderQuotaRemaining = "Quota-Remaining"
 	HeaderQuotaOverage   = "Quota-Overage"
 	HeaderQuotaCost      = "Quota-Cost"
+	HeaderQuotaCredits   = "Quota-Credits"
 )
 
 // EnsureUsage is a middleware that checks if the quota has enough usage left.
 func EnsureUsage(client Client, o Options) func(next http.Handler) http.Handler {
 	o.ApplyDefaults()
+	o.instrument("ensure_usage", client.GetService())
 
-	return func(next http.Handler) http.Handler {
+	return o.traced("EnsureUsage", client.GetService(), func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if !client.IsEnabled() {
 				next.ServeHTTP(w, r)
@@ -56,25 +58,24 @@ func EnsureUsage(client Client, o Options) func(next http.Handler) http.Handler
 				return
 			}
 
-			w.Header().Set(HeaderQuotaRemaining, strconv.FormatInt(max(limit.FreeMax-usage, 0), 10))
-			if overage := max(usage-limit.FreeMax, 0); overage > 0 {
-				w.Header().Set(HeaderQuotaOverage, strconv.FormatInt(overage, 10))
-			}
-			if usage+cu > limit.OverMax {
+			credits := quota.GetCredits(client.GetService())
+			setQuotaHeaders(w, limit, credits, usage)
+			if usage+cu > limit.OverMax+credits {
 				o.ErrHandler(r, w, proto.ErrQuotaExceeded)
 				return
 			}
 
 			next.ServeHTTP(w, r)
 		})
-	}
+	})
 }
 
 // SpendUsage is a middleware that spends the usage from the quota.
 func SpendUsage(client Client, o Options) func(next http.Handler) http.Handler {
 	o.ApplyDefaults()
+	o.instrument("spend_usage", client.GetService())
 
-	return func(next http.Handler) http.Handler {
+	return o.traced("SpendUsage", client.GetService(), func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if !client.IsEnabled() {
 				next.ServeHTTP(w, r)
@@ -111,10 +112,7 @@ func SpendUsage(client Client, o Options) func(next http.Handler) http.Handler {
 				return
 			}
 
-			w.Header().Set(HeaderQuotaRemaining, strconv.FormatInt(max(limit.FreeMax-total, 0), 10))
-			if overage := total - limit.FreeMax; overage > 0 {
-				w.Header().Set(HeaderQuotaOverage, strconv.FormatInt(overage, 10))
-			}
+			setQuotaHeaders(w, limit, quota.GetCredits(client.GetService()), total)
 
 			if errors.Is(err, proto.ErrQuotaExceeded) {
 				o.ErrHandler(r, w, err)
@@ -127,5 +125,16 @@ func SpendUsage(client Client, o Options) func(next http.Handler) http.Handler {
 
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
+	})
+}
+
+// setQuotaHeaders sets the remaining free usage, the remaining credits and the overage, which starts after the credits.
+func setQuotaHeaders(w http.ResponseWriter, limit proto.ServiceLimit, credits, usage int64) {
+	w.Header().Set(HeaderQuotaRemaining, strconv.FormatInt(max(limit.FreeMax-usage, 0), 10))
+	if credits > 0 {
+		w.Header().Set(HeaderQuotaCredits, strconv.FormatInt(min(max(limit.FreeMax+credits-usage, 0), credits), 10))
+	}
+	if overage := usage - limit.FreeMax - credits; overage > 0 {
+		w.Header().Set(HeaderQuotaOverage, strconv.FormatInt(overage, 10))
 	}
 }
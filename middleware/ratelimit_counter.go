@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucketCounter keeps the buckets of the TokenBucket algorithm.
+// A bucket holds up to burst tokens and it's refilled at limit tokens per window.
+type TokenBucketCounter interface {
+	// TakeTokens takes cost tokens from the bucket, if available. A cost of 0 only reads the bucket,
+	// a negative one gives the tokens back, up to burst.
+	// It returns the tokens left in the bucket.
+	TakeTokens(ctx context.Context, key string, limit, burst int, window time.Duration, cost int) (remaining float64, ok bool, err error)
+}
+
+// NewLocalTokenBucket returns an in-memory TokenBucketCounter.
+func NewLocalTokenBucket() TokenBucketCounter {
+	return &localTokenBucket{buckets: make(map[string]*tokenBucket)}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+type localTokenBucket struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastEvict time.Time
+}
+
+func (c *localTokenBucket) TakeTokens(_ context.Context, key string, limit, burst int, window time.Duration, cost int) (float64, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.evict(now, window)
+
+	b, ok := c.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		c.buckets[key] = b
+	}
+
+	tokens, ok := refillTokens(b.tokens, now.Sub(b.last), limit, burst, window, cost)
+	b.tokens, b.last = tokens, now
+	b.full = now.Add(tokenRefillTime(tokens, float64(burst), limit, window))
+	return tokens, ok, nil
+}
+
+// evict removes the full buckets, since they are the same as a new one.
+func (c *localTokenBucket) evict(now time.Time, window time.Duration) {
+	if now.Sub(c.lastEvict) < window {
+		return
+	}
+	c.lastEvict = now
+	for key, b := range c.buckets {
+		if now.After(b.full) {
+			delete(c.buckets, key)
+		}
+	}
+}
+
+// refillTokens adds the tokens accrued in the elapsed time and takes cost tokens if available, a negative cost is given back.
+// It returns the tokens left and whether the cost was taken.
+func refillTokens(tokens float64, elapsed time.Duration, limit, burst int, window time.Duration, cost int) (float64, bool) {
+	if elapsed > 0 {
+		tokens = math.Min(float64(burst), tokens+float64(limit)*elapsed.Seconds()/window.Seconds())
+	}
+	if tokens < float64(cost) {
+		return tokens, false
+	}
+	return math.Min(float64(burst), tokens-float64(cost)), true
+}
+
+// tokenRefillTime returns the time needed to refill the bucket from tokens to target.
+func tokenRefillTime(tokens, target float64, limit int, window time.Duration) time.Duration {
+	if tokens >= target || limit <= 0 {
+		return 0
+	}
+	return time.Duration((target - tokens) / float64(limit) * float64(window))
+}
@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/go-chi/httprate"
+)
+
+// RateWindow is a limit of requests in a window of time.
+type RateWindow struct {
+	Limit  int
+	Window time.Duration
+	// Burst is the bucket size of the TokenBucket algorithm, it defaults to Limit.
+	Burst int
+}
+
+// RateResult is the state of a rate window.
+type RateResult struct {
+	RateWindow
+	// Rate is the amount counted in the window, or taken from the bucket.
+	Rate       int
+	Remaining  int
+	Reset      time.Time
+	RetryAfter time.Duration
+	Allowed    bool
+}
+
+// WindowCounter is implemented by the counters that can count windows other than a minute.
+// Counters that don't implement it are only used for the minute window, the others are counted in memory.
+type WindowCounter interface {
+	WindowCounter(window time.Duration) httprate.LimitCounter
+}
+
+// RateLimiter enforces the rate windows of a key, using the counter of the algorithm.
+// Like httprate, the windows are read and counted in separate calls, so concurrent requests can slightly exceed a limit.
+type RateLimiter struct {
+	base    httprate.LimitCounter
+	buckets TokenBucketCounter
+
+	// mu guards counters only, it's never held across calls to the counters
+	mu       sync.Mutex
+	counters map[time.Duration]httprate.LimitCounter
+}
+
+// NewRateLimiter returns a RateLimiter with the given counter, if it implements TokenBucketCounter it's used for the buckets too.
+// A nil counter, or one without buckets, falls back to in-memory counters.
+func NewRateLimiter(counter httprate.LimitCounter) *RateLimiter {
+	if counter == nil {
+		counter = httprate.NewLocalLimitCounter(rateLimitWindow)
+	}
+	counter.Config(0, rateLimitWindow)
+	buckets, ok := counter.(TokenBucketCounter)
+	if !ok {
+		buckets = NewLocalTokenBucket()
+	}
+	return &RateLimiter{
+		base:     counter,
+		counters: map[time.Duration]httprate.LimitCounter{rateLimitWindow: counter},
+		buckets:  buckets,
+	}
+}
+
+// Allow counts the cost in all the windows if none of them is over the limit.
+// It returns the window that is over the limit, or the one with the fewest remaining requests.
+func (l *RateLimiter) Allow(ctx context.Context, key string, algorithm proto.RateAlgorithm, windows []RateWindow, cost int) (RateResult, error) {
+	results, err := l.status(ctx, key, algorithm, windows, cost)
+	if err != nil {
+		return RateResult{}, err
+	}
+
+	for _, r := range results {
+		if !r.Allowed {
+			return r, nil
+		}
+	}
+
+	for i, w := range windows {
+		if algorithm == proto.RateAlgorithm_TokenBucket {
+			tokens, ok, err := l.buckets.TakeTokens(ctx, windowKey(key, w.Window), w.Limit, results[i].Burst, w.Window, cost)
+			if err != nil {
+				return RateResult{}, fmt.Errorf("take tokens: %w", err)
+			}
+			if !ok {
+				// the bucket was emptied after the status was read, the tokens taken from the previous ones are given back
+				l.returnTokens(ctx, key, windows[:i], results[:i], cost)
+				return bucketResult(results[i].RateWindow, tokens, cost), nil
+			}
+			results[i] = bucketResult(results[i].RateWindow, tokens, 0)
+			continue
+		}
+		now := time.Now().UTC()
+		if err := l.counter(w.Window).IncrementBy(windowKey(key, w.Window), now.Truncate(w.Window), cost); err != nil {
+			return RateResult{}, fmt.Errorf("increment: %w", err)
+		}
+		results[i].Rate += cost
+		results[i].Remaining -= cost
+	}
+
+	result := results[0]
+	for _, r := range results[1:] {
+		if r.Remaining < result.Remaining {
+			result = r
+		}
+	}
+	return result, nil
+}
+
+// returnTokens gives the cost back to the buckets of the windows, the errors are ignored since the buckets refill anyway.
+func (l *RateLimiter) returnTokens(ctx context.Context, key string, windows []RateWindow, results []RateResult, cost int) {
+	for i, w := range windows {
+		l.buckets.TakeTokens(ctx, windowKey(key, w.Window), w.Limit, results[i].Burst, w.Window, -cost)
+	}
+}
+
+// refund gives the cost counted by Allow back to all the windows, when the request is rejected by another limit.
+// The errors are ignored since the counters expire and the buckets refill anyway.
+func (l *RateLimiter) refund(ctx context.Context, key string, algorithm proto.RateAlgorithm, windows []RateWindow, cost int) {
+	for _, w := range windows {
+		if algorithm == proto.RateAlgorithm_TokenBucket {
+			if w.Burst <= 0 {
+				w.Burst = w.Limit
+			}
+			l.buckets.TakeTokens(ctx, windowKey(key, w.Window), w.Limit, w.Burst, w.Window, -cost)
+			continue
+		}
+		l.counter(w.Window).IncrementBy(windowKey(key, w.Window), time.Now().UTC().Truncate(w.Window), -cost)
+	}
+}
+
+// Status returns the current state of each window, without counting any request.
+func (l *RateLimiter) Status(ctx context.Context, key string, algorithm proto.RateAlgorithm, windows []RateWindow) ([]RateResult, error) {
+	return l.status(ctx, key, algorithm, windows, 0)
+}
+
+func (l *RateLimiter) status(ctx context.Context, key string, algorithm proto.RateAlgorithm, windows []RateWindow, cost int) ([]RateResult, error) {
+	results := make([]RateResult, len(windows))
+	for i, w := range windows {
+		if w.Burst <= 0 {
+			w.Burst = w.Limit
+		}
+
+		if algorithm == proto.RateAlgorithm_TokenBucket {
+			tokens, _, err := l.buckets.TakeTokens(ctx, windowKey(key, w.Window), w.Limit, w.Burst, w.Window, 0)
+			if err != nil {
+				return nil, fmt.Errorf("get tokens: %w", err)
+			}
+			results[i] = bucketResult(w, tokens, cost)
+			continue
+		}
+
+		now := time.Now().UTC()
+		currentWindow := now.Truncate(w.Window)
+		previousWindow := currentWindow.Add(-w.Window)
+		curr, prev, err := l.counter(w.Window).Get(windowKey(key, w.Window), currentWindow, previousWindow)
+		if err != nil {
+			return nil, fmt.Errorf("get counter: %w", err)
+		}
+
+		rate := float64(curr)
+		// the sliding window weights the previous window by the part of it that is still in the window
+		retryAfter := w.Window
+		if algorithm == proto.RateAlgorithm_FixedWindow {
+			retryAfter = currentWindow.Add(w.Window).Sub(now)
+		} else {
+			rate += float64(prev) * float64(w.Window-now.Sub(currentWindow)) / float64(w.Window)
+		}
+
+		r := RateResult{
+			RateWindow: w,
+			Rate:       int(math.Round(rate)),
+			Reset:      currentWindow.Add(w.Window),
+		}
+		r.Remaining = w.Limit - r.Rate
+		r.Allowed = r.Rate+cost <= w.Limit
+		if !r.Allowed {
+			r.RetryAfter = retryAfter
+		}
+		results[i] = r
+	}
+	return results, nil
+}
+
+// counter returns the counter of the window, creating it the first time.
+func (l *RateLimiter) counter(window time.Duration) httprate.LimitCounter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c, ok := l.counters[window]; ok {
+		return c
+	}
+	var c httprate.LimitCounter
+	if wc, ok := l.base.(WindowCounter); ok {
+		c = wc.WindowCounter(window)
+	} else {
+		c = httprate.NewLocalLimitCounter(window)
+	}
+	c.Config(0, window)
+	l.counters[window] = c
+	return c
+}
+
+// bucketResult returns the state of a bucket with the given tokens.
+func bucketResult(w RateWindow, tokens float64, cost int) RateResult {
+	now := time.Now()
+	r := RateResult{
+		RateWindow: w,
+		Rate:       w.Burst - int(tokens),
+		Remaining:  int(tokens),
+		Reset:      now.Add(tokenRefillTime(tokens, float64(w.Burst), w.Limit, w.Window)),
+		Allowed:    tokens >= float64(cost),
+	}
+	if !r.Allowed {
+		r.RetryAfter = tokenRefillTime(tokens, float64(cost), w.Limit, w.Window)
+	}
+	return r
+}
+
+// windowKey returns the key of a window, the minute window uses the key as is.
+func windowKey(key string, window time.Duration) string {
+	if window == rateLimitWindow {
+		return key
+	}
+	return fmt.Sprintf("%s%s:", key, window)
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/0xsequence/quotacontrol/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ctxKeyParentSpan = &contextKey{"ParentSpan"}
+
+// traced wraps each request of the middleware in a span, which ends when the request is passed to the next handler.
+// The span of a rejected request ends with the middleware.
+func (o *Options) traced(name string, service proto.Service, mw func(next http.Handler) http.Handler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			span := trace.SpanFromContext(ctx)
+			span.SetAttributes(tracing.Decision(tracing.Allowed))
+			if projectID, ok := GetProjectID(ctx); ok {
+				span.SetAttributes(tracing.ProjectID(projectID))
+			}
+			span.End()
+
+			// the next handlers are siblings of the span, not its children
+			parent, _ := ctx.Value(ctxKeyParentSpan).(trace.Span)
+			next.ServeHTTP(w, r.WithContext(trace.ContextWithSpan(ctx, parent)))
+		}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), ctxKeyParentSpan, trace.SpanFromContext(r.Context()))
+			ctx, span := o.Tracer.Start(ctx, "middleware."+name, trace.WithAttributes(tracing.Service(service)))
+			defer span.End()
+			handler.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -1,11 +1,15 @@
 package mock
 
 import (
+	"cmp"
 	"context"
+	"maps"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/0xsequence/authcontrol"
+	"github.com/0xsequence/quotacontrol"
 	"github.com/0xsequence/quotacontrol/internal/usage"
 	"github.com/0xsequence/quotacontrol/proto"
 )
@@ -17,9 +21,11 @@ func NewMemoryStore() *MemoryStore {
 		limits:      map[uint64]proto.Limit{},
 		accessKeys:  map[string]proto.AccessKey{},
 		usage:       map[proto.Service]usage.Record{},
+		batches:     map[string]bool{},
 		users:       map[string]bool{},
 		projects:    map[uint64]*authcontrol.Auth{},
 		permissions: map[uint64]map[string]userPermission{},
+		grants:      map[uint64]*proto.CreditGrant{},
 	}
 	for i := range proto.Service_name {
 		svc := proto.Service(i)
@@ -40,9 +46,30 @@ type MemoryStore struct {
 	infos       map[uint64]proto.ProjectInfo
 	accessKeys  map[string]proto.AccessKey
 	usage       map[proto.Service]usage.Record
+	batches     map[string]bool
 	users       map[string]bool
 	projects    map[uint64]*authcontrol.Auth
 	permissions map[uint64]map[string]userPermission
+	grants      map[uint64]*proto.CreditGrant
+	// history keeps every insert of usage, for GetUsageHistory
+	history []usageEntry
+	// creditUsage keeps every spend of credits, for GetCreditUsage
+	creditUsage []creditEntry
+	audit       []*proto.AuditEvent
+}
+
+type usageEntry struct {
+	Time      time.Time
+	ProjectID uint64
+	AccessKey string
+	Service   proto.Service
+	Usage     proto.UsageBreakdown
+}
+
+type creditEntry struct {
+	Time    time.Time
+	GrantID uint64
+	Amount  int64
 }
 
 func (m *MemoryStore) SetProjectInfo(ctx context.Context, projectID uint64, info *proto.ProjectInfo) error {
@@ -126,66 +153,249 @@ func (m *MemoryStore) ListAccessKeys(ctx context.Context, projectID uint64, acti
 	return accessKeys, nil
 }
 
+func (m *MemoryStore) ListExpiredAccessKeys(ctx context.Context, now time.Time) ([]*proto.AccessKey, error) {
+	m.Lock()
+	defer m.Unlock()
+	accessKeys := []*proto.AccessKey{}
+	for _, v := range m.accessKeys {
+		if v.Active && v.IsExpired(now) {
+			accessKeys = append(accessKeys, proto.Ptr(v))
+		}
+	}
+	return accessKeys, nil
+}
+
 func (m *MemoryStore) GetAccountUsage(ctx context.Context, projectID uint64, service *proto.Service, min, max time.Time) (int64, error) {
 	m.Lock()
 	defer m.Unlock()
-	var usage int64
-	if service != nil {
-		usage += m.usage[*service].ByProjectID[projectID]
+	return m.sumUsage(projectID, nil, service).Total(), nil
+}
+
+func (m *MemoryStore) GetAccessKeyUsage(ctx context.Context, projectID uint64, accessKey string, service *proto.Service, min, max time.Time) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.accessKeys[accessKey]; !ok {
+		return 0, proto.ErrAccessKeyNotFound
+	}
+	return m.sumUsage(projectID, &accessKey, service).Total(), nil
+}
+
+func (m *MemoryStore) GetUsageBreakdown(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, min, max time.Time) (proto.UsageBreakdown, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.sumUsage(projectID, accessKey, service), nil
+}
+
+// sumUsage returns the usage of the access key if set, or of the project and its keys. It must be called with the lock held.
+func (m *MemoryStore) sumUsage(projectID uint64, accessKey *string, service *proto.Service) proto.UsageBreakdown {
+	var usage proto.UsageBreakdown
+	for svc, record := range m.usage {
+		if service != nil && svc != *service {
+			continue
+		}
+		if accessKey != nil {
+			usage = usage.Add(record.ByAccessKey[*accessKey])
+			continue
+		}
+		usage = usage.Add(record.ByProjectID[projectID])
 		for _, v := range m.accessKeys {
 			if v.ProjectID == projectID {
-				usage += m.usage[*service].ByAccessKey[v.AccessKey]
+				usage = usage.Add(record.ByAccessKey[v.AccessKey])
 			}
 		}
-		return usage, nil
 	}
-	for _, v := range m.usage {
-		usage += v.ByProjectID[projectID]
-		for _, u := range v.ByAccessKey {
-			usage += u
+	return usage
+}
+
+func (m *MemoryStore) InsertAccessUsage(ctx context.Context, projectID uint64, accessKey string, service proto.Service, time time.Time, usage proto.UsageBreakdown) error {
+	m.Lock()
+	defer m.Unlock()
+	m.usage[service].ByAccessKey[accessKey] = m.usage[service].ByAccessKey[accessKey].Add(usage)
+	m.history = append(m.history, usageEntry{Time: time, ProjectID: projectID, AccessKey: accessKey, Service: service, Usage: usage})
+	return nil
+}
+
+func (m *MemoryStore) InsertBatchUsage(ctx context.Context, batchID string, projectID uint64, accessKey string, service proto.Service, time time.Time, usage proto.UsageBreakdown) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.batches[batchID] {
+		return false, nil
+	}
+	m.batches[batchID] = true
+	m.usage[service].ByAccessKey[accessKey] = m.usage[service].ByAccessKey[accessKey].Add(usage)
+	m.history = append(m.history, usageEntry{Time: time, ProjectID: projectID, AccessKey: accessKey, Service: service, Usage: usage})
+	return true, nil
+}
+
+func (m *MemoryStore) GetUsageHistory(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, min, max time.Time, granularity proto.UsageGranularity, groupBy []proto.UsageGroupBy) ([]*proto.UsagePoint, error) {
+	byService := slices.Contains(groupBy, proto.UsageGroupBy_Service)
+	byAccessKey := slices.Contains(groupBy, proto.UsageGroupBy_AccessKey)
+	min, max = granularity.Truncate(min), granularity.Truncate(max)
+
+	type pointKey struct {
+		Time      time.Time
+		Service   proto.Service
+		AccessKey string
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	points := make(map[pointKey]*proto.UsagePoint)
+	for _, e := range m.history {
+		if e.ProjectID != projectID || (accessKey != nil && e.AccessKey != *accessKey) || (service != nil && e.Service != *service) {
+			continue
+		}
+		t := granularity.Truncate(e.Time)
+		if t.Before(min) || t.After(max) {
+			continue
 		}
+		key := pointKey{Time: t}
+		if byService {
+			key.Service = e.Service
+		}
+		if byAccessKey {
+			key.AccessKey = e.AccessKey
+		}
+		p, ok := points[key]
+		if !ok {
+			p = &proto.UsagePoint{Time: t, Usage: &proto.UsageBreakdown{}}
+			if byService {
+				p.Service = proto.Ptr(e.Service)
+			}
+			if byAccessKey {
+				p.AccessKey = proto.Ptr(e.AccessKey)
+			}
+			points[key] = p
+		}
+		*p.Usage = p.Usage.Add(e.Usage)
 	}
-	return usage, nil
+
+	history := slices.Collect(maps.Values(points))
+	slices.SortFunc(history, func(a, b *proto.UsagePoint) int {
+		return cmp.Or(
+			a.Time.Compare(b.Time),
+			cmp.Compare(ptrValue(a.Service), ptrValue(b.Service)),
+			cmp.Compare(ptrValue(a.AccessKey), ptrValue(b.AccessKey)),
+		)
+	})
+	return history, nil
 }
 
-func (m *MemoryStore) GetAccessKeyUsage(ctx context.Context, projectID uint64, accessKey string, service *proto.Service, min, max time.Time) (int64, error) {
+func ptrValue[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
+
+func (m *MemoryStore) ResetUsage(ctx context.Context, accessKey string, service *proto.Service) error {
+	m.Lock()
+	m.usage[*service].ByAccessKey[accessKey] = proto.UsageBreakdown{}
+	m.history = slices.DeleteFunc(m.history, func(e usageEntry) bool {
+		return e.AccessKey == accessKey && e.Service == *service
+	})
+	m.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) InsertCreditGrant(ctx context.Context, grant *proto.CreditGrant) error {
 	m.Lock()
 	defer m.Unlock()
-	if _, ok := m.accessKeys[accessKey]; !ok {
-		return 0, proto.ErrAccessKeyNotFound
+	grant.ID = uint64(len(m.grants) + 1)
+	m.grants[grant.ID] = proto.Ptr(*grant)
+	return nil
+}
+
+func (m *MemoryStore) ListCreditGrants(ctx context.Context, projectID uint64, service *proto.Service) ([]*proto.CreditGrant, error) {
+	m.Lock()
+	defer m.Unlock()
+	grants := make([]*proto.CreditGrant, 0)
+	for id := uint64(1); id <= uint64(len(m.grants)); id++ {
+		g := m.grants[id]
+		if g.ProjectID != projectID || (service != nil && g.Service != *service) {
+			continue
+		}
+		grants = append(grants, proto.Ptr(*g))
 	}
-	if service != nil {
-		usage, ok := m.usage[*service].ByAccessKey[accessKey]
-		if !ok {
-			return 0, nil
+	return grants, nil
+}
+
+func (m *MemoryStore) RevokeCreditGrant(ctx context.Context, projectID, grantID uint64, now time.Time) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	g, ok := m.grants[grantID]
+	if !ok || g.ProjectID != projectID || g.RevokedAt != nil {
+		return false, nil
+	}
+	g.RevokedAt = &now
+	return true, nil
+}
+
+func (m *MemoryStore) InsertUsageWithCredits(ctx context.Context, batchID string, projectID uint64, accessKey string, service proto.Service, time time.Time, usage proto.UsageBreakdown, spends []quotacontrol.CreditSpend) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	if batchID != "" && m.batches[batchID] {
+		return false, nil
+	}
+	for _, v := range spends {
+		g, ok := m.grants[v.GrantID]
+		if !ok || g.ProjectID != projectID || g.Used+v.Amount > g.Amount {
+			return false, quotacontrol.ErrCreditsExhausted
 		}
-		return usage, nil
 	}
+	if batchID != "" {
+		m.batches[batchID] = true
+	}
+	for _, v := range spends {
+		m.grants[v.GrantID].Used += v.Amount
+		m.creditUsage = append(m.creditUsage, creditEntry{Time: time, GrantID: v.GrantID, Amount: v.Amount})
+	}
+	m.usage[service].ByAccessKey[accessKey] = m.usage[service].ByAccessKey[accessKey].Add(usage)
+	m.history = append(m.history, usageEntry{Time: time, ProjectID: projectID, AccessKey: accessKey, Service: service, Usage: usage})
+	return true, nil
+}
+
+// GetCreditUsage returns the credits spent in the days between min and max, like the usage history.
+func (m *MemoryStore) GetCreditUsage(ctx context.Context, projectID uint64, service *proto.Service, min, max time.Time) (int64, error) {
+	day := proto.UsageGranularity_Day
+	min, max = day.Truncate(min), day.Truncate(max)
+
+	m.Lock()
+	defer m.Unlock()
 	var usage int64
-	for _, v := range m.usage {
-		if u, ok := v.ByAccessKey[accessKey]; ok {
-			usage += u
+	for _, e := range m.creditUsage {
+		g := m.grants[e.GrantID]
+		if g.ProjectID != projectID || (service != nil && g.Service != *service) {
+			continue
 		}
+		if t := day.Truncate(e.Time); t.Before(min) || t.After(max) {
+			continue
+		}
+		usage += e.Amount
 	}
 	return usage, nil
 }
 
-func (m *MemoryStore) InsertAccessUsage(ctx context.Context, projectID uint64, accessKey string, service proto.Service, time time.Time, usage int64) error {
+func (m *MemoryStore) InsertAuditEvent(ctx context.Context, event *proto.AuditEvent) error {
 	m.Lock()
 	defer m.Unlock()
-	if _, ok := m.usage[service].ByAccessKey[accessKey]; !ok {
-		m.usage[service].ByAccessKey[accessKey] = usage
-		return nil
-	}
-	m.usage[service].ByAccessKey[accessKey] += usage
+	event.ID = uint64(len(m.audit) + 1)
+	m.audit = append(m.audit, proto.Ptr(*event))
 	return nil
 }
 
-func (m *MemoryStore) ResetUsage(ctx context.Context, accessKey string, service *proto.Service) error {
+func (m *MemoryStore) ListAuditEvents(ctx context.Context, projectID uint64, min, max time.Time) ([]*proto.AuditEvent, error) {
 	m.Lock()
-	m.usage[*service].ByAccessKey[accessKey] = 0
-	m.Unlock()
-	return nil
+	defer m.Unlock()
+	events := make([]*proto.AuditEvent, 0)
+	for _, e := range m.audit {
+		if e.ProjectID != projectID || e.CreatedAt.Before(min) || e.CreatedAt.After(max) {
+			continue
+		}
+		events = append(events, proto.Ptr(*e))
+	}
+	return events, nil
 }
 
 func (m *MemoryStore) AddUser(ctx context.Context, userID string, admin bool) error {
@@ -10,7 +10,9 @@ import (
 	"time"
 
 	"github.com/0xsequence/quotacontrol"
+	"github.com/0xsequence/quotacontrol/metrics"
 	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/0xsequence/quotacontrol/tracing"
 	"github.com/alicebob/miniredis/v2"
 	redisclient "github.com/redis/go-redis/v9"
 )
@@ -39,9 +41,11 @@ func NewServer(cfg *quotacontrol.Config) (server *Server, cleanup func()) {
 	qc := Server{
 		logger:        slog.Default(),
 		listener:      listener,
+		redis:         s,
 		cache:         client,
 		Store:         store,
 		notifications: make(map[uint64][]Event),
+		calls:         make(map[string]int),
 	}
 
 	qcCache := quotacontrol.Cache{
@@ -55,14 +59,26 @@ func NewServer(cfg *quotacontrol.Config) (server *Server, cleanup func()) {
 		AccessKeyStore:   store,
 		UsageStore:       store,
 		PermissionStore:  store,
+		CreditStore:      store,
+		AuditStore:       store,
 	}
 
 	logger := qc.logger.With(slog.Bool("mock", true))
-	qc.QuotaControlServer = quotacontrol.NewServer(cfg.Redis, logger, qcCache, qcStore)
+	qc.QuotaControlServer = quotacontrol.NewServer(cfg.Redis, logger, qcCache, qcStore,
+		quotacontrol.WithInvalidator(quotacontrol.NewRedisInvalidator(client, logger)),
+	)
+
+	var handler http.Handler = proto.NewQuotaControlServer(&qc)
+	if cfg.Tracing.Provider != nil {
+		handler = tracing.Handler(cfg.Tracing.Provider.Tracer(tracing.TracerName), cfg.Tracing.Propagator, handler)
+	}
+	if cfg.Metrics.Collector != nil {
+		handler = metrics.Handler(cfg.Metrics.Collector, handler)
+	}
 
 	go func() {
 		logger.Info("server starting...", slog.String("url", cfg.URL))
-		http.Serve(listener, proto.NewQuotaControlServer(&qc))
+		http.Serve(listener, handler)
 	}()
 
 	return &qc, func() {
@@ -76,6 +92,7 @@ func NewServer(cfg *quotacontrol.Config) (server *Server, cleanup func()) {
 type Server struct {
 	logger   *slog.Logger
 	listener net.Listener
+	redis    *miniredis.Miniredis
 	cache    *redisclient.Client
 
 	Store *MemoryStore
@@ -84,10 +101,46 @@ type Server struct {
 
 	mu            sync.Mutex
 	notifications map[uint64][]Event
+	calls         map[string]int
 
+	// Deprecated: use SetErrGetProjectQuota, setting the field while the server is running is a data race.
 	ErrGetProjectQuota error
-	ErrGetAccessQuota  error
-	PrepareUsageDelay  time.Duration
+	// Deprecated: use SetErrGetAccessQuota, setting the field while the server is running is a data race.
+	ErrGetAccessQuota error
+
+	// the injected errors and delays are guarded by mu, since the requests that timed out can still read them
+	fetchDelay           time.Duration
+	errSyncUsageResponse error
+
+	PrepareUsageDelay time.Duration
+}
+
+// SetErrGetProjectQuota sets the error returned by GetProjectQuota, nil to clear it.
+func (s *Server) SetErrGetProjectQuota(err error) {
+	s.mu.Lock()
+	s.ErrGetProjectQuota = err
+	s.mu.Unlock()
+}
+
+// SetErrGetAccessQuota sets the error returned by GetAccessQuota, nil to clear it.
+func (s *Server) SetErrGetAccessQuota(err error) {
+	s.mu.Lock()
+	s.ErrGetAccessQuota = err
+	s.mu.Unlock()
+}
+
+// SetFetchDelay delays GetProjectQuota, GetAccessQuota, GetUserPermission and GetUsage, like a slow server.
+func (s *Server) SetFetchDelay(d time.Duration) {
+	s.mu.Lock()
+	s.fetchDelay = d
+	s.mu.Unlock()
+}
+
+// SetErrSyncUsageResponse sets the error returned by the sync methods after the usage is stored, like a lost response.
+func (s *Server) SetErrSyncUsageResponse(err error) {
+	s.mu.Lock()
+	s.errSyncUsageResponse = err
+	s.mu.Unlock()
 }
 
 func (s *Server) FlushNotifications() {
@@ -100,22 +153,64 @@ func (s *Server) FlushCache(ctx context.Context) {
 	s.cache.FlushAll(ctx)
 }
 
-// GetProjectQuota returns the quota for a project unless ErrGetProjectQuota is set
+// FastForward moves the time of the cache forward, expiring the keys.
+func (s *Server) FastForward(d time.Duration) {
+	s.redis.FastForward(d)
+}
+
+// GetCalls returns the number of calls received by the method, only the fetch methods are counted.
+func (s *Server) GetCalls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
+
+// fetch counts the call and waits for the fetch delay.
+func (s *Server) fetch(method string) {
+	s.mu.Lock()
+	s.calls[method]++
+	delay := s.fetchDelay
+	s.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// injected returns the error injected in the field, read with the lock held.
+func (s *Server) injected(err *error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *err
+}
+
+// GetProjectQuota returns the quota for a project unless an error is set with SetErrGetProjectQuota
 func (s *Server) GetProjectQuota(ctx context.Context, projectID uint64, now time.Time) (*proto.AccessQuota, error) {
-	if s.ErrGetProjectQuota != nil {
-		return nil, s.ErrGetProjectQuota
+	s.fetch("GetProjectQuota")
+	if err := s.injected(&s.ErrGetProjectQuota); err != nil {
+		return nil, err
 	}
 	return s.QuotaControlServer.GetProjectQuota(ctx, projectID, now)
 }
 
-// GetAccessQuota returns the quota for an access key unless ErrGetAccessQuota is set
+// GetAccessQuota returns the quota for an access key unless an error is set with SetErrGetAccessQuota
 func (s *Server) GetAccessQuota(ctx context.Context, accessKey string, now time.Time) (*proto.AccessQuota, error) {
-	if s.ErrGetAccessQuota != nil {
-		return nil, s.ErrGetAccessQuota
+	s.fetch("GetAccessQuota")
+	if err := s.injected(&s.ErrGetAccessQuota); err != nil {
+		return nil, err
 	}
 	return s.QuotaControlServer.GetAccessQuota(ctx, accessKey, now)
 }
 
+// GetUserPermission returns the permission of the user
+func (s *Server) GetUserPermission(ctx context.Context, projectID uint64, userID string) (proto.UserPermission, *proto.ResourceAccess, error) {
+	s.fetch("GetUserPermission")
+	return s.QuotaControlServer.GetUserPermission(ctx, projectID, userID)
+}
+
+// GetUsage returns the usage of the project
+func (s *Server) GetUsage(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, from, to *time.Time) (int64, error) {
+	s.fetch("GetUsage")
+	return s.QuotaControlServer.GetUsage(ctx, projectID, accessKey, service, from, to)
+}
+
 // GetEvents returns the events that have been notified for a project
 func (s *Server) GetEvents(projectID uint64) []Event {
 	s.mu.Lock()
@@ -134,3 +229,21 @@ func (s *Server) NotifyEvent(ctx context.Context, projectID uint64, service prot
 	s.mu.Unlock()
 	return s.QuotaControlServer.NotifyEvent(ctx, projectID, service, eventType)
 }
+
+// SyncProjectUsage syncs the usage, returning the error set with SetErrSyncUsageResponse if any
+func (s *Server) SyncProjectUsage(ctx context.Context, service proto.Service, now time.Time, usage map[uint64]int64, batchID *string, breakdown map[uint64]*proto.UsageBreakdown) (map[uint64]bool, error) {
+	result, err := s.QuotaControlServer.SyncProjectUsage(ctx, service, now, usage, batchID, breakdown)
+	if err := s.injected(&s.errSyncUsageResponse); err != nil {
+		return nil, err
+	}
+	return result, err
+}
+
+// SyncAccessKeyUsage syncs the usage, returning the error set with SetErrSyncUsageResponse if any
+func (s *Server) SyncAccessKeyUsage(ctx context.Context, service proto.Service, now time.Time, usage map[string]int64, batchID *string, breakdown map[string]*proto.UsageBreakdown) (map[string]bool, error) {
+	result, err := s.QuotaControlServer.SyncAccessKeyUsage(ctx, service, now, usage, batchID, breakdown)
+	if err := s.injected(&s.errSyncUsageResponse); err != nil {
+		return nil, err
+	}
+	return result, err
+}
@@ -0,0 +1,142 @@
+package quotacontrol
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	_ EventNotifier = (*WebhookNotifier)(nil)
+	_ EventNotifier = ChannelNotifier(nil)
+	_ EventNotifier = (*LogNotifier)(nil)
+)
+
+const (
+	HeaderWebhookTimestamp = "X-Quotacontrol-Timestamp"
+	HeaderWebhookSignature = "X-Quotacontrol-Signature"
+)
+
+// WebhookSignature returns the HMAC-SHA256 signature of a webhook payload.
+// The signed message is the timestamp header value, a dot and the body.
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewWebhookNotifier returns a notifier that posts the events as JSON to url, signed with secret.
+func NewWebhookNotifier(url, secret string) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:        url,
+		Secret:     secret,
+		Client:     http.DefaultClient,
+		MaxRetries: 3,
+		Backoff:    time.Second,
+	}
+}
+
+// WebhookNotifier posts the events to an HTTP endpoint.
+// Transport errors and 429/5xx responses are retried with exponential backoff.
+type WebhookNotifier struct {
+	URL        string
+	Secret     string
+	Client     *http.Client
+	MaxRetries int
+	Backoff    time.Duration
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	backoff := w.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.MaxRetries {
+			return fmt.Errorf("webhook: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("webhook: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post sends the payload, it returns true if the request can be retried.
+func (w *WebhookNotifier) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookTimestamp, timestamp)
+	req.Header.Set(HeaderWebhookSignature, WebhookSignature(w.Secret, timestamp, body))
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+// ChannelNotifier sends the events to a channel, blocking until it's received or the context is done.
+type ChannelNotifier chan<- Event
+
+func (c ChannelNotifier) Notify(ctx context.Context, event Event) error {
+	select {
+	case c <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NewLogNotifier returns a notifier that logs the events.
+func NewLogNotifier(log *slog.Logger) *LogNotifier {
+	if log == nil {
+		log = slog.Default()
+	}
+	return &LogNotifier{log: log}
+}
+
+// LogNotifier logs the events.
+type LogNotifier struct {
+	log *slog.Logger
+}
+
+func (l *LogNotifier) Notify(ctx context.Context, event Event) error {
+	l.log.InfoContext(ctx, "notify event",
+		slog.Uint64("projectId", event.ProjectID),
+		slog.String("service", event.Service.GetName()),
+		slog.String("eventType", event.Type.String()),
+	)
+	return nil
+}
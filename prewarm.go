@@ -0,0 +1,132 @@
+package quotacontrol
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/0xsequence/quotacontrol/proto"
+)
+
+const (
+	defaultPrewarmWindow = 10 * time.Minute
+	// activeProjectTTL is how long a project is considered active after its last request.
+	activeProjectTTL = time.Hour
+	// activeProjectRefresh is how often the last request of an active project is recorded.
+	activeProjectRefresh = time.Minute
+)
+
+// prewarmWindow returns how long before the end of the cycle the usage of the next one is loaded, 0 if disabled.
+func (c *Client) prewarmWindow() time.Duration {
+	switch {
+	case c.cfg.PrewarmWindow < 0:
+		return 0
+	case c.cfg.PrewarmWindow == 0:
+		return defaultPrewarmWindow
+	}
+	return c.cfg.PrewarmWindow
+}
+
+// runPrewarm loads the usage of the next cycle of the active projects, until the context is done.
+func (c *Client) runPrewarm(ctx context.Context, window time.Duration) {
+	ticker := time.NewTicker(min(time.Minute, window/2))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for projectID, p := range c.active.due(now, window) {
+				if err := c.prewarmProject(ctx, projectID, p.cycle, p.now); err != nil {
+					c.logger.Error("prewarm usage", slog.Uint64("projectId", projectID), slog.Any("error", err))
+				}
+			}
+		}
+	}
+}
+
+// prewarmProject loads the usage of the cycle after the given one, so the requests after the rollover find it in the cache.
+func (c *Client) prewarmProject(ctx context.Context, projectID uint64, cycle *proto.Cycle, now time.Time) error {
+	// the end is the start of the last day of the cycle or the start of the next one, so the day after is in the next cycle
+	next := cycle.GetEnd(now).AddDate(0, 0, 1)
+	// the server doesn't cache the quota of a cycle that hasn't started, so the clients keep using the current one
+	quota, err := c.quotaClient.GetProjectQuota(ctx, projectID, next)
+	if err != nil {
+		return fmt.Errorf("get project quota: %w", err)
+	}
+	if quota.Cycle.GetStart(next).Equal(cycle.GetStart(now)) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.usageWaitTimeout())
+	defer cancel()
+	// the TTL is relative to the current time, not to the one of the next cycle
+	ttl := quota.Cycle.GetEnd(next).Add(usageGrace).Sub(time.Now())
+	if _, _, err := c.loadUsage(ctx, projectID, "", quota.Cycle, next, ttl); err != nil {
+		return fmt.Errorf("load usage: %w", err)
+	}
+	return nil
+}
+
+// activeProjects are the projects that used the service recently, with their current cycle.
+// It's updated by every request, so the projects are kept in a sync.Map and the ones seen recently are not written again.
+type activeProjects struct {
+	projects sync.Map // uint64 -> *activeProject
+}
+
+type activeProject struct {
+	cycle *proto.Cycle
+	// now is the time of the request that saw the cycle
+	now time.Time
+	// start is the start of the cycle
+	start time.Time
+	// seen is the unix time in nanoseconds of the last request
+	seen atomic.Int64
+	// warmed is set by due, once the next cycle is loaded
+	warmed atomic.Bool
+}
+
+// see marks the project as active in the cycle.
+func (a *activeProjects) see(projectID uint64, cycle *proto.Cycle, now time.Time) {
+	start := cycle.GetStart(now)
+	seen := time.Now().UnixNano()
+	if v, ok := a.projects.Load(projectID); ok {
+		p := v.(*activeProject)
+		if p.start.Equal(start) {
+			if seen-p.seen.Load() > int64(activeProjectRefresh) {
+				p.seen.Store(seen)
+			}
+			return
+		}
+	}
+	p := &activeProject{cycle: cycle, now: now, start: start}
+	p.seen.Store(seen)
+	a.projects.Store(projectID, p)
+}
+
+// due returns the active projects whose cycle ends within the window and marks them as warmed.
+// The projects that are not active anymore are forgotten.
+func (a *activeProjects) due(now time.Time, window time.Duration) map[uint64]*activeProject {
+	var m map[uint64]*activeProject
+	a.projects.Range(func(k, v any) bool {
+		projectID, p := k.(uint64), v.(*activeProject)
+		if now.Sub(time.Unix(0, p.seen.Load())) > activeProjectTTL {
+			// a request may have replaced it in the meantime
+			a.projects.CompareAndDelete(projectID, p)
+			return true
+		}
+		if p.warmed.Load() || now.Before(p.cycle.GetEnd(p.now).AddDate(0, 0, 1).Add(-window)) {
+			return true
+		}
+		p.warmed.Store(true)
+		if m == nil {
+			m = make(map[uint64]*activeProject)
+		}
+		m[projectID] = p
+		return true
+	})
+	return m
+}
@@ -35,16 +35,73 @@ func (a *AccessKey) ValidateService(service Service) bool {
 	return false
 }
 
+// GetSettings returns the limits of the access key for the given service, if it has any.
+func (a *AccessKey) GetSettings(svc Service) (ServiceLimit, bool) {
+	settings, ok := a.ServiceLimit[svc.String()]
+	return settings, ok
+}
+
+// SetSetting sets the limits of the access key for the given service.
+func (a *AccessKey) SetSetting(svc Service, limits ServiceLimit) {
+	if a.ServiceLimit == nil {
+		a.ServiceLimit = make(map[string]ServiceLimit)
+	}
+	a.ServiceLimit[svc.String()] = limits
+}
+
+// ValidateLimits checks the limits of the access key, only the rate limits and overMax are used and zero disables them.
+func (a *AccessKey) ValidateLimits() error {
+	for name, cfg := range a.ServiceLimit {
+		svc, ok := ParseService(name)
+		if !ok {
+			return fmt.Errorf("unknown service %s", name)
+		}
+		if cfg.RateLimit < 0 || cfg.OverMax < 0 {
+			return fmt.Errorf("service %s: rateLimit and overMax must be >= 0", svc.GetName())
+		}
+		if cfg.RateLimit == 0 && len(cfg.RateWindows) > 0 {
+			return fmt.Errorf("service %s: rateWindows require a rateLimit", svc.GetName())
+		}
+	}
+	return nil
+}
+
+// IsExpired checks if the access key is past its expiry, set when it's rotated with a grace period.
+func (a *AccessKey) IsExpired(now time.Time) bool {
+	return a.ExpiresAt != nil && !now.Before(*a.ExpiresAt)
+}
+
 // ValidateChains checks if the given chain IDs are allowed by the project.
 func (i *ProjectInfo) ValidateChains(chainIDs []uint64) error {
-	if len(i.ChainIDs) == 0 {
-		return nil
+	return validateChains(chainIDs, i.ChainIDs)
+}
+
+// ValidateChains checks if the given chain IDs are allowed by the access key.
+func (a *AccessKey) ValidateChains(chainIDs []uint64) error {
+	return validateChains(chainIDs, a.AllowedChainIDs)
+}
+
+// ValidateChains checks if the given chain IDs are allowed by both the project and the access key.
+func (q *AccessQuota) ValidateChains(chainIDs []uint64) error {
+	var project, key []uint64
+	if q.Info != nil {
+		project = q.Info.ChainIDs
 	}
+	if q.AccessKey != nil {
+		key = q.AccessKey.AllowedChainIDs
+	}
+	return validateChains(chainIDs, project, key)
+}
 
+// validateChains returns an error naming the chain IDs missing from any of the allowed lists, an empty list allows all of them.
+func validateChains(chainIDs []uint64, allowed ...[]uint64) error {
 	invalid := make([]uint64, 0, len(chainIDs))
 	for _, id := range chainIDs {
-		if !slices.Contains(i.ChainIDs, id) {
-			invalid = append(invalid, id)
+		for _, list := range allowed {
+			if len(list) != 0 && !slices.Contains(list, id) {
+				invalid = append(invalid, id)
+				break
+			}
 		}
 	}
 
@@ -99,9 +156,34 @@ func (l ServiceLimit) Validate() error {
 	if l.OverWarn != 0 && l.OverWarn > l.OverMax {
 		return fmt.Errorf("overWarn must be >= 0 and <= overMax")
 	}
+	if l.RateBurst < 0 {
+		return fmt.Errorf("rateBurst must be >= 0")
+	}
+	seen := map[int64]bool{60: true}
+	for _, w := range l.RateWindows {
+		if w.Limit < 1 || w.Seconds < 1 {
+			return fmt.Errorf("rateWindows must have limit > 0 and seconds > 0")
+		}
+		if seen[w.Seconds] {
+			return fmt.Errorf("rateWindows must have distinct seconds, other than 60")
+		}
+		seen[w.Seconds] = true
+	}
 	return nil
 }
 
+// GetRateWindows returns all the rate limits of the service, starting with the requests/minute one.
+func (l ServiceLimit) GetRateWindows() []RateWindow {
+	windows := make([]RateWindow, 0, len(l.RateWindows)+1)
+	windows = append(windows, RateWindow{Limit: l.RateLimit, Seconds: 60})
+	return append(windows, l.RateWindows...)
+}
+
+// Duration returns the length of the window.
+func (w RateWindow) Duration() time.Duration {
+	return time.Duration(w.Seconds) * time.Second
+}
+
 // getOverThreshold returns the amount over the threshold
 func getOverThreshold(v, total, threshold int64) (int64, bool) {
 	if total < threshold {
@@ -146,6 +228,61 @@ func (l *ServiceLimit) GetSpendResult(v, total int64) (int64, *EventType) {
 	return 0, nil
 }
 
+// Total returns the allowed usage, without the limited one.
+func (u UsageBreakdown) Total() int64 {
+	return u.Free + u.Credit + u.Overage
+}
+
+// Add returns the sum of the usage of each bucket.
+func (u UsageBreakdown) Add(v UsageBreakdown) UsageBreakdown {
+	return UsageBreakdown{
+		Free:    u.Free + v.Free,
+		Credit:  u.Credit + v.Credit,
+		Overage: u.Overage + v.Overage,
+		Limited: u.Limited + v.Limited,
+	}
+}
+
+// Duration returns the length of the time buckets.
+func (g UsageGranularity) Duration() time.Duration {
+	if g == UsageGranularity_Hour {
+		return time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// Truncate returns the start of the time bucket of t, in UTC.
+func (g UsageGranularity) Truncate(t time.Time) time.Time {
+	return t.UTC().Truncate(g.Duration())
+}
+
+// GetSpendBuckets is like GetSpendResult, with the credits spent after freeMax and before the overage.
+// The overage thresholds are moved forward by the credits, and the allowed usage is split by bucket.
+func (l *ServiceLimit) GetSpendBuckets(v, total, credits int64) (UsageBreakdown, *EventType) {
+	limit := *l
+	if credits > 0 {
+		if limit.OverWarn != 0 {
+			limit.OverWarn += credits
+		}
+		limit.OverMax += credits
+	}
+	usage, event := limit.GetSpendResult(v, total)
+
+	before := total - v
+	r := UsageBreakdown{
+		Free:    getOverlap(before, before+usage, 0, l.FreeMax),
+		Credit:  getOverlap(before, before+usage, l.FreeMax, l.FreeMax+max(credits, 0)),
+		Limited: v - usage,
+	}
+	r.Overage = usage - r.Free - r.Credit
+	return r, event
+}
+
+// getOverlap returns the length of the intersection of the ranges [from, to) and [start, end).
+func getOverlap(from, to, start, end int64) int64 {
+	return max(0, min(to, end)-max(from, start))
+}
+
 func (q *AccessQuota) IsActive() bool {
 	if q.Limit == nil || q.AccessKey == nil {
 		return false
@@ -153,6 +290,14 @@ func (q *AccessQuota) IsActive() bool {
 	return q.AccessKey.Active
 }
 
+// GetCredits returns the credits available to the service in the cycle.
+func (q *AccessQuota) GetCredits(svc Service) int64 {
+	if q == nil {
+		return 0
+	}
+	return q.Credits[svc.String()]
+}
+
 func (q *AccessQuota) IsJWT() bool {
 	return q.AccessKey != nil && q.AccessKey.AccessKey == ""
 }
@@ -172,6 +317,16 @@ func (q *AccessQuota) GetProjectID() uint64 {
 	}
 }
 
+// IsActive returns true if the grant is not revoked nor expired.
+func (g *CreditGrant) IsActive(now time.Time) bool {
+	return g.RevokedAt == nil && now.Before(g.ExpiresAt)
+}
+
+// Remaining returns the credits of the grant that are not spent.
+func (g *CreditGrant) Remaining() int64 {
+	return max(0, g.Amount-g.Used)
+}
+
 func (c *Cycle) GetStart(now time.Time) time.Time {
 	if c != nil && !c.Start.IsZero() {
 		return c.Start
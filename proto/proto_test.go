@@ -230,6 +230,47 @@ func TestGetSpendResult(t *testing.T) {
 	})
 }
 
+func TestGetSpendBuckets(t *testing.T) {
+	limit := proto.ServiceLimit{
+		FreeMax:  20,
+		OverWarn: 30,
+		OverMax:  40,
+	}
+	const credits = 10
+
+	for _, tc := range []struct {
+		Name   string
+		V      int64
+		Total  int64
+		Result proto.UsageBreakdown
+		Event  *proto.EventType
+	}{
+		{Name: "Free", V: 5, Total: 10, Result: proto.UsageBreakdown{Free: 5}},
+		{Name: "FreeToCredit", V: 10, Total: 25, Result: proto.UsageBreakdown{Free: 5, Credit: 5}, Event: proto.Ptr(proto.EventType_FreeMax)},
+		{Name: "CreditToOverage", V: 10, Total: 35, Result: proto.UsageBreakdown{Credit: 5, Overage: 5}},
+		{Name: "OverWarn", V: 5, Total: 40, Result: proto.UsageBreakdown{Overage: 5}, Event: proto.Ptr(proto.EventType_OverWarn)},
+		{Name: "OverageToLimited", V: 10, Total: 55, Result: proto.UsageBreakdown{Overage: 5, Limited: 5}, Event: proto.Ptr(proto.EventType_OverMax)},
+		{Name: "Limited", V: 5, Total: 60, Result: proto.UsageBreakdown{Limited: 5}},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			r, evt := limit.GetSpendBuckets(tc.V, tc.Total, credits)
+			assert.Equal(t, tc.Result, r)
+			assert.Equal(t, tc.V-tc.Result.Limited, r.Total())
+			if tc.Event == nil {
+				assert.Nil(t, evt)
+				return
+			}
+			require.NotNil(t, evt)
+			assert.Equal(t, tc.Event.String(), evt.String())
+		})
+	}
+
+	t.Run("NoCredits", func(t *testing.T) {
+		r, _ := limit.GetSpendBuckets(10, 45, 0)
+		assert.Equal(t, proto.UsageBreakdown{Overage: 5, Limited: 5}, r)
+	})
+}
+
 func TestValidateLimit(t *testing.T) {
 	assert.NoError(t, proto.ServiceLimit{RateLimit: 1, FreeMax: 2, OverMax: 2}.Validate())
 	assert.NoError(t, proto.ServiceLimit{RateLimit: 1, FreeMax: 2, OverMax: 4}.Validate())
@@ -243,6 +284,39 @@ func TestValidateLimit(t *testing.T) {
 	assert.Error(t, proto.ServiceLimit{RateLimit: 1, FreeWarn: 1, FreeMax: 2, OverWarn: 5, OverMax: 4}.Validate())
 }
 
+func TestValidateKeyLimits(t *testing.T) {
+	key := proto.AccessKey{}
+	assert.NoError(t, key.ValidateLimits())
+	key.SetSetting(proto.Service_Indexer, proto.ServiceLimit{RateLimit: 10})
+	key.SetSetting(proto.Service_NodeGateway, proto.ServiceLimit{OverMax: 100})
+	assert.NoError(t, key.ValidateLimits())
+
+	key.SetSetting(proto.Service_Indexer, proto.ServiceLimit{OverMax: -1})
+	assert.Error(t, key.ValidateLimits())
+	key.SetSetting(proto.Service_Indexer, proto.ServiceLimit{RateWindows: []proto.RateWindow{{Limit: 10, Seconds: 1}}})
+	assert.Error(t, key.ValidateLimits())
+	key.ServiceLimit = map[string]proto.ServiceLimit{"unknown": {RateLimit: 10}}
+	assert.Error(t, key.ValidateLimits())
+}
+
+func TestValidateChains(t *testing.T) {
+	quota := proto.AccessQuota{}
+	assert.NoError(t, quota.ValidateChains([]uint64{1, 2, 3}))
+
+	quota.Info = &proto.ProjectInfo{ChainIDs: []uint64{1, 2}}
+	quota.AccessKey = &proto.AccessKey{}
+	assert.NoError(t, quota.ValidateChains([]uint64{1, 2}))
+	assert.EqualError(t, quota.ValidateChains([]uint64{1, 3}), "invalid chain IDs: [3]")
+
+	quota.AccessKey.AllowedChainIDs = []uint64{2, 3}
+	assert.NoError(t, quota.ValidateChains([]uint64{2}))
+	assert.EqualError(t, quota.ValidateChains([]uint64{1, 2, 3}), "invalid chain IDs: [1 3]")
+
+	quota.Info.ChainIDs = nil
+	assert.NoError(t, quota.ValidateChains([]uint64{2, 3}))
+	assert.EqualError(t, quota.ValidateChains([]uint64{1}), "invalid chain IDs: [1]")
+}
+
 func TestServiceName(t *testing.T) {
 	for i := range proto.Service_name {
 		svc := proto.Service(i)
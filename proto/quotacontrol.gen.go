@@ -46,10 +46,11 @@ type QuotaControlClient interface {
 	GetProjectStatus(ctx context.Context, projectId uint64) (*ProjectStatus, error)
 	// Access Key
 	GetAccessKey(ctx context.Context, accessKey string) (*AccessKey, error)
-	CreateAccessKey(ctx context.Context, projectId uint64, displayName string, requireOrigin bool, allowedOrigins []string, allowedServices []Service) (*AccessKey, error)
-	UpdateAccessKey(ctx context.Context, accessKey string, displayName *string, requireOrigin *bool, allowedOrigins []string, allowedServices []Service) (*AccessKey, error)
+	CreateAccessKey(ctx context.Context, projectId uint64, displayName string, requireOrigin bool, allowedOrigins []string, allowedServices []Service, serviceLimit map[string]*ServiceLimit, allowedChainIds []uint64) (*AccessKey, error)
+	UpdateAccessKey(ctx context.Context, accessKey string, displayName *string, requireOrigin *bool, allowedOrigins []string, allowedServices []Service, serviceLimit map[string]*ServiceLimit, allowedChainIds []uint64) (*AccessKey, error)
 	ListAccessKeys(ctx context.Context, projectId uint64, active *bool, service *Service) ([]*AccessKey, error)
-	RotateAccessKey(ctx context.Context, accessKey string) (*AccessKey, error)
+	// gracePeriod is in seconds, the old key stays valid during it and then it's disabled.
+	RotateAccessKey(ctx context.Context, accessKey string, gracePeriod *uint32) (*AccessKey, error)
 	DisableAccessKey(ctx context.Context, accessKey string) (bool, error)
 	// Default Access Keys
 	GetDefaultAccessKey(ctx context.Context, projectID uint64) (*AccessKey, error)
@@ -58,19 +59,30 @@ type QuotaControlClient interface {
 	GetProjectQuota(ctx context.Context, projectId uint64, now time.Time) (*AccessQuota, error)
 	GetAccessQuota(ctx context.Context, accessKey string, now time.Time) (*AccessQuota, error)
 	ClearAccessQuotaCache(ctx context.Context, projectID uint64) (bool, error)
+	// Credits
+	GrantCredits(ctx context.Context, projectId uint64, service Service, amount int64, expiresAt time.Time, description *string) (*CreditGrant, error)
+	ListCreditGrants(ctx context.Context, projectId uint64, service *Service, active *bool) ([]*CreditGrant, error)
+	RevokeCreditGrant(ctx context.Context, projectId uint64, id uint64) (bool, error)
+	GetCreditUsage(ctx context.Context, projectId uint64, service *Service, from *time.Time, to *time.Time) (int64, error)
+	// Audit
+	ListAuditEvents(ctx context.Context, projectId uint64, from *time.Time, to *time.Time) ([]*AuditEvent, error)
 	// Usage
 	GetUsage(ctx context.Context, projectID uint64, accessKey *string, service *Service, from *time.Time, to *time.Time) (int64, error)
+	GetUsageBreakdown(ctx context.Context, projectID uint64, accessKey *string, service *Service, from *time.Time, to *time.Time) (*UsageBreakdown, error)
+	GetUsageHistory(ctx context.Context, projectID uint64, accessKey *string, service *Service, from *time.Time, to *time.Time, granularity UsageGranularity, groupBy []UsageGroupBy) ([]*UsagePoint, error)
 	ClearUsage(ctx context.Context, projectID uint64, service *Service, now time.Time) (bool, error)
-	SyncProjectUsage(ctx context.Context, service Service, now time.Time, usage map[uint64]int64) (map[uint64]bool, error)
-	SyncAccessKeyUsage(ctx context.Context, service Service, now time.Time, usage map[string]int64) (map[string]bool, error)
+	// batchId makes the sync idempotent, a replay of an already processed batch is ignored.
+	// usage is the allowed usage, breakdown splits it by bucket and adds the limited one, the server splits it if missing.
+	SyncProjectUsage(ctx context.Context, service Service, now time.Time, usage map[uint64]int64, batchId *string, breakdown map[uint64]*UsageBreakdown) (map[uint64]bool, error)
+	SyncAccessKeyUsage(ctx context.Context, service Service, now time.Time, usage map[string]int64, batchId *string, breakdown map[string]*UsageBreakdown) (map[string]bool, error)
 	NotifyEvent(ctx context.Context, projectID uint64, service Service, eventType EventType) (bool, error)
 	// User permissions for a projectId
 	GetUserPermission(ctx context.Context, projectId uint64, userId string) (UserPermission, *ResourceAccess, error)
-	// Deprecated: use GetUsage
+	// Deprecated: use GetUsage or GetUsageBreakdown
 	GetAccountUsage(ctx context.Context, projectID uint64, service *Service, from *time.Time, to *time.Time) (*AccessUsage, error)
-	// Deprecated: use GetUsage
+	// Deprecated: use GetUsage or GetUsageBreakdown
 	GetAccessKeyUsage(ctx context.Context, accessKey string, service *Service, from *time.Time, to *time.Time) (*AccessUsage, error)
-	// Deprecated: use GetUsage
+	// Deprecated: use GetUsage or GetUsageBreakdown
 	GetAsyncUsage(ctx context.Context, projectID uint64, service *Service, from *time.Time, to *time.Time) (*AccessUsage, error)
 	// Deprecated: use SyncProjectUsage
 	UpdateProjectUsage(ctx context.Context, service Service, now time.Time, usage map[uint64]*AccessUsage) (map[uint64]bool, error)
@@ -91,10 +103,11 @@ type QuotaControlServer interface {
 	GetProjectStatus(ctx context.Context, projectId uint64) (*ProjectStatus, error)
 	// Access Key
 	GetAccessKey(ctx context.Context, accessKey string) (*AccessKey, error)
-	CreateAccessKey(ctx context.Context, projectId uint64, displayName string, requireOrigin bool, allowedOrigins []string, allowedServices []Service) (*AccessKey, error)
-	UpdateAccessKey(ctx context.Context, accessKey string, displayName *string, requireOrigin *bool, allowedOrigins []string, allowedServices []Service) (*AccessKey, error)
+	CreateAccessKey(ctx context.Context, projectId uint64, displayName string, requireOrigin bool, allowedOrigins []string, allowedServices []Service, serviceLimit map[string]*ServiceLimit, allowedChainIds []uint64) (*AccessKey, error)
+	UpdateAccessKey(ctx context.Context, accessKey string, displayName *string, requireOrigin *bool, allowedOrigins []string, allowedServices []Service, serviceLimit map[string]*ServiceLimit, allowedChainIds []uint64) (*AccessKey, error)
 	ListAccessKeys(ctx context.Context, projectId uint64, active *bool, service *Service) ([]*AccessKey, error)
-	RotateAccessKey(ctx context.Context, accessKey string) (*AccessKey, error)
+	// gracePeriod is in seconds, the old key stays valid during it and then it's disabled.
+	RotateAccessKey(ctx context.Context, accessKey string, gracePeriod *uint32) (*AccessKey, error)
 	DisableAccessKey(ctx context.Context, accessKey string) (bool, error)
 	// Default Access Keys
 	GetDefaultAccessKey(ctx context.Context, projectID uint64) (*AccessKey, error)
@@ -103,19 +116,30 @@ type QuotaControlServer interface {
 	GetProjectQuota(ctx context.Context, projectId uint64, now time.Time) (*AccessQuota, error)
 	GetAccessQuota(ctx context.Context, accessKey string, now time.Time) (*AccessQuota, error)
 	ClearAccessQuotaCache(ctx context.Context, projectID uint64) (bool, error)
+	// Credits
+	GrantCredits(ctx context.Context, projectId uint64, service Service, amount int64, expiresAt time.Time, description *string) (*CreditGrant, error)
+	ListCreditGrants(ctx context.Context, projectId uint64, service *Service, active *bool) ([]*CreditGrant, error)
+	RevokeCreditGrant(ctx context.Context, projectId uint64, id uint64) (bool, error)
+	GetCreditUsage(ctx context.Context, projectId uint64, service *Service, from *time.Time, to *time.Time) (int64, error)
+	// Audit
+	ListAuditEvents(ctx context.Context, projectId uint64, from *time.Time, to *time.Time) ([]*AuditEvent, error)
 	// Usage
 	GetUsage(ctx context.Context, projectID uint64, accessKey *string, service *Service, from *time.Time, to *time.Time) (int64, error)
+	GetUsageBreakdown(ctx context.Context, projectID uint64, accessKey *string, service *Service, from *time.Time, to *time.Time) (*UsageBreakdown, error)
+	GetUsageHistory(ctx context.Context, projectID uint64, accessKey *string, service *Service, from *time.Time, to *time.Time, granularity UsageGranularity, groupBy []UsageGroupBy) ([]*UsagePoint, error)
 	ClearUsage(ctx context.Context, projectID uint64, service *Service, now time.Time) (bool, error)
-	SyncProjectUsage(ctx context.Context, service Service, now time.Time, usage map[uint64]int64) (map[uint64]bool, error)
-	SyncAccessKeyUsage(ctx context.Context, service Service, now time.Time, usage map[string]int64) (map[string]bool, error)
+	// batchId makes the sync idempotent, a replay of an already processed batch is ignored.
+	// usage is the allowed usage, breakdown splits it by bucket and adds the limited one, the server splits it if missing.
+	SyncProjectUsage(ctx context.Context, service Service, now time.Time, usage map[uint64]int64, batchId *string, breakdown map[uint64]*UsageBreakdown) (map[uint64]bool, error)
+	SyncAccessKeyUsage(ctx context.Context, service Service, now time.Time, usage map[string]int64, batchId *string, breakdown map[string]*UsageBreakdown) (map[string]bool, error)
 	NotifyEvent(ctx context.Context, projectID uint64, service Service, eventType EventType) (bool, error)
 	// User permissions for a projectId
 	GetUserPermission(ctx context.Context, projectId uint64, userId string) (UserPermission, *ResourceAccess, error)
-	// Deprecated: use GetUsage
+	// Deprecated: use GetUsage or GetUsageBreakdown
 	GetAccountUsage(ctx context.Context, projectID uint64, service *Service, from *time.Time, to *time.Time) (*AccessUsage, error)
-	// Deprecated: use GetUsage
+	// Deprecated: use GetUsage or GetUsageBreakdown
 	GetAccessKeyUsage(ctx context.Context, accessKey string, service *Service, from *time.Time, to *time.Time) (*AccessUsage, error)
-	// Deprecated: use GetUsage
+	// Deprecated: use GetUsage or GetUsageBreakdown
 	GetAsyncUsage(ctx context.Context, projectID uint64, service *Service, from *time.Time, to *time.Time) (*AccessUsage, error)
 	// Deprecated: use SyncProjectUsage
 	UpdateProjectUsage(ctx context.Context, service Service, now time.Time, usage map[uint64]*AccessUsage) (map[uint64]bool, error)
@@ -192,6 +216,92 @@ func (x *Service) Is(values ...Service) bool {
 	return false
 }
 
+// UsageGranularity is the length of the time buckets of the usage history.
+type UsageGranularity uint16
+
+const (
+	UsageGranularity_Day  UsageGranularity = 0
+	UsageGranularity_Hour UsageGranularity = 1
+)
+
+var UsageGranularity_name = map[uint16]string{
+	0: "Day",
+	1: "Hour",
+}
+
+var UsageGranularity_value = map[string]uint16{
+	"Day":  0,
+	"Hour": 1,
+}
+
+func (x UsageGranularity) String() string {
+	return UsageGranularity_name[uint16(x)]
+}
+
+func (x UsageGranularity) MarshalText() ([]byte, error) {
+	return []byte(UsageGranularity_name[uint16(x)]), nil
+}
+
+func (x *UsageGranularity) UnmarshalText(b []byte) error {
+	*x = UsageGranularity(UsageGranularity_value[string(b)])
+	return nil
+}
+
+func (x *UsageGranularity) Is(values ...UsageGranularity) bool {
+	if x == nil {
+		return false
+	}
+	for _, v := range values {
+		if *x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// UsageGroupBy splits the usage history by service or access key.
+type UsageGroupBy uint16
+
+const (
+	UsageGroupBy_Service   UsageGroupBy = 0
+	UsageGroupBy_AccessKey UsageGroupBy = 1
+)
+
+var UsageGroupBy_name = map[uint16]string{
+	0: "Service",
+	1: "AccessKey",
+}
+
+var UsageGroupBy_value = map[string]uint16{
+	"Service":   0,
+	"AccessKey": 1,
+}
+
+func (x UsageGroupBy) String() string {
+	return UsageGroupBy_name[uint16(x)]
+}
+
+func (x UsageGroupBy) MarshalText() ([]byte, error) {
+	return []byte(UsageGroupBy_name[uint16(x)]), nil
+}
+
+func (x *UsageGroupBy) UnmarshalText(b []byte) error {
+	*x = UsageGroupBy(UsageGroupBy_value[string(b)])
+	return nil
+}
+
+func (x *UsageGroupBy) Is(values ...UsageGroupBy) bool {
+	if x == nil {
+		return false
+	}
+	for _, v := range values {
+		if *x == v {
+			return true
+		}
+	}
+	return false
+}
+
 type EventType uint16
 
 const (
@@ -240,6 +350,54 @@ func (x *EventType) Is(values ...EventType) bool {
 	return false
 }
 
+type RateAlgorithm uint16
+
+const (
+	RateAlgorithm_Default       RateAlgorithm = 0
+	RateAlgorithm_SlidingWindow RateAlgorithm = 1
+	RateAlgorithm_FixedWindow   RateAlgorithm = 2
+	RateAlgorithm_TokenBucket   RateAlgorithm = 3
+)
+
+var RateAlgorithm_name = map[uint16]string{
+	0: "Default",
+	1: "SlidingWindow",
+	2: "FixedWindow",
+	3: "TokenBucket",
+}
+
+var RateAlgorithm_value = map[string]uint16{
+	"Default":       0,
+	"SlidingWindow": 1,
+	"FixedWindow":   2,
+	"TokenBucket":   3,
+}
+
+func (x RateAlgorithm) String() string {
+	return RateAlgorithm_name[uint16(x)]
+}
+
+func (x RateAlgorithm) MarshalText() ([]byte, error) {
+	return []byte(RateAlgorithm_name[uint16(x)]), nil
+}
+
+func (x *RateAlgorithm) UnmarshalText(b []byte) error {
+	*x = RateAlgorithm(RateAlgorithm_value[string(b)])
+	return nil
+}
+
+func (x *RateAlgorithm) Is(values ...RateAlgorithm) bool {
+	if x == nil {
+		return false
+	}
+	for _, v := range values {
+		if *x == v {
+			return true
+		}
+	}
+	return false
+}
+
 type UserPermission uint16
 
 const (
@@ -325,6 +483,27 @@ type ServiceLimit struct {
 	OverWarn int64 `json:"overWarn"`
 	// Over usage maximum threshold.
 	OverMax int64 `json:"overMax"`
+	// Rate limiting algorithm, the middleware configuration is used if not set.
+	RateAlgorithm RateAlgorithm `json:"rateAlgorithm,omitempty"`
+	// Bucket size for the TokenBucket algorithm, defaults to rateLimit.
+	RateBurst int64 `json:"rateBurst,omitempty"`
+	// Additional rate limits, enforced together with rateLimit.
+	RateWindows []RateWindow `json:"rateWindows,omitempty"`
+}
+
+// RateWindow is a limit of requests in a window of time.
+type RateWindow struct {
+	// Requests limit for the window.
+	Limit int64 `json:"limit"`
+	// Window length in seconds.
+	Seconds int64 `json:"seconds"`
+}
+
+// RateWindowStatus is the current rate of a window.
+type RateWindowStatus struct {
+	Limit   int64 `json:"limit"`
+	Seconds int64 `json:"seconds"`
+	Rate    int64 `json:"rate"`
 }
 
 type AccessKey struct {
@@ -337,6 +516,13 @@ type AccessKey struct {
 	AllowedOrigins  validation.Origins `json:"allowedOrigins" db:"allowed_origins"`
 	AllowedServices []Service          `json:"allowedServices" db:"allowed_services"`
 	CreatedAt       *time.Time         `json:"createdAt,omitempty" db:"created_at,omitempty"`
+	// expiresAt is set by a rotation with a grace period, the key is disabled after it.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" db:"expires_at,omitempty"`
+	// Limits of the key by service, enforced together with the project ones.
+	// rateLimit and its windows limit the requests of the key, overMax caps its usage in the cycle.
+	ServiceLimit map[string]ServiceLimit `json:"serviceLimit,omitempty" db:"service_limit"`
+	// Chains allowed for the key, within the ones of the project. All of them if empty.
+	AllowedChainIDs []uint64 `json:"allowedChainIds,omitempty" db:"allowed_chain_ids"`
 }
 
 // Deprecated: use int64 instead
@@ -346,6 +532,27 @@ type AccessUsage struct {
 	LimitedCompute int64 `json:"limitedCompute" db:"limited_compute"`
 }
 
+// UsageBreakdown is the usage split by bucket.
+type UsageBreakdown struct {
+	// Usage below freeMax.
+	Free int64 `json:"free"`
+	// Usage paid with prepaid credits.
+	Credit int64 `json:"credit"`
+	// Usage over freeMax and the credits, billed as overage.
+	Overage int64 `json:"overage"`
+	// Usage over overMax, rejected.
+	Limited int64 `json:"limited"`
+}
+
+// UsagePoint is the usage of a time bucket. Service and accessKey are set when the history is grouped by them.
+type UsagePoint struct {
+	// Start of the bucket.
+	Time      time.Time       `json:"time"`
+	Service   *Service        `json:"service,omitempty"`
+	AccessKey *string         `json:"accessKey,omitempty"`
+	Usage     *UsageBreakdown `json:"usage"`
+}
+
 type Cycle struct {
 	Start time.Time `json:"start"`
 	End   time.Time `json:"end"`
@@ -357,6 +564,42 @@ type AccessQuota struct {
 	Cycle     *Cycle     `json:"cycle"`
 	Limit     *Limit     `json:"limit"`
 	AccessKey *AccessKey `json:"accessKey"`
+	// Credits available in the cycle by service, spent after freeMax and before the overage.
+	Credits map[string]int64 `json:"credits,omitempty"`
+}
+
+// CreditGrant is an amount of prepaid credits of a project for a service.
+type CreditGrant struct {
+	ID        uint64  `json:"id"`
+	ProjectID uint64  `json:"projectId"`
+	Service   Service `json:"service"`
+	// Credits granted, in compute units.
+	Amount int64 `json:"amount"`
+	// Credits already spent.
+	Used        int64      `json:"used"`
+	Description string     `json:"description"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	RevokedAt   *time.Time `json:"revokedAt,omitempty"`
+}
+
+// AuditEvent records a change made by the server to a project or to one of its access keys.
+type AuditEvent struct {
+	ID        uint64 `json:"id"`
+	ProjectID uint64 `json:"projectId"`
+	// Caller that made the change, its session type followed by its account or service.
+	Actor string `json:"actor"`
+	// RPC method that made the change.
+	RPC string `json:"rpc"`
+	// Access key before the change, missing if it was created.
+	Before *AccessKey `json:"before,omitempty"`
+	// Access key after the change, missing if the change is not about a key.
+	After *AccessKey `json:"after,omitempty"`
+	// Credit grant created or revoked by the change.
+	CreditGrant *CreditGrant `json:"creditGrant,omitempty"`
+	// Service the change is limited to, missing if it's about all of them or not about a service.
+	Service   *Service  `json:"service,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
 }
 
 type ProjectStatus struct {
@@ -364,6 +607,8 @@ type ProjectStatus struct {
 	Limit            *Limit           `json:"limit"`
 	UsageCounter     map[string]int64 `json:"usageCounter"`
 	RateLimitCounter map[string]int64 `json:"rateLimitCounter"`
+	// Rate of each window, by service.
+	RateLimitWindows map[string][]RateWindowStatus `json:"rateLimitWindows,omitempty"`
 }
 
 type Subscription struct {
@@ -388,12 +633,12 @@ const QuotaControlPathPrefix = "/rpc/QuotaControl/"
 
 type quotaControlClient struct {
 	client HTTPClient
-	urls   [25]string
+	urls   [32]string
 }
 
 func NewQuotaControlClient(addr string, client HTTPClient) QuotaControlClient {
 	prefix := urlBase(addr) + QuotaControlPathPrefix
-	urls := [25]string{
+	urls := [32]string{
 		prefix + "Ping",
 		prefix + "GetProjectStatus",
 		prefix + "GetAccessKey",
@@ -407,7 +652,14 @@ func NewQuotaControlClient(addr string, client HTTPClient) QuotaControlClient {
 		prefix + "GetProjectQuota",
 		prefix + "GetAccessQuota",
 		prefix + "ClearAccessQuotaCache",
+		prefix + "GrantCredits",
+		prefix + "ListCreditGrants",
+		prefix + "RevokeCreditGrant",
+		prefix + "GetCreditUsage",
+		prefix + "ListAuditEvents",
 		prefix + "GetUsage",
+		prefix + "GetUsageBreakdown",
+		prefix + "GetUsageHistory",
 		prefix + "ClearUsage",
 		prefix + "SyncProjectUsage",
 		prefix + "SyncAccessKeyUsage",
@@ -480,14 +732,16 @@ func (c *quotaControlClient) GetAccessKey(ctx context.Context, accessKey string)
 	return out.Ret0, err
 }
 
-func (c *quotaControlClient) CreateAccessKey(ctx context.Context, projectId uint64, displayName string, requireOrigin bool, allowedOrigins []string, allowedServices []Service) (*AccessKey, error) {
+func (c *quotaControlClient) CreateAccessKey(ctx context.Context, projectId uint64, displayName string, requireOrigin bool, allowedOrigins []string, allowedServices []Service, serviceLimit map[string]*ServiceLimit, allowedChainIds []uint64) (*AccessKey, error) {
 	in := struct {
-		Arg0 uint64    `json:"projectId"`
-		Arg1 string    `json:"displayName"`
-		Arg2 bool      `json:"requireOrigin"`
-		Arg3 []string  `json:"allowedOrigins"`
-		Arg4 []Service `json:"allowedServices"`
-	}{projectId, displayName, requireOrigin, allowedOrigins, allowedServices}
+		Arg0 uint64                   `json:"projectId"`
+		Arg1 string                   `json:"displayName"`
+		Arg2 bool                     `json:"requireOrigin"`
+		Arg3 []string                 `json:"allowedOrigins"`
+		Arg4 []Service                `json:"allowedServices"`
+		Arg5 map[string]*ServiceLimit `json:"serviceLimit"`
+		Arg6 []uint64                 `json:"allowedChainIds"`
+	}{projectId, displayName, requireOrigin, allowedOrigins, allowedServices, serviceLimit, allowedChainIds}
 	out := struct {
 		Ret0 *AccessKey `json:"accessKey"`
 	}{}
@@ -503,14 +757,16 @@ func (c *quotaControlClient) CreateAccessKey(ctx context.Context, projectId uint
 	return out.Ret0, err
 }
 
-func (c *quotaControlClient) UpdateAccessKey(ctx context.Context, accessKey string, displayName *string, requireOrigin *bool, allowedOrigins []string, allowedServices []Service) (*AccessKey, error) {
+func (c *quotaControlClient) UpdateAccessKey(ctx context.Context, accessKey string, displayName *string, requireOrigin *bool, allowedOrigins []string, allowedServices []Service, serviceLimit map[string]*ServiceLimit, allowedChainIds []uint64) (*AccessKey, error) {
 	in := struct {
-		Arg0 string    `json:"accessKey"`
-		Arg1 *string   `json:"displayName"`
-		Arg2 *bool     `json:"requireOrigin"`
-		Arg3 []string  `json:"allowedOrigins"`
-		Arg4 []Service `json:"allowedServices"`
-	}{accessKey, displayName, requireOrigin, allowedOrigins, allowedServices}
+		Arg0 string                   `json:"accessKey"`
+		Arg1 *string                  `json:"displayName"`
+		Arg2 *bool                    `json:"requireOrigin"`
+		Arg3 []string                 `json:"allowedOrigins"`
+		Arg4 []Service                `json:"allowedServices"`
+		Arg5 map[string]*ServiceLimit `json:"serviceLimit"`
+		Arg6 []uint64                 `json:"allowedChainIds"`
+	}{accessKey, displayName, requireOrigin, allowedOrigins, allowedServices, serviceLimit, allowedChainIds}
 	out := struct {
 		Ret0 *AccessKey `json:"accessKey"`
 	}{}
@@ -547,10 +803,11 @@ func (c *quotaControlClient) ListAccessKeys(ctx context.Context, projectId uint6
 	return out.Ret0, err
 }
 
-func (c *quotaControlClient) RotateAccessKey(ctx context.Context, accessKey string) (*AccessKey, error) {
+func (c *quotaControlClient) RotateAccessKey(ctx context.Context, accessKey string, gracePeriod *uint32) (*AccessKey, error) {
 	in := struct {
-		Arg0 string `json:"accessKey"`
-	}{accessKey}
+		Arg0 string  `json:"accessKey"`
+		Arg1 *uint32 `json:"gracePeriod"`
+	}{accessKey, gracePeriod}
 	out := struct {
 		Ret0 *AccessKey `json:"accessKey"`
 	}{}
@@ -683,6 +940,113 @@ func (c *quotaControlClient) ClearAccessQuotaCache(ctx context.Context, projectI
 	return out.Ret0, err
 }
 
+func (c *quotaControlClient) GrantCredits(ctx context.Context, projectId uint64, service Service, amount int64, expiresAt time.Time, description *string) (*CreditGrant, error) {
+	in := struct {
+		Arg0 uint64    `json:"projectId"`
+		Arg1 Service   `json:"service"`
+		Arg2 int64     `json:"amount"`
+		Arg3 time.Time `json:"expiresAt"`
+		Arg4 *string   `json:"description"`
+	}{projectId, service, amount, expiresAt, description}
+	out := struct {
+		Ret0 *CreditGrant `json:"grant"`
+	}{}
+
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[13], in, &out)
+	if resp != nil {
+		cerr := resp.Body.Close()
+		if err == nil && cerr != nil {
+			err = ErrWebrpcRequestFailed.WithCausef("failed to close response body: %w", cerr)
+		}
+	}
+
+	return out.Ret0, err
+}
+
+func (c *quotaControlClient) ListCreditGrants(ctx context.Context, projectId uint64, service *Service, active *bool) ([]*CreditGrant, error) {
+	in := struct {
+		Arg0 uint64   `json:"projectId"`
+		Arg1 *Service `json:"service"`
+		Arg2 *bool    `json:"active"`
+	}{projectId, service, active}
+	out := struct {
+		Ret0 []*CreditGrant `json:"grants"`
+	}{}
+
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[14], in, &out)
+	if resp != nil {
+		cerr := resp.Body.Close()
+		if err == nil && cerr != nil {
+			err = ErrWebrpcRequestFailed.WithCausef("failed to close response body: %w", cerr)
+		}
+	}
+
+	return out.Ret0, err
+}
+
+func (c *quotaControlClient) RevokeCreditGrant(ctx context.Context, projectId uint64, id uint64) (bool, error) {
+	in := struct {
+		Arg0 uint64 `json:"projectId"`
+		Arg1 uint64 `json:"id"`
+	}{projectId, id}
+	out := struct {
+		Ret0 bool `json:"ok"`
+	}{}
+
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[15], in, &out)
+	if resp != nil {
+		cerr := resp.Body.Close()
+		if err == nil && cerr != nil {
+			err = ErrWebrpcRequestFailed.WithCausef("failed to close response body: %w", cerr)
+		}
+	}
+
+	return out.Ret0, err
+}
+
+func (c *quotaControlClient) GetCreditUsage(ctx context.Context, projectId uint64, service *Service, from *time.Time, to *time.Time) (int64, error) {
+	in := struct {
+		Arg0 uint64     `json:"projectId"`
+		Arg1 *Service   `json:"service"`
+		Arg2 *time.Time `json:"from"`
+		Arg3 *time.Time `json:"to"`
+	}{projectId, service, from, to}
+	out := struct {
+		Ret0 int64 `json:"usage"`
+	}{}
+
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[16], in, &out)
+	if resp != nil {
+		cerr := resp.Body.Close()
+		if err == nil && cerr != nil {
+			err = ErrWebrpcRequestFailed.WithCausef("failed to close response body: %w", cerr)
+		}
+	}
+
+	return out.Ret0, err
+}
+
+func (c *quotaControlClient) ListAuditEvents(ctx context.Context, projectId uint64, from *time.Time, to *time.Time) ([]*AuditEvent, error) {
+	in := struct {
+		Arg0 uint64     `json:"projectId"`
+		Arg1 *time.Time `json:"from"`
+		Arg2 *time.Time `json:"to"`
+	}{projectId, from, to}
+	out := struct {
+		Ret0 []*AuditEvent `json:"events"`
+	}{}
+
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[17], in, &out)
+	if resp != nil {
+		cerr := resp.Body.Close()
+		if err == nil && cerr != nil {
+			err = ErrWebrpcRequestFailed.WithCausef("failed to close response body: %w", cerr)
+		}
+	}
+
+	return out.Ret0, err
+}
+
 func (c *quotaControlClient) GetUsage(ctx context.Context, projectID uint64, accessKey *string, service *Service, from *time.Time, to *time.Time) (int64, error) {
 	in := struct {
 		Arg0 uint64     `json:"projectID"`
@@ -695,7 +1059,55 @@ func (c *quotaControlClient) GetUsage(ctx context.Context, projectID uint64, acc
 		Ret0 int64 `json:"usage"`
 	}{}
 
-	resp, err := doHTTPRequest(ctx, c.client, c.urls[13], in, &out)
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[18], in, &out)
+	if resp != nil {
+		cerr := resp.Body.Close()
+		if err == nil && cerr != nil {
+			err = ErrWebrpcRequestFailed.WithCausef("failed to close response body: %w", cerr)
+		}
+	}
+
+	return out.Ret0, err
+}
+
+func (c *quotaControlClient) GetUsageBreakdown(ctx context.Context, projectID uint64, accessKey *string, service *Service, from *time.Time, to *time.Time) (*UsageBreakdown, error) {
+	in := struct {
+		Arg0 uint64     `json:"projectID"`
+		Arg1 *string    `json:"accessKey"`
+		Arg2 *Service   `json:"service"`
+		Arg3 *time.Time `json:"from"`
+		Arg4 *time.Time `json:"to"`
+	}{projectID, accessKey, service, from, to}
+	out := struct {
+		Ret0 *UsageBreakdown `json:"usage"`
+	}{}
+
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[19], in, &out)
+	if resp != nil {
+		cerr := resp.Body.Close()
+		if err == nil && cerr != nil {
+			err = ErrWebrpcRequestFailed.WithCausef("failed to close response body: %w", cerr)
+		}
+	}
+
+	return out.Ret0, err
+}
+
+func (c *quotaControlClient) GetUsageHistory(ctx context.Context, projectID uint64, accessKey *string, service *Service, from *time.Time, to *time.Time, granularity UsageGranularity, groupBy []UsageGroupBy) ([]*UsagePoint, error) {
+	in := struct {
+		Arg0 uint64           `json:"projectID"`
+		Arg1 *string          `json:"accessKey"`
+		Arg2 *Service         `json:"service"`
+		Arg3 *time.Time       `json:"from"`
+		Arg4 *time.Time       `json:"to"`
+		Arg5 UsageGranularity `json:"granularity"`
+		Arg6 []UsageGroupBy   `json:"groupBy"`
+	}{projectID, accessKey, service, from, to, granularity, groupBy}
+	out := struct {
+		Ret0 []*UsagePoint `json:"history"`
+	}{}
+
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[20], in, &out)
 	if resp != nil {
 		cerr := resp.Body.Close()
 		if err == nil && cerr != nil {
@@ -716,7 +1128,7 @@ func (c *quotaControlClient) ClearUsage(ctx context.Context, projectID uint64, s
 		Ret0 bool `json:"ok"`
 	}{}
 
-	resp, err := doHTTPRequest(ctx, c.client, c.urls[14], in, &out)
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[21], in, &out)
 	if resp != nil {
 		cerr := resp.Body.Close()
 		if err == nil && cerr != nil {
@@ -727,17 +1139,19 @@ func (c *quotaControlClient) ClearUsage(ctx context.Context, projectID uint64, s
 	return out.Ret0, err
 }
 
-func (c *quotaControlClient) SyncProjectUsage(ctx context.Context, service Service, now time.Time, usage map[uint64]int64) (map[uint64]bool, error) {
+func (c *quotaControlClient) SyncProjectUsage(ctx context.Context, service Service, now time.Time, usage map[uint64]int64, batchId *string, breakdown map[uint64]*UsageBreakdown) (map[uint64]bool, error) {
 	in := struct {
-		Arg0 Service          `json:"service"`
-		Arg1 time.Time        `json:"now"`
-		Arg2 map[uint64]int64 `json:"usage"`
-	}{service, now, usage}
+		Arg0 Service                    `json:"service"`
+		Arg1 time.Time                  `json:"now"`
+		Arg2 map[uint64]int64           `json:"usage"`
+		Arg3 *string                    `json:"batchId"`
+		Arg4 map[uint64]*UsageBreakdown `json:"breakdown"`
+	}{service, now, usage, batchId, breakdown}
 	out := struct {
 		Ret0 map[uint64]bool `json:"ok"`
 	}{}
 
-	resp, err := doHTTPRequest(ctx, c.client, c.urls[15], in, &out)
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[22], in, &out)
 	if resp != nil {
 		cerr := resp.Body.Close()
 		if err == nil && cerr != nil {
@@ -748,17 +1162,19 @@ func (c *quotaControlClient) SyncProjectUsage(ctx context.Context, service Servi
 	return out.Ret0, err
 }
 
-func (c *quotaControlClient) SyncAccessKeyUsage(ctx context.Context, service Service, now time.Time, usage map[string]int64) (map[string]bool, error) {
+func (c *quotaControlClient) SyncAccessKeyUsage(ctx context.Context, service Service, now time.Time, usage map[string]int64, batchId *string, breakdown map[string]*UsageBreakdown) (map[string]bool, error) {
 	in := struct {
-		Arg0 Service          `json:"service"`
-		Arg1 time.Time        `json:"now"`
-		Arg2 map[string]int64 `json:"usage"`
-	}{service, now, usage}
+		Arg0 Service                    `json:"service"`
+		Arg1 time.Time                  `json:"now"`
+		Arg2 map[string]int64           `json:"usage"`
+		Arg3 *string                    `json:"batchId"`
+		Arg4 map[string]*UsageBreakdown `json:"breakdown"`
+	}{service, now, usage, batchId, breakdown}
 	out := struct {
 		Ret0 map[string]bool `json:"ok"`
 	}{}
 
-	resp, err := doHTTPRequest(ctx, c.client, c.urls[16], in, &out)
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[23], in, &out)
 	if resp != nil {
 		cerr := resp.Body.Close()
 		if err == nil && cerr != nil {
@@ -779,7 +1195,7 @@ func (c *quotaControlClient) NotifyEvent(ctx context.Context, projectID uint64,
 		Ret0 bool `json:"ok"`
 	}{}
 
-	resp, err := doHTTPRequest(ctx, c.client, c.urls[17], in, &out)
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[24], in, &out)
 	if resp != nil {
 		cerr := resp.Body.Close()
 		if err == nil && cerr != nil {
@@ -800,7 +1216,7 @@ func (c *quotaControlClient) GetUserPermission(ctx context.Context, projectId ui
 		Ret1 *ResourceAccess `json:"resourceAccess"`
 	}{}
 
-	resp, err := doHTTPRequest(ctx, c.client, c.urls[18], in, &out)
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[25], in, &out)
 	if resp != nil {
 		cerr := resp.Body.Close()
 		if err == nil && cerr != nil {
@@ -822,7 +1238,7 @@ func (c *quotaControlClient) GetAccountUsage(ctx context.Context, projectID uint
 		Ret0 *AccessUsage `json:"usage"`
 	}{}
 
-	resp, err := doHTTPRequest(ctx, c.client, c.urls[19], in, &out)
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[26], in, &out)
 	if resp != nil {
 		cerr := resp.Body.Close()
 		if err == nil && cerr != nil {
@@ -844,7 +1260,7 @@ func (c *quotaControlClient) GetAccessKeyUsage(ctx context.Context, accessKey st
 		Ret0 *AccessUsage `json:"usage"`
 	}{}
 
-	resp, err := doHTTPRequest(ctx, c.client, c.urls[20], in, &out)
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[27], in, &out)
 	if resp != nil {
 		cerr := resp.Body.Close()
 		if err == nil && cerr != nil {
@@ -866,7 +1282,7 @@ func (c *quotaControlClient) GetAsyncUsage(ctx context.Context, projectID uint64
 		Ret0 *AccessUsage `json:"usage"`
 	}{}
 
-	resp, err := doHTTPRequest(ctx, c.client, c.urls[21], in, &out)
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[28], in, &out)
 	if resp != nil {
 		cerr := resp.Body.Close()
 		if err == nil && cerr != nil {
@@ -887,7 +1303,7 @@ func (c *quotaControlClient) UpdateProjectUsage(ctx context.Context, service Ser
 		Ret0 map[uint64]bool `json:"ok"`
 	}{}
 
-	resp, err := doHTTPRequest(ctx, c.client, c.urls[22], in, &out)
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[29], in, &out)
 	if resp != nil {
 		cerr := resp.Body.Close()
 		if err == nil && cerr != nil {
@@ -908,7 +1324,7 @@ func (c *quotaControlClient) UpdateKeyUsage(ctx context.Context, service Service
 		Ret0 map[string]bool `json:"ok"`
 	}{}
 
-	resp, err := doHTTPRequest(ctx, c.client, c.urls[23], in, &out)
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[30], in, &out)
 	if resp != nil {
 		cerr := resp.Body.Close()
 		if err == nil && cerr != nil {
@@ -930,7 +1346,7 @@ func (c *quotaControlClient) PrepareUsage(ctx context.Context, projectID uint64,
 		Ret0 bool `json:"ok"`
 	}{}
 
-	resp, err := doHTTPRequest(ctx, c.client, c.urls[24], in, &out)
+	resp, err := doHTTPRequest(ctx, c.client, c.urls[31], in, &out)
 	if resp != nil {
 		cerr := resp.Body.Close()
 		if err == nil && cerr != nil {
@@ -1007,8 +1423,22 @@ func (s *quotaControlService) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		handler = s.serveGetAccessQuotaJSON
 	case "/rpc/QuotaControl/ClearAccessQuotaCache":
 		handler = s.serveClearAccessQuotaCacheJSON
+	case "/rpc/QuotaControl/GrantCredits":
+		handler = s.serveGrantCreditsJSON
+	case "/rpc/QuotaControl/ListCreditGrants":
+		handler = s.serveListCreditGrantsJSON
+	case "/rpc/QuotaControl/RevokeCreditGrant":
+		handler = s.serveRevokeCreditGrantJSON
+	case "/rpc/QuotaControl/GetCreditUsage":
+		handler = s.serveGetCreditUsageJSON
+	case "/rpc/QuotaControl/ListAuditEvents":
+		handler = s.serveListAuditEventsJSON
 	case "/rpc/QuotaControl/GetUsage":
 		handler = s.serveGetUsageJSON
+	case "/rpc/QuotaControl/GetUsageBreakdown":
+		handler = s.serveGetUsageBreakdownJSON
+	case "/rpc/QuotaControl/GetUsageHistory":
+		handler = s.serveGetUsageHistoryJSON
 	case "/rpc/QuotaControl/ClearUsage":
 		handler = s.serveClearUsageJSON
 	case "/rpc/QuotaControl/SyncProjectUsage":
@@ -1195,11 +1625,13 @@ func (s *quotaControlService) serveCreateAccessKeyJSON(ctx context.Context, w ht
 	defer r.Body.Close()
 
 	reqPayload := struct {
-		Arg0 uint64    `json:"projectId"`
-		Arg1 string    `json:"displayName"`
-		Arg2 bool      `json:"requireOrigin"`
-		Arg3 []string  `json:"allowedOrigins"`
-		Arg4 []Service `json:"allowedServices"`
+		Arg0 uint64                   `json:"projectId"`
+		Arg1 string                   `json:"displayName"`
+		Arg2 bool                     `json:"requireOrigin"`
+		Arg3 []string                 `json:"allowedOrigins"`
+		Arg4 []Service                `json:"allowedServices"`
+		Arg5 map[string]*ServiceLimit `json:"serviceLimit"`
+		Arg6 []uint64                 `json:"allowedChainIds"`
 	}{}
 	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
 		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
@@ -1207,7 +1639,7 @@ func (s *quotaControlService) serveCreateAccessKeyJSON(ctx context.Context, w ht
 	}
 
 	// Call service method implementation.
-	ret0, err := s.QuotaControlServer.CreateAccessKey(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2, reqPayload.Arg3, reqPayload.Arg4)
+	ret0, err := s.QuotaControlServer.CreateAccessKey(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2, reqPayload.Arg3, reqPayload.Arg4, reqPayload.Arg5, reqPayload.Arg6)
 	if err != nil {
 		rpcErr, ok := err.(WebRPCError)
 		if !ok {
@@ -1242,11 +1674,13 @@ func (s *quotaControlService) serveUpdateAccessKeyJSON(ctx context.Context, w ht
 	defer r.Body.Close()
 
 	reqPayload := struct {
-		Arg0 string    `json:"accessKey"`
-		Arg1 *string   `json:"displayName"`
-		Arg2 *bool     `json:"requireOrigin"`
-		Arg3 []string  `json:"allowedOrigins"`
-		Arg4 []Service `json:"allowedServices"`
+		Arg0 string                   `json:"accessKey"`
+		Arg1 *string                  `json:"displayName"`
+		Arg2 *bool                    `json:"requireOrigin"`
+		Arg3 []string                 `json:"allowedOrigins"`
+		Arg4 []Service                `json:"allowedServices"`
+		Arg5 map[string]*ServiceLimit `json:"serviceLimit"`
+		Arg6 []uint64                 `json:"allowedChainIds"`
 	}{}
 	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
 		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
@@ -1254,7 +1688,7 @@ func (s *quotaControlService) serveUpdateAccessKeyJSON(ctx context.Context, w ht
 	}
 
 	// Call service method implementation.
-	ret0, err := s.QuotaControlServer.UpdateAccessKey(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2, reqPayload.Arg3, reqPayload.Arg4)
+	ret0, err := s.QuotaControlServer.UpdateAccessKey(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2, reqPayload.Arg3, reqPayload.Arg4, reqPayload.Arg5, reqPayload.Arg6)
 	if err != nil {
 		rpcErr, ok := err.(WebRPCError)
 		if !ok {
@@ -1334,7 +1768,8 @@ func (s *quotaControlService) serveRotateAccessKeyJSON(ctx context.Context, w ht
 	defer r.Body.Close()
 
 	reqPayload := struct {
-		Arg0 string `json:"accessKey"`
+		Arg0 string  `json:"accessKey"`
+		Arg1 *uint32 `json:"gracePeriod"`
 	}{}
 	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
 		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
@@ -1342,7 +1777,7 @@ func (s *quotaControlService) serveRotateAccessKeyJSON(ctx context.Context, w ht
 	}
 
 	// Call service method implementation.
-	ret0, err := s.QuotaControlServer.RotateAccessKey(ctx, reqPayload.Arg0)
+	ret0, err := s.QuotaControlServer.RotateAccessKey(ctx, reqPayload.Arg0, reqPayload.Arg1)
 	if err != nil {
 		rpcErr, ok := err.(WebRPCError)
 		if !ok {
@@ -1627,8 +2062,8 @@ func (s *quotaControlService) serveClearAccessQuotaCacheJSON(ctx context.Context
 	w.Write(respBody)
 }
 
-func (s *quotaControlService) serveGetUsageJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	ctx = context.WithValue(ctx, MethodNameCtxKey, "GetUsage")
+func (s *quotaControlService) serveGrantCreditsJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx = context.WithValue(ctx, MethodNameCtxKey, "GrantCredits")
 
 	reqBody, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -1638,11 +2073,11 @@ func (s *quotaControlService) serveGetUsageJSON(ctx context.Context, w http.Resp
 	defer r.Body.Close()
 
 	reqPayload := struct {
-		Arg0 uint64     `json:"projectID"`
-		Arg1 *string    `json:"accessKey"`
-		Arg2 *Service   `json:"service"`
-		Arg3 *time.Time `json:"from"`
-		Arg4 *time.Time `json:"to"`
+		Arg0 uint64    `json:"projectId"`
+		Arg1 Service   `json:"service"`
+		Arg2 int64     `json:"amount"`
+		Arg3 time.Time `json:"expiresAt"`
+		Arg4 *string   `json:"description"`
 	}{}
 	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
 		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
@@ -1650,7 +2085,7 @@ func (s *quotaControlService) serveGetUsageJSON(ctx context.Context, w http.Resp
 	}
 
 	// Call service method implementation.
-	ret0, err := s.QuotaControlServer.GetUsage(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2, reqPayload.Arg3, reqPayload.Arg4)
+	ret0, err := s.QuotaControlServer.GrantCredits(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2, reqPayload.Arg3, reqPayload.Arg4)
 	if err != nil {
 		rpcErr, ok := err.(WebRPCError)
 		if !ok {
@@ -1661,7 +2096,7 @@ func (s *quotaControlService) serveGetUsageJSON(ctx context.Context, w http.Resp
 	}
 
 	respPayload := struct {
-		Ret0 int64 `json:"usage"`
+		Ret0 *CreditGrant `json:"grant"`
 	}{ret0}
 	respBody, err := json.Marshal(respPayload)
 	if err != nil {
@@ -1674,8 +2109,8 @@ func (s *quotaControlService) serveGetUsageJSON(ctx context.Context, w http.Resp
 	w.Write(respBody)
 }
 
-func (s *quotaControlService) serveClearUsageJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	ctx = context.WithValue(ctx, MethodNameCtxKey, "ClearUsage")
+func (s *quotaControlService) serveListCreditGrantsJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx = context.WithValue(ctx, MethodNameCtxKey, "ListCreditGrants")
 
 	reqBody, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -1685,9 +2120,9 @@ func (s *quotaControlService) serveClearUsageJSON(ctx context.Context, w http.Re
 	defer r.Body.Close()
 
 	reqPayload := struct {
-		Arg0 uint64    `json:"projectID"`
-		Arg1 *Service  `json:"service"`
-		Arg2 time.Time `json:"now"`
+		Arg0 uint64   `json:"projectId"`
+		Arg1 *Service `json:"service"`
+		Arg2 *bool    `json:"active"`
 	}{}
 	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
 		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
@@ -1695,7 +2130,7 @@ func (s *quotaControlService) serveClearUsageJSON(ctx context.Context, w http.Re
 	}
 
 	// Call service method implementation.
-	ret0, err := s.QuotaControlServer.ClearUsage(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2)
+	ret0, err := s.QuotaControlServer.ListCreditGrants(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2)
 	if err != nil {
 		rpcErr, ok := err.(WebRPCError)
 		if !ok {
@@ -1706,7 +2141,7 @@ func (s *quotaControlService) serveClearUsageJSON(ctx context.Context, w http.Re
 	}
 
 	respPayload := struct {
-		Ret0 bool `json:"ok"`
+		Ret0 []*CreditGrant `json:"grants"`
 	}{ret0}
 	respBody, err := json.Marshal(respPayload)
 	if err != nil {
@@ -1719,8 +2154,8 @@ func (s *quotaControlService) serveClearUsageJSON(ctx context.Context, w http.Re
 	w.Write(respBody)
 }
 
-func (s *quotaControlService) serveSyncProjectUsageJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	ctx = context.WithValue(ctx, MethodNameCtxKey, "SyncProjectUsage")
+func (s *quotaControlService) serveRevokeCreditGrantJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx = context.WithValue(ctx, MethodNameCtxKey, "RevokeCreditGrant")
 
 	reqBody, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -1730,9 +2165,8 @@ func (s *quotaControlService) serveSyncProjectUsageJSON(ctx context.Context, w h
 	defer r.Body.Close()
 
 	reqPayload := struct {
-		Arg0 Service          `json:"service"`
-		Arg1 time.Time        `json:"now"`
-		Arg2 map[uint64]int64 `json:"usage"`
+		Arg0 uint64 `json:"projectId"`
+		Arg1 uint64 `json:"id"`
 	}{}
 	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
 		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
@@ -1740,7 +2174,7 @@ func (s *quotaControlService) serveSyncProjectUsageJSON(ctx context.Context, w h
 	}
 
 	// Call service method implementation.
-	ret0, err := s.QuotaControlServer.SyncProjectUsage(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2)
+	ret0, err := s.QuotaControlServer.RevokeCreditGrant(ctx, reqPayload.Arg0, reqPayload.Arg1)
 	if err != nil {
 		rpcErr, ok := err.(WebRPCError)
 		if !ok {
@@ -1751,7 +2185,333 @@ func (s *quotaControlService) serveSyncProjectUsageJSON(ctx context.Context, w h
 	}
 
 	respPayload := struct {
-		Ret0 map[uint64]bool `json:"ok"`
+		Ret0 bool `json:"ok"`
+	}{ret0}
+	respBody, err := json.Marshal(respPayload)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadResponse.WithCausef("failed to marshal json response: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+}
+
+func (s *quotaControlService) serveGetCreditUsageJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx = context.WithValue(ctx, MethodNameCtxKey, "GetCreditUsage")
+
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to read request data: %w", err))
+		return
+	}
+	defer r.Body.Close()
+
+	reqPayload := struct {
+		Arg0 uint64     `json:"projectId"`
+		Arg1 *Service   `json:"service"`
+		Arg2 *time.Time `json:"from"`
+		Arg3 *time.Time `json:"to"`
+	}{}
+	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
+		return
+	}
+
+	// Call service method implementation.
+	ret0, err := s.QuotaControlServer.GetCreditUsage(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2, reqPayload.Arg3)
+	if err != nil {
+		rpcErr, ok := err.(WebRPCError)
+		if !ok {
+			rpcErr = ErrWebrpcEndpoint.WithCause(err)
+		}
+		s.sendErrorJSON(w, r, rpcErr)
+		return
+	}
+
+	respPayload := struct {
+		Ret0 int64 `json:"usage"`
+	}{ret0}
+	respBody, err := json.Marshal(respPayload)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadResponse.WithCausef("failed to marshal json response: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+}
+
+func (s *quotaControlService) serveListAuditEventsJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx = context.WithValue(ctx, MethodNameCtxKey, "ListAuditEvents")
+
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to read request data: %w", err))
+		return
+	}
+	defer r.Body.Close()
+
+	reqPayload := struct {
+		Arg0 uint64     `json:"projectId"`
+		Arg1 *time.Time `json:"from"`
+		Arg2 *time.Time `json:"to"`
+	}{}
+	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
+		return
+	}
+
+	// Call service method implementation.
+	ret0, err := s.QuotaControlServer.ListAuditEvents(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2)
+	if err != nil {
+		rpcErr, ok := err.(WebRPCError)
+		if !ok {
+			rpcErr = ErrWebrpcEndpoint.WithCause(err)
+		}
+		s.sendErrorJSON(w, r, rpcErr)
+		return
+	}
+
+	respPayload := struct {
+		Ret0 []*AuditEvent `json:"events"`
+	}{ret0}
+	respBody, err := json.Marshal(respPayload)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadResponse.WithCausef("failed to marshal json response: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+}
+
+func (s *quotaControlService) serveGetUsageJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx = context.WithValue(ctx, MethodNameCtxKey, "GetUsage")
+
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to read request data: %w", err))
+		return
+	}
+	defer r.Body.Close()
+
+	reqPayload := struct {
+		Arg0 uint64     `json:"projectID"`
+		Arg1 *string    `json:"accessKey"`
+		Arg2 *Service   `json:"service"`
+		Arg3 *time.Time `json:"from"`
+		Arg4 *time.Time `json:"to"`
+	}{}
+	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
+		return
+	}
+
+	// Call service method implementation.
+	ret0, err := s.QuotaControlServer.GetUsage(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2, reqPayload.Arg3, reqPayload.Arg4)
+	if err != nil {
+		rpcErr, ok := err.(WebRPCError)
+		if !ok {
+			rpcErr = ErrWebrpcEndpoint.WithCause(err)
+		}
+		s.sendErrorJSON(w, r, rpcErr)
+		return
+	}
+
+	respPayload := struct {
+		Ret0 int64 `json:"usage"`
+	}{ret0}
+	respBody, err := json.Marshal(respPayload)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadResponse.WithCausef("failed to marshal json response: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+}
+
+func (s *quotaControlService) serveGetUsageBreakdownJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx = context.WithValue(ctx, MethodNameCtxKey, "GetUsageBreakdown")
+
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to read request data: %w", err))
+		return
+	}
+	defer r.Body.Close()
+
+	reqPayload := struct {
+		Arg0 uint64     `json:"projectID"`
+		Arg1 *string    `json:"accessKey"`
+		Arg2 *Service   `json:"service"`
+		Arg3 *time.Time `json:"from"`
+		Arg4 *time.Time `json:"to"`
+	}{}
+	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
+		return
+	}
+
+	// Call service method implementation.
+	ret0, err := s.QuotaControlServer.GetUsageBreakdown(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2, reqPayload.Arg3, reqPayload.Arg4)
+	if err != nil {
+		rpcErr, ok := err.(WebRPCError)
+		if !ok {
+			rpcErr = ErrWebrpcEndpoint.WithCause(err)
+		}
+		s.sendErrorJSON(w, r, rpcErr)
+		return
+	}
+
+	respPayload := struct {
+		Ret0 *UsageBreakdown `json:"usage"`
+	}{ret0}
+	respBody, err := json.Marshal(respPayload)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadResponse.WithCausef("failed to marshal json response: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+}
+
+func (s *quotaControlService) serveGetUsageHistoryJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx = context.WithValue(ctx, MethodNameCtxKey, "GetUsageHistory")
+
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to read request data: %w", err))
+		return
+	}
+	defer r.Body.Close()
+
+	reqPayload := struct {
+		Arg0 uint64           `json:"projectID"`
+		Arg1 *string          `json:"accessKey"`
+		Arg2 *Service         `json:"service"`
+		Arg3 *time.Time       `json:"from"`
+		Arg4 *time.Time       `json:"to"`
+		Arg5 UsageGranularity `json:"granularity"`
+		Arg6 []UsageGroupBy   `json:"groupBy"`
+	}{}
+	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
+		return
+	}
+
+	// Call service method implementation.
+	ret0, err := s.QuotaControlServer.GetUsageHistory(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2, reqPayload.Arg3, reqPayload.Arg4, reqPayload.Arg5, reqPayload.Arg6)
+	if err != nil {
+		rpcErr, ok := err.(WebRPCError)
+		if !ok {
+			rpcErr = ErrWebrpcEndpoint.WithCause(err)
+		}
+		s.sendErrorJSON(w, r, rpcErr)
+		return
+	}
+
+	respPayload := struct {
+		Ret0 []*UsagePoint `json:"history"`
+	}{ret0}
+	respBody, err := json.Marshal(respPayload)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadResponse.WithCausef("failed to marshal json response: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+}
+
+func (s *quotaControlService) serveClearUsageJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx = context.WithValue(ctx, MethodNameCtxKey, "ClearUsage")
+
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to read request data: %w", err))
+		return
+	}
+	defer r.Body.Close()
+
+	reqPayload := struct {
+		Arg0 uint64    `json:"projectID"`
+		Arg1 *Service  `json:"service"`
+		Arg2 time.Time `json:"now"`
+	}{}
+	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
+		return
+	}
+
+	// Call service method implementation.
+	ret0, err := s.QuotaControlServer.ClearUsage(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2)
+	if err != nil {
+		rpcErr, ok := err.(WebRPCError)
+		if !ok {
+			rpcErr = ErrWebrpcEndpoint.WithCause(err)
+		}
+		s.sendErrorJSON(w, r, rpcErr)
+		return
+	}
+
+	respPayload := struct {
+		Ret0 bool `json:"ok"`
+	}{ret0}
+	respBody, err := json.Marshal(respPayload)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadResponse.WithCausef("failed to marshal json response: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+}
+
+func (s *quotaControlService) serveSyncProjectUsageJSON(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx = context.WithValue(ctx, MethodNameCtxKey, "SyncProjectUsage")
+
+	reqBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to read request data: %w", err))
+		return
+	}
+	defer r.Body.Close()
+
+	reqPayload := struct {
+		Arg0 Service                    `json:"service"`
+		Arg1 time.Time                  `json:"now"`
+		Arg2 map[uint64]int64           `json:"usage"`
+		Arg3 *string                    `json:"batchId"`
+		Arg4 map[uint64]*UsageBreakdown `json:"breakdown"`
+	}{}
+	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
+		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
+		return
+	}
+
+	// Call service method implementation.
+	ret0, err := s.QuotaControlServer.SyncProjectUsage(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2, reqPayload.Arg3, reqPayload.Arg4)
+	if err != nil {
+		rpcErr, ok := err.(WebRPCError)
+		if !ok {
+			rpcErr = ErrWebrpcEndpoint.WithCause(err)
+		}
+		s.sendErrorJSON(w, r, rpcErr)
+		return
+	}
+
+	respPayload := struct {
+		Ret0 map[uint64]bool `json:"ok"`
 	}{ret0}
 	respBody, err := json.Marshal(respPayload)
 	if err != nil {
@@ -1775,9 +2535,11 @@ func (s *quotaControlService) serveSyncAccessKeyUsageJSON(ctx context.Context, w
 	defer r.Body.Close()
 
 	reqPayload := struct {
-		Arg0 Service          `json:"service"`
-		Arg1 time.Time        `json:"now"`
-		Arg2 map[string]int64 `json:"usage"`
+		Arg0 Service                    `json:"service"`
+		Arg1 time.Time                  `json:"now"`
+		Arg2 map[string]int64           `json:"usage"`
+		Arg3 *string                    `json:"batchId"`
+		Arg4 map[string]*UsageBreakdown `json:"breakdown"`
 	}{}
 	if err := json.Unmarshal(reqBody, &reqPayload); err != nil {
 		s.sendErrorJSON(w, r, ErrWebrpcBadRequest.WithCausef("failed to unmarshal request data: %w", err))
@@ -1785,7 +2547,7 @@ func (s *quotaControlService) serveSyncAccessKeyUsageJSON(ctx context.Context, w
 	}
 
 	// Call service method implementation.
-	ret0, err := s.QuotaControlServer.SyncAccessKeyUsage(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2)
+	ret0, err := s.QuotaControlServer.SyncAccessKeyUsage(ctx, reqPayload.Arg0, reqPayload.Arg1, reqPayload.Arg2, reqPayload.Arg3, reqPayload.Arg4)
 	if err != nil {
 		rpcErr, ok := err.(WebRPCError)
 		if !ok {
@@ -2274,11 +3036,46 @@ var methods = map[string]*method{
 		service:     "QuotaControl",
 		annotations: map[string]string{},
 	},
+	"/rpc/QuotaControl/GrantCredits": {
+		name:        "GrantCredits",
+		service:     "QuotaControl",
+		annotations: map[string]string{},
+	},
+	"/rpc/QuotaControl/ListCreditGrants": {
+		name:        "ListCreditGrants",
+		service:     "QuotaControl",
+		annotations: map[string]string{},
+	},
+	"/rpc/QuotaControl/RevokeCreditGrant": {
+		name:        "RevokeCreditGrant",
+		service:     "QuotaControl",
+		annotations: map[string]string{},
+	},
+	"/rpc/QuotaControl/GetCreditUsage": {
+		name:        "GetCreditUsage",
+		service:     "QuotaControl",
+		annotations: map[string]string{},
+	},
+	"/rpc/QuotaControl/ListAuditEvents": {
+		name:        "ListAuditEvents",
+		service:     "QuotaControl",
+		annotations: map[string]string{},
+	},
 	"/rpc/QuotaControl/GetUsage": {
 		name:        "GetUsage",
 		service:     "QuotaControl",
 		annotations: map[string]string{},
 	},
+	"/rpc/QuotaControl/GetUsageBreakdown": {
+		name:        "GetUsageBreakdown",
+		service:     "QuotaControl",
+		annotations: map[string]string{},
+	},
+	"/rpc/QuotaControl/GetUsageHistory": {
+		name:        "GetUsageHistory",
+		service:     "QuotaControl",
+		annotations: map[string]string{},
+	},
 	"/rpc/QuotaControl/ClearUsage": {
 		name:        "ClearUsage",
 		service:     "QuotaControl",
@@ -2365,7 +3162,14 @@ var WebRPCServices = map[string][]string{
 		"GetProjectQuota",
 		"GetAccessQuota",
 		"ClearAccessQuotaCache",
+		"GrantCredits",
+		"ListCreditGrants",
+		"RevokeCreditGrant",
+		"GetCreditUsage",
+		"ListAuditEvents",
 		"GetUsage",
+		"GetUsageBreakdown",
+		"GetUsageHistory",
 		"ClearUsage",
 		"SyncProjectUsage",
 		"SyncAccessKeyUsage",
@@ -2643,7 +3447,9 @@ var (
 	ErrNoDefaultKey            = WebRPCError{Code: 1300, Name: "NoDefaultKey", Message: "No default access key found", HTTPStatus: 403}
 	ErrMaxAccessKeys           = WebRPCError{Code: 1301, Name: "MaxAccessKeys", Message: "Access keys limit reached", HTTPStatus: 403}
 	ErrAtLeastOneKey           = WebRPCError{Code: 1302, Name: "AtLeastOneKey", Message: "You need at least one Access Key", HTTPStatus: 403}
+	ErrCreditGrantNotFound     = WebRPCError{Code: 1400, Name: "CreditGrantNotFound", Message: "Credit grant not found", HTTPStatus: 404}
 	ErrTimeout                 = WebRPCError{Code: 1900, Name: "Timeout", Message: "Request timed out", HTTPStatus: 408}
+	ErrQuotaUnavailable        = WebRPCError{Code: 1901, Name: "QuotaUnavailable", Message: "Quota service unavailable, try again later", HTTPStatus: 503}
 )
 
 const WebrpcHeader = "Webrpc"
@@ -40,6 +40,9 @@ export interface QuotaControlClient {
 
   listAccessKeys(req: ListAccessKeysRequest, headers?: object, signal?: AbortSignal): Promise<ListAccessKeysResponse>
 
+  /**
+   * gracePeriod is in seconds, the old key stays valid during it and then it's disabled.
+   */
   rotateAccessKey(req: RotateAccessKeyRequest, headers?: object, signal?: AbortSignal): Promise<RotateAccessKeyResponse>
 
   disableAccessKey(req: DisableAccessKeyRequest, headers?: object, signal?: AbortSignal): Promise<DisableAccessKeyResponse>
@@ -60,13 +63,37 @@ export interface QuotaControlClient {
 
   clearAccessQuotaCache(req: ClearAccessQuotaCacheRequest, headers?: object, signal?: AbortSignal): Promise<ClearAccessQuotaCacheResponse>
 
+  /**
+   * Credits
+   */
+  grantCredits(req: GrantCreditsRequest, headers?: object, signal?: AbortSignal): Promise<GrantCreditsResponse>
+
+  listCreditGrants(req: ListCreditGrantsRequest, headers?: object, signal?: AbortSignal): Promise<ListCreditGrantsResponse>
+
+  revokeCreditGrant(req: RevokeCreditGrantRequest, headers?: object, signal?: AbortSignal): Promise<RevokeCreditGrantResponse>
+
+  getCreditUsage(req: GetCreditUsageRequest, headers?: object, signal?: AbortSignal): Promise<GetCreditUsageResponse>
+
+  /**
+   * Audit
+   */
+  listAuditEvents(req: ListAuditEventsRequest, headers?: object, signal?: AbortSignal): Promise<ListAuditEventsResponse>
+
   /**
    * Usage
    */
   getUsage(req: GetUsageRequest, headers?: object, signal?: AbortSignal): Promise<GetUsageResponse>
 
+  getUsageBreakdown(req: GetUsageBreakdownRequest, headers?: object, signal?: AbortSignal): Promise<GetUsageBreakdownResponse>
+
+  getUsageHistory(req: GetUsageHistoryRequest, headers?: object, signal?: AbortSignal): Promise<GetUsageHistoryResponse>
+
   clearUsage(req: ClearUsageRequest, headers?: object, signal?: AbortSignal): Promise<ClearUsageResponse>
 
+  /**
+   * batchId makes the sync idempotent, a replay of an already processed batch is ignored.
+   * usage is the allowed usage, breakdown splits it by bucket and adds the limited one, the server splits it if missing.
+   */
   syncProjectUsage(req: SyncProjectUsageRequest, headers?: object, signal?: AbortSignal): Promise<SyncProjectUsageResponse>
 
   syncAccessKeyUsage(req: SyncAccessKeyUsageRequest, headers?: object, signal?: AbortSignal): Promise<SyncAccessKeyUsageResponse>
@@ -79,17 +106,17 @@ export interface QuotaControlClient {
   getUserPermission(req: GetUserPermissionRequest, headers?: object, signal?: AbortSignal): Promise<GetUserPermissionResponse>
 
   /**
-   * Deprecated: use GetUsage
+   * Deprecated: use GetUsage or GetUsageBreakdown
    */
   getAccountUsage(req: GetAccountUsageRequest, headers?: object, signal?: AbortSignal): Promise<GetAccountUsageResponse>
 
   /**
-   * Deprecated: use GetUsage
+   * Deprecated: use GetUsage or GetUsageBreakdown
    */
   getAccessKeyUsage(req: GetAccessKeyUsageRequest, headers?: object, signal?: AbortSignal): Promise<GetAccessKeyUsageResponse>
 
   /**
-   * Deprecated: use GetUsage
+   * Deprecated: use GetUsage or GetUsageBreakdown
    */
   getAsyncUsage(req: GetAsyncUsageRequest, headers?: object, signal?: AbortSignal): Promise<GetAsyncUsageResponse>
 
@@ -126,6 +153,16 @@ export enum Service {
   Trails = 'Trails'
 }
 
+export enum UsageGranularity {
+  Day = 'Day',
+  Hour = 'Hour'
+}
+
+export enum UsageGroupBy {
+  Service = 'Service',
+  AccessKey = 'AccessKey'
+}
+
 export enum EventType {
   FreeWarn = 'FreeWarn',
   FreeMax = 'FreeMax',
@@ -133,6 +170,13 @@ export enum EventType {
   OverMax = 'OverMax'
 }
 
+export enum RateAlgorithm {
+  Default = 'Default',
+  SlidingWindow = 'SlidingWindow',
+  FixedWindow = 'FixedWindow',
+  TokenBucket = 'TokenBucket'
+}
+
 export enum UserPermission {
   UNAUTHORIZED = 'UNAUTHORIZED',
   READ = 'READ',
@@ -163,6 +207,20 @@ export interface ServiceLimit {
   freeMax: number
   overWarn: number
   overMax: number
+  rateAlgorithm?: RateAlgorithm
+  rateBurst?: number
+  rateWindows?: Array<RateWindow>
+}
+
+export interface RateWindow {
+  limit: number
+  seconds: number
+}
+
+export interface RateWindowStatus {
+  limit: number
+  seconds: number
+  rate: number
 }
 
 export interface AccessKey {
@@ -175,6 +233,9 @@ export interface AccessKey {
   allowedOrigins: Array<string>
   allowedServices: Array<Service>
   createdAt?: string
+  expiresAt?: string
+  serviceLimit?: {[key: string]: ServiceLimit}
+  allowedChainIds?: Array<number>
 }
 
 export interface AccessUsage {
@@ -183,6 +244,20 @@ export interface AccessUsage {
   limitedCompute: number
 }
 
+export interface UsageBreakdown {
+  free: number
+  credit: number
+  overage: number
+  limited: number
+}
+
+export interface UsagePoint {
+  time: string
+  service?: Service
+  accessKey?: string
+  usage: UsageBreakdown
+}
+
 export interface Cycle {
   start: string
   end: string
@@ -193,6 +268,31 @@ export interface AccessQuota {
   cycle: Cycle
   limit: Limit
   accessKey: AccessKey
+  credits?: {[key: string]: number}
+}
+
+export interface CreditGrant {
+  id: number
+  projectId: number
+  service: Service
+  amount: number
+  used: number
+  description: string
+  createdAt: string
+  expiresAt: string
+  revokedAt?: string
+}
+
+export interface AuditEvent {
+  id: number
+  projectId: number
+  actor: string
+  rpc: string
+  before?: AccessKey
+  after?: AccessKey
+  creditGrant?: CreditGrant
+  service?: Service
+  createdAt: string
 }
 
 export interface ProjectStatus {
@@ -200,6 +300,7 @@ export interface ProjectStatus {
   limit: Limit
   usageCounter: {[key: string]: number}
   rateLimitCounter: {[key: string]: number}
+  rateLimitWindows?: {[key: string]: Array<RateWindowStatus>}
 }
 
 export interface Subscription {
@@ -245,6 +346,8 @@ export interface CreateAccessKeyRequest {
   requireOrigin: boolean
   allowedOrigins: Array<string>
   allowedServices: Array<Service>
+  serviceLimit?: {[key: string]: ServiceLimit}
+  allowedChainIds?: Array<number>
 }
 
 export interface CreateAccessKeyResponse {
@@ -257,6 +360,8 @@ export interface UpdateAccessKeyRequest {
   requireOrigin?: boolean
   allowedOrigins?: Array<string>
   allowedServices?: Array<Service>
+  serviceLimit?: {[key: string]: ServiceLimit}
+  allowedChainIds?: Array<number>
 }
 
 export interface UpdateAccessKeyResponse {
@@ -275,6 +380,7 @@ export interface ListAccessKeysResponse {
 
 export interface RotateAccessKeyRequest {
   accessKey: string
+  gracePeriod?: number
 }
 
 export interface RotateAccessKeyResponse {
@@ -332,6 +438,58 @@ export interface ClearAccessQuotaCacheResponse {
   ok: boolean
 }
 
+export interface GrantCreditsRequest {
+  projectId: number
+  service: Service
+  amount: number
+  expiresAt: string
+  description?: string
+}
+
+export interface GrantCreditsResponse {
+  grant: CreditGrant
+}
+
+export interface ListCreditGrantsRequest {
+  projectId: number
+  service?: Service
+  active?: boolean
+}
+
+export interface ListCreditGrantsResponse {
+  grants: Array<CreditGrant>
+}
+
+export interface RevokeCreditGrantRequest {
+  projectId: number
+  id: number
+}
+
+export interface RevokeCreditGrantResponse {
+  ok: boolean
+}
+
+export interface GetCreditUsageRequest {
+  projectId: number
+  service?: Service
+  from?: string
+  to?: string
+}
+
+export interface GetCreditUsageResponse {
+  usage: number
+}
+
+export interface ListAuditEventsRequest {
+  projectId: number
+  from?: string
+  to?: string
+}
+
+export interface ListAuditEventsResponse {
+  events: Array<AuditEvent>
+}
+
 export interface GetUsageRequest {
   projectID: number
   accessKey?: string
@@ -344,6 +502,32 @@ export interface GetUsageResponse {
   usage: number
 }
 
+export interface GetUsageBreakdownRequest {
+  projectID: number
+  accessKey?: string
+  service?: Service
+  from?: string
+  to?: string
+}
+
+export interface GetUsageBreakdownResponse {
+  usage: UsageBreakdown
+}
+
+export interface GetUsageHistoryRequest {
+  projectID: number
+  accessKey?: string
+  service?: Service
+  from?: string
+  to?: string
+  granularity: UsageGranularity
+  groupBy?: Array<UsageGroupBy>
+}
+
+export interface GetUsageHistoryResponse {
+  history: Array<UsagePoint>
+}
+
 export interface ClearUsageRequest {
   projectID: number
   service?: Service
@@ -358,6 +542,8 @@ export interface SyncProjectUsageRequest {
   service: Service
   now: string
   usage: {[key: number]: number}
+  batchId?: string
+  breakdown?: {[key: number]: UsageBreakdown}
 }
 
 export interface SyncProjectUsageResponse {
@@ -368,6 +554,8 @@ export interface SyncAccessKeyUsageRequest {
   service: Service
   now: string
   usage: {[key: string]: number}
+  batchId?: string
+  breakdown?: {[key: string]: UsageBreakdown}
 }
 
 export interface SyncAccessKeyUsageResponse {
@@ -492,7 +680,14 @@ export class QuotaControl implements QuotaControlClient {
     getProjectQuota: (req: GetProjectQuotaRequest) => ['QuotaControl', 'getProjectQuota', req] as const,
     getAccessQuota: (req: GetAccessQuotaRequest) => ['QuotaControl', 'getAccessQuota', req] as const,
     clearAccessQuotaCache: (req: ClearAccessQuotaCacheRequest) => ['QuotaControl', 'clearAccessQuotaCache', req] as const,
+    grantCredits: (req: GrantCreditsRequest) => ['QuotaControl', 'grantCredits', req] as const,
+    listCreditGrants: (req: ListCreditGrantsRequest) => ['QuotaControl', 'listCreditGrants', req] as const,
+    revokeCreditGrant: (req: RevokeCreditGrantRequest) => ['QuotaControl', 'revokeCreditGrant', req] as const,
+    getCreditUsage: (req: GetCreditUsageRequest) => ['QuotaControl', 'getCreditUsage', req] as const,
+    listAuditEvents: (req: ListAuditEventsRequest) => ['QuotaControl', 'listAuditEvents', req] as const,
     getUsage: (req: GetUsageRequest) => ['QuotaControl', 'getUsage', req] as const,
+    getUsageBreakdown: (req: GetUsageBreakdownRequest) => ['QuotaControl', 'getUsageBreakdown', req] as const,
+    getUsageHistory: (req: GetUsageHistoryRequest) => ['QuotaControl', 'getUsageHistory', req] as const,
     clearUsage: (req: ClearUsageRequest) => ['QuotaControl', 'clearUsage', req] as const,
     syncProjectUsage: (req: SyncProjectUsageRequest) => ['QuotaControl', 'syncProjectUsage', req] as const,
     syncAccessKeyUsage: (req: SyncAccessKeyUsageRequest) => ['QuotaControl', 'syncAccessKeyUsage', req] as const,
@@ -662,6 +857,66 @@ export class QuotaControl implements QuotaControlClient {
     })
   }
 
+  grantCredits = (req: GrantCreditsRequest, headers?: object, signal?: AbortSignal): Promise<GrantCreditsResponse> => {
+    return this.fetch(
+      this.url('GrantCredits'),
+      createHttpRequest(JsonEncode(req, 'GrantCreditsRequest'), headers, signal)).then((res) => {
+      return buildResponse(res).then(_data => {
+        return JsonDecode<GrantCreditsResponse>(_data, 'GrantCreditsResponse')
+      })
+    }, (error) => {
+      throw WebrpcRequestFailedError.new({ cause: `fetch(): ${error instanceof Error ? error.message : String(error)}` })
+    })
+  }
+
+  listCreditGrants = (req: ListCreditGrantsRequest, headers?: object, signal?: AbortSignal): Promise<ListCreditGrantsResponse> => {
+    return this.fetch(
+      this.url('ListCreditGrants'),
+      createHttpRequest(JsonEncode(req, 'ListCreditGrantsRequest'), headers, signal)).then((res) => {
+      return buildResponse(res).then(_data => {
+        return JsonDecode<ListCreditGrantsResponse>(_data, 'ListCreditGrantsResponse')
+      })
+    }, (error) => {
+      throw WebrpcRequestFailedError.new({ cause: `fetch(): ${error instanceof Error ? error.message : String(error)}` })
+    })
+  }
+
+  revokeCreditGrant = (req: RevokeCreditGrantRequest, headers?: object, signal?: AbortSignal): Promise<RevokeCreditGrantResponse> => {
+    return this.fetch(
+      this.url('RevokeCreditGrant'),
+      createHttpRequest(JsonEncode(req, 'RevokeCreditGrantRequest'), headers, signal)).then((res) => {
+      return buildResponse(res).then(_data => {
+        return JsonDecode<RevokeCreditGrantResponse>(_data, 'RevokeCreditGrantResponse')
+      })
+    }, (error) => {
+      throw WebrpcRequestFailedError.new({ cause: `fetch(): ${error instanceof Error ? error.message : String(error)}` })
+    })
+  }
+
+  getCreditUsage = (req: GetCreditUsageRequest, headers?: object, signal?: AbortSignal): Promise<GetCreditUsageResponse> => {
+    return this.fetch(
+      this.url('GetCreditUsage'),
+      createHttpRequest(JsonEncode(req, 'GetCreditUsageRequest'), headers, signal)).then((res) => {
+      return buildResponse(res).then(_data => {
+        return JsonDecode<GetCreditUsageResponse>(_data, 'GetCreditUsageResponse')
+      })
+    }, (error) => {
+      throw WebrpcRequestFailedError.new({ cause: `fetch(): ${error instanceof Error ? error.message : String(error)}` })
+    })
+  }
+
+  listAuditEvents = (req: ListAuditEventsRequest, headers?: object, signal?: AbortSignal): Promise<ListAuditEventsResponse> => {
+    return this.fetch(
+      this.url('ListAuditEvents'),
+      createHttpRequest(JsonEncode(req, 'ListAuditEventsRequest'), headers, signal)).then((res) => {
+      return buildResponse(res).then(_data => {
+        return JsonDecode<ListAuditEventsResponse>(_data, 'ListAuditEventsResponse')
+      })
+    }, (error) => {
+      throw WebrpcRequestFailedError.new({ cause: `fetch(): ${error instanceof Error ? error.message : String(error)}` })
+    })
+  }
+
   getUsage = (req: GetUsageRequest, headers?: object, signal?: AbortSignal): Promise<GetUsageResponse> => {
     return this.fetch(
       this.url('GetUsage'),
@@ -674,6 +929,30 @@ export class QuotaControl implements QuotaControlClient {
     })
   }
 
+  getUsageBreakdown = (req: GetUsageBreakdownRequest, headers?: object, signal?: AbortSignal): Promise<GetUsageBreakdownResponse> => {
+    return this.fetch(
+      this.url('GetUsageBreakdown'),
+      createHttpRequest(JsonEncode(req, 'GetUsageBreakdownRequest'), headers, signal)).then((res) => {
+      return buildResponse(res).then(_data => {
+        return JsonDecode<GetUsageBreakdownResponse>(_data, 'GetUsageBreakdownResponse')
+      })
+    }, (error) => {
+      throw WebrpcRequestFailedError.new({ cause: `fetch(): ${error instanceof Error ? error.message : String(error)}` })
+    })
+  }
+
+  getUsageHistory = (req: GetUsageHistoryRequest, headers?: object, signal?: AbortSignal): Promise<GetUsageHistoryResponse> => {
+    return this.fetch(
+      this.url('GetUsageHistory'),
+      createHttpRequest(JsonEncode(req, 'GetUsageHistoryRequest'), headers, signal)).then((res) => {
+      return buildResponse(res).then(_data => {
+        return JsonDecode<GetUsageHistoryResponse>(_data, 'GetUsageHistoryResponse')
+      })
+    }, (error) => {
+      throw WebrpcRequestFailedError.new({ cause: `fetch(): ${error instanceof Error ? error.message : String(error)}` })
+    })
+  }
+
   clearUsage = (req: ClearUsageRequest, headers?: object, signal?: AbortSignal): Promise<ClearUsageResponse> => {
     return this.fetch(
       this.url('ClearUsage'),
@@ -1281,6 +1560,18 @@ export class AtLeastOneKeyError extends WebrpcError {
   }
 }
 
+export class CreditGrantNotFoundError extends WebrpcError {
+  constructor(error: WebrpcErrorParams = {}) {
+    super(error)
+    this.name = error.name || 'CreditGrantNotFound'
+    this.code = typeof error.code === 'number' ? error.code : 1400
+    this.message = error.message || `Credit grant not found`
+    this.status = typeof error.status === 'number' ? error.status : 404
+    if (error.cause !== undefined) this.cause = error.cause
+    Object.setPrototypeOf(this, CreditGrantNotFoundError.prototype)
+  }
+}
+
 export class TimeoutError extends WebrpcError {
   constructor(error: WebrpcErrorParams = {}) {
     super(error)
@@ -1293,6 +1584,18 @@ export class TimeoutError extends WebrpcError {
   }
 }
 
+export class QuotaUnavailableError extends WebrpcError {
+  constructor(error: WebrpcErrorParams = {}) {
+    super(error)
+    this.name = error.name || 'QuotaUnavailable'
+    this.code = typeof error.code === 'number' ? error.code : 1901
+    this.message = error.message || `Quota service unavailable, try again later`
+    this.status = typeof error.status === 'number' ? error.status : 503
+    if (error.cause !== undefined) this.cause = error.cause
+    Object.setPrototypeOf(this, QuotaUnavailableError.prototype)
+  }
+}
+
 
 export enum errors {
   WebrpcEndpoint = 'WebrpcEndpoint',
@@ -1328,7 +1631,9 @@ export enum errors {
   NoDefaultKey = 'NoDefaultKey',
   MaxAccessKeys = 'MaxAccessKeys',
   AtLeastOneKey = 'AtLeastOneKey',
+  CreditGrantNotFound = 'CreditGrantNotFound',
   Timeout = 'Timeout',
+  QuotaUnavailable = 'QuotaUnavailable',
 }
 
 export enum WebrpcErrorCodes {
@@ -1365,7 +1670,9 @@ export enum WebrpcErrorCodes {
   NoDefaultKey = 1300,
   MaxAccessKeys = 1301,
   AtLeastOneKey = 1302,
+  CreditGrantNotFound = 1400,
   Timeout = 1900,
+  QuotaUnavailable = 1901,
 }
 
 export const webrpcErrorByCode: { [code: number]: any } = {
@@ -1402,7 +1709,9 @@ export const webrpcErrorByCode: { [code: number]: any } = {
   [1300]: NoDefaultKeyError,
   [1301]: MaxAccessKeysError,
   [1302]: AtLeastOneKeyError,
+  [1400]: CreditGrantNotFoundError,
   [1900]: TimeoutError,
+  [1901]: QuotaUnavailableError,
 }
 
 
@@ -0,0 +1,250 @@
+package quotacontrol
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/0xsequence/quotacontrol/middleware"
+	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/go-chi/httprate"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisCounterTimeout is the timeout of the redis commands of the rate limiter, after which the in-memory fallback is used.
+const redisCounterTimeout = 250 * time.Millisecond
+
+// NewLimitCounter returns a redis counter for the rate limiter middleware, with the keys prefixed by service.
+// It also implements middleware.TokenBucketCounter and middleware.WindowCounter, so all the algorithms and windows are shared across instances.
+// It returns nil, so the limits are kept in memory, if redis is disabled or its configuration is invalid (see RedisConfig.Validate).
+func NewLimitCounter(svc proto.Service, cfg RedisConfig, logger *slog.Logger) httprate.LimitCounter {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	prefix := redisRLPrefix
+	if s := svc.String(); s != "" {
+		prefix = fmt.Sprintf("%s%s:", redisRLPrefix, s)
+	}
+
+	client, err := newLimitClient(cfg)
+	if err != nil {
+		if logger != nil {
+			logger.Error("invalid redis config, using in-memory rate limits", slog.Any("error", err))
+		}
+		return nil
+	}
+
+	return &limitCounter{
+		LimitCounter: newRedisCounter(client, prefix, logger),
+		client:       client,
+		prefix:       prefix,
+		logger:       logger,
+		fallback:     middleware.NewLocalTokenBucket(),
+	}
+}
+
+// newLimitClient returns a client with short timeouts and no retries, so the fallback kicks in quickly.
+func newLimitClient(cfg RedisConfig) (redis.UniversalClient, error) {
+	opts, err := cfg.options()
+	if err != nil {
+		return nil, err
+	}
+	opts.DisableIndentity = true
+	opts.DialTimeout = 2 * redisCounterTimeout
+	opts.ReadTimeout = redisCounterTimeout
+	opts.WriteTimeout = redisCounterTimeout
+	opts.PoolSize = cmp.Or(cfg.MaxActive, 8)
+	opts.MinIdleConns = 1
+	opts.MaxIdleConns = cmp.Or(cfg.MaxIdle, 4)
+	opts.MaxRetries = -1
+	return cfg.newClient(opts), nil
+}
+
+type limitCounter struct {
+	httprate.LimitCounter
+	client   redis.UniversalClient
+	prefix   string
+	logger   *slog.Logger
+	fallback middleware.TokenBucketCounter
+}
+
+var (
+	_ middleware.TokenBucketCounter = (*limitCounter)(nil)
+	_ middleware.WindowCounter      = (*limitCounter)(nil)
+)
+
+// WindowCounter returns a counter for windows other than a minute, sharing the redis client.
+func (c *limitCounter) WindowCounter(window time.Duration) httprate.LimitCounter {
+	return newRedisCounter(c.client, c.prefix, c.logger)
+}
+
+// tokenBucketScript refills the bucket with the tokens accrued since the last call, and takes the cost if available.
+// A negative cost gives the tokens back, up to burst.
+// The bucket expires when it would be full again, since a missing bucket is a full one.
+//
+// KEYS[1] bucket key
+// ARGV[1] now in milliseconds
+// ARGV[2] tokens per millisecond
+// ARGV[3] burst
+// ARGV[4] cost
+var tokenBucketScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1])
+local last = state[2]
+if tokens == nil or last == false then
+	tokens = burst
+	last = ARGV[1]
+elseif now > tonumber(last) then
+	tokens = math.min(burst, tokens + (now - tonumber(last)) * rate)
+	last = ARGV[1]
+end
+
+local ok = 0
+if tokens >= cost then
+	tokens = math.min(burst, tokens - cost)
+	ok = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', last)
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1000)
+return {ok, tostring(tokens)}
+`)
+
+func (c *limitCounter) TakeTokens(ctx context.Context, key string, limit, burst int, window time.Duration, cost int) (float64, bool, error) {
+	rate := float64(limit) / float64(window.Milliseconds())
+	ctx, cancel := context.WithTimeout(ctx, redisCounterTimeout)
+	defer cancel()
+
+	res, err := tokenBucketScript.Run(ctx, c.client, []string{c.prefix + "bucket:" + key}, time.Now().UnixMilli(), rate, burst, cost).Slice()
+	if err == nil && len(res) != 2 {
+		err = fmt.Errorf("unexpected result %v", res)
+	}
+	if err != nil {
+		if c.logger != nil {
+			c.logger.Error("redis token bucket error", slog.Any("error", err))
+		}
+		return c.fallback.TakeTokens(ctx, key, limit, burst, window, cost)
+	}
+
+	ok, _ := res[0].(int64)
+	s, _ := res[1].(string)
+	tokens, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("parse tokens: %w", err)
+	}
+	return tokens, ok == 1, nil
+}
+
+// newRedisCounter returns a sliding window counter on redis, that falls back to a local counter while redis is unavailable.
+func newRedisCounter(client redis.UniversalClient, prefix string, logger *slog.Logger) *redisCounter {
+	return &redisCounter{
+		client:   client,
+		prefix:   prefix,
+		logger:   logger,
+		fallback: httprate.NewLocalLimitCounter(time.Minute),
+	}
+}
+
+// redisCounter is a httprate.LimitCounter on redis.
+// It replaces the counter of httprate-redis, which only accepts a single node *redis.Client,
+// so it can run on the redis.UniversalClient of a cluster or a sentinel failover.
+// The key of the counter is a hash tag, so the current and previous windows are in the same cluster slot.
+type redisCounter struct {
+	client     redis.UniversalClient
+	prefix     string
+	logger     *slog.Logger
+	window     time.Duration
+	fallback   httprate.LimitCounter
+	fallenBack atomic.Bool
+}
+
+var _ httprate.LimitCounter = (*redisCounter)(nil)
+
+func (c *redisCounter) Config(requestLimit int, windowLength time.Duration) {
+	c.window = windowLength
+	c.fallback.Config(requestLimit, windowLength)
+}
+
+func (c *redisCounter) Increment(key string, currentWindow time.Time) error {
+	return c.IncrementBy(key, currentWindow, 1)
+}
+
+func (c *redisCounter) IncrementBy(key string, currentWindow time.Time, amount int) error {
+	if c.fallenBack.Load() {
+		return c.fallback.IncrementBy(key, currentWindow, amount)
+	}
+
+	ctx := context.Background()
+	windowKey := c.windowKey(key, currentWindow)
+	pipe := c.client.TxPipeline()
+	pipe.IncrBy(ctx, windowKey, int64(amount))
+	pipe.Expire(ctx, windowKey, c.window*3)
+	if _, err := pipe.Exec(ctx); err != nil {
+		c.fallBack(fmt.Errorf("increment window: %w", err))
+		return c.fallback.IncrementBy(key, currentWindow, amount)
+	}
+	return nil
+}
+
+func (c *redisCounter) Get(key string, currentWindow, previousWindow time.Time) (int, int, error) {
+	if c.fallenBack.Load() {
+		return c.fallback.Get(key, currentWindow, previousWindow)
+	}
+
+	values, err := c.client.MGet(context.Background(), c.windowKey(key, currentWindow), c.windowKey(key, previousWindow)).Result()
+	if err == nil && len(values) != 2 {
+		err = fmt.Errorf("unexpected result %v", values)
+	}
+	if err != nil {
+		c.fallBack(fmt.Errorf("get windows: %w", err))
+		return c.fallback.Get(key, currentWindow, previousWindow)
+	}
+
+	// the values are strings even if set by INCRBY, the missing ones are nil
+	var counts [2]int
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			counts[i], _ = strconv.Atoi(s)
+		}
+	}
+	return counts[0], counts[1], nil
+}
+
+func (c *redisCounter) windowKey(key string, window time.Time) string {
+	return c.prefix + "{" + key + "}:" + strconv.FormatInt(window.Unix(), 10)
+}
+
+// fallBack switches to the local counter until redis answers again.
+func (c *redisCounter) fallBack(err error) {
+	if c.logger != nil {
+		c.logger.Error("redis counter error", slog.Any("error", err))
+	}
+	if c.fallenBack.Swap(true) {
+		return
+	}
+	if c.logger != nil {
+		c.logger.Warn("redis counter fallback", slog.Bool("fallback", true))
+	}
+	go func() {
+		for {
+			time.Sleep(200 * time.Millisecond)
+			if err := c.client.Ping(context.Background()).Err(); err == nil {
+				c.fallenBack.Store(false)
+				if c.logger != nil {
+					c.logger.Warn("redis counter fallback", slog.Bool("fallback", false))
+				}
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,92 @@
+package quotacontrol_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/quotacontrol"
+	"github.com/0xsequence/quotacontrol/middleware"
+	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisTokenBucket(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cfg := quotacontrol.RedisConfig{
+		Enabled: true,
+		Host:    mr.Host(),
+		Port:    uint16(mr.Server().Addr().Port),
+	}
+
+	// two counters sharing the same redis, like two instances of a service
+	counters := []middleware.TokenBucketCounter{
+		quotacontrol.NewLimitCounter(proto.Service_API, cfg, slog.Default()).(middleware.TokenBucketCounter),
+		quotacontrol.NewLimitCounter(proto.Service_API, cfg, slog.Default()).(middleware.TokenBucketCounter),
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		remaining, ok, err := counters[i%2].TakeTokens(ctx, "key", 60, 10, time.Hour, 1)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.InDelta(t, 10-i-1, remaining, 0.1)
+	}
+	_, ok, err := counters[0].TakeTokens(ctx, "key", 60, 10, time.Hour, 1)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// the bucket expires when it's full again
+	ttl := mr.TTL("rl:API:bucket:key")
+	assert.InDelta(t, 10*time.Minute, ttl, float64(5*time.Second))
+
+	// other services have their own buckets
+	other := quotacontrol.NewLimitCounter(proto.Service_Indexer, cfg, slog.Default()).(middleware.TokenBucketCounter)
+	_, ok, err = other.TakeTokens(ctx, "key", 60, 10, time.Hour, 10)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestRedisWindowCounter(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireUserAuth("quota", "secret")
+	cfg := quotacontrol.RedisConfig{
+		Enabled:  true,
+		Addrs:    []string{mr.Addr()},
+		Username: "quota",
+		Password: "secret",
+	}
+
+	counter := quotacontrol.NewLimitCounter(proto.Service_API, cfg, slog.Default())
+	counter.Config(10, time.Minute)
+
+	now := time.Now().Truncate(time.Minute)
+	prev := now.Add(-time.Minute)
+	require.NoError(t, counter.IncrementBy("key", prev, 2))
+	require.NoError(t, counter.IncrementBy("key", now, 3))
+	require.NoError(t, counter.Increment("key", now))
+
+	curr, last, err := counter.Get("key", now, prev)
+	require.NoError(t, err)
+	assert.Equal(t, 4, curr)
+	assert.Equal(t, 2, last)
+
+	// the windows of a key share the hash tag, so they are in the same cluster slot
+	assert.ElementsMatch(t, []string{
+		fmt.Sprintf("rl:API:{key}:%d", prev.Unix()),
+		fmt.Sprintf("rl:API:{key}:%d", now.Unix()),
+	}, mr.Keys())
+
+	// cluster and sentinel can't be used together
+	cfg.Cluster, cfg.MasterName = true, "master"
+	_, err = quotacontrol.NewRedisClient(cfg)
+	require.Error(t, err)
+	require.Error(t, cfg.Validate())
+	assert.Nil(t, quotacontrol.NewLimitCounter(proto.Service_API, cfg, slog.Default()))
+	require.Error(t, quotacontrol.Config{Redis: cfg}.Validate())
+	assert.NotNil(t, quotacontrol.NewClient(slog.Default(), proto.Service_API, quotacontrol.Config{Redis: cfg}, nil))
+}
@@ -0,0 +1,100 @@
+package quotacontrol
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// NewRedisClient returns a client for the redis of the configuration: a single node, a cluster or a sentinel failover.
+func NewRedisClient(cfg RedisConfig) (redis.UniversalClient, error) {
+	opts, err := cfg.options()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.newClient(opts), nil
+}
+
+// Validate checks the configuration, e.g. that cluster and sentinel are not both set and that the TLS files can be read.
+// The constructors log it and run degraded when it's invalid, call it at startup to fail instead.
+func (cfg RedisConfig) Validate() error {
+	_, err := cfg.options()
+	return err
+}
+
+// addrs returns the addresses of the nodes, or the sentinels.
+func (cfg RedisConfig) addrs() []string {
+	if len(cfg.Addrs) > 0 {
+		return cfg.Addrs
+	}
+	return []string{fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)}
+}
+
+// options returns the connection options, the pool and the timeouts are left to the caller.
+func (cfg RedisConfig) options() (*redis.UniversalOptions, error) {
+	if cfg.Cluster && cfg.MasterName != "" {
+		return nil, errors.New("redis: cluster and sentinel are exclusive")
+	}
+
+	opts := redis.UniversalOptions{
+		Addrs:            cfg.addrs(),
+		DB:               cfg.DBIndex,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		MasterName:       cfg.MasterName,
+		SentinelUsername: cfg.SentinelUsername,
+		SentinelPassword: cfg.SentinelPassword,
+		MaxIdleConns:     cfg.MaxIdle,
+		PoolSize:         cfg.MaxActive,
+	}
+	if cfg.TLS.Enabled {
+		tlsConfig, err := cfg.TLS.config()
+		if err != nil {
+			return nil, fmt.Errorf("redis tls: %w", err)
+		}
+		opts.TLSConfig = tlsConfig
+	}
+	return &opts, nil
+}
+
+// newClient returns the client of the connection mode.
+func (cfg RedisConfig) newClient(opts *redis.UniversalOptions) redis.UniversalClient {
+	switch {
+	case cfg.Cluster:
+		return redis.NewClusterClient(opts.Cluster())
+	case cfg.MasterName != "":
+		return redis.NewFailoverClient(opts.Failover())
+	}
+	return redis.NewClient(opts.Simple())
+}
+
+func (cfg RedisTLSConfig) config() (*tls.Config, error) {
+	c := tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		raw, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cmp.Or(cfg.KeyFile, cfg.CertFile))
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return &c, nil
+}
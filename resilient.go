@@ -0,0 +1,258 @@
+package quotacontrol
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/0xsequence/quotacontrol/metrics"
+	"github.com/0xsequence/quotacontrol/proto"
+)
+
+const (
+	defaultCallTimeout     = 5 * time.Second
+	defaultRetries         = 2
+	defaultRetryBackoff    = 50 * time.Millisecond
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 10 * time.Second
+)
+
+// ResilienceConfig configures the timeouts, retries and circuit breaker of the calls to the quota server.
+type ResilienceConfig struct {
+	// Timeout is the timeout of each call, 5 seconds by default.
+	Timeout time.Duration `toml:"timeout"`
+	// Retries is the number of retries of the reads, 2 by default and negative to disable them.
+	Retries int `toml:"retries"`
+	// RetryBackoff is the wait before the first retry, it doubles on each retry and it's jittered.
+	RetryBackoff time.Duration `toml:"retry_backoff"`
+	// BreakerFailures is the number of consecutive failures that open the breaker, 5 by default and negative to disable it.
+	BreakerFailures int `toml:"breaker_failures"`
+	// BreakerCooldown is how long the breaker stays open before a call is let through to probe the server.
+	BreakerCooldown time.Duration `toml:"breaker_cooldown"`
+}
+
+// BreakerState is the state of the circuit breaker.
+type BreakerState uint8
+
+const (
+	// BreakerClosed lets all the calls through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects all the calls with ErrQuotaUnavailable.
+	BreakerOpen
+	// BreakerHalfOpen lets a single call through, its result closes or opens the breaker.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+var errBreakerOpen = proto.ErrQuotaUnavailable.WithCausef("circuit breaker open")
+
+// NewResilientClient wraps the client with timeouts, retries and a circuit breaker.
+// Only the methods used by Client are wrapped, the others are called as they are.
+func NewResilientClient(client proto.QuotaControlClient, cfg ResilienceConfig) *ResilientClient {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultCallTimeout
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = defaultRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = defaultRetryBackoff
+	}
+	if cfg.BreakerFailures == 0 {
+		cfg.BreakerFailures = defaultBreakerFailures
+	}
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = defaultBreakerCooldown
+	}
+	return &ResilientClient{
+		QuotaControlClient: client,
+		cfg:                cfg,
+		metrics:            metrics.Noop{},
+	}
+}
+
+// ResilientClient is a proto.QuotaControlClient that retries the idempotent reads and stops calling the server when it keeps failing.
+type ResilientClient struct {
+	proto.QuotaControlClient
+	cfg     ResilienceConfig
+	metrics metrics.Collector
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+var _ proto.QuotaControlClient = (*ResilientClient)(nil)
+
+// State returns the state of the circuit breaker.
+func (c *ResilientClient) State() BreakerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == BreakerOpen && time.Since(c.openedAt) >= c.cfg.BreakerCooldown {
+		return BreakerHalfOpen
+	}
+	return c.state
+}
+
+func (c *ResilientClient) GetProjectQuota(ctx context.Context, projectID uint64, now time.Time) (*proto.AccessQuota, error) {
+	return call(ctx, c, true, func(ctx context.Context) (*proto.AccessQuota, error) {
+		return c.QuotaControlClient.GetProjectQuota(ctx, projectID, now)
+	})
+}
+
+func (c *ResilientClient) GetAccessQuota(ctx context.Context, accessKey string, now time.Time) (*proto.AccessQuota, error) {
+	return call(ctx, c, true, func(ctx context.Context) (*proto.AccessQuota, error) {
+		return c.QuotaControlClient.GetAccessQuota(ctx, accessKey, now)
+	})
+}
+
+func (c *ResilientClient) GetUsage(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, from, to *time.Time) (int64, error) {
+	return call(ctx, c, true, func(ctx context.Context) (int64, error) {
+		return c.QuotaControlClient.GetUsage(ctx, projectID, accessKey, service, from, to)
+	})
+}
+
+func (c *ResilientClient) GetUserPermission(ctx context.Context, projectID uint64, userID string) (proto.UserPermission, *proto.ResourceAccess, error) {
+	res, err := call(ctx, c, true, func(ctx context.Context) (permissionResult, error) {
+		perm, access, err := c.QuotaControlClient.GetUserPermission(ctx, projectID, userID)
+		return permissionResult{perm: perm, access: access}, err
+	})
+	return res.perm, res.access, err
+}
+
+func (c *ResilientClient) NotifyEvent(ctx context.Context, projectID uint64, service proto.Service, eventType proto.EventType) (bool, error) {
+	return call(ctx, c, false, func(ctx context.Context) (bool, error) {
+		return c.QuotaControlClient.NotifyEvent(ctx, projectID, service, eventType)
+	})
+}
+
+func (c *ResilientClient) SyncProjectUsage(ctx context.Context, service proto.Service, now time.Time, usage map[uint64]int64, batchID *string, breakdown map[uint64]*proto.UsageBreakdown) (map[uint64]bool, error) {
+	return call(ctx, c, false, func(ctx context.Context) (map[uint64]bool, error) {
+		return c.QuotaControlClient.SyncProjectUsage(ctx, service, now, usage, batchID, breakdown)
+	})
+}
+
+func (c *ResilientClient) SyncAccessKeyUsage(ctx context.Context, service proto.Service, now time.Time, usage map[string]int64, batchID *string, breakdown map[string]*proto.UsageBreakdown) (map[string]bool, error) {
+	return call(ctx, c, false, func(ctx context.Context) (map[string]bool, error) {
+		return c.QuotaControlClient.SyncAccessKeyUsage(ctx, service, now, usage, batchID, breakdown)
+	})
+}
+
+// call runs fn with the timeout, through the breaker. If retry is set the failures are retried with a jittered exponential backoff.
+func call[T any](ctx context.Context, c *ResilientClient, retry bool, fn func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
+	backoff := c.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if !c.allow() {
+			return zero, errBreakerOpen
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+		v, err := fn(callCtx)
+		cancel()
+
+		if ctx.Err() != nil {
+			// the caller giving up is not a result of the server
+			c.release()
+			return v, err
+		}
+		failed := isServerFailure(err)
+		c.done(failed)
+		if !failed || !retry || attempt >= c.cfg.Retries {
+			return v, err
+		}
+
+		// wait between half and all of the backoff
+		wait := backoff/2 + rand.N(backoff/2+1)
+		backoff *= 2
+		select {
+		case <-ctx.Done():
+			return v, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// isServerFailure tells if the error is caused by the server being unavailable, and not by the request.
+func isServerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var rpcErr proto.WebRPCError
+	if !errors.As(err, &rpcErr) {
+		return true
+	}
+	return rpcErr.Code == proto.ErrWebrpcRequestFailed.Code || rpcErr.HTTPStatus >= 500
+}
+
+// allow tells if the call can be done, in half open state only one call is let through.
+func (c *ResilientClient) allow() bool {
+	if c.cfg.BreakerFailures < 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case BreakerOpen:
+		if time.Since(c.openedAt) < c.cfg.BreakerCooldown {
+			return false
+		}
+		c.setState(BreakerHalfOpen)
+		c.probing = true
+		return true
+	case BreakerHalfOpen:
+		if c.probing {
+			return false
+		}
+		c.probing = true
+	}
+	return true
+}
+
+// release lets another call probe the server, without recording a result.
+func (c *ResilientClient) release() {
+	c.mu.Lock()
+	c.probing = false
+	c.mu.Unlock()
+}
+
+// done records the result of a call.
+func (c *ResilientClient) done(failed bool) {
+	if c.cfg.BreakerFailures < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probing = false
+	if !failed {
+		c.setState(BreakerClosed)
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.state == BreakerHalfOpen || c.failures >= c.cfg.BreakerFailures {
+		c.setState(BreakerOpen)
+		c.openedAt = time.Now()
+	}
+}
+
+// setState changes the state of the breaker and records it, the lock must be held.
+func (c *ResilientClient) setState(state BreakerState) {
+	if c.state != state {
+		c.metrics.BreakerState(state.String())
+	}
+	c.state = state
+}
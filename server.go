@@ -5,12 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"time"
 
 	"github.com/0xsequence/authcontrol"
 	"github.com/0xsequence/quotacontrol/middleware"
 	"github.com/0xsequence/quotacontrol/proto"
-	"github.com/go-chi/httprate"
 	"github.com/goware/validation"
 )
 
@@ -27,12 +27,45 @@ type AccessKeyStore interface {
 	FindAccessKey(ctx context.Context, accessKey string) (*proto.AccessKey, error)
 	InsertAccessKey(ctx context.Context, accessKey *proto.AccessKey) error
 	UpdateAccessKey(ctx context.Context, accessKey *proto.AccessKey) (*proto.AccessKey, error)
+	// ListExpiredAccessKeys returns the active access keys of all the projects that are past their grace period at now.
+	ListExpiredAccessKeys(ctx context.Context, now time.Time) ([]*proto.AccessKey, error)
 }
 
+// UsageStore keeps the usage split by bucket, GetAccessKeyUsage and GetAccountUsage return the allowed usage.
 type UsageStore interface {
 	GetAccessKeyUsage(ctx context.Context, projectID uint64, accessKey string, service *proto.Service, min, max time.Time) (int64, error)
 	GetAccountUsage(ctx context.Context, projectID uint64, service *proto.Service, min, max time.Time) (int64, error)
-	InsertAccessUsage(ctx context.Context, projectID uint64, accessKey string, service proto.Service, time time.Time, usage int64) error
+	// GetUsageBreakdown returns the usage by bucket of the project, or of the access key if set. An empty key is the async usage.
+	GetUsageBreakdown(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, min, max time.Time) (proto.UsageBreakdown, error)
+	InsertAccessUsage(ctx context.Context, projectID uint64, accessKey string, service proto.Service, time time.Time, usage proto.UsageBreakdown) error
+	// InsertBatchUsage inserts the usage and records the batch ID in one operation.
+	// It returns false, without inserting, if the batch ID has been already processed.
+	InsertBatchUsage(ctx context.Context, batchID string, projectID uint64, accessKey string, service proto.Service, time time.Time, usage proto.UsageBreakdown) (bool, error)
+	// GetUsageHistory returns the usage by time bucket, sorted by time, service and access key.
+	// Service and access key of the points are set only if grouped by them.
+	GetUsageHistory(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, min, max time.Time, granularity proto.UsageGranularity, groupBy []proto.UsageGroupBy) ([]*proto.UsagePoint, error)
+}
+
+// CreditStore keeps the prepaid credits of the projects and their spending.
+type CreditStore interface {
+	// InsertCreditGrant inserts the grant and sets its ID.
+	InsertCreditGrant(ctx context.Context, grant *proto.CreditGrant) error
+	ListCreditGrants(ctx context.Context, projectID uint64, service *proto.Service) ([]*proto.CreditGrant, error)
+	// RevokeCreditGrant sets the revocation time of the grant, it returns false if the grant is not found.
+	RevokeCreditGrant(ctx context.Context, projectID, grantID uint64, now time.Time) (bool, error)
+	// InsertUsageWithCredits inserts the usage, once per batch if batchID is not empty, and records the credits spent from each grant, in one operation.
+	// It returns false, without inserting, if the batch ID has been already processed,
+	// and ErrCreditsExhausted, without inserting, if a grant of the project doesn't have enough credits left.
+	InsertUsageWithCredits(ctx context.Context, batchID string, projectID uint64, accessKey string, service proto.Service, time time.Time, usage proto.UsageBreakdown, spends []CreditSpend) (bool, error)
+	GetCreditUsage(ctx context.Context, projectID uint64, service *proto.Service, min, max time.Time) (int64, error)
+}
+
+// AuditStore keeps the changes made by the server to the projects and their access keys.
+type AuditStore interface {
+	// InsertAuditEvent inserts the event and sets its ID.
+	InsertAuditEvent(ctx context.Context, event *proto.AuditEvent) error
+	// ListAuditEvents returns the events of the project created in the interval, oldest first.
+	ListAuditEvents(ctx context.Context, projectID uint64, min, max time.Time) ([]*proto.AuditEvent, error)
 }
 
 // PermissionStore is the interface that wraps the GetUserPermission method.
@@ -46,27 +79,83 @@ type Cache struct {
 	PermissionCache
 }
 
+// eventCache returns the first of the caches that keeps track of the events, nil if none does.
+func (c Cache) eventCache() EventCache {
+	for _, v := range []any{c.UsageCache, c.QuotaCache, c.PermissionCache} {
+		if cache, ok := v.(EventCache); ok {
+			return cache
+		}
+	}
+	return nil
+}
+
 type Store struct {
 	ProjectInfoStore
 	LimitStore
 	AccessKeyStore
 	UsageStore
 	PermissionStore
+	// CreditStore is optional, without it projects have no credits.
+	CreditStore
+	// AuditStore is optional, without it the changes are not recorded.
+	AuditStore
+}
+
+// ServerOption configures optional features of the server.
+type ServerOption func(*server)
+
+// WithDispatcher sets the dispatcher used by NotifyEvent.
+// By default events are logged once per cycle, using the server cache (e.g. RedisCache) to de-duplicate them.
+func WithDispatcher(d *Dispatcher) ServerOption {
+	return func(s *server) {
+		s.dispatcher = d
+	}
+}
+
+// WithInvalidator sets the invalidator used to evict the in-memory caches of the clients when keys or limits change.
+func WithInvalidator(inv Invalidator) ServerOption {
+	return func(s *server) {
+		s.invalidator = inv
+	}
+}
+
+// WithKeyExpiry disables the rotated access keys past their grace period every interval, until ctx is done.
+// Without it they're disabled only when their quota is fetched or the keys of their project are listed.
+func WithKeyExpiry(ctx context.Context, interval time.Duration) ServerOption {
+	return func(s *server) {
+		s.expiry.ctx, s.expiry.interval = ctx, interval
+	}
 }
 
 // NewServer returns server implementation for proto.QuotaControl.
-func NewServer(redis RedisConfig, log *slog.Logger, cache Cache, store Store) proto.QuotaControlServer {
+// An invalid redis configuration leaves the rate limit counters in memory, see RedisConfig.Validate.
+func NewServer(redis RedisConfig, log *slog.Logger, cache Cache, store Store, opts ...ServerOption) proto.QuotaControlServer {
 	if log == nil {
 		log = slog.Default()
 	}
 
-	return &server{
+	s := &server{
 		log:        log.With(slog.String("qc-version", proto.WebRPCSchemaVersion())),
 		cache:      cache,
 		store:      store,
 		keyVersion: authcontrol.DefaultEncoding.Version(),
 		redis:      redis,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.dispatcher == nil {
+		s.dispatcher = NewDispatcher(s.log, cache.eventCache(), NewLogNotifier(s.log))
+	}
+	s.rateLimiters = make(map[proto.Service]*middleware.RateLimiter, len(proto.Service_name))
+	for i := range proto.Service_name {
+		svc := proto.Service(i)
+		s.rateLimiters[svc] = middleware.NewRateLimiter(NewLimitCounter(svc, s.redis, s.log))
+	}
+	if s.expiry.interval > 0 {
+		go s.runKeyExpiry(s.expiry.ctx, s.expiry.interval)
+	}
+	return s
 }
 
 // server is the quotacontrol server backend implementation.
@@ -76,6 +165,16 @@ type server struct {
 	store      Store
 	keyVersion byte
 	redis      RedisConfig
+	dispatcher *Dispatcher
+	// invalidator is optional, it broadcasts the stale quotas to the clients.
+	invalidator Invalidator
+	// rateLimiters reads the rate limit counters of each service.
+	rateLimiters map[proto.Service]*middleware.RateLimiter
+	// expiry is the sweep of the expired access keys, it runs only if interval is set.
+	expiry struct {
+		ctx      context.Context
+		interval time.Duration
+	}
 }
 
 var _ proto.QuotaControlServer = &server{}
@@ -84,36 +183,45 @@ func (s server) Ping(ctx context.Context) (string, error) {
 	return proto.WebRPCSchemaVersion(), nil
 }
 
-// Deprecated: use GetUsage instead.
+// Deprecated: use GetUsage or GetUsageBreakdown instead.
 func (s server) GetAccountUsage(ctx context.Context, projectID uint64, service *proto.Service, from, to *time.Time) (*proto.AccessUsage, error) {
-	usage, err := s.GetUsage(ctx, projectID, nil, service, from, to)
+	usage, err := s.GetUsageBreakdown(ctx, projectID, nil, service, from, to)
 	if err != nil {
 		return nil, fmt.Errorf("get account usage: %w", err)
 	}
-	return &proto.AccessUsage{ValidCompute: usage}, nil
+	return accessUsage(usage), nil
 }
 
-// Deprecated: use GetUsage instead.
+// Deprecated: use GetUsage or GetUsageBreakdown instead.
 func (s server) GetAsyncUsage(ctx context.Context, projectID uint64, service *proto.Service, from, to *time.Time) (*proto.AccessUsage, error) {
-	usage, err := s.GetUsage(ctx, projectID, proto.Ptr(""), service, from, to)
+	usage, err := s.GetUsageBreakdown(ctx, projectID, proto.Ptr(""), service, from, to)
 	if err != nil {
 		return nil, fmt.Errorf("get usage: %w", err)
 	}
-	return &proto.AccessUsage{ValidCompute: usage}, nil
+	return accessUsage(usage), nil
 }
 
-// Deprecated: use GetUsage instead.
+// Deprecated: use GetUsage or GetUsageBreakdown instead.
 func (s server) GetAccessKeyUsage(ctx context.Context, accessKey string, service *proto.Service, from, to *time.Time) (*proto.AccessUsage, error) {
 	projectID, err := authcontrol.GetProjectIDFromAccessKey(accessKey)
 	if err != nil {
 		return nil, fmt.Errorf("get project id: %w", err)
 	}
 
-	usage, err := s.GetUsage(ctx, projectID, &accessKey, service, from, to)
+	usage, err := s.GetUsageBreakdown(ctx, projectID, &accessKey, service, from, to)
 	if err != nil {
 		return nil, fmt.Errorf("get usage: %w", err)
 	}
-	return &proto.AccessUsage{ValidCompute: usage}, nil
+	return accessUsage(usage), nil
+}
+
+// accessUsage converts the breakdown to the deprecated AccessUsage, the credits are part of the valid compute.
+func accessUsage(usage *proto.UsageBreakdown) *proto.AccessUsage {
+	return &proto.AccessUsage{
+		ValidCompute:   usage.Total(),
+		OverCompute:    usage.Overage,
+		LimitedCompute: usage.Limited,
+	}
 }
 
 func (s server) GetUsage(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, from *time.Time, to *time.Time) (int64, error) {
@@ -152,6 +260,75 @@ func (s server) GetUsage(ctx context.Context, projectID uint64, accessKey *strin
 	}
 }
 
+// GetUsageBreakdown returns the usage by bucket, including the limited usage that was rejected.
+// The interval defaults to the current cycle.
+func (s server) GetUsageBreakdown(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, from *time.Time, to *time.Time) (*proto.UsageBreakdown, error) {
+	start, end, err := s.getInterval(ctx, projectID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := s.store.UsageStore.GetUsageBreakdown(ctx, projectID, accessKey, service, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("get usage breakdown: %w", err)
+	}
+	return &usage, nil
+}
+
+// maxUsageHistoryBuckets is the maximum number of time buckets of GetUsageHistory, a month of hours.
+const maxUsageHistoryBuckets = 31 * 24
+
+// GetUsageHistory returns the usage by time bucket, optionally grouped by service and access key.
+// The interval defaults to the current cycle.
+func (s server) GetUsageHistory(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, from *time.Time, to *time.Time, granularity proto.UsageGranularity, groupBy []proto.UsageGroupBy) ([]*proto.UsagePoint, error) {
+	if _, ok := proto.UsageGranularity_name[uint16(granularity)]; !ok {
+		return nil, proto.ErrWebrpcBadRequest.WithCausef("invalid granularity %d", granularity)
+	}
+	for _, g := range groupBy {
+		if _, ok := proto.UsageGroupBy_name[uint16(g)]; !ok {
+			return nil, proto.ErrWebrpcBadRequest.WithCausef("invalid group by %d", g)
+		}
+	}
+
+	start, end, err := s.getInterval(ctx, projectID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if end.Before(start) {
+		return nil, proto.ErrWebrpcBadRequest.WithCausef("from must be before to")
+	}
+	if end.Sub(start)/granularity.Duration() > maxUsageHistoryBuckets {
+		return nil, proto.ErrWebrpcBadRequest.WithCausef("interval too long for %s granularity", granularity)
+	}
+
+	history, err := s.store.UsageStore.GetUsageHistory(ctx, projectID, accessKey, service, start, end, granularity, groupBy)
+	if err != nil {
+		return nil, fmt.Errorf("get usage history: %w", err)
+	}
+	return history, nil
+}
+
+// getInterval returns the interval from-to, the missing ends default to the ones of the current cycle of the project.
+func (s server) getInterval(ctx context.Context, projectID uint64, from, to *time.Time) (time.Time, time.Time, error) {
+	now := middleware.GetTime(ctx)
+	info, err := s.store.ProjectInfoStore.GetProjectInfo(ctx, projectID, now)
+	if err != nil {
+		if errors.Is(err, proto.ErrProjectNotFound) {
+			return time.Time{}, time.Time{}, err
+		}
+		return time.Time{}, time.Time{}, fmt.Errorf("get project info: %w", err)
+	}
+
+	start, end := info.Cycle.GetStart(now), info.Cycle.GetEnd(now)
+	if from != nil {
+		start = *from
+	}
+	if to != nil {
+		end = *to
+	}
+	return start, end, nil
+}
+
 // Deprecated: new version of client sets the usage cache directly. This is going to be removed in the future.
 func (s server) PrepareUsage(ctx context.Context, projectID uint64, service *proto.Service, cycle *proto.Cycle, now time.Time) (bool, error) {
 	min, max := cycle.GetStart(now), cycle.GetEnd(now)
@@ -161,7 +338,7 @@ func (s server) PrepareUsage(ctx context.Context, projectID uint64, service *pro
 	}
 
 	key := cacheKeyQuota(projectID, cycle, service, now)
-	if err := s.cache.UsageCache.SetUsage(ctx, key, usage); err != nil {
+	if err := s.cache.UsageCache.SetUsage(ctx, key, usage, usageTTL(cycle, now)); err != nil {
 		return false, fmt.Errorf("set usage cache: %w", err)
 	}
 	return true, nil
@@ -182,19 +359,48 @@ func (s server) ClearUsage(ctx context.Context, projectID uint64, service *proto
 		if err != nil {
 			return false, fmt.Errorf("clear usage cache: %w", err)
 		}
+		if err := s.clearKeyUsage(ctx, projectID, info.Cycle, []proto.Service{*service}, now); err != nil {
+			return false, err
+		}
+		s.auditEvent(ctx, proto.AuditEvent{ProjectID: projectID, RPC: "ClearUsage", Service: service})
 		return ok, nil
 	}
 
+	services := make([]proto.Service, 0, len(proto.Service_name))
 	for i := range proto.Service_name {
 		svc := proto.Service(i)
 		key := cacheKeyQuota(projectID, info.Cycle, &svc, now)
 		if _, err := s.cache.UsageCache.ClearUsage(ctx, key); err != nil {
 			return false, fmt.Errorf("clear usage cache for service %s: %w", svc.String(), err)
 		}
+		services = append(services, svc)
+	}
+	if err := s.clearKeyUsage(ctx, projectID, info.Cycle, services, now); err != nil {
+		return false, err
 	}
+	s.auditEvent(ctx, proto.AuditEvent{ProjectID: projectID, RPC: "ClearUsage"})
 	return true, nil
 }
 
+// clearKeyUsage clears the usage of the services counted for the access keys of the project with a usage limit.
+func (s server) clearKeyUsage(ctx context.Context, projectID uint64, cycle *proto.Cycle, services []proto.Service, now time.Time) error {
+	keys, err := s.store.AccessKeyStore.ListAccessKeys(ctx, projectID, proto.Ptr(true), nil)
+	if err != nil {
+		return fmt.Errorf("list access keys: %w", err)
+	}
+	for _, k := range keys {
+		for _, svc := range services {
+			if cfg, ok := k.GetSettings(svc); !ok || cfg.OverMax <= 0 {
+				continue
+			}
+			if _, err := s.cache.UsageCache.ClearUsage(ctx, cacheKeyAccessKey(k.AccessKey, cycle, &svc, now)); err != nil {
+				return fmt.Errorf("clear usage cache for access key %s: %w", k.AccessKey, err)
+			}
+		}
+	}
+	return nil
+}
+
 func (s server) GetProjectQuota(ctx context.Context, projectID uint64, now time.Time) (*proto.AccessQuota, error) {
 	info, err := s.store.ProjectInfoStore.GetProjectInfo(ctx, projectID, now)
 	if err != nil {
@@ -209,16 +415,25 @@ func (s server) GetProjectQuota(ctx context.Context, projectID uint64, now time.
 		return nil, fmt.Errorf("get access limit: %w", err)
 	}
 
+	credits, err := s.getCredits(ctx, projectID, info.Cycle, now)
+	if err != nil {
+		return nil, fmt.Errorf("get credits: %w", err)
+	}
+
 	record := proto.AccessQuota{
 		Info:      info,
 		Limit:     limit,
 		Cycle:     info.Cycle,
 		AccessKey: &proto.AccessKey{ProjectID: projectID},
+		Credits:   credits,
 	}
 
 	// deprecated: cache is set by the client side now
-	if err := s.cache.QuotaCache.SetProjectQuota(ctx, &record); err != nil {
-		s.log.Error("set access quota in cache", slog.Any("error", err))
+	// the quota of a cycle that hasn't started, like the next one prewarmed by the clients, must not replace the current one
+	if !time.Now().Before(info.Cycle.GetStart(now)) {
+		if err := s.cache.QuotaCache.SetProjectQuota(ctx, &record); err != nil {
+			s.log.Error("set access quota in cache", slog.Any("error", err))
+		}
 	}
 
 	return &record, nil
@@ -232,6 +447,11 @@ func (s server) GetAccessQuota(ctx context.Context, accessKey string, now time.T
 		}
 		return nil, fmt.Errorf("find access key: %w", err)
 	}
+	if access.Active && access.IsExpired(time.Now()) {
+		if access, err = s.expireAccessKey(ctx, access); err != nil {
+			return nil, fmt.Errorf("expire access key: %w", err)
+		}
+	}
 	info, err := s.store.ProjectInfoStore.GetProjectInfo(ctx, access.ProjectID, now)
 	if err != nil {
 		if errors.Is(err, proto.ErrProjectNotFound) {
@@ -244,11 +464,17 @@ func (s server) GetAccessQuota(ctx context.Context, accessKey string, now time.T
 		return nil, fmt.Errorf("get access limit: %w", err)
 	}
 
+	credits, err := s.getCredits(ctx, access.ProjectID, info.Cycle, now)
+	if err != nil {
+		return nil, fmt.Errorf("get credits: %w", err)
+	}
+
 	record := proto.AccessQuota{
 		Info:      info,
 		Limit:     limit,
 		Cycle:     info.Cycle,
 		AccessKey: access,
+		Credits:   credits,
 	}
 
 	if err := s.cache.QuotaCache.SetAccessQuota(ctx, &record); err != nil {
@@ -258,16 +484,33 @@ func (s server) GetAccessQuota(ctx context.Context, accessKey string, now time.T
 	return &record, nil
 }
 
+// NotifyEvent dispatches the event, it returns false if it was already notified in the current cycle.
 func (s server) NotifyEvent(ctx context.Context, projectID uint64, service proto.Service, eventType proto.EventType) (bool, error) {
-	s.log.Info("notify event", slog.Uint64("projectId", projectID), slog.String("service", service.GetName()), slog.String("eventType", eventType.String()))
-	return true, nil
+	now := middleware.GetTime(ctx)
+	info, err := s.store.ProjectInfoStore.GetProjectInfo(ctx, projectID, now)
+	if err != nil {
+		return false, fmt.Errorf("get project info: %w", err)
+	}
+
+	event := Event{
+		ProjectID: projectID,
+		Service:   service,
+		Type:      eventType,
+		Cycle:     info.Cycle,
+		Time:      now,
+	}
+	ok, err := s.dispatcher.Dispatch(ctx, event)
+	if err != nil {
+		return false, fmt.Errorf("dispatch event: %w", err)
+	}
+	return ok, nil
 }
 
-func (s server) SyncProjectUsage(ctx context.Context, service proto.Service, now time.Time, usage map[uint64]int64) (map[uint64]bool, error) {
+func (s server) SyncProjectUsage(ctx context.Context, service proto.Service, now time.Time, usage map[uint64]int64, batchID *string, breakdown map[uint64]*proto.UsageBreakdown) (map[uint64]bool, error) {
 	var errs []error
 	m := make(map[uint64]bool, len(usage))
 	for projectID, usage := range usage {
-		err := s.store.UsageStore.InsertAccessUsage(ctx, projectID, "", service, now, usage)
+		err := s.insertUsage(ctx, batchID, projectID, "", service, now, usage, breakdown[projectID])
 		if err != nil {
 			errs = append(errs, fmt.Errorf("%d: %w", projectID, err))
 		}
@@ -286,10 +529,10 @@ func (s server) UpdateProjectUsage(ctx context.Context, service proto.Service, n
 		m[projectID] = u.ValidCompute
 	}
 
-	return s.SyncProjectUsage(ctx, service, now, m)
+	return s.SyncProjectUsage(ctx, service, now, m, nil, nil)
 }
 
-func (s server) SyncAccessKeyUsage(ctx context.Context, service proto.Service, now time.Time, usage map[string]int64) (map[string]bool, error) {
+func (s server) SyncAccessKeyUsage(ctx context.Context, service proto.Service, now time.Time, usage map[string]int64, batchID *string, breakdown map[string]*proto.UsageBreakdown) (map[string]bool, error) {
 	var errs []error
 	m := make(map[string]bool, len(usage))
 	for key, usage := range usage {
@@ -298,7 +541,7 @@ func (s server) SyncAccessKeyUsage(ctx context.Context, service proto.Service, n
 			errs = append(errs, fmt.Errorf("%s: %w", key, err))
 			continue
 		}
-		if err = s.store.UsageStore.InsertAccessUsage(ctx, projectID, key, service, now, usage); err != nil {
+		if err = s.insertUsage(ctx, batchID, projectID, key, service, now, usage, breakdown[key]); err != nil {
 			errs = append(errs, fmt.Errorf("%s: %w", key, err))
 		}
 		m[key] = err == nil
@@ -315,7 +558,60 @@ func (s server) UpdateKeyUsage(ctx context.Context, service proto.Service, now t
 	for accessKey, u := range usage {
 		m[accessKey] = u.ValidCompute
 	}
-	return s.SyncAccessKeyUsage(ctx, service, now, m)
+	return s.SyncAccessKeyUsage(ctx, service, now, m, nil, nil)
+}
+
+// maxCreditAttempts is the number of times the usage is attributed, when its credits are spent by a concurrent sync.
+const maxCreditAttempts = 3
+
+// insertUsage inserts the usage, once per batch if batchID is set.
+// The usage is split by bucket if the breakdown is missing, and its credits are spent from the grants of the project along with it.
+// Each project and key of the batch is recorded on its own, so a partially failed batch can be retried.
+func (s server) insertUsage(ctx context.Context, batchID *string, projectID uint64, accessKey string, service proto.Service, now time.Time, usage int64, breakdown *proto.UsageBreakdown) error {
+	for attempt := 1; ; attempt++ {
+		buckets, spends, err := s.attributeUsage(ctx, projectID, service, now, usage, breakdown)
+		if err != nil {
+			return fmt.Errorf("attribute usage: %w", err)
+		}
+
+		_, err = s.insertBatchUsage(ctx, batchID, projectID, accessKey, service, now, buckets, spends)
+		// the grants were spent after they were read, the usage is attributed again with what is left
+		if errors.Is(err, ErrCreditsExhausted) && attempt < maxCreditAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+// insertBatchUsage inserts the usage and spends its credits, it returns false if the batch was already processed.
+func (s server) insertBatchUsage(ctx context.Context, batchID *string, projectID uint64, accessKey string, service proto.Service, now time.Time, usage proto.UsageBreakdown, spends []CreditSpend) (bool, error) {
+	var id string
+	if batchID != nil {
+		id = fmt.Sprintf("%s:project:%d", *batchID, projectID)
+		if accessKey != "" {
+			id = fmt.Sprintf("%s:key:%s", *batchID, accessKey)
+		}
+	}
+
+	var (
+		ok  = true
+		err error
+	)
+	switch {
+	case len(spends) > 0:
+		ok, err = s.store.CreditStore.InsertUsageWithCredits(ctx, id, projectID, accessKey, service, now, usage, spends)
+	case id == "":
+		err = s.store.UsageStore.InsertAccessUsage(ctx, projectID, accessKey, service, now, usage)
+	default:
+		ok, err = s.store.UsageStore.InsertBatchUsage(ctx, id, projectID, accessKey, service, now, usage)
+	}
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		s.log.Info("usage batch already processed", slog.String("op", "insert_usage"), slog.String("batchId", id))
+	}
+	return ok, nil
 }
 
 func (s server) ClearAccessQuotaCache(ctx context.Context, projectID uint64) (bool, error) {
@@ -332,9 +628,20 @@ func (s server) ClearAccessQuotaCache(ctx context.Context, projectID uint64) (bo
 			s.log.Error("delete access quota from cache", slog.Any("error", err))
 		}
 	}
+	s.invalidate(ctx, Invalidation{ProjectID: projectID})
 	return true, nil
 }
 
+// invalidate publishes the invalidation to the clients, if an invalidator is set.
+func (s server) invalidate(ctx context.Context, inv Invalidation) {
+	if s.invalidator == nil {
+		return
+	}
+	if err := s.invalidator.Publish(ctx, inv); err != nil {
+		s.log.Error("publish invalidation", slog.Any("error", err))
+	}
+}
+
 func (s server) GetAccessKey(ctx context.Context, accessKey string) (*proto.AccessKey, error) {
 	return s.store.AccessKeyStore.FindAccessKey(ctx, accessKey)
 }
@@ -353,7 +660,19 @@ func (s server) GetDefaultAccessKey(ctx context.Context, projectID uint64) (*pro
 	return nil, proto.ErrNoDefaultKey
 }
 
-func (s server) CreateAccessKey(ctx context.Context, projectID uint64, displayName string, requireOrigin bool, allowedOrigins []string, allowedServices []proto.Service) (*proto.AccessKey, error) {
+func (s server) CreateAccessKey(ctx context.Context, projectID uint64, displayName string, requireOrigin bool, allowedOrigins []string, allowedServices []proto.Service, serviceLimit map[string]*proto.ServiceLimit, allowedChainIDs []uint64) (*proto.AccessKey, error) {
+	if err := s.validateKeyChains(ctx, projectID, allowedChainIDs); err != nil {
+		return nil, err
+	}
+	k, err := s.createAccessKey(ctx, projectID, displayName, requireOrigin, allowedOrigins, allowedServices, keyLimits(serviceLimit), allowedChainIDs)
+	if err != nil {
+		return nil, err
+	}
+	s.audit(ctx, "CreateAccessKey", projectID, nil, k)
+	return k, nil
+}
+
+func (s server) createAccessKey(ctx context.Context, projectID uint64, displayName string, requireOrigin bool, allowedOrigins []string, allowedServices []proto.Service, serviceLimit map[string]proto.ServiceLimit, allowedChainIDs []uint64) (*proto.AccessKey, error) {
 	list, err := s.store.AccessKeyStore.ListAccessKeys(ctx, projectID, proto.Ptr(true), nil)
 	if err != nil {
 		return nil, fmt.Errorf("list access keys: %w", err)
@@ -378,29 +697,52 @@ func (s server) CreateAccessKey(ctx context.Context, projectID uint64, displayNa
 		RequireOrigin:   requireOrigin,
 		AllowedOrigins:  origins,
 		AllowedServices: allowedServices,
+		ServiceLimit:    serviceLimit,
+		AllowedChainIDs: allowedChainIDs,
+	}
+	if err := k.ValidateLimits(); err != nil {
+		return nil, proto.ErrWebrpcBadRequest.WithCausef("validate service limit: %v", err)
 	}
 	if err := s.store.AccessKeyStore.InsertAccessKey(ctx, &k); err != nil {
 		return nil, fmt.Errorf("insert access key: %w", err)
 	}
+
+	// the key or its project may be cached as not found
+	if err := s.cache.QuotaCache.DeleteProjectQuota(ctx, projectID); err != nil {
+		s.log.Error("delete project quota from cache", slog.Any("error", err))
+	}
+	if err := s.cache.QuotaCache.DeleteAccessQuota(ctx, k.AccessKey); err != nil {
+		s.log.Error("delete access quota from cache", slog.Any("error", err))
+	}
+	s.invalidate(ctx, Invalidation{ProjectID: projectID, AccessKey: k.AccessKey})
+
 	return &k, nil
 }
 
-func (s server) RotateAccessKey(ctx context.Context, accessKey string) (*proto.AccessKey, error) {
+// RotateAccessKey replaces the access key with a new one, which becomes the default if the old one was.
+// Without a grace period the old key is disabled now, otherwise it stays valid until it expires.
+func (s server) RotateAccessKey(ctx context.Context, accessKey string, gracePeriod *uint32) (*proto.AccessKey, error) {
 	existing, err := s.store.AccessKeyStore.FindAccessKey(ctx, accessKey)
 	if err != nil {
 		return nil, fmt.Errorf("find access key: %w", err)
 	}
 
+	before := proto.Ptr(*existing)
 	isDefaultKey := existing.Default
 
-	existing.Active = false
 	existing.Default = false
+	if gracePeriod != nil && *gracePeriod > 0 {
+		existing.ExpiresAt = proto.Ptr(time.Now().UTC().Add(time.Duration(*gracePeriod) * time.Second))
+	} else {
+		existing.Active = false
+	}
 
-	if _, err := s.updateAccessKey(ctx, existing); err != nil {
+	if existing, err = s.updateAccessKey(ctx, existing); err != nil {
 		return nil, fmt.Errorf("update access key: %w", err)
 	}
+	s.audit(ctx, "RotateAccessKey", existing.ProjectID, before, existing)
 
-	newKey, err := s.CreateAccessKey(ctx, existing.ProjectID, existing.DisplayName, existing.RequireOrigin, existing.AllowedOrigins.ToStrings(), existing.AllowedServices)
+	newKey, err := s.createAccessKey(ctx, existing.ProjectID, existing.DisplayName, existing.RequireOrigin, existing.AllowedOrigins.ToStrings(), existing.AllowedServices, existing.ServiceLimit, existing.AllowedChainIDs)
 	if err != nil {
 		return nil, fmt.Errorf("create access key: %w", err)
 	}
@@ -412,15 +754,17 @@ func (s server) RotateAccessKey(ctx context.Context, accessKey string) (*proto.A
 			return nil, fmt.Errorf("update access key: %w", err)
 		}
 	}
+	s.audit(ctx, "RotateAccessKey", newKey.ProjectID, nil, newKey)
 
 	return newKey, nil
 }
 
-func (s server) UpdateAccessKey(ctx context.Context, accessKey string, displayName *string, requireOrigin *bool, allowedOrigins []string, allowedServices []proto.Service) (*proto.AccessKey, error) {
+func (s server) UpdateAccessKey(ctx context.Context, accessKey string, displayName *string, requireOrigin *bool, allowedOrigins []string, allowedServices []proto.Service, serviceLimit map[string]*proto.ServiceLimit, allowedChainIDs []uint64) (*proto.AccessKey, error) {
 	k, err := s.store.AccessKeyStore.FindAccessKey(ctx, accessKey)
 	if err != nil {
 		return nil, fmt.Errorf("find access key: %w", err)
 	}
+	before := proto.Ptr(*k)
 
 	if displayName != nil {
 		k.DisplayName = *displayName
@@ -438,21 +782,35 @@ func (s server) UpdateAccessKey(ctx context.Context, accessKey string, displayNa
 	if allowedServices != nil {
 		k.AllowedServices = allowedServices
 	}
+	if serviceLimit != nil {
+		k.ServiceLimit = keyLimits(serviceLimit)
+		if err := k.ValidateLimits(); err != nil {
+			return nil, proto.ErrWebrpcBadRequest.WithCausef("validate service limit: %v", err)
+		}
+	}
+	if allowedChainIDs != nil {
+		if err := s.validateKeyChains(ctx, k.ProjectID, allowedChainIDs); err != nil {
+			return nil, err
+		}
+		k.AllowedChainIDs = allowedChainIDs
+	}
 
 	if k, err = s.updateAccessKey(ctx, k); err != nil {
 		return nil, fmt.Errorf("update access key: %w", err)
 	}
+	s.audit(ctx, "UpdateAccessKey", k.ProjectID, before, k)
 	return k, nil
 }
 
 func (s server) SetDefaultAccessKey(ctx context.Context, projectID uint64, accessKey string) (bool, error) {
 	// make sure accessKey exists
 	k, err := s.store.AccessKeyStore.FindAccessKey(ctx, accessKey)
-	if err != nil {
+	if err != nil && !errors.Is(err, proto.ErrAccessKeyNotFound) {
 		return false, fmt.Errorf("find access key: %w", err)
 	}
 
-	if k.ProjectID != projectID {
+	// a missing key is denied like the key of another project, so the callers can't tell which keys exist
+	if err != nil || k.ProjectID != projectID {
 		return false, proto.ErrPermissionDenied.WithCausef("project doesn't own the given access key")
 	}
 
@@ -467,22 +825,46 @@ func (s server) SetDefaultAccessKey(ctx context.Context, projectID uint64, acces
 	}
 
 	// update old default access
+	before := proto.Ptr(*defaultKey)
 	defaultKey.Default = false
-	if _, err := s.updateAccessKey(ctx, defaultKey); err != nil {
+	if defaultKey, err = s.updateAccessKey(ctx, defaultKey); err != nil {
 		return false, fmt.Errorf("update old default access key: %w", err)
 	}
+	s.audit(ctx, "SetDefaultAccessKey", projectID, before, defaultKey)
 
 	// set new access key to default
+	before = proto.Ptr(*k)
 	k.Default = true
-	if _, err = s.updateAccessKey(ctx, k); err != nil {
+	if k, err = s.updateAccessKey(ctx, k); err != nil {
 		return false, fmt.Errorf("update new default access key: %w", err)
 	}
+	s.audit(ctx, "SetDefaultAccessKey", projectID, before, k)
 
 	return true, nil
 }
 
 func (s server) ListAccessKeys(ctx context.Context, projectID uint64, active *bool, service *proto.Service) ([]*proto.AccessKey, error) {
-	return s.store.AccessKeyStore.ListAccessKeys(ctx, projectID, active, service)
+	return s.listAccessKeys(ctx, projectID, active, service)
+}
+
+// listAccessKeys lists the access keys of the project, disabling first the ones past their grace period.
+func (s server) listAccessKeys(ctx context.Context, projectID uint64, active *bool, service *proto.Service) ([]*proto.AccessKey, error) {
+	list, err := s.store.AccessKeyStore.ListAccessKeys(ctx, projectID, active, service)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i, k := range list {
+		if k.Active && k.IsExpired(now) {
+			if list[i], err = s.expireAccessKey(ctx, k); err != nil {
+				return nil, fmt.Errorf("expire access key: %w", err)
+			}
+		}
+	}
+	if active != nil && *active {
+		list = slices.DeleteFunc(list, func(k *proto.AccessKey) bool { return !k.Active })
+	}
+	return list, nil
 }
 
 func (s server) DisableAccessKey(ctx context.Context, accessKey string) (bool, error) {
@@ -491,7 +873,7 @@ func (s server) DisableAccessKey(ctx context.Context, accessKey string) (bool, e
 		return false, fmt.Errorf("find access key: %w", err)
 	}
 
-	list, err := s.store.AccessKeyStore.ListAccessKeys(ctx, k.ProjectID, proto.Ptr(true), nil)
+	list, err := s.listAccessKeys(ctx, k.ProjectID, proto.Ptr(true), nil)
 	if err != nil {
 		return false, fmt.Errorf("list access keys: %w", err)
 	}
@@ -500,11 +882,13 @@ func (s server) DisableAccessKey(ctx context.Context, accessKey string) (bool, e
 		return false, proto.ErrAtLeastOneKey
 	}
 
+	before := proto.Ptr(*k)
 	k.Active = false
 	k.Default = false
-	if _, err := s.updateAccessKey(ctx, k); err != nil {
+	if k, err = s.updateAccessKey(ctx, k); err != nil {
 		return false, fmt.Errorf("update access key: %w", err)
 	}
+	s.audit(ctx, "DisableAccessKey", k.ProjectID, before, k)
 
 	// set another project accessKey to default
 	if _, err := s.GetDefaultAccessKey(ctx, k.ProjectID); err == proto.ErrNoDefaultKey {
@@ -514,16 +898,94 @@ func (s server) DisableAccessKey(ctx context.Context, accessKey string) (bool, e
 		}
 
 		newDefaultKey := listUpdated[0]
+		before := proto.Ptr(*newDefaultKey)
 		newDefaultKey.Default = true
 
-		if _, err = s.updateAccessKey(ctx, newDefaultKey); err != nil {
+		if newDefaultKey, err = s.updateAccessKey(ctx, newDefaultKey); err != nil {
 			return false, fmt.Errorf("update new default access key: %w", err)
 		}
+		s.audit(ctx, "DisableAccessKey", k.ProjectID, before, newDefaultKey)
 	}
 
 	return true, nil
 }
 
+// validateKeyChains checks that the chains of an access key are within the ones of its project, if the project has any.
+func (s server) validateKeyChains(ctx context.Context, projectID uint64, chainIDs []uint64) error {
+	if len(chainIDs) == 0 {
+		return nil
+	}
+	info, err := s.store.ProjectInfoStore.GetProjectInfo(ctx, projectID, time.Now())
+	if err != nil {
+		if errors.Is(err, proto.ErrProjectNotFound) {
+			return err
+		}
+		return fmt.Errorf("get project info: %w", err)
+	}
+	if err := info.ValidateChains(chainIDs); err != nil {
+		return proto.ErrWebrpcBadRequest.WithCausef("validate allowed chain IDs: %v", err)
+	}
+	return nil
+}
+
+// keyLimits returns the limits of an access key from the RPC arguments, an empty map removes them.
+func keyLimits(serviceLimit map[string]*proto.ServiceLimit) map[string]proto.ServiceLimit {
+	if serviceLimit == nil {
+		return nil
+	}
+	limits := make(map[string]proto.ServiceLimit, len(serviceLimit))
+	for name, limit := range serviceLimit {
+		if limit != nil {
+			limits[name] = *limit
+		}
+	}
+	return limits
+}
+
+// runKeyExpiry disables the access keys past their grace period every interval, until ctx is done.
+func (s server) runKeyExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.expireAccessKeys(ctx, time.Now()); err != nil {
+			s.log.Error("expire access keys", slog.Any("error", err))
+		}
+	}
+}
+
+// expireAccessKeys disables the active access keys of all the projects that are past their grace period at now.
+func (s server) expireAccessKeys(ctx context.Context, now time.Time) error {
+	list, err := s.store.AccessKeyStore.ListExpiredAccessKeys(ctx, now)
+	if err != nil {
+		return fmt.Errorf("list expired access keys: %w", err)
+	}
+	for _, k := range list {
+		if _, err := s.expireAccessKey(ctx, k); err != nil {
+			return fmt.Errorf("expire access key: %w", err)
+		}
+	}
+	return nil
+}
+
+// expireAccessKey disables the access key at the end of its grace period.
+// The clients fetch the quota of an expired key again, so its cached quota is replaced.
+// The change is audited under RotateAccessKey, which set the grace period.
+func (s server) expireAccessKey(ctx context.Context, k *proto.AccessKey) (*proto.AccessKey, error) {
+	before := proto.Ptr(*k)
+	k.Active = false
+	k, err := s.updateAccessKey(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	s.audit(ctx, "RotateAccessKey", k.ProjectID, before, k)
+	return k, nil
+}
+
 func (s server) GetUserPermission(ctx context.Context, projectID uint64, userID string) (proto.UserPermission, *proto.ResourceAccess, error) {
 	perm, access, err := s.store.PermissionStore.GetUserPermission(ctx, projectID, userID)
 	if err != nil {
@@ -549,6 +1011,7 @@ func (s server) updateAccessKey(ctx context.Context, k *proto.AccessKey) (*proto
 	if err := s.cache.QuotaCache.DeleteAccessQuota(ctx, k.AccessKey); err != nil {
 		s.log.Error("delete access quota from cache", slog.Any("error", err))
 	}
+	s.invalidate(ctx, Invalidation{AccessKey: k.AccessKey})
 
 	return k, nil
 }
@@ -575,6 +1038,7 @@ func (s server) GetProjectStatus(ctx context.Context, projectID uint64) (*proto.
 	status.Limit = limit
 
 	status.RateLimitCounter = make(map[string]int64)
+	status.RateLimitWindows = make(map[string][]proto.RateWindowStatus)
 	status.UsageCounter = make(map[string]int64)
 
 	for i := range proto.Service_name {
@@ -599,16 +1063,37 @@ func (s server) GetProjectStatus(ctx context.Context, projectID uint64) (*proto.
 			}
 		}
 
-		limitCounter := NewLimitCounter(svc, s.redis, s.log)
-		limiter := httprate.NewRateLimiter(int(cfg.RateLimit), time.Minute, httprate.WithLimitCounter(limitCounter))
-		_, rate, err := limiter.Status(middleware.ProjectRateKey(projectID) + ":")
+		windows, err := s.getRateStatus(ctx, svc, cfg, middleware.ProjectRateKey(projectID)+":")
 		if err != nil {
 			return nil, fmt.Errorf("get rate limit status: %w", err)
 		}
 		name := svc.GetName()
 		status.UsageCounter[name] = usage
-		status.RateLimitCounter[name] = int64(rate)
+		status.RateLimitCounter[name] = windows[0].Rate
+		status.RateLimitWindows[name] = windows
 	}
 
 	return &status, nil
 }
+
+// getRateStatus returns the current rate of each window of the service limit, using its algorithm.
+// Without redis the status is always 0, since the middleware counts in memory.
+func (s server) getRateStatus(ctx context.Context, svc proto.Service, cfg proto.ServiceLimit, key string) ([]proto.RateWindowStatus, error) {
+	limiter, ok := s.rateLimiters[svc]
+	if !ok {
+		limiter = middleware.NewRateLimiter(nil)
+	}
+	results, err := limiter.Status(ctx, key, cfg.RateAlgorithm, middleware.ServiceRateWindows(cfg, 1))
+	if err != nil {
+		return nil, err
+	}
+	status := make([]proto.RateWindowStatus, len(results))
+	for i, r := range results {
+		status[i] = proto.RateWindowStatus{
+			Limit:   int64(r.Limit),
+			Seconds: int64(r.Window.Seconds()),
+			Rate:    int64(r.Rate),
+		}
+	}
+	return status, nil
+}
@@ -6,9 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -16,13 +20,25 @@ import (
 	"github.com/0xsequence/authcontrol"
 	authproto "github.com/0xsequence/authcontrol/proto"
 	"github.com/0xsequence/quotacontrol"
+	"github.com/0xsequence/quotacontrol/internal/usage"
+	"github.com/0xsequence/quotacontrol/metrics"
 	"github.com/0xsequence/quotacontrol/middleware"
 	"github.com/0xsequence/quotacontrol/mock"
 	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/0xsequence/quotacontrol/tracing"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/httprate"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -256,14 +272,14 @@ func TestMiddlewareUseAccessKey(t *testing.T) {
 		for _, err := range errList {
 			server.FlushCache(ctx)
 			t.Run(fmt.Sprintf("GetAccessQuotaError: %s", err), func(t *testing.T) {
-				server.ErrGetAccessQuota = err
+				server.SetErrGetAccessQuota(err)
 				ok, headers, err := executeRequest(ctx, r, "", key, "")
 				assert.True(t, ok)
 				assert.Equal(t, "", headers.Get(middleware.HeaderQuotaLimit))
 				assert.NoError(t, err)
 			})
 		}
-		server.ErrGetAccessQuota = nil
+		server.SetErrGetAccessQuota(nil)
 
 		client.Stop(context.Background())
 		usage, err := server.Store.GetAccountUsage(ctx, ProjectID, &Service, now.Add(-time.Hour), now.Add(time.Hour))
@@ -316,7 +332,7 @@ func TestDefaultKey(t *testing.T) {
 	assert.Equal(t, access, quota.AccessKey)
 	assert.Equal(t, &limit, quota.Limit)
 
-	access, err = server.UpdateAccessKey(ctx, keys[0], proto.Ptr("new name"), nil, nil, []proto.Service{Service})
+	access, err = server.UpdateAccessKey(ctx, keys[0], proto.Ptr("new name"), nil, nil, []proto.Service{Service}, nil, nil)
 	require.NoError(t, err)
 
 	quota, err = client.FetchKeyQuota(ctx, keys[0], "", nil, now)
@@ -344,6 +360,222 @@ func TestDefaultKey(t *testing.T) {
 	assert.Equal(t, &newAccess, quota.AccessKey)
 }
 
+func TestAuditLog(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := authcontrol.WithAccount(authcontrol.WithSessionType(context.Background(), authproto.SessionType_User), WalletAddress)
+	start := time.Now()
+
+	first, err := server.CreateAccessKey(ctx, ProjectID, "first", false, nil, nil, nil, nil)
+	require.NoError(t, err)
+	second, err := server.CreateAccessKey(ctx, ProjectID, "second", false, nil, nil, nil, nil)
+	require.NoError(t, err)
+	renamed, err := server.UpdateAccessKey(ctx, second.AccessKey, proto.Ptr("renamed"), nil, nil, nil, nil, nil)
+	require.NoError(t, err)
+	_, err = server.SetDefaultAccessKey(ctx, ProjectID, second.AccessKey)
+	require.NoError(t, err)
+	rotated, err := server.RotateAccessKey(ctx, first.AccessKey, nil)
+	require.NoError(t, err)
+
+	middle := time.Now()
+	ok, err := server.DisableAccessKey(ctx, second.AccessKey)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// the reads and the other projects are not recorded
+	_, err = server.ListAccessKeys(ctx, ProjectID, nil, nil)
+	require.NoError(t, err)
+	_, err = server.CreateAccessKey(ctx, ProjectID+1, "other", false, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	events, err := server.ListAuditEvents(ctx, ProjectID, nil, nil)
+	require.NoError(t, err)
+	require.Len(t, events, 9)
+
+	type change struct {
+		RPC    string
+		Before string
+		After  string
+	}
+	keyOf := func(k *proto.AccessKey) string {
+		if k == nil {
+			return ""
+		}
+		return k.AccessKey
+	}
+	expected := []change{
+		{"CreateAccessKey", "", first.AccessKey},
+		{"CreateAccessKey", "", second.AccessKey},
+		{"UpdateAccessKey", second.AccessKey, second.AccessKey},
+		{"SetDefaultAccessKey", first.AccessKey, first.AccessKey},
+		{"SetDefaultAccessKey", second.AccessKey, second.AccessKey},
+		{"RotateAccessKey", first.AccessKey, first.AccessKey},
+		{"RotateAccessKey", "", rotated.AccessKey},
+		{"DisableAccessKey", second.AccessKey, second.AccessKey},
+		{"DisableAccessKey", rotated.AccessKey, rotated.AccessKey},
+	}
+	for i, e := range events {
+		assert.Equal(t, expected[i], change{e.RPC, keyOf(e.Before), keyOf(e.After)}, "event %d", i)
+		assert.Equal(t, uint64(ProjectID), e.ProjectID)
+		assert.Equal(t, "User:"+WalletAddress, e.Actor)
+		assert.NotZero(t, e.ID)
+	}
+
+	// the changes are kept as they were
+	assert.Equal(t, "second", events[2].Before.DisplayName)
+	assert.Equal(t, renamed, events[2].After)
+	assert.True(t, events[5].Before.Active)
+	assert.False(t, events[5].After.Active)
+	assert.True(t, events[7].Before.Active)
+	assert.False(t, events[7].After.Active)
+	assert.True(t, events[8].After.Default)
+
+	events, err = server.ListAuditEvents(ctx, ProjectID, &middle, nil)
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+	events, err = server.ListAuditEvents(ctx, ProjectID, &start, &middle)
+	require.NoError(t, err)
+	assert.Len(t, events, 7)
+}
+
+func TestKeyRotation(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	limit := proto.Limit{}
+	limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 100, FreeMax: 10, OverMax: 20})
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+
+	oldKey, err := server.CreateAccessKey(ctx, ProjectID, "key", false, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	client := quotacontrol.NewClient(slog.Default(), Service, cfg, nil)
+	authOptions := authcontrol.Options{JWTSecret: Secret}
+	r := chi.NewRouter()
+	r.Use(authcontrol.VerifyToken(authOptions))
+	r.Use(authcontrol.Session(authOptions))
+	r.Use(middleware.VerifyQuota(client, middleware.Options{}))
+	r.Handle("/*", new(hitCounter))
+
+	// the quota of the key is cached before the rotation
+	ok, headers, err := executeRequest(ctx, r, "", oldKey.AccessKey, "")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Empty(t, headers.Get(middleware.HeaderAccessKeyDeprecated))
+
+	newKey, err := server.RotateAccessKey(ctx, oldKey.AccessKey, proto.Ptr(uint32(1)))
+	require.NoError(t, err)
+	assert.True(t, newKey.Default)
+
+	// during the grace period both keys are valid, and the old one is deprecated
+	rotated, err := server.GetAccessKey(ctx, oldKey.AccessKey)
+	require.NoError(t, err)
+	assert.True(t, rotated.Active)
+	assert.False(t, rotated.Default)
+	require.NotNil(t, rotated.ExpiresAt)
+
+	ok, headers, err = executeRequest(ctx, r, "", oldKey.AccessKey, "")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, rotated.ExpiresAt.Format(http.TimeFormat), headers.Get(middleware.HeaderAccessKeyDeprecated))
+
+	ok, headers, err = executeRequest(ctx, r, "", newKey.AccessKey, "")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Empty(t, headers.Get(middleware.HeaderAccessKeyDeprecated))
+
+	// after it the old key is disabled, even if its quota is cached
+	time.Sleep(time.Until(*rotated.ExpiresAt))
+	ok, _, err = executeRequest(ctx, r, "", oldKey.AccessKey, "")
+	require.ErrorIs(t, err, proto.ErrAccessKeyNotFound)
+	assert.False(t, ok)
+
+	expired, err := server.GetAccessKey(ctx, oldKey.AccessKey)
+	require.NoError(t, err)
+	assert.False(t, expired.Active)
+
+	ok, _, err = executeRequest(ctx, r, "", newKey.AccessKey, "")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// without a grace period the key is disabled right away
+	_, err = server.RotateAccessKey(ctx, newKey.AccessKey, nil)
+	require.NoError(t, err)
+	ok, _, err = executeRequest(ctx, r, "", newKey.AccessKey, "")
+	require.ErrorIs(t, err, proto.ErrAccessKeyNotFound)
+	assert.False(t, ok)
+}
+
+func TestKeyExpiry(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cache := quotacontrol.NewRedisCache(redis.NewClient(&redis.Options{Addr: mr.Addr()}), time.Minute)
+	store := mock.NewMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	newServer := func(opts ...quotacontrol.ServerOption) proto.QuotaControlServer {
+		return quotacontrol.NewServer(quotacontrol.RedisConfig{}, slog.Default(), quotacontrol.Cache{
+			QuotaCache:      cache,
+			UsageCache:      cache,
+			PermissionCache: cache,
+		}, quotacontrol.Store{
+			ProjectInfoStore: store,
+			LimitStore:       store,
+			AccessKeyStore:   store,
+			UsageStore:       store,
+			PermissionStore:  store,
+			AuditStore:       store,
+		}, opts...)
+	}
+
+	expired := func(projectID uint64) *proto.AccessKey {
+		key := proto.AccessKey{
+			Active:    true,
+			AccessKey: authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), projectID),
+			ProjectID: projectID,
+			ExpiresAt: proto.Ptr(time.Now().Add(-time.Minute)),
+		}
+		require.NoError(t, store.InsertAccessKey(ctx, &key))
+		require.NoError(t, store.InsertAccessKey(ctx, &proto.AccessKey{
+			Active:    true,
+			Default:   true,
+			AccessKey: authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), projectID),
+			ProjectID: projectID,
+		}))
+		return &key
+	}
+
+	// the keys of the listed project are disabled first
+	server := newServer()
+	key := expired(ProjectID)
+	list, err := server.ListAccessKeys(ctx, ProjectID, proto.Ptr(true), nil)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.NotEqual(t, key.AccessKey, list[0].AccessKey)
+	_, err = server.DisableAccessKey(ctx, list[0].AccessKey)
+	require.ErrorIs(t, err, proto.ErrAtLeastOneKey)
+
+	// the sweep disables the keys nobody uses
+	key = expired(ProjectID + 1)
+	newServer(quotacontrol.WithKeyExpiry(ctx, 10*time.Millisecond))
+	var events []*proto.AuditEvent
+	require.Eventually(t, func() bool {
+		events, err = server.ListAuditEvents(ctx, ProjectID+1, nil, nil)
+		return err == nil && len(events) > 0
+	}, time.Second, 10*time.Millisecond)
+	k, err := store.FindAccessKey(ctx, key.AccessKey)
+	require.NoError(t, err)
+	assert.False(t, k.Active)
+	require.Len(t, events, 1)
+	assert.Equal(t, "RotateAccessKey", events[0].RPC)
+	assert.Equal(t, key.AccessKey, events[0].After.AccessKey)
+}
+
 func TestJWT(t *testing.T) {
 	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(context.Background(), 1), ProjectID)
 
@@ -409,6 +641,8 @@ func TestJWT(t *testing.T) {
 		assert.Equal(t, "", headers.Get(middleware.HeaderQuotaLimit))
 	})
 	server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID})
+	// the key is cached as not found, it's cleared by CreateAccessKey when the key is created through the server
+	require.NoError(t, client.ClearQuotaCacheByAccessKey(ctx, key))
 	t.Run("AccessKeyFound", func(t *testing.T) {
 		ok, _, err := executeRequest(ctx, r, "", key, token)
 		require.NoError(t, err)
@@ -871,6 +1105,32 @@ func TestChainID(t *testing.T) {
 	ok, _, err = executeRequest(ctx, r, "/3/"+path, AccessKey, "")
 	assert.ErrorIs(t, err, proto.ErrInvalidChain)
 	assert.False(t, ok)
+
+	// the chains of the key must be within the ones of the project
+	_, err = server.CreateAccessKey(ctx, ProjectID, "chains", false, nil, nil, nil, []uint64{2, 3})
+	require.ErrorIs(t, err, proto.ErrWebrpcBadRequest)
+	key, err := server.CreateAccessKey(ctx, ProjectID, "chains", false, nil, nil, nil, []uint64{2})
+	require.NoError(t, err)
+	_, err = server.UpdateAccessKey(ctx, key.AccessKey, nil, nil, nil, nil, nil, []uint64{3})
+	require.ErrorIs(t, err, proto.ErrWebrpcBadRequest)
+
+	ok, _, err = executeRequest(ctx, r, "/2/"+path, key.AccessKey, "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	for _, chain := range []string{"1", "3"} {
+		ok, _, err = executeRequest(ctx, r, "/"+chain+"/"+path, key.AccessKey, "")
+		assert.ErrorIs(t, err, proto.ErrInvalidChain)
+		var rpcErr proto.WebRPCError
+		require.ErrorAs(t, err, &rpcErr)
+		assert.Equal(t, "invalid chain IDs: ["+chain+"]", rpcErr.Cause)
+		assert.False(t, ok)
+	}
+
+	// the keys without chains keep the ones of the project
+	ok, _, err = executeRequest(ctx, r, "/1/"+path, AccessKey, "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
 }
 
 func TestPerServiceRateLimit(t *testing.T) {
@@ -993,70 +1253,1359 @@ func TestPerServiceRateLimit(t *testing.T) {
 
 }
 
-func newConfig() quotacontrol.Config {
-	return quotacontrol.Config{
-		Enabled:    true,
-		UpdateFreq: time.Minute,
-		Redis: quotacontrol.RedisConfig{
-			Enabled: true,
-		},
-		RateLimiter: quotacontrol.RateLimitConfig{
-			Enabled: true,
-		},
+func TestRateLimitWindows(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	logger := slog.Default()
+	client := quotacontrol.NewClient(logger, Service, cfg, nil)
+	quotaOptions := middleware.Options{}
+
+	authOptions := authcontrol.Options{JWTSecret: Secret}
+
+	r := chi.NewRouter()
+	r.Use(authcontrol.VerifyToken(authOptions))
+	r.Use(authcontrol.Session(authOptions))
+	r.Use(middleware.VerifyQuota(client, quotaOptions))
+	r.Use(middleware.RateLimit(client, cfg.RateLimiter, quotacontrol.NewLimitCounter(Service, cfg.Redis, logger), quotaOptions))
+	r.Handle("/*", new(hitCounter))
+
+	// 10 requests per minute and 5 per hour, the hourly limit trips first
+	limit := proto.Limit{}
+	limit.SetSetting(Service, proto.ServiceLimit{
+		RateLimit:   10,
+		RateWindows: []proto.RateWindow{{Limit: 5, Seconds: 3600}},
+		FreeWarn:    100,
+		FreeMax:     100,
+		OverWarn:    100,
+		OverMax:     100,
+	})
+
+	ctx := context.Background()
+	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID}))
+
+	for i := 0; i < 5; i++ {
+		ok, headers, err := executeRequest(ctx, r, "", key, "")
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, "3600", headers.Get(middleware.HeaderRateWindow))
+		assert.Equal(t, strconv.Itoa(5-i-1), headers.Get(middleware.HeaderRateRemaining))
 	}
-}
 
-type hitCounter int64
+	ok, headers, err := executeRequest(ctx, r, "", key, "")
+	require.ErrorIs(t, err, proto.ErrQuotaRateLimit)
+	require.False(t, ok)
+	assert.Equal(t, "5", headers.Get(middleware.HeaderRateLimit))
+	assert.Equal(t, "3600", headers.Get(middleware.HeaderRateWindow))
+	assert.Equal(t, "0", headers.Get(middleware.HeaderRateRemaining))
 
-func (c *hitCounter) GetValue() int64 { return atomic.LoadInt64((*int64)(c)) }
-func (c *hitCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	atomic.AddInt64((*int64)(c), 1)
-	w.WriteHeader(http.StatusOK)
-}
+	status, err := server.GetProjectStatus(ctx, ProjectID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), status.RateLimitCounter[Service.GetName()])
+	assert.Equal(t, []proto.RateWindowStatus{
+		{Limit: 10, Seconds: 60, Rate: 5},
+		{Limit: 5, Seconds: 3600, Rate: 5},
+	}, status.RateLimitWindows[Service.GetName()])
 
-type spendingCounter int64
+	// without a requests/minute limit the other windows are still enforced
+	limit.SetSetting(Service, proto.ServiceLimit{
+		RateWindows: []proto.RateWindow{{Limit: 2, Seconds: 3600}},
+		FreeMax:     100,
+		OverMax:     100,
+	})
+	otherKey := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID+1)
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID+1, &limit))
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: otherKey, ProjectID: ProjectID + 1}))
 
-func (c *spendingCounter) GetValue() int64 { return atomic.LoadInt64((*int64)(c)) }
-func (c *spendingCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// up the counter only if quota control run
-	if middleware.HasSpending(r.Context()) {
-		atomic.AddInt64((*int64)(c), 1)
+	for i := 0; i < 2; i++ {
+		ok, headers, err := executeRequest(ctx, r, "", otherKey, "")
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, "3600", headers.Get(middleware.HeaderRateWindow))
 	}
-	w.WriteHeader(http.StatusOK)
+	ok, _, err = executeRequest(ctx, r, "", otherKey, "")
+	require.ErrorIs(t, err, proto.ErrQuotaRateLimit)
+	require.False(t, ok)
 }
 
-func executeRequest(ctx context.Context, handler http.Handler, path, accessKey, jwt string) (bool, http.Header, error) {
-	req, err := http.NewRequest("POST", path, nil)
-	if err != nil {
-		return false, nil, err
-	}
-	req.Header.Set("X-Real-IP", "127.0.0.1")
-	if accessKey != "" {
-		req.Header.Set(authcontrol.HeaderAccessKey, accessKey)
-	}
-	if jwt != "" {
-		req.Header.Set("Authorization", "Bearer "+jwt)
-	}
+func TestKeyLimits(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
 
-	rr := httptest.NewRecorder()
-	handler.ServeHTTP(rr, req.WithContext(ctx))
+	ctx := context.Background()
+	now := time.Now()
+	limit := proto.Limit{}
+	limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 100, FreeMax: 100, OverMax: 100})
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+
+	// the limits of the keys are validated
+	_, err := server.CreateAccessKey(ctx, ProjectID, "invalid", false, nil, nil, map[string]*proto.ServiceLimit{
+		Service.String(): {OverMax: -1},
+	}, nil)
+	require.ErrorIs(t, err, proto.ErrWebrpcBadRequest)
+
+	rateKey, err := server.CreateAccessKey(ctx, ProjectID, "rate", false, nil, nil, map[string]*proto.ServiceLimit{
+		Service.String(): {RateLimit: 3},
+	}, nil)
+	require.NoError(t, err)
+	usageKey, err := server.CreateAccessKey(ctx, ProjectID, "usage", false, nil, nil, nil, nil)
+	require.NoError(t, err)
+	usageKey, err = server.UpdateAccessKey(ctx, usageKey.AccessKey, nil, nil, nil, nil, map[string]*proto.ServiceLimit{
+		Service.String(): {OverMax: 5},
+	}, nil)
+	require.NoError(t, err)
+	otherKey, err := server.CreateAccessKey(ctx, ProjectID, "other", false, nil, nil, nil, nil)
+	require.NoError(t, err)
 
-	if status := rr.Result().StatusCode; status < http.StatusOK || status >= http.StatusBadRequest {
-		w := proto.WebRPCError{}
-		json.Unmarshal(rr.Body.Bytes(), &w)
-		return false, rr.Header(), w
-	}
+	logger := slog.Default()
+	client := quotacontrol.NewClient(logger, Service, cfg, nil)
 
-	return true, rr.Header(), nil
-}
+	t.Run("RateLimit", func(t *testing.T) {
+		authOptions := authcontrol.Options{JWTSecret: Secret}
+		r := chi.NewRouter()
+		r.Use(authcontrol.VerifyToken(authOptions))
+		r.Use(authcontrol.Session(authOptions))
+		r.Use(middleware.VerifyQuota(client, middleware.Options{}))
+		r.Use(middleware.RateLimit(client, cfg.RateLimiter, quotacontrol.NewLimitCounter(Service, cfg.Redis, logger), middleware.Options{}))
+		r.Handle("/*", new(hitCounter))
 
-type chainFinder map[string]uint64
+		for i := range 3 {
+			ok, headers, err := executeRequest(ctx, r, "", rateKey.AccessKey, "")
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "3", headers.Get(middleware.HeaderRateLimit))
+			assert.Equal(t, strconv.Itoa(3-i-1), headers.Get(middleware.HeaderRateRemaining))
+		}
+		ok, headers, err := executeRequest(ctx, r, "", rateKey.AccessKey, "")
+		require.ErrorIs(t, err, proto.ErrQuotaRateLimit)
+		assert.False(t, ok)
+		assert.Equal(t, "3", headers.Get(middleware.HeaderRateLimit))
 
-func (c chainFinder) FindChain(chainID string) (uint64, struct{}, error) {
-	for name, id := range c {
-		if name == chainID || strconv.FormatUint(id, 10) == chainID {
-			return id, struct{}{}, nil
+		// the other keys of the project use the project limit
+		ok, headers, err = executeRequest(ctx, r, "", otherKey.AccessKey, "")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "100", headers.Get(middleware.HeaderRateLimit))
+		assert.Equal(t, "96", headers.Get(middleware.HeaderRateRemaining))
+	})
+
+	t.Run("ProjectRateLimit", func(t *testing.T) {
+		// the key allows more requests than its project
+		projectID := ProjectID + 1
+		projectLimit := proto.Limit{}
+		projectLimit.SetSetting(Service, proto.ServiceLimit{RateLimit: 2, FreeMax: 100, OverMax: 100})
+		require.NoError(t, server.Store.SetAccessLimit(ctx, projectID, &projectLimit))
+		key, err := server.CreateAccessKey(ctx, projectID, "rate", false, nil, nil, map[string]*proto.ServiceLimit{
+			Service.String(): {RateLimit: 5},
+		}, nil)
+		require.NoError(t, err)
+
+		counter := quotacontrol.NewLimitCounter(Service, cfg.Redis, logger)
+		authOptions := authcontrol.Options{JWTSecret: Secret}
+		r := chi.NewRouter()
+		r.Use(authcontrol.VerifyToken(authOptions))
+		r.Use(authcontrol.Session(authOptions))
+		r.Use(middleware.VerifyQuota(client, middleware.Options{}))
+		r.Use(middleware.RateLimit(client, cfg.RateLimiter, counter, middleware.Options{}))
+		r.Handle("/*", new(hitCounter))
+
+		for range 2 {
+			ok, _, err := executeRequest(ctx, r, "", key.AccessKey, "")
+			require.NoError(t, err)
+			assert.True(t, ok)
 		}
-	}
-	return 0, struct{}{}, errors.New("not found")
+		for range 3 {
+			ok, headers, err := executeRequest(ctx, r, "", key.AccessKey, "")
+			require.ErrorIs(t, err, proto.ErrQuotaRateLimit)
+			assert.False(t, ok)
+			assert.Equal(t, "2", headers.Get(middleware.HeaderRateLimit))
+		}
+
+		// the requests denied by the project are given back to the key
+		status, err := middleware.NewRateLimiter(counter).Status(ctx, middleware.KeyRateKey(key.AccessKey)+":", proto.RateAlgorithm_SlidingWindow,
+			middleware.ServiceRateWindows(proto.ServiceLimit{RateLimit: 5}, 1)[:1])
+		require.NoError(t, err)
+		assert.Equal(t, 3, status[0].Remaining)
+	})
+
+	t.Run("Usage", func(t *testing.T) {
+		quota, err := client.FetchKeyQuota(ctx, usageKey.AccessKey, "", nil, now)
+		require.NoError(t, err)
+		keyLimit, ok := quota.AccessKey.GetSettings(Service)
+		require.True(t, ok)
+		assert.Equal(t, int64(5), keyLimit.OverMax)
+
+		ok, total, err := client.SpendQuota(ctx, quota, 3, now)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int64(3), total)
+
+		// the cost is cut by the key, the part that fits is spent from the project
+		ok, total, err = client.SpendQuota(ctx, quota, 3, now)
+		require.ErrorIs(t, err, proto.ErrQuotaExceeded)
+		assert.False(t, ok)
+		assert.Equal(t, int64(5), total)
+
+		_, _, err = client.SpendQuota(ctx, quota, 1, now)
+		require.ErrorIs(t, err, proto.ErrQuotaExceeded)
+
+		// the other keys of the project can still spend
+		other, err := client.FetchKeyQuota(ctx, otherKey.AccessKey, "", nil, now)
+		require.NoError(t, err)
+		ok, total, err = client.SpendQuota(ctx, other, 1, now)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int64(6), total)
+
+		// the usage of the key is loaded from the server once the cache is cleared
+		_, err = server.SyncAccessKeyUsage(ctx, Service, now, map[string]int64{usageKey.AccessKey: 4, otherKey.AccessKey: 1}, nil, nil)
+		require.NoError(t, err)
+		_, err = server.ClearUsage(ctx, ProjectID, &Service, now)
+		require.NoError(t, err)
+		events, err := server.ListAuditEvents(ctx, ProjectID, nil, nil)
+		require.NoError(t, err)
+		require.NotEmpty(t, events)
+		assert.Equal(t, "ClearUsage", events[len(events)-1].RPC)
+		assert.Equal(t, &Service, events[len(events)-1].Service)
+		ok, total, err = client.SpendQuota(ctx, quota, 1, now)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int64(6), total)
+		_, _, err = client.SpendQuota(ctx, quota, 1, now)
+		require.ErrorIs(t, err, proto.ErrQuotaExceeded)
+	})
+
+	t.Run("Refund", func(t *testing.T) {
+		projectID := ProjectID + 2
+		projectLimit := proto.Limit{}
+		projectLimit.SetSetting(Service, proto.ServiceLimit{RateLimit: 100, FreeMax: 4, OverMax: 4})
+		require.NoError(t, server.Store.SetAccessLimit(ctx, projectID, &projectLimit))
+		key, err := server.CreateAccessKey(ctx, projectID, "refund", false, nil, nil, map[string]*proto.ServiceLimit{
+			Service.String(): {OverMax: 6},
+		}, nil)
+		require.NoError(t, err)
+
+		quota, err := client.FetchKeyQuota(ctx, key.AccessKey, "", nil, now)
+		require.NoError(t, err)
+		ok, _, err := client.SpendQuota(ctx, quota, 3, now)
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		// the project allows 1 of the 3 units, the key gives the other 2 back
+		_, total, err := client.SpendQuota(ctx, quota, 3, now)
+		require.ErrorIs(t, err, proto.ErrQuotaExceeded)
+		assert.Equal(t, int64(4), total)
+
+		// with a higher project limit the key has 2 units left
+		quota.Limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 100, FreeMax: 100, OverMax: 100})
+		ok, _, err = client.SpendQuota(ctx, quota, 2, now)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		_, _, err = client.SpendQuota(ctx, quota, 1, now)
+		require.ErrorIs(t, err, proto.ErrQuotaExceeded)
+	})
+}
+
+func TestSyncUsageLostResponse(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+	err := server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID})
+	require.NoError(t, err)
+
+	qc := proto.NewQuotaControlClient(cfg.URL, http.DefaultClient)
+	now := time.Now()
+
+	tracker := usage.NewTracker()
+	tracker.AddKeyUsage(key, now, proto.UsageBreakdown{Free: 5})
+	tracker.AddProjectUsage(ProjectID, now, proto.UsageBreakdown{Free: 3})
+
+	// the usage is stored, but the client gets an error
+	server.SetErrSyncUsageResponse(proto.ErrWebrpcRequestFailed)
+	assert.Error(t, tracker.SyncUsage(ctx, qc, Service))
+
+	// the retry is ignored by the server
+	server.SetErrSyncUsageResponse(nil)
+	require.NoError(t, tracker.SyncUsage(ctx, qc, Service))
+
+	keyUsage, err := server.Store.GetAccessKeyUsage(ctx, ProjectID, key, &Service, now, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), keyUsage)
+}
+
+func TestCredits(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	now := time.Now()
+	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+
+	limit := proto.Limit{
+		ServiceLimit: map[string]proto.ServiceLimit{
+			Service.String(): {RateLimit: 100, FreeMax: 10, OverMax: 20},
+		},
+	}
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID}))
+
+	_, err := server.GrantCredits(ctx, ProjectID, Service, 0, now.Add(time.Hour), nil)
+	require.ErrorIs(t, err, proto.ErrWebrpcBadRequest)
+	_, err = server.GrantCredits(ctx, ProjectID, Service, 10, now.Add(-time.Hour), nil)
+	require.ErrorIs(t, err, proto.ErrWebrpcBadRequest)
+
+	longGrant, err := server.GrantCredits(ctx, ProjectID, Service, 15, now.Add(30*24*time.Hour), proto.Ptr("top-up"))
+	require.NoError(t, err)
+	shortGrant, err := server.GrantCredits(ctx, ProjectID, Service, 5, now.Add(24*time.Hour), nil)
+	require.NoError(t, err)
+
+	client := quotacontrol.NewClient(slog.Default(), Service, cfg, nil)
+	quota, err := client.FetchKeyQuota(ctx, key, "", nil, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), quota.GetCredits(Service))
+
+	// the overage starts after the credits, so the limit is overMax plus the credits
+	ok, total, err := client.SpendQuota(ctx, quota, 30, now)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(30), total)
+	ok, _, err = client.SpendQuota(ctx, quota, 10, now)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	_, _, err = client.SpendQuota(ctx, quota, 1, now)
+	require.ErrorIs(t, err, proto.ErrQuotaExceeded)
+
+	// the credits are spent on sync, starting from the grant that expires first
+	qc := proto.NewQuotaControlClient(cfg.URL, http.DefaultClient)
+	_, err = qc.SyncAccessKeyUsage(ctx, Service, now, map[string]int64{key: 40}, nil, nil)
+	require.NoError(t, err)
+
+	creditUsage, err := server.GetCreditUsage(ctx, ProjectID, &Service, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), creditUsage)
+
+	// the sync has no breakdown, so the server splits the usage
+	breakdown, err := server.GetUsageBreakdown(ctx, ProjectID, nil, &Service, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, &proto.UsageBreakdown{Free: 10, Credit: 20, Overage: 10}, breakdown)
+
+	grants, err := server.ListCreditGrants(ctx, ProjectID, &Service, nil)
+	require.NoError(t, err)
+	require.Len(t, grants, 2)
+	assert.Equal(t, longGrant.ID, grants[0].ID)
+	assert.Equal(t, "top-up", grants[0].Description)
+	assert.Equal(t, int64(15), grants[0].Used)
+	assert.Equal(t, shortGrant.ID, grants[1].ID)
+	assert.Equal(t, int64(5), grants[1].Used)
+
+	// the spent credits are still part of the cycle
+	quota, err = server.GetAccessQuota(ctx, key, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), quota.GetCredits(Service))
+
+	ok, err = server.RevokeCreditGrant(ctx, ProjectID, longGrant.ID)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	_, err = server.RevokeCreditGrant(ctx, ProjectID, longGrant.ID)
+	require.ErrorIs(t, err, proto.ErrCreditGrantNotFound)
+
+	grants, err = server.ListCreditGrants(ctx, ProjectID, nil, proto.Ptr(true))
+	require.NoError(t, err)
+	require.Len(t, grants, 1)
+	assert.Equal(t, shortGrant.ID, grants[0].ID)
+
+	// the audit log records the grants
+	events, err := server.ListAuditEvents(ctx, ProjectID, nil, nil)
+	require.NoError(t, err)
+	events = slices.DeleteFunc(events, func(e *proto.AuditEvent) bool { return e.CreditGrant == nil })
+	require.Len(t, events, 3)
+	assert.Equal(t, "GrantCredits", events[0].RPC)
+	assert.Equal(t, *longGrant, *events[0].CreditGrant)
+	assert.Equal(t, "GrantCredits", events[1].RPC)
+	assert.Equal(t, shortGrant.ID, events[1].CreditGrant.ID)
+	assert.Equal(t, "RevokeCreditGrant", events[2].RPC)
+	assert.Equal(t, longGrant.ID, events[2].CreditGrant.ID)
+	assert.Equal(t, int64(15), events[2].CreditGrant.Amount)
+	assert.NotNil(t, events[2].CreditGrant.RevokedAt)
+}
+
+func TestCreditsInactiveGrant(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	now := time.Now()
+	later := now.Add(2 * time.Hour)
+	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+
+	limit := proto.Limit{
+		ServiceLimit: map[string]proto.ServiceLimit{
+			Service.String(): {RateLimit: 100, FreeMax: 10, OverMax: 20},
+		},
+	}
+	cycle := &proto.Cycle{Start: now.AddDate(0, 0, -1), End: now.AddDate(0, 0, 1)}
+	require.NoError(t, server.Store.SetProjectInfo(ctx, ProjectID, &proto.ProjectInfo{ID: ProjectID, Cycle: cycle}))
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID}))
+
+	expiring, err := server.GrantCredits(ctx, ProjectID, Service, 10, now.Add(time.Hour), nil)
+	require.NoError(t, err)
+	revoked, err := server.GrantCredits(ctx, ProjectID, Service, 10, now.Add(30*24*time.Hour), nil)
+	require.NoError(t, err)
+
+	// the usage spends the credits of both grants
+	qc := proto.NewQuotaControlClient(cfg.URL, http.DefaultClient)
+	_, err = qc.SyncAccessKeyUsage(ctx, Service, now, map[string]int64{key: 30}, nil, nil)
+	require.NoError(t, err)
+	grants, err := server.ListCreditGrants(ctx, ProjectID, &Service, nil)
+	require.NoError(t, err)
+	require.Len(t, grants, 2)
+	assert.Equal(t, expiring.ID, grants[0].ID)
+	assert.Equal(t, int64(10), grants[0].Used)
+	assert.Equal(t, int64(10), grants[1].Used)
+
+	ok, err := server.RevokeCreditGrant(ctx, ProjectID, revoked.ID)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// one grant is revoked and the other one expired, the credits they paid for are still part of the cycle
+	quota, err := server.GetAccessQuota(ctx, key, later)
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), quota.GetCredits(Service))
+
+	// so the project can still use its overage
+	client := quotacontrol.NewClient(slog.Default(), Service, cfg, nil)
+	quota, err = client.FetchKeyQuota(ctx, key, "", nil, later)
+	require.NoError(t, err)
+	ok, total, err := client.SpendQuota(ctx, quota, 10, later)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(40), total)
+	_, _, err = client.SpendQuota(ctx, quota, 1, later)
+	require.ErrorIs(t, err, proto.ErrQuotaExceeded)
+
+	// the credits spent outside of the cycle don't count
+	creditUsage, err := server.Store.GetCreditUsage(ctx, ProjectID, &Service, now.AddDate(0, 0, 2), now.AddDate(0, 0, 3))
+	require.NoError(t, err)
+	assert.Zero(t, creditUsage)
+}
+
+func TestUsageBreakdown(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	now := time.Now()
+	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+
+	limit := proto.Limit{
+		ServiceLimit: map[string]proto.ServiceLimit{
+			Service.String(): {RateLimit: 100, FreeMax: 10, OverMax: 20},
+		},
+	}
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID}))
+
+	client := quotacontrol.NewClient(slog.Default(), Service, cfg, nil)
+	go client.Run(ctx)
+
+	quota, err := client.FetchKeyQuota(ctx, key, "", nil, now)
+	require.NoError(t, err)
+
+	for _, cost := range []int64{8, 8} {
+		ok, _, err := client.SpendQuota(ctx, quota, cost, now)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+	// 4 units fit in the overage, the rest is limited
+	_, _, err = client.SpendQuota(ctx, quota, 10, now)
+	require.ErrorIs(t, err, proto.ErrQuotaExceeded)
+	_, _, err = client.SpendQuota(ctx, quota, 1, now)
+	require.ErrorIs(t, err, proto.ErrQuotaExceeded)
+
+	client.Stop(ctx)
+
+	usage, err := server.GetUsage(ctx, ProjectID, nil, &Service, &now, &now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), usage)
+
+	breakdown, err := server.GetUsageBreakdown(ctx, ProjectID, &key, &Service, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, &proto.UsageBreakdown{Free: 10, Overage: 10, Limited: 7}, breakdown)
+
+	accessUsage, err := server.GetAccessKeyUsage(ctx, key, &Service, &now, &now)
+	require.NoError(t, err)
+	assert.Equal(t, &proto.AccessUsage{ValidCompute: 20, OverCompute: 10, LimitedCompute: 7}, accessUsage)
+
+	// a breakdown that doesn't add up to the usage is split with the limits of the project
+	otherProjectID := ProjectID + 1
+	otherKey := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), otherProjectID)
+	require.NoError(t, server.Store.SetAccessLimit(ctx, otherProjectID, &limit))
+	_, err = server.SyncAccessKeyUsage(ctx, Service, now, map[string]int64{otherKey: 15}, nil, map[string]*proto.UsageBreakdown{
+		otherKey: {Free: 1, Limited: 2},
+	})
+	require.NoError(t, err)
+	breakdown, err = server.GetUsageBreakdown(ctx, otherProjectID, &otherKey, &Service, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, &proto.UsageBreakdown{Free: 10, Overage: 5, Limited: 2}, breakdown)
+}
+
+func TestUsageHistory(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	keys := []string{
+		authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID),
+		authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID),
+	}
+	for _, key := range keys {
+		require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID}))
+	}
+
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	qc := proto.NewQuotaControlClient(cfg.URL, http.DefaultClient)
+	for _, v := range []struct {
+		time    time.Time
+		service proto.Service
+		usage   map[string]int64
+	}{
+		{time: day.Add(time.Hour), service: proto.Service_Indexer, usage: map[string]int64{keys[0]: 1, keys[1]: 2}},
+		{time: day.Add(time.Hour), service: proto.Service_NodeGateway, usage: map[string]int64{keys[0]: 4}},
+		{time: day.Add(3 * time.Hour), service: proto.Service_Indexer, usage: map[string]int64{keys[1]: 8}},
+		{time: day.AddDate(0, 0, 1), service: proto.Service_Indexer, usage: map[string]int64{keys[0]: 16}},
+	} {
+		_, err := qc.SyncAccessKeyUsage(ctx, v.service, v.time, v.usage, nil, nil)
+		require.NoError(t, err)
+	}
+
+	from, to := day, day.AddDate(0, 0, 1)
+	history, err := qc.GetUsageHistory(ctx, ProjectID, nil, nil, &from, &to, proto.UsageGranularity_Day, nil)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, day, history[0].Time.UTC())
+	assert.Equal(t, int64(15), history[0].Usage.Total())
+	assert.Equal(t, int64(16), history[1].Usage.Total())
+
+	to = day.Add(23 * time.Hour)
+	history, err = qc.GetUsageHistory(ctx, ProjectID, nil, proto.Ptr(proto.Service_Indexer), &from, &to, proto.UsageGranularity_Hour, []proto.UsageGroupBy{proto.UsageGroupBy_AccessKey})
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	// the points of the same time are sorted by access key
+	sorted, hourUsage := slices.Sorted(slices.Values(keys)), map[string]int64{keys[0]: 1, keys[1]: 2}
+	for i, v := range []struct {
+		time  time.Time
+		key   string
+		usage int64
+	}{
+		{time: day.Add(time.Hour), key: sorted[0], usage: hourUsage[sorted[0]]},
+		{time: day.Add(time.Hour), key: sorted[1], usage: hourUsage[sorted[1]]},
+		{time: day.Add(3 * time.Hour), key: keys[1], usage: 8},
+	} {
+		assert.Equal(t, v.time, history[i].Time.UTC())
+		assert.Nil(t, history[i].Service)
+		require.NotNil(t, history[i].AccessKey)
+		assert.Equal(t, v.key, *history[i].AccessKey)
+		assert.Equal(t, v.usage, history[i].Usage.Total())
+	}
+
+	// too many hourly buckets
+	to = day.AddDate(0, 2, 0)
+	_, err = qc.GetUsageHistory(ctx, ProjectID, nil, nil, &from, &to, proto.UsageGranularity_Hour, nil)
+	require.ErrorIs(t, err, proto.ErrWebrpcBadRequest)
+	_, err = server.GetUsageHistory(ctx, ProjectID, nil, nil, &from, &from, proto.UsageGranularity(9), nil)
+	require.ErrorIs(t, err, proto.ErrWebrpcBadRequest)
+}
+
+func newConfig() quotacontrol.Config {
+	return quotacontrol.Config{
+		Enabled:    true,
+		UpdateFreq: time.Minute,
+		Redis: quotacontrol.RedisConfig{
+			Enabled: true,
+		},
+		RateLimiter: quotacontrol.RateLimitConfig{
+			Enabled: true,
+		},
+	}
+}
+
+type hitCounter int64
+
+func (c *hitCounter) GetValue() int64 { return atomic.LoadInt64((*int64)(c)) }
+func (c *hitCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64((*int64)(c), 1)
+	w.WriteHeader(http.StatusOK)
+}
+
+type spendingCounter int64
+
+func (c *spendingCounter) GetValue() int64 { return atomic.LoadInt64((*int64)(c)) }
+func (c *spendingCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// up the counter only if quota control run
+	if middleware.HasSpending(r.Context()) {
+		atomic.AddInt64((*int64)(c), 1)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func executeRequest(ctx context.Context, handler http.Handler, path, accessKey, jwt string) (bool, http.Header, error) {
+	req, err := http.NewRequest("POST", path, nil)
+	if err != nil {
+		return false, nil, err
+	}
+	req.Header.Set("X-Real-IP", "127.0.0.1")
+	if accessKey != "" {
+		req.Header.Set(authcontrol.HeaderAccessKey, accessKey)
+	}
+	if jwt != "" {
+		req.Header.Set("Authorization", "Bearer "+jwt)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req.WithContext(ctx))
+
+	if status := rr.Result().StatusCode; status < http.StatusOK || status >= http.StatusBadRequest {
+		w := proto.WebRPCError{}
+		json.Unmarshal(rr.Body.Bytes(), &w)
+		return false, rr.Header(), w
+	}
+
+	return true, rr.Header(), nil
+}
+
+type chainFinder map[string]uint64
+
+func (c chainFinder) FindChain(chainID string) (uint64, struct{}, error) {
+	for name, id := range c {
+		if name == chainID || strconv.FormatUint(id, 10) == chainID {
+			return id, struct{}{}, nil
+		}
+	}
+	return 0, struct{}{}, errors.New("not found")
+}
+
+func TestInvalidation(t *testing.T) {
+	cfg := newConfig()
+	cfg.LRUSize = 10
+	cfg.LRUExpiration = time.Hour
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	now := time.Now()
+	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+
+	limit := proto.Limit{}
+	limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 100, FreeMax: 10, OverMax: 20})
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID}))
+	// the last key of a project can't be disabled
+	_, err := server.CreateAccessKey(ctx, ProjectID, "other", false, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	freeMax := func(quota *proto.AccessQuota) int64 {
+		cfg, _ := quota.Limit.GetSettings(Service)
+		return cfg.FreeMax
+	}
+
+	// two pods sharing the same redis
+	clients := []*quotacontrol.Client{
+		quotacontrol.NewClient(slog.Default(), Service, cfg, nil),
+		quotacontrol.NewClient(slog.Default(), Service, cfg, nil),
+	}
+	for _, client := range clients {
+		go client.Run(ctx)
+	}
+
+	rc := redis.NewClient(&redis.Options{Addr: fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port)})
+	require.Eventually(t, func() bool {
+		channels, err := rc.PubSubChannels(ctx, "*").Result()
+		if err != nil || len(channels) != 1 {
+			return false
+		}
+		subs, err := rc.PubSubNumSub(ctx, channels...).Result()
+		return err == nil && subs[channels[0]] == int64(len(clients))
+	}, time.Second, 10*time.Millisecond)
+
+	for _, client := range clients {
+		quota, err := client.FetchKeyQuota(ctx, key, "", nil, now)
+		require.NoError(t, err)
+		assert.True(t, quota.AccessKey.Active)
+		quota, err = client.FetchProjectQuota(ctx, ProjectID, nil, now)
+		require.NoError(t, err)
+		assert.Equal(t, int64(10), freeMax(quota))
+	}
+
+	// a disabled key is evicted from the LRU of every client
+	ok, err := server.DisableAccessKey(ctx, key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	for _, client := range clients {
+		assert.Eventually(t, func() bool {
+			_, err := client.FetchKeyQuota(ctx, key, "", nil, now)
+			return errors.Is(err, proto.ErrAccessKeyNotFound)
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// a limit change is evicted once the project cache is cleared
+	limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 100, FreeMax: 50, OverMax: 100})
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+	_, err = server.ClearAccessQuotaCache(ctx, ProjectID)
+	require.NoError(t, err)
+	for _, client := range clients {
+		assert.Eventually(t, func() bool {
+			quota, err := client.FetchProjectQuota(ctx, ProjectID, nil, now)
+			return err == nil && freeMax(quota) == 50
+		}, time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestInvalidationResubscribe(t *testing.T) {
+	cfg := newConfig()
+	cfg.LRUSize = 10
+	_, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	// the redis of the client is down when it starts
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	host, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	cfg.Redis.Host = host
+	p, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	cfg.Redis.Port = uint16(p)
+
+	client := quotacontrol.NewClient(slog.Default(), Service, cfg, nil)
+	go client.Run(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	mr := miniredis.NewMiniRedis()
+	require.NoError(t, mr.StartAddr(addr))
+	t.Cleanup(mr.Close)
+
+	// the subscription is retried once it's back
+	rc := redis.NewClient(&redis.Options{Addr: addr})
+	require.Eventually(t, func() bool {
+		subs, err := rc.PubSubNumSub(ctx, "quotacontrol:v2:invalidate").Result()
+		return err == nil && subs["quotacontrol:v2:invalidate"] == 1
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestNotFoundCache(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	now := time.Now()
+	client := quotacontrol.NewClient(slog.Default(), Service, cfg, nil)
+
+	limit := proto.Limit{}
+	limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 100, FreeMax: 10, OverMax: 20})
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+
+	// the server is not called again for an unknown key
+	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+	_, err := client.FetchKeyQuota(ctx, key, "", nil, now)
+	require.ErrorIs(t, err, proto.ErrAccessKeyNotFound)
+	server.SetErrGetAccessQuota(proto.ErrWebrpcInternalError)
+	_, err = client.FetchKeyQuota(ctx, key, "", nil, now)
+	require.ErrorIs(t, err, proto.ErrAccessKeyNotFound)
+
+	// the same for an unknown project, until a key is created
+	server.SetErrGetProjectQuota(proto.ErrProjectNotFound)
+	_, err = client.FetchProjectQuota(ctx, ProjectID, nil, now)
+	require.ErrorIs(t, err, proto.ErrProjectNotFound)
+	server.SetErrGetProjectQuota(proto.ErrWebrpcInternalError)
+	_, err = client.FetchProjectQuota(ctx, ProjectID, nil, now)
+	require.ErrorIs(t, err, proto.ErrProjectNotFound)
+
+	server.SetErrGetProjectQuota(nil)
+	_, err = server.CreateAccessKey(ctx, ProjectID, "new", false, nil, nil, nil, nil)
+	require.NoError(t, err)
+	quota, err := client.FetchProjectQuota(ctx, ProjectID, nil, now)
+	require.NoError(t, err)
+	assert.Equal(t, ProjectID, quota.GetProjectID())
+
+	// the entries expire after the ttl
+	cfg.NotFoundTTL = time.Second
+	client = quotacontrol.NewClient(slog.Default(), Service, cfg, nil)
+	server.SetErrGetAccessQuota(nil)
+	key = authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+	_, err = client.FetchKeyQuota(ctx, key, "", nil, now)
+	require.ErrorIs(t, err, proto.ErrAccessKeyNotFound)
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID}))
+	_, err = client.FetchKeyQuota(ctx, key, "", nil, now)
+	require.ErrorIs(t, err, proto.ErrAccessKeyNotFound)
+	server.FastForward(time.Second)
+	_, err = client.FetchKeyQuota(ctx, key, "", nil, now)
+	require.NoError(t, err)
+}
+
+func TestCoalescing(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+	server.SetFetchDelay(100 * time.Millisecond)
+
+	ctx := context.Background()
+	now := time.Now()
+	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+
+	limit := proto.Limit{}
+	limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 100, FreeMax: 10, OverMax: 20})
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID}))
+	require.NoError(t, server.Store.SetUserPermission(ctx, ProjectID, WalletAddress, proto.UserPermission_READ, proto.ResourceAccess{ProjectID: ProjectID}))
+
+	client := quotacontrol.NewClient(slog.Default(), Service, cfg, nil)
+
+	const requests = 100
+	run := func(fn func()) {
+		var wg sync.WaitGroup
+		for range requests {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fn()
+			}()
+		}
+		wg.Wait()
+	}
+
+	run(func() {
+		quota, err := client.FetchKeyQuota(ctx, key, "", nil, now)
+		assert.NoError(t, err)
+		assert.Equal(t, key, quota.AccessKey.AccessKey)
+	})
+	assert.Equal(t, 1, server.GetCalls("GetAccessQuota"))
+
+	run(func() {
+		quota, err := client.FetchProjectQuota(ctx, ProjectID, nil, now)
+		assert.NoError(t, err)
+		assert.Equal(t, ProjectID, quota.GetProjectID())
+	})
+	assert.Equal(t, 1, server.GetCalls("GetProjectQuota"))
+
+	userCtx := authcontrol.WithAccount(ctx, WalletAddress)
+	run(func() {
+		perm, _, err := client.FetchPermission(userCtx, ProjectID)
+		assert.NoError(t, err)
+		assert.Equal(t, proto.UserPermission_READ, perm)
+	})
+	assert.Equal(t, 1, server.GetCalls("GetUserPermission"))
+
+	assert.Equal(t, quotacontrol.ClientStats{
+		QuotaFetches:        2,
+		QuotaCoalesced:      2*requests - 2,
+		PermissionFetches:   1,
+		PermissionCoalesced: requests - 1,
+	}, client.Stats())
+
+	// the shared call outlives the caller that started it
+	otherKey := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: otherKey, ProjectID: ProjectID}))
+
+	firstCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	first := make(chan struct{})
+	go func() {
+		defer close(first)
+		client.FetchKeyQuota(firstCtx, otherKey, "", nil, now)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	run(func() {
+		quota, err := client.FetchKeyQuota(ctx, otherKey, "", nil, now)
+		assert.NoError(t, err)
+		if assert.NotNil(t, quota) {
+			assert.Equal(t, otherKey, quota.AccessKey.AccessKey)
+		}
+	})
+	<-first
+	assert.Equal(t, 2, server.GetCalls("GetAccessQuota"))
+}
+
+func TestFailPolicy(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+
+	limit := proto.Limit{}
+	limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 100, FreeMax: 10, OverMax: 20})
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID}))
+
+	// the quota server is down
+	server.SetErrGetAccessQuota(proto.ErrWebrpcInternalError)
+
+	newRouter := func(fail quotacontrol.FailConfig, decisions *[]middleware.Degradation) http.Handler {
+		client := quotacontrol.NewClient(slog.Default(), Service, cfg, nil)
+		authOptions := authcontrol.Options{JWTSecret: Secret}
+		quotaOptions := middleware.Options{
+			Fail: fail,
+			OnDegraded: func(r *http.Request, d middleware.Degradation) {
+				*decisions = append(*decisions, d)
+			},
+		}
+		r := chi.NewRouter()
+		r.Use(authcontrol.VerifyToken(authOptions))
+		r.Use(authcontrol.Session(authOptions))
+		r.Use(middleware.VerifyQuota(client, quotaOptions))
+		r.Handle("/*", new(hitCounter))
+		return r
+	}
+
+	t.Run("Open", func(t *testing.T) {
+		var decisions []middleware.Degradation
+		r := newRouter(quotacontrol.FailConfig{}, &decisions)
+		ok, headers, err := executeRequest(ctx, r, "", key, "")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "open", headers.Get(middleware.HeaderQuotaDegraded))
+		assert.Equal(t, []middleware.Degradation{{Policy: middleware.FailOpen, Key: key, Allowed: true}}, decisions)
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		var decisions []middleware.Degradation
+		r := newRouter(quotacontrol.FailConfig{Policy: middleware.FailClosed}, &decisions)
+		ok, headers, err := executeRequest(ctx, r, "", key, "")
+		require.ErrorIs(t, err, proto.ErrQuotaUnavailable)
+		assert.False(t, ok)
+		assert.Equal(t, "closed", headers.Get(middleware.HeaderQuotaDegraded))
+		assert.Equal(t, []middleware.Degradation{{Policy: middleware.FailClosed, Key: key}}, decisions)
+	})
+
+	t.Run("Degraded", func(t *testing.T) {
+		var decisions []middleware.Degradation
+		r := newRouter(quotacontrol.FailConfig{Policy: middleware.FailDegraded, DegradedRPM: 2}, &decisions)
+		for range 2 {
+			ok, headers, err := executeRequest(ctx, r, "", key, "")
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "degraded", headers.Get(middleware.HeaderQuotaDegraded))
+		}
+		ok, _, err := executeRequest(ctx, r, "", key, "")
+		require.ErrorIs(t, err, proto.ErrQuotaRateLimit)
+		assert.False(t, ok)
+		require.Len(t, decisions, 3)
+		assert.True(t, decisions[1].Allowed)
+		assert.False(t, decisions[2].Allowed)
+	})
+
+	// the project quota is down too, and the requests of the project sessions have both quotas missing
+	server.SetErrGetProjectQuota(proto.ErrWebrpcInternalError)
+	server.Store.SetUserPermission(ctx, ProjectID, WalletAddress, proto.UserPermission_READ, proto.ResourceAccess{ProjectID: ProjectID})
+	token := authcontrol.S2SToken(Secret, map[string]any{"project": ProjectID, "account": WalletAddress})
+
+	t.Run("DegradedProject", func(t *testing.T) {
+		var decisions []middleware.Degradation
+		r := newRouter(quotacontrol.FailConfig{Policy: middleware.FailDegraded, DegradedRPM: 1}, &decisions)
+		// the request is counted once by the degraded limit
+		ok, _, err := executeRequest(ctx, r, "", key, token)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, []middleware.Degradation{{Policy: middleware.FailDegraded, Key: key, Allowed: true}}, decisions)
+		ok, _, err = executeRequest(ctx, r, "", key, token)
+		require.ErrorIs(t, err, proto.ErrQuotaRateLimit)
+		assert.False(t, ok)
+	})
+
+	t.Run("OpenPermission", func(t *testing.T) {
+		var decisions []middleware.Degradation
+		r := newRouter(quotacontrol.FailConfig{}, &decisions)
+		// the permission of the account is checked without quota
+		other := authcontrol.S2SToken(Secret, map[string]any{"project": ProjectID, "account": "otherAddress"})
+		ok, _, err := executeRequest(ctx, r, "", "", other)
+		require.ErrorIs(t, err, proto.ErrUnauthorizedUser)
+		assert.False(t, ok)
+		assert.Empty(t, decisions)
+
+		ok, _, err = executeRequest(ctx, r, "", "", token)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, []middleware.Degradation{{Policy: middleware.FailOpen, Key: strconv.FormatUint(ProjectID, 10), Allowed: true}}, decisions)
+	})
+
+	t.Run("Available", func(t *testing.T) {
+		server.SetErrGetAccessQuota(nil)
+		server.SetErrGetProjectQuota(nil)
+		var decisions []middleware.Degradation
+		r := newRouter(quotacontrol.FailConfig{Policy: middleware.FailClosed}, &decisions)
+		ok, headers, err := executeRequest(ctx, r, "", key, "")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Empty(t, headers.Get(middleware.HeaderQuotaDegraded))
+		assert.Empty(t, decisions)
+	})
+}
+
+func TestResilientClient(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	now := time.Now()
+	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+
+	limit := proto.Limit{}
+	limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 100, FreeMax: 10, OverMax: 20})
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID}))
+
+	qc := quotacontrol.NewResilientClient(proto.NewQuotaControlClient(cfg.URL, http.DefaultClient), quotacontrol.ResilienceConfig{
+		Timeout:         50 * time.Millisecond,
+		Retries:         2,
+		RetryBackoff:    time.Millisecond,
+		BreakerFailures: 4,
+		BreakerCooldown: 100 * time.Millisecond,
+	})
+
+	// the reads are retried on failures, but not on errors of the request
+	server.SetErrGetAccessQuota(proto.ErrWebrpcInternalError)
+	_, err := qc.GetAccessQuota(ctx, key, now)
+	require.ErrorIs(t, err, proto.ErrWebrpcInternalError)
+	assert.Equal(t, 3, server.GetCalls("GetAccessQuota"))
+	assert.Equal(t, quotacontrol.BreakerClosed, qc.State())
+
+	server.SetErrGetAccessQuota(proto.ErrAccessKeyNotFound)
+	_, err = qc.GetAccessQuota(ctx, key, now)
+	require.ErrorIs(t, err, proto.ErrAccessKeyNotFound)
+	assert.Equal(t, 4, server.GetCalls("GetAccessQuota"))
+
+	// the calls time out, and the breaker opens after the consecutive failures
+	server.SetErrGetAccessQuota(nil)
+	server.SetFetchDelay(200 * time.Millisecond)
+	_, err = qc.GetAccessQuota(ctx, key, now)
+	require.ErrorIs(t, err, proto.ErrWebrpcRequestFailed)
+	_, err = qc.GetAccessQuota(ctx, key, now)
+	require.ErrorIs(t, err, proto.ErrQuotaUnavailable)
+	assert.Equal(t, quotacontrol.BreakerOpen, qc.State())
+
+	// the breaker lets a call through after the cooldown
+	server.SetFetchDelay(0)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, quotacontrol.BreakerHalfOpen, qc.State())
+	quota, err := qc.GetAccessQuota(ctx, key, now)
+	require.NoError(t, err)
+	assert.Equal(t, key, quota.AccessKey.AccessKey)
+	assert.Equal(t, quotacontrol.BreakerClosed, qc.State())
+
+	// with the breaker open the client has no quota, so the fail policy applies
+	cfg.Resilience = quotacontrol.ResilienceConfig{Retries: -1, BreakerFailures: 1, BreakerCooldown: time.Minute}
+	client := quotacontrol.NewClient(slog.Default(), Service, cfg, nil)
+	server.SetErrGetProjectQuota(proto.ErrWebrpcInternalError)
+	quota, err = client.FetchProjectQuota(ctx, ProjectID, nil, now)
+	require.NoError(t, err)
+	assert.Nil(t, quota)
+	assert.Equal(t, quotacontrol.BreakerOpen, client.Stats().Breaker)
+}
+
+func TestEnsureUsage(t *testing.T) {
+	cfg := newConfig()
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+	// slower than the old polling, which gave up after 600ms
+	server.SetFetchDelay(800 * time.Millisecond)
+
+	ctx := context.Background()
+	now := time.Now()
+	cycle := &proto.Cycle{Start: now.Add(-time.Hour), End: now.Add(time.Hour)}
+
+	// two instances share the cache
+	clients := []*quotacontrol.Client{
+		quotacontrol.NewClient(slog.Default(), Service, cfg, nil),
+		quotacontrol.NewClient(slog.Default(), Service, cfg, nil),
+	}
+
+	const requests = 50
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			usage, err := clients[i%2].EnsureUsage(ctx, ProjectID, cycle, now)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), usage)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, server.GetCalls("GetUsage"))
+
+	// the wait is bounded by the timeout
+	server.FlushCache(ctx)
+	cfg.UsageWaitTimeout = 100 * time.Millisecond
+	client := quotacontrol.NewClient(slog.Default(), Service, cfg, nil)
+	_, err := client.EnsureUsage(ctx, ProjectID, cycle, now)
+	require.ErrorIs(t, err, proto.ErrTimeout)
+}
+
+func TestPrewarmUsage(t *testing.T) {
+	cfg := newConfig()
+	cfg.PrewarmWindow = time.Second
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	now := time.Now()
+	limit := proto.Limit{}
+	limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 100, FreeMax: 10, OverMax: 20})
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+
+	client := quotacontrol.NewClient(slog.Default(), Service, cfg, nil)
+	runCtx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	go client.Run(runCtx)
+
+	// the cycle ends within the prewarm window, its end is the start of its last day
+	cycle := &proto.Cycle{Start: now.AddDate(0, 0, -2), End: now.Add(300*time.Millisecond).AddDate(0, 0, -1)}
+	_, err := client.EnsureUsage(ctx, ProjectID, cycle, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, server.GetCalls("GetUsage"))
+
+	// the usage of the next cycle is loaded before it starts
+	assert.Eventually(t, func() bool {
+		return server.GetCalls("GetUsage") == 2
+	}, 2*time.Second, 50*time.Millisecond)
+
+	next := cycle.End.AddDate(0, 0, 1)
+	quota, err := server.GetProjectQuota(ctx, ProjectID, next)
+	require.NoError(t, err)
+	_, err = client.EnsureUsage(ctx, ProjectID, quota.Cycle, next)
+	require.NoError(t, err)
+	assert.Equal(t, 2, server.GetCalls("GetUsage"))
+
+	// the usage lasts until the end of the cycle, not for the TTL of the cache
+	server.FastForward(2 * time.Hour)
+	_, err = client.EnsureUsage(ctx, ProjectID, cycle, now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, server.GetCalls("GetUsage"))
+
+	// the quota of the next cycle doesn't replace the cached one of the current cycle
+	otherProjectID := ProjectID + 1
+	nextCycle := &proto.Cycle{Start: now.AddDate(0, 0, 1), End: now.AddDate(0, 1, 0)}
+	require.NoError(t, server.Store.SetProjectInfo(ctx, otherProjectID, &proto.ProjectInfo{Cycle: nextCycle}))
+	require.NoError(t, server.Store.SetAccessLimit(ctx, otherProjectID, &limit))
+	_, err = server.GetProjectQuota(ctx, otherProjectID, nextCycle.Start)
+	require.NoError(t, err)
+
+	rc := redis.NewClient(&redis.Options{Addr: fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port)})
+	_, err = quotacontrol.NewRedisCache(rc, time.Minute).GetProjectQuota(ctx, otherProjectID)
+	assert.ErrorIs(t, err, proto.ErrAccessKeyNotFound)
+}
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	collector, err := metrics.NewPrometheus(reg, "")
+	require.NoError(t, err)
+
+	cfg := newConfig()
+	cfg.Metrics.Collector = collector
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+
+	limit := proto.Limit{}
+	limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 2, FreeMax: 10, OverMax: 20})
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID}))
+
+	logger := slog.Default()
+	client := quotacontrol.NewClient(logger, Service, cfg, nil)
+	go client.Run(ctx)
+
+	authOptions := authcontrol.Options{JWTSecret: Secret}
+	quotaOptions := middleware.Options{Metrics: client.Metrics()}
+	r := chi.NewRouter()
+	r.Use(authcontrol.VerifyToken(authOptions))
+	r.Use(authcontrol.Session(authOptions))
+	r.Use(middleware.VerifyQuota(client, quotaOptions))
+	r.Use(middleware.RateLimit(client, cfg.RateLimiter, quotacontrol.NewLimitCounter(Service, cfg.Redis, logger), quotaOptions))
+	r.Use(middleware.SpendUsage(client, quotaOptions))
+	r.Handle("/*", new(hitCounter))
+
+	for range 2 {
+		ok, _, err := executeRequest(ctx, r, "", key, "")
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+	ok, _, err := executeRequest(ctx, r, "", key, "")
+	require.ErrorIs(t, err, proto.ErrQuotaRateLimit)
+	assert.False(t, ok)
+	client.Stop(ctx)
+
+	count := func(name string, labels prometheus.Labels) float64 {
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		for _, f := range families {
+			if f.GetName() != name {
+				continue
+			}
+		metrics:
+			for _, m := range f.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+						continue metrics
+					}
+				}
+				if h := m.GetHistogram(); h != nil {
+					return float64(h.GetSampleCount())
+				}
+				return m.GetCounter().GetValue() + m.GetGauge().GetValue()
+			}
+		}
+		return 0
+	}
+
+	assert.Equal(t, 1.0, count("quotacontrol_cache_lookups_total", prometheus.Labels{"cache": "quota", "result": metrics.CacheMiss}))
+	assert.Equal(t, 2.0, count("quotacontrol_cache_lookups_total", prometheus.Labels{"cache": "quota", "result": metrics.CacheHit}))
+	assert.Equal(t, 1.0, count("quotacontrol_server_fetches_total", prometheus.Labels{"kind": "quota", "coalesced": "false"}))
+	assert.Equal(t, 1.0, count("quotacontrol_breaker_state", prometheus.Labels{"state": "closed"}))
+	assert.Equal(t, 2.0, count("quotacontrol_spend_quota_duration_seconds", prometheus.Labels{"result": metrics.SpendSpent}))
+	assert.Equal(t, 1.0, count("quotacontrol_middleware_denials_total", prometheus.Labels{"middleware": "rate_limit", "status": "429"}))
+	assert.Equal(t, 1.0, count("quotacontrol_usage_syncs_total", prometheus.Labels{"result": "ok"}))
+	assert.Equal(t, 0.0, count("quotacontrol_usage_backlog", nil))
+	assert.Equal(t, 1.0, count("quotacontrol_rpc_duration_seconds", prometheus.Labels{"method": "GetAccessQuota", "status": "200"}))
+	assert.Equal(t, 1.0, count("quotacontrol_rpc_duration_seconds", prometheus.Labels{"method": "GetUsage", "status": "200"}))
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	cfg := newConfig()
+	cfg.Tracing.Provider = provider
+	cfg.Tracing.Propagator = propagation.TraceContext{}
+	server, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	ctx := context.Background()
+	key := authcontrol.GenerateAccessKey(authcontrol.WithVersion(ctx, 1), ProjectID)
+
+	limit := proto.Limit{}
+	limit.SetSetting(Service, proto.ServiceLimit{RateLimit: 1, FreeMax: 10, OverMax: 20})
+	require.NoError(t, server.Store.SetAccessLimit(ctx, ProjectID, &limit))
+	require.NoError(t, server.Store.InsertAccessKey(ctx, &proto.AccessKey{Active: true, AccessKey: key, ProjectID: ProjectID}))
+
+	logger := slog.Default()
+	client := quotacontrol.NewClient(logger, Service, cfg, nil)
+
+	authOptions := authcontrol.Options{JWTSecret: Secret}
+	quotaOptions := middleware.Options{Tracer: client.Tracer()}
+	r := chi.NewRouter()
+	r.Use(authcontrol.VerifyToken(authOptions))
+	r.Use(authcontrol.Session(authOptions))
+	r.Use(middleware.VerifyQuota(client, quotaOptions))
+	r.Use(middleware.RateLimit(client, cfg.RateLimiter, quotacontrol.NewLimitCounter(Service, cfg.Redis, logger), quotaOptions))
+	r.Use(middleware.SpendUsage(client, quotaOptions))
+	r.Handle("/*", new(hitCounter))
+
+	request := func() []sdktrace.ReadOnlySpan {
+		recorder.Reset()
+		ctx, span := provider.Tracer("test").Start(ctx, "request")
+		executeRequest(ctx, r, "", key, "")
+		span.End()
+		return recorder.Ended()
+	}
+	find := func(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+		for _, s := range spans {
+			if s.Name() == name {
+				return s
+			}
+		}
+		require.Fail(t, "span not found", name)
+		return nil
+	}
+	attr := func(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+		for _, kv := range span.Attributes() {
+			if kv.Key == key {
+				return kv.Value.Emit()
+			}
+		}
+		return ""
+	}
+
+	spans := request()
+	root := find(spans, "request")
+	for _, s := range spans {
+		assert.Equal(t, root.SpanContext().TraceID(), s.SpanContext().TraceID(), s.Name())
+	}
+
+	// the middlewares are siblings, the client methods are their children
+	verify := find(spans, "middleware.VerifyQuota")
+	assert.Equal(t, root.SpanContext().SpanID(), verify.Parent().SpanID())
+	assert.Equal(t, tracing.Allowed, attr(verify, tracing.DecisionKey))
+	assert.Equal(t, strconv.FormatUint(ProjectID, 10), attr(verify, tracing.ProjectIDKey))
+	assert.Equal(t, Service.GetName(), attr(verify, tracing.ServiceKey))
+	spend := find(spans, "middleware.SpendUsage")
+	assert.Equal(t, root.SpanContext().SpanID(), spend.Parent().SpanID())
+
+	fetch := find(spans, "Client.FetchKeyQuota")
+	assert.Equal(t, verify.SpanContext().SpanID(), fetch.Parent().SpanID())
+	assert.Equal(t, metrics.CacheMiss, attr(fetch, tracing.CacheKey))
+	assert.Equal(t, metrics.SpendSpent, attr(find(spans, "Client.SpendQuota"), tracing.DecisionKey))
+	find(spans, "Client.EnsureUsage")
+	find(spans, "RateLimiter.Allow")
+
+	// the quota server continues the trace of the client
+	var rpcs []sdktrace.ReadOnlySpan
+	for _, s := range spans {
+		if s.Name() == "QuotaControl/GetAccessQuota" {
+			rpcs = append(rpcs, s)
+		}
+	}
+	require.Len(t, rpcs, 2)
+	slices.SortFunc(rpcs, func(a, b sdktrace.ReadOnlySpan) int { return int(a.SpanKind()) - int(b.SpanKind()) })
+	assert.Equal(t, trace.SpanKindServer, rpcs[0].SpanKind())
+	assert.Equal(t, trace.SpanKindClient, rpcs[1].SpanKind())
+	assert.Equal(t, rpcs[1].SpanContext().SpanID(), rpcs[0].Parent().SpanID())
+	assert.Equal(t, fetch.SpanContext().SpanID(), rpcs[1].Parent().SpanID())
+
+	// the rejected requests are recorded in the span of the middleware
+	spans = request()
+	limited := find(spans, "middleware.RateLimit")
+	assert.Equal(t, tracing.Denied, attr(limited, tracing.DecisionKey))
+	assert.Equal(t, codes.Error, limited.Status().Code)
+	assert.Equal(t, tracing.Denied, attr(find(spans, "RateLimiter.Allow"), tracing.DecisionKey))
+	assert.Equal(t, metrics.CacheHit, attr(find(spans, "Client.FetchKeyQuota"), tracing.CacheKey))
+}
+
+func TestUsageJournal(t *testing.T) {
+	cfg := newConfig()
+	_, cleanup := mock.NewServer(&cfg)
+	t.Cleanup(cleanup)
+
+	cfg.UsageJournal = filepath.Join(t.TempDir(), "usage.journal")
+	require.NoError(t, cfg.Validate())
+	assert.NotNil(t, quotacontrol.NewClient(slog.Default(), Service, cfg, nil))
+
+	// the journal that can't be opened is reported by Validate, the client keeps the usage in memory
+	cfg.UsageJournal = filepath.Join(t.TempDir(), "missing", "usage.journal")
+	require.Error(t, cfg.Validate())
+	assert.NotNil(t, quotacontrol.NewClient(slog.Default(), Service, cfg, nil))
 }
@@ -0,0 +1,72 @@
+package quotacontrol
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/0xsequence/quotacontrol/metrics"
+	"github.com/0xsequence/quotacontrol/proto"
+)
+
+// ClientStats are the counters of the calls made by the client to the quota server on cache misses, and the state of its breaker.
+type ClientStats struct {
+	// QuotaFetches is the number of GetProjectQuota and GetAccessQuota calls.
+	QuotaFetches int64
+	// QuotaCoalesced is the number of quota misses that shared the result of a call in flight.
+	QuotaCoalesced int64
+	// PermissionFetches is the number of GetUserPermission calls.
+	PermissionFetches int64
+	// PermissionCoalesced is the number of permission misses that shared the result of a call in flight.
+	PermissionCoalesced int64
+	// Breaker is the state of the circuit breaker of the calls to the quota server.
+	Breaker BreakerState
+}
+
+type clientStats struct {
+	quotaFetches        atomic.Int64
+	quotaCoalesced      atomic.Int64
+	permissionFetches   atomic.Int64
+	permissionCoalesced atomic.Int64
+}
+
+// countFetch counts a call to the server, or a coalesced one if it joined a call in flight.
+func (c *Client) countFetch(kind string, fetches, coalesced *atomic.Int64, joined bool) {
+	c.metrics.ServerFetch(kind, joined)
+	if joined {
+		coalesced.Add(1)
+		return
+	}
+	fetches.Add(1)
+}
+
+// permissionResult is the result of GetUserPermission shared by the coalesced calls.
+type permissionResult struct {
+	perm   proto.UserPermission
+	access *proto.ResourceAccess
+}
+
+// lookupResult returns the result of a quota cache lookup, misses are the errors of the keys that are not cached.
+func lookupResult(err error, misses ...error) string {
+	if err == nil || errors.Is(err, ErrCachedNotFound) {
+		return metrics.CacheHit
+	}
+	for _, miss := range misses {
+		if errors.Is(err, miss) {
+			return metrics.CacheMiss
+		}
+	}
+	return metrics.CacheError
+}
+
+// spendResult returns the result of a SpendQuota call.
+func spendResult(spent bool, err error) string {
+	switch {
+	case errors.Is(err, proto.ErrQuotaExceeded):
+		return metrics.SpendExceeded
+	case err != nil:
+		return metrics.SpendError
+	case spent:
+		return metrics.SpendSpent
+	}
+	return metrics.SpendSkipped
+}
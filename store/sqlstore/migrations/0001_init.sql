@@ -0,0 +1,47 @@
+CREATE TABLE projects (
+    id            INTEGER PRIMARY KEY,
+    ecosystem_id  INTEGER NOT NULL DEFAULT 0,
+    cycle_start   INTEGER,
+    chain_ids     TEXT NOT NULL DEFAULT '[]',
+    features      TEXT NOT NULL DEFAULT '[]'
+);
+
+CREATE TABLE limits (
+    project_id    INTEGER PRIMARY KEY,
+    config        TEXT NOT NULL
+);
+
+CREATE TABLE access_keys (
+    access_key        TEXT PRIMARY KEY,
+    project_id        INTEGER NOT NULL,
+    display_name      TEXT NOT NULL DEFAULT '',
+    active            BOOLEAN NOT NULL DEFAULT TRUE,
+    is_default        BOOLEAN NOT NULL DEFAULT FALSE,
+    require_origin    BOOLEAN NOT NULL DEFAULT FALSE,
+    allowed_origins   TEXT NOT NULL DEFAULT '[]',
+    allowed_services  TEXT NOT NULL DEFAULT '[]',
+    created_at        INTEGER NOT NULL
+);
+
+CREATE INDEX access_keys_project_id_idx ON access_keys (project_id, created_at);
+
+-- usage is bucketed by day (unix seconds of midnight UTC) and service.
+-- An empty access_key holds the usage not tied to a key (async usage).
+CREATE TABLE usage (
+    project_id    INTEGER NOT NULL,
+    access_key    TEXT NOT NULL,
+    service       INTEGER NOT NULL,
+    day           INTEGER NOT NULL,
+    usage         INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (project_id, access_key, service, day)
+);
+
+CREATE INDEX usage_project_day_idx ON usage (project_id, day);
+
+CREATE TABLE user_permissions (
+    project_id    INTEGER NOT NULL,
+    user_id       TEXT NOT NULL,
+    permission    INTEGER NOT NULL,
+    access        TEXT NOT NULL DEFAULT '{}',
+    PRIMARY KEY (project_id, user_id)
+);
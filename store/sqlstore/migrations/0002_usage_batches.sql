@@ -0,0 +1,7 @@
+-- usage_batches keeps the processed sync batches, so that replays are ignored.
+CREATE TABLE usage_batches (
+    id            TEXT PRIMARY KEY,
+    created_at    INTEGER NOT NULL
+);
+
+CREATE INDEX usage_batches_created_at_idx ON usage_batches (created_at);
@@ -0,0 +1,26 @@
+-- credit_grants are the prepaid credits of a project, spent after the free usage and before the overage.
+CREATE TABLE credit_grants (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    project_id    INTEGER NOT NULL,
+    service       INTEGER NOT NULL,
+    amount        INTEGER NOT NULL,
+    used          INTEGER NOT NULL DEFAULT 0,
+    description   TEXT NOT NULL DEFAULT '',
+    created_at    INTEGER NOT NULL,
+    expires_at    INTEGER NOT NULL,
+    revoked_at    INTEGER
+);
+
+CREATE INDEX credit_grants_project_id_idx ON credit_grants (project_id, service);
+
+-- credit_usage is the usage paid with each grant, bucketed by day like usage.
+CREATE TABLE credit_usage (
+    project_id    INTEGER NOT NULL,
+    grant_id      INTEGER NOT NULL,
+    service       INTEGER NOT NULL,
+    day           INTEGER NOT NULL,
+    usage         INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (grant_id, day)
+);
+
+CREATE INDEX credit_usage_project_day_idx ON credit_usage (project_id, day);
@@ -0,0 +1,5 @@
+-- usage keeps the allowed usage, split in free, credit and overage, plus the limited usage that was rejected.
+-- The free usage is usage - credit - overage, so the rows written before the breakdown are free.
+ALTER TABLE usage ADD COLUMN credit INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE usage ADD COLUMN overage INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE usage ADD COLUMN limited INTEGER NOT NULL DEFAULT 0;
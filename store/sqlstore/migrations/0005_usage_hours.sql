@@ -0,0 +1,19 @@
+-- usage_hours is the usage bucketed by hour (unix seconds), for the hourly history.
+-- It's written together with usage, and it can be pruned with PruneUsageHours.
+CREATE TABLE usage_hours (
+    project_id    INTEGER NOT NULL,
+    access_key    TEXT NOT NULL,
+    service       INTEGER NOT NULL,
+    hour          INTEGER NOT NULL,
+    usage         INTEGER NOT NULL DEFAULT 0,
+    credit        INTEGER NOT NULL DEFAULT 0,
+    overage       INTEGER NOT NULL DEFAULT 0,
+    limited       INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (project_id, access_key, service, hour)
+);
+
+CREATE INDEX usage_hours_project_hour_idx ON usage_hours (project_id, hour);
+
+-- The usage recorded before is only known by day, it's seeded in the first hour of its day.
+INSERT INTO usage_hours (project_id, access_key, service, hour, usage, credit, overage, limited)
+SELECT project_id, access_key, service, day, usage, credit, overage, limited FROM usage;
@@ -0,0 +1,2 @@
+-- expires_at is set on the old access key when it's rotated with a grace period.
+ALTER TABLE access_keys ADD COLUMN expires_at INTEGER;
@@ -0,0 +1,2 @@
+-- service_limit keeps the limits of the access key by service, enforced together with the ones of the project.
+ALTER TABLE access_keys ADD COLUMN service_limit TEXT NOT NULL DEFAULT '{}';
@@ -0,0 +1,2 @@
+-- allowed_chain_ids restricts the access key to a subset of the chains of the project, empty allows them all.
+ALTER TABLE access_keys ADD COLUMN allowed_chain_ids TEXT NOT NULL DEFAULT '[]';
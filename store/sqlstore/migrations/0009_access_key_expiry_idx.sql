@@ -0,0 +1,2 @@
+-- access_keys_expires_at_idx finds the rotated access keys past their grace period.
+CREATE INDEX access_keys_expires_at_idx ON access_keys (expires_at) WHERE active = 1 AND expires_at IS NOT NULL;
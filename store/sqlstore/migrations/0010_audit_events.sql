@@ -0,0 +1,15 @@
+-- audit_events records the changes made by the server to the projects and their access keys.
+-- before, after and credit_grant are stored as JSON, NULL when missing.
+CREATE TABLE audit_events (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    project_id    INTEGER NOT NULL,
+    actor         TEXT NOT NULL,
+    rpc           TEXT NOT NULL,
+    before        TEXT,
+    after         TEXT,
+    credit_grant  TEXT,
+    service       INTEGER,
+    created_at    INTEGER NOT NULL
+);
+
+CREATE INDEX audit_events_project_id_idx ON audit_events (project_id, created_at);
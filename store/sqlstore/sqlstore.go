@@ -0,0 +1,832 @@
+// Package sqlstore is a persistent implementation of the quotacontrol stores on top of SQLite.
+//
+// Queries use `?` placeholders and `ON CONFLICT` upserts, so only SQLite is supported:
+// other databases (e.g. Postgres with `$1` placeholders) won't work with it.
+// Call Migrate before using the store to create or update the schema.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/0xsequence/quotacontrol"
+	"github.com/0xsequence/quotacontrol/proto"
+)
+
+var (
+	_ quotacontrol.ProjectInfoStore = (*Store)(nil)
+	_ quotacontrol.LimitStore       = (*Store)(nil)
+	_ quotacontrol.AccessKeyStore   = (*Store)(nil)
+	_ quotacontrol.UsageStore       = (*Store)(nil)
+	_ quotacontrol.PermissionStore  = (*Store)(nil)
+	_ quotacontrol.CreditStore      = (*Store)(nil)
+	_ quotacontrol.AuditStore       = (*Store)(nil)
+)
+
+// New returns a new SQL store using the given database.
+func New(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Store implements all the quotacontrol store interfaces.
+type Store struct {
+	db *sql.DB
+}
+
+// Stores returns a quotacontrol.Store backed by s.
+func (s *Store) Stores() quotacontrol.Store {
+	return quotacontrol.Store{
+		ProjectInfoStore: s,
+		LimitStore:       s,
+		AccessKeyStore:   s,
+		UsageStore:       s,
+		PermissionStore:  s,
+		CreditStore:      s,
+		AuditStore:       s,
+	}
+}
+
+// SetProjectInfo creates or updates a project, a nil info deletes it.
+// The start of info.Cycle is used as anchor for the monthly cycles.
+func (s *Store) SetProjectInfo(ctx context.Context, projectID uint64, info *proto.ProjectInfo) error {
+	if info == nil {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM projects WHERE id = ?`, projectID); err != nil {
+			return fmt.Errorf("delete project: %w", err)
+		}
+		return nil
+	}
+
+	var cycleStart *int64
+	if info.Cycle != nil && !info.Cycle.Start.IsZero() {
+		cycleStart = proto.Ptr(info.Cycle.Start.Unix())
+	}
+	chainIDs, err := marshalJSON(info.ChainIDs)
+	if err != nil {
+		return fmt.Errorf("marshal chain ids: %w", err)
+	}
+	features, err := marshalJSON(info.Features)
+	if err != nil {
+		return fmt.Errorf("marshal features: %w", err)
+	}
+
+	const query = `INSERT INTO projects (id, ecosystem_id, cycle_start, chain_ids, features) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET ecosystem_id = excluded.ecosystem_id, cycle_start = excluded.cycle_start,
+		chain_ids = excluded.chain_ids, features = excluded.features`
+	if _, err := s.db.ExecContext(ctx, query, projectID, info.EcosystemID, cycleStart, chainIDs, features); err != nil {
+		return fmt.Errorf("upsert project: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) GetProjectInfo(ctx context.Context, projectID uint64, now time.Time) (*proto.ProjectInfo, error) {
+	const query = `SELECT ecosystem_id, cycle_start, chain_ids, features FROM projects WHERE id = ?`
+
+	var (
+		info               = proto.ProjectInfo{ID: projectID}
+		cycleStart         sql.NullInt64
+		chainIDs, features string
+	)
+	err := s.db.QueryRowContext(ctx, query, projectID).Scan(&info.EcosystemID, &cycleStart, &chainIDs, &features)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, proto.ErrProjectNotFound
+		}
+		return nil, fmt.Errorf("select project: %w", err)
+	}
+	if err := json.Unmarshal([]byte(chainIDs), &info.ChainIDs); err != nil {
+		return nil, fmt.Errorf("unmarshal chain ids: %w", err)
+	}
+	if err := json.Unmarshal([]byte(features), &info.Features); err != nil {
+		return nil, fmt.Errorf("unmarshal features: %w", err)
+	}
+	if cycleStart.Valid {
+		info.Cycle = monthlyCycle(time.Unix(cycleStart.Int64, 0).UTC(), now)
+	}
+	return &info, nil
+}
+
+// SetAccessLimit creates or updates the limit of a project, creating the project if missing.
+func (s *Store) SetAccessLimit(ctx context.Context, projectID uint64, limit *proto.Limit) error {
+	config, err := json.Marshal(limit)
+	if err != nil {
+		return fmt.Errorf("marshal limit: %w", err)
+	}
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO projects (id) VALUES (?) ON CONFLICT (id) DO NOTHING`, projectID); err != nil {
+			return fmt.Errorf("insert project: %w", err)
+		}
+		const query = `INSERT INTO limits (project_id, config) VALUES (?, ?)
+			ON CONFLICT (project_id) DO UPDATE SET config = excluded.config`
+		if _, err := tx.ExecContext(ctx, query, projectID, string(config)); err != nil {
+			return fmt.Errorf("upsert limit: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *Store) GetAccessLimit(ctx context.Context, projectID uint64, cycle *proto.Cycle) (*proto.Limit, error) {
+	var config string
+	err := s.db.QueryRowContext(ctx, `SELECT config FROM limits WHERE project_id = ?`, projectID).Scan(&config)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, proto.ErrProjectNotFound
+		}
+		return nil, fmt.Errorf("select limit: %w", err)
+	}
+	var limit proto.Limit
+	if err := json.Unmarshal([]byte(config), &limit); err != nil {
+		return nil, fmt.Errorf("unmarshal limit: %w", err)
+	}
+	return &limit, nil
+}
+
+const accessKeyColumns = `access_key, project_id, display_name, active, is_default, require_origin, allowed_origins, allowed_services, created_at, expires_at, service_limit, allowed_chain_ids`
+
+func (s *Store) InsertAccessKey(ctx context.Context, access *proto.AccessKey) error {
+	if access.CreatedAt == nil {
+		access.CreatedAt = proto.Ptr(time.Now().UTC().Truncate(time.Second))
+	}
+	origins, services, limits, chains, err := marshalAccessKey(access)
+	if err != nil {
+		return err
+	}
+
+	const query = `INSERT INTO access_keys (` + accessKeyColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = s.db.ExecContext(ctx, query, access.AccessKey, access.ProjectID, access.DisplayName, access.Active,
+		access.Default, access.RequireOrigin, origins, services, access.CreatedAt.Unix(), unixTime(access.ExpiresAt), limits, chains)
+	if err != nil {
+		return fmt.Errorf("insert access key: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) UpdateAccessKey(ctx context.Context, access *proto.AccessKey) (*proto.AccessKey, error) {
+	origins, services, limits, chains, err := marshalAccessKey(access)
+	if err != nil {
+		return nil, err
+	}
+
+	const query = `UPDATE access_keys SET display_name = ?, active = ?, is_default = ?, require_origin = ?,
+		allowed_origins = ?, allowed_services = ?, expires_at = ?, service_limit = ?, allowed_chain_ids = ? WHERE access_key = ?`
+	res, err := s.db.ExecContext(ctx, query, access.DisplayName, access.Active, access.Default, access.RequireOrigin,
+		origins, services, unixTime(access.ExpiresAt), limits, chains, access.AccessKey)
+	if err != nil {
+		return nil, fmt.Errorf("update access key: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, proto.ErrAccessKeyNotFound
+	}
+	return s.FindAccessKey(ctx, access.AccessKey)
+}
+
+func (s *Store) FindAccessKey(ctx context.Context, accessKey string) (*proto.AccessKey, error) {
+	const query = `SELECT ` + accessKeyColumns + ` FROM access_keys WHERE access_key = ?`
+	access, err := scanAccessKey(s.db.QueryRowContext(ctx, query, accessKey))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, proto.ErrAccessKeyNotFound
+		}
+		return nil, fmt.Errorf("select access key: %w", err)
+	}
+	return access, nil
+}
+
+func (s *Store) ListAccessKeys(ctx context.Context, projectID uint64, active *bool, service *proto.Service) ([]*proto.AccessKey, error) {
+	query, args := `SELECT `+accessKeyColumns+` FROM access_keys WHERE project_id = ?`, []any{projectID}
+	if active != nil {
+		query, args = query+` AND active = ?`, append(args, *active)
+	}
+	query += ` ORDER BY created_at, access_key`
+
+	accessKeys, err := s.selectAccessKeys(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	// allowed services are stored as JSON, so the filter is applied here
+	if service != nil {
+		accessKeys = slices.DeleteFunc(accessKeys, func(access *proto.AccessKey) bool { return !access.ValidateService(*service) })
+	}
+	return accessKeys, nil
+}
+
+func (s *Store) ListExpiredAccessKeys(ctx context.Context, now time.Time) ([]*proto.AccessKey, error) {
+	const query = `SELECT ` + accessKeyColumns + ` FROM access_keys WHERE active = 1 AND expires_at IS NOT NULL AND expires_at <= ?
+	ORDER BY expires_at, access_key`
+	return s.selectAccessKeys(ctx, query, now.Unix())
+}
+
+// selectAccessKeys runs a query of the access key columns.
+func (s *Store) selectAccessKeys(ctx context.Context, query string, args ...any) ([]*proto.AccessKey, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("select access keys: %w", err)
+	}
+	defer rows.Close()
+
+	accessKeys := []*proto.AccessKey{}
+	for rows.Next() {
+		access, err := scanAccessKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan access key: %w", err)
+		}
+		accessKeys = append(accessKeys, access)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("select access keys: %w", err)
+	}
+	return accessKeys, nil
+}
+
+// usageUpsert returns the upsert of the usage in table, bucketed by the bucket column.
+func usageUpsert(table, bucket string) string {
+	return fmt.Sprintf(`INSERT INTO %[1]s (project_id, access_key, service, %[2]s, usage, credit, overage, limited)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (project_id, access_key, service, %[2]s) DO UPDATE SET usage = %[1]s.usage + excluded.usage,
+	credit = %[1]s.credit + excluded.credit, overage = %[1]s.overage + excluded.overage, limited = %[1]s.limited + excluded.limited`, table, bucket)
+}
+
+var (
+	insertUsageQuery     = usageUpsert("usage", "day")
+	insertUsageHourQuery = usageUpsert("usage_hours", "hour")
+)
+
+// insertUsage upserts the usage in the daily and hourly tables.
+func insertUsage(ctx context.Context, tx *sql.Tx, projectID uint64, accessKey string, service proto.Service, now time.Time, usage proto.UsageBreakdown) error {
+	buckets := []struct {
+		query  string
+		bucket int64
+	}{
+		{query: insertUsageQuery, bucket: day(now)},
+		{query: insertUsageHourQuery, bucket: hour(now)},
+	}
+	for _, b := range buckets {
+		args := []any{projectID, accessKey, uint16(service), b.bucket, usage.Total(), usage.Credit, usage.Overage, usage.Limited}
+		if _, err := tx.ExecContext(ctx, b.query, args...); err != nil {
+			return fmt.Errorf("upsert usage: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) InsertAccessUsage(ctx context.Context, projectID uint64, accessKey string, service proto.Service, now time.Time, usage proto.UsageBreakdown) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		return insertUsage(ctx, tx, projectID, accessKey, service, now, usage)
+	})
+}
+
+// InsertBatchUsage inserts the usage and the batch ID in a transaction, it returns false if the batch ID exists.
+func (s *Store) InsertBatchUsage(ctx context.Context, batchID string, projectID uint64, accessKey string, service proto.Service, now time.Time, usage proto.UsageBreakdown) (bool, error) {
+	var inserted bool
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		ok, err := insertBatch(ctx, tx, batchID)
+		if err != nil || !ok {
+			return err
+		}
+		if err := insertUsage(ctx, tx, projectID, accessKey, service, now, usage); err != nil {
+			return err
+		}
+		inserted = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return inserted, nil
+}
+
+// insertBatch inserts the batch ID, it returns false if it exists.
+func insertBatch(ctx context.Context, tx *sql.Tx, batchID string) (bool, error) {
+	const query = `INSERT INTO usage_batches (id, created_at) VALUES (?, ?) ON CONFLICT (id) DO NOTHING`
+	res, err := tx.ExecContext(ctx, query, batchID, time.Now().Unix())
+	if err != nil {
+		return false, fmt.Errorf("insert usage batch: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("insert usage batch: %w", err)
+	}
+	return n > 0, nil
+}
+
+// PruneUsageBatches deletes the batch IDs processed before the given time.
+// Clients retry a batch until it's synced, so the retention must be longer than an outage could last.
+func (s *Store) PruneUsageBatches(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM usage_batches WHERE created_at < ?`, before.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("delete usage batches: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete usage batches: %w", err)
+	}
+	return n, nil
+}
+
+// PruneUsageHours deletes the hourly usage before the given time, the daily usage is kept.
+func (s *Store) PruneUsageHours(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM usage_hours WHERE hour < ?`, hour(before))
+	if err != nil {
+		return 0, fmt.Errorf("delete usage hours: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete usage hours: %w", err)
+	}
+	return n, nil
+}
+
+// GetUsageHistory returns the usage by time bucket between min and max, both included.
+// The daily history is read from the usage table, the hourly one from usage_hours.
+func (s *Store) GetUsageHistory(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, min, max time.Time, granularity proto.UsageGranularity, groupBy []proto.UsageGroupBy) ([]*proto.UsagePoint, error) {
+	table, bucket, from, to := "usage", "day", day(min), day(max)
+	if granularity == proto.UsageGranularity_Hour {
+		table, bucket, from, to = "usage_hours", "hour", hour(min), hour(max)
+	}
+	byService := slices.Contains(groupBy, proto.UsageGroupBy_Service)
+	byAccessKey := slices.Contains(groupBy, proto.UsageGroupBy_AccessKey)
+
+	columns := []string{bucket}
+	if byService {
+		columns = append(columns, "service")
+	}
+	if byAccessKey {
+		columns = append(columns, "access_key")
+	}
+	group := strings.Join(columns, ", ")
+
+	query := `SELECT ` + group + `, SUM(usage - credit - overage), SUM(credit), SUM(overage), SUM(limited) FROM ` + table +
+		` WHERE project_id = ? AND ` + bucket + ` >= ? AND ` + bucket + ` <= ?`
+	args := []any{projectID, from, to}
+	if accessKey != nil {
+		query, args = query+` AND access_key = ?`, append(args, *accessKey)
+	}
+	if service != nil {
+		query, args = query+` AND service = ?`, append(args, uint16(*service))
+	}
+	query += ` GROUP BY ` + group + ` ORDER BY ` + group
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("select usage history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []*proto.UsagePoint{}
+	for rows.Next() {
+		var (
+			t     int64
+			svc   uint16
+			key   string
+			usage proto.UsageBreakdown
+		)
+		dest := []any{&t}
+		if byService {
+			dest = append(dest, &svc)
+		}
+		if byAccessKey {
+			dest = append(dest, &key)
+		}
+		dest = append(dest, &usage.Free, &usage.Credit, &usage.Overage, &usage.Limited)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("scan usage history: %w", err)
+		}
+
+		p := proto.UsagePoint{Time: time.Unix(t, 0).UTC(), Usage: &usage}
+		if byService {
+			p.Service = proto.Ptr(proto.Service(svc))
+		}
+		if byAccessKey {
+			p.AccessKey = proto.Ptr(key)
+		}
+		history = append(history, &p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("select usage history: %w", err)
+	}
+	return history, nil
+}
+
+// GetAccessKeyUsage returns the usage of an access key for the days between min and max, both included.
+// An empty accessKey returns the usage not tied to any key.
+func (s *Store) GetAccessKeyUsage(ctx context.Context, projectID uint64, accessKey string, service *proto.Service, min, max time.Time) (int64, error) {
+	query := `SELECT COALESCE(SUM(usage), 0) FROM usage WHERE project_id = ? AND access_key = ? AND day >= ? AND day <= ?`
+	return s.sumUsage(ctx, query, service, projectID, accessKey, day(min), day(max))
+}
+
+// GetAccountUsage returns the usage of a project for the days between min and max, both included.
+func (s *Store) GetAccountUsage(ctx context.Context, projectID uint64, service *proto.Service, min, max time.Time) (int64, error) {
+	query := `SELECT COALESCE(SUM(usage), 0) FROM usage WHERE project_id = ? AND day >= ? AND day <= ?`
+	return s.sumUsage(ctx, query, service, projectID, day(min), day(max))
+}
+
+// GetUsageBreakdown returns the usage by bucket for the days between min and max, both included.
+// A nil accessKey returns the usage of the whole project, an empty one the usage not tied to any key.
+func (s *Store) GetUsageBreakdown(ctx context.Context, projectID uint64, accessKey *string, service *proto.Service, min, max time.Time) (proto.UsageBreakdown, error) {
+	query := `SELECT COALESCE(SUM(usage - credit - overage), 0), COALESCE(SUM(credit), 0), COALESCE(SUM(overage), 0),
+		COALESCE(SUM(limited), 0) FROM usage WHERE project_id = ? AND day >= ? AND day <= ?`
+	args := []any{projectID, day(min), day(max)}
+	if accessKey != nil {
+		query, args = query+` AND access_key = ?`, append(args, *accessKey)
+	}
+	if service != nil {
+		query, args = query+` AND service = ?`, append(args, uint16(*service))
+	}
+
+	var usage proto.UsageBreakdown
+	if err := s.db.QueryRowContext(ctx, query, args...).Scan(&usage.Free, &usage.Credit, &usage.Overage, &usage.Limited); err != nil {
+		return proto.UsageBreakdown{}, fmt.Errorf("select usage breakdown: %w", err)
+	}
+	return usage, nil
+}
+
+func (s *Store) sumUsage(ctx context.Context, query string, service *proto.Service, args ...any) (int64, error) {
+	if service != nil {
+		query, args = query+` AND service = ?`, append(args, uint16(*service))
+	}
+	var usage int64
+	if err := s.db.QueryRowContext(ctx, query, args...).Scan(&usage); err != nil {
+		return 0, fmt.Errorf("select usage: %w", err)
+	}
+	return usage, nil
+}
+
+const creditGrantColumns = `id, project_id, service, amount, used, description, created_at, expires_at, revoked_at`
+
+// InsertCreditGrant inserts the grant and sets its ID.
+func (s *Store) InsertCreditGrant(ctx context.Context, grant *proto.CreditGrant) error {
+	const query = `INSERT INTO credit_grants (project_id, service, amount, used, description, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	res, err := s.db.ExecContext(ctx, query, grant.ProjectID, uint16(grant.Service), grant.Amount, grant.Used,
+		grant.Description, grant.CreatedAt.Unix(), grant.ExpiresAt.Unix())
+	if err != nil {
+		return fmt.Errorf("insert credit grant: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("insert credit grant: %w", err)
+	}
+	grant.ID = uint64(id)
+	return nil
+}
+
+func (s *Store) ListCreditGrants(ctx context.Context, projectID uint64, service *proto.Service) ([]*proto.CreditGrant, error) {
+	query, args := `SELECT `+creditGrantColumns+` FROM credit_grants WHERE project_id = ?`, []any{projectID}
+	if service != nil {
+		query, args = query+` AND service = ?`, append(args, uint16(*service))
+	}
+	query += ` ORDER BY id`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("select credit grants: %w", err)
+	}
+	defer rows.Close()
+
+	grants := []*proto.CreditGrant{}
+	for rows.Next() {
+		var (
+			grant                proto.CreditGrant
+			service              uint16
+			createdAt, expiresAt int64
+			revokedAt            sql.NullInt64
+		)
+		err := rows.Scan(&grant.ID, &grant.ProjectID, &service, &grant.Amount, &grant.Used, &grant.Description,
+			&createdAt, &expiresAt, &revokedAt)
+		if err != nil {
+			return nil, fmt.Errorf("scan credit grant: %w", err)
+		}
+		grant.Service = proto.Service(service)
+		grant.CreatedAt = time.Unix(createdAt, 0).UTC()
+		grant.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+		if revokedAt.Valid {
+			grant.RevokedAt = proto.Ptr(time.Unix(revokedAt.Int64, 0).UTC())
+		}
+		grants = append(grants, &grant)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("select credit grants: %w", err)
+	}
+	return grants, nil
+}
+
+// RevokeCreditGrant revokes a grant of the project, it returns false if the grant is not found or already revoked.
+func (s *Store) RevokeCreditGrant(ctx context.Context, projectID, grantID uint64, now time.Time) (bool, error) {
+	const query = `UPDATE credit_grants SET revoked_at = ? WHERE id = ? AND project_id = ? AND revoked_at IS NULL`
+	res, err := s.db.ExecContext(ctx, query, now.Unix(), grantID, projectID)
+	if err != nil {
+		return false, fmt.Errorf("revoke credit grant: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("revoke credit grant: %w", err)
+	}
+	return n > 0, nil
+}
+
+// InsertUsageWithCredits inserts the usage, the batch ID if not empty, and the usage paid with each grant in a transaction.
+// The used amount of a grant never exceeds its amount, the transaction fails with quotacontrol.ErrCreditsExhausted instead.
+func (s *Store) InsertUsageWithCredits(ctx context.Context, batchID string, projectID uint64, accessKey string, service proto.Service, now time.Time, usage proto.UsageBreakdown, spends []quotacontrol.CreditSpend) (bool, error) {
+	var inserted bool
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		if batchID != "" {
+			ok, err := insertBatch(ctx, tx, batchID)
+			if err != nil || !ok {
+				return err
+			}
+		}
+		if err := insertUsage(ctx, tx, projectID, accessKey, service, now, usage); err != nil {
+			return err
+		}
+		for _, v := range spends {
+			if err := insertCreditUsage(ctx, tx, projectID, service, now, v); err != nil {
+				return err
+			}
+		}
+		inserted = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return inserted, nil
+}
+
+// insertCreditUsage adds the spend to the used amount of the grant, if it has the credits left, and upserts the credit usage of the day.
+func insertCreditUsage(ctx context.Context, tx *sql.Tx, projectID uint64, service proto.Service, now time.Time, spend quotacontrol.CreditSpend) error {
+	const update = `UPDATE credit_grants SET used = used + ? WHERE id = ? AND project_id = ? AND used + ? <= amount`
+	res, err := tx.ExecContext(ctx, update, spend.Amount, spend.GrantID, projectID, spend.Amount)
+	if err != nil {
+		return fmt.Errorf("update credit grant: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("update credit grant: %w", err)
+	}
+	if n == 0 {
+		return quotacontrol.ErrCreditsExhausted
+	}
+	const query = `INSERT INTO credit_usage (project_id, grant_id, service, day, usage) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (grant_id, day) DO UPDATE SET usage = credit_usage.usage + excluded.usage`
+	if _, err := tx.ExecContext(ctx, query, projectID, spend.GrantID, uint16(service), day(now), spend.Amount); err != nil {
+		return fmt.Errorf("upsert credit usage: %w", err)
+	}
+	return nil
+}
+
+// GetCreditUsage returns the usage paid with credits for the days between min and max, both included.
+func (s *Store) GetCreditUsage(ctx context.Context, projectID uint64, service *proto.Service, min, max time.Time) (int64, error) {
+	query := `SELECT COALESCE(SUM(usage), 0) FROM credit_usage WHERE project_id = ? AND day >= ? AND day <= ?`
+	return s.sumUsage(ctx, query, service, projectID, day(min), day(max))
+}
+
+// SetUserPermission creates or updates the permission of a user on a project.
+func (s *Store) SetUserPermission(ctx context.Context, projectID uint64, userID string, permission proto.UserPermission, access proto.ResourceAccess) error {
+	data, err := json.Marshal(access)
+	if err != nil {
+		return fmt.Errorf("marshal access: %w", err)
+	}
+	const query = `INSERT INTO user_permissions (project_id, user_id, permission, access) VALUES (?, ?, ?, ?)
+		ON CONFLICT (project_id, user_id) DO UPDATE SET permission = excluded.permission, access = excluded.access`
+	if _, err := s.db.ExecContext(ctx, query, projectID, userID, uint16(permission), string(data)); err != nil {
+		return fmt.Errorf("upsert user permission: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) GetUserPermission(ctx context.Context, projectID uint64, userID string) (proto.UserPermission, *proto.ResourceAccess, error) {
+	const query = `SELECT permission, access FROM user_permissions WHERE project_id = ? AND user_id = ?`
+
+	var (
+		permission uint16
+		data       string
+	)
+	err := s.db.QueryRowContext(ctx, query, projectID, userID).Scan(&permission, &data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return proto.UserPermission_UNAUTHORIZED, nil, nil
+		}
+		return proto.UserPermission_UNAUTHORIZED, nil, fmt.Errorf("select user permission: %w", err)
+	}
+	var access proto.ResourceAccess
+	if err := json.Unmarshal([]byte(data), &access); err != nil {
+		return proto.UserPermission_UNAUTHORIZED, nil, fmt.Errorf("unmarshal access: %w", err)
+	}
+	return proto.UserPermission(permission), &access, nil
+}
+
+// InsertAuditEvent inserts the event and sets its ID.
+func (s *Store) InsertAuditEvent(ctx context.Context, event *proto.AuditEvent) error {
+	before, err := marshalOptional(event.Before)
+	if err != nil {
+		return fmt.Errorf("marshal before: %w", err)
+	}
+	after, err := marshalOptional(event.After)
+	if err != nil {
+		return fmt.Errorf("marshal after: %w", err)
+	}
+	grant, err := marshalOptional(event.CreditGrant)
+	if err != nil {
+		return fmt.Errorf("marshal credit grant: %w", err)
+	}
+	var service *uint16
+	if event.Service != nil {
+		service = proto.Ptr(uint16(*event.Service))
+	}
+
+	const query = `INSERT INTO audit_events (project_id, actor, rpc, before, after, credit_grant, service, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := s.db.ExecContext(ctx, query, event.ProjectID, event.Actor, event.RPC, before, after, grant, service, event.CreatedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("insert audit event: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("insert audit event: %w", err)
+	}
+	event.ID = uint64(id)
+	return nil
+}
+
+// ListAuditEvents returns the events of the project created between min and max, both included, oldest first.
+func (s *Store) ListAuditEvents(ctx context.Context, projectID uint64, min, max time.Time) ([]*proto.AuditEvent, error) {
+	const query = `SELECT id, project_id, actor, rpc, before, after, credit_grant, service, created_at FROM audit_events
+		WHERE project_id = ? AND created_at >= ? AND created_at <= ? ORDER BY created_at, id`
+	rows, err := s.db.QueryContext(ctx, query, projectID, min.Unix(), max.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("select audit events: %w", err)
+	}
+	defer rows.Close()
+
+	events := []*proto.AuditEvent{}
+	for rows.Next() {
+		var (
+			event                proto.AuditEvent
+			before, after, grant sql.NullString
+			service              sql.NullInt16
+			createdAt            int64
+		)
+		err := rows.Scan(&event.ID, &event.ProjectID, &event.Actor, &event.RPC, &before, &after, &grant, &service, &createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("scan audit event: %w", err)
+		}
+		if event.Before, err = unmarshalOptional[proto.AccessKey](before); err != nil {
+			return nil, fmt.Errorf("unmarshal before: %w", err)
+		}
+		if event.After, err = unmarshalOptional[proto.AccessKey](after); err != nil {
+			return nil, fmt.Errorf("unmarshal after: %w", err)
+		}
+		if event.CreditGrant, err = unmarshalOptional[proto.CreditGrant](grant); err != nil {
+			return nil, fmt.Errorf("unmarshal credit grant: %w", err)
+		}
+		if service.Valid {
+			event.Service = proto.Ptr(proto.Service(service.Int16))
+		}
+		event.CreatedAt = time.Unix(createdAt, 0).UTC()
+		events = append(events, &event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("select audit events: %w", err)
+	}
+	return events, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAccessKey(row scanner) (*proto.AccessKey, error) {
+	var (
+		access                            proto.AccessKey
+		origins, services, limits, chains string
+		createdAt                         int64
+		expiresAt                         sql.NullInt64
+	)
+	err := row.Scan(&access.AccessKey, &access.ProjectID, &access.DisplayName, &access.Active, &access.Default,
+		&access.RequireOrigin, &origins, &services, &createdAt, &expiresAt, &limits, &chains)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(origins), &access.AllowedOrigins); err != nil {
+		return nil, fmt.Errorf("unmarshal allowed origins: %w", err)
+	}
+	if err := json.Unmarshal([]byte(services), &access.AllowedServices); err != nil {
+		return nil, fmt.Errorf("unmarshal allowed services: %w", err)
+	}
+	if err := json.Unmarshal([]byte(limits), &access.ServiceLimit); err != nil {
+		return nil, fmt.Errorf("unmarshal service limit: %w", err)
+	}
+	// the keys without limits are stored as an empty object
+	if len(access.ServiceLimit) == 0 {
+		access.ServiceLimit = nil
+	}
+	if err := json.Unmarshal([]byte(chains), &access.AllowedChainIDs); err != nil {
+		return nil, fmt.Errorf("unmarshal allowed chain IDs: %w", err)
+	}
+	// an empty list allows all the chains of the project
+	if len(access.AllowedChainIDs) == 0 {
+		access.AllowedChainIDs = nil
+	}
+	access.CreatedAt = proto.Ptr(time.Unix(createdAt, 0).UTC())
+	if expiresAt.Valid {
+		access.ExpiresAt = proto.Ptr(time.Unix(expiresAt.Int64, 0).UTC())
+	}
+	return &access, nil
+}
+
+func marshalAccessKey(access *proto.AccessKey) (origins, services, limits, chains string, err error) {
+	if origins, err = marshalJSON(access.AllowedOrigins); err != nil {
+		return "", "", "", "", fmt.Errorf("marshal allowed origins: %w", err)
+	}
+	if services, err = marshalJSON(access.AllowedServices); err != nil {
+		return "", "", "", "", fmt.Errorf("marshal allowed services: %w", err)
+	}
+	limits = "{}"
+	if len(access.ServiceLimit) > 0 {
+		b, err := json.Marshal(access.ServiceLimit)
+		if err != nil {
+			return "", "", "", "", fmt.Errorf("marshal service limit: %w", err)
+		}
+		limits = string(b)
+	}
+	if chains, err = marshalJSON(access.AllowedChainIDs); err != nil {
+		return "", "", "", "", fmt.Errorf("marshal allowed chain IDs: %w", err)
+	}
+	return origins, services, limits, chains, nil
+}
+
+// marshalJSON encodes v, storing nil slices as empty arrays.
+func marshalJSON[T any](v []T) (string, error) {
+	if v == nil {
+		v = []T{}
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// marshalOptional encodes v, or returns nil to store NULL.
+func marshalOptional[T any](v *T) (*string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Ptr(string(b)), nil
+}
+
+// unmarshalOptional decodes s, or returns nil if it's NULL.
+func unmarshalOptional[T any](s sql.NullString) (*T, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	var v T
+	if err := json.Unmarshal([]byte(s.String), &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// unixTime returns the unix time of t, or nil to store NULL.
+func unixTime(t *time.Time) *int64 {
+	if t == nil {
+		return nil
+	}
+	return proto.Ptr(t.Unix())
+}
+
+// day returns the usage bucket of t, the unix time of its day at midnight UTC.
+func day(t time.Time) int64 {
+	return t.UTC().Truncate(24 * time.Hour).Unix()
+}
+
+// hour returns the hourly usage bucket of t, the unix time of the start of its hour.
+func hour(t time.Time) int64 {
+	return t.UTC().Truncate(time.Hour).Unix()
+}
+
+// monthlyCycle returns the monthly cycle containing now, starting from anchor.
+func monthlyCycle(anchor, now time.Time) *proto.Cycle {
+	months := (now.Year()-anchor.Year())*12 + int(now.Month()-anchor.Month())
+	if addMonths(anchor, months).After(now) {
+		months--
+	}
+	return &proto.Cycle{
+		Start: addMonths(anchor, months),
+		End:   addMonths(anchor, months+1).AddDate(0, 0, -1),
+	}
+}
+
+// addMonths adds months to t, clamping the day to the last one of the resulting month
+// instead of rolling over into the next one (e.g. Jan 31 + 1 month is Feb 28).
+func addMonths(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	lastDay := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(t.Day(), lastDay)-1)
+}
@@ -0,0 +1,512 @@
+package sqlstore_test
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/0xsequence/quotacontrol"
+	"github.com/0xsequence/quotacontrol/proto"
+	"github.com/0xsequence/quotacontrol/store/sqlstore"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/goware/validation"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func newStore(t *testing.T) *sqlstore.Store {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "quotacontrol.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	store := sqlstore.New(db)
+	require.NoError(t, store.Migrate(context.Background()))
+	// migrations are applied only once
+	require.NoError(t, store.Migrate(context.Background()))
+	return store
+}
+
+func TestProjectInfo(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	_, err := store.GetProjectInfo(ctx, 1, time.Now())
+	assert.ErrorIs(t, err, proto.ErrProjectNotFound)
+
+	anchor := time.Date(2025, 1, 15, 0, 0, 0, 0, time.UTC)
+	info := proto.ProjectInfo{
+		ID:          1,
+		EcosystemID: 7,
+		Cycle:       &proto.Cycle{Start: anchor},
+		ChainIDs:    []uint64{1, 137},
+		Features:    []string{"feature"},
+	}
+	require.NoError(t, store.SetProjectInfo(ctx, 1, &info))
+
+	got, err := store.GetProjectInfo(ctx, 1, time.Date(2025, 3, 20, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, info.EcosystemID, got.EcosystemID)
+	assert.Equal(t, info.ChainIDs, got.ChainIDs)
+	assert.Equal(t, info.Features, got.Features)
+	assert.Equal(t, time.Date(2025, 3, 15, 0, 0, 0, 0, time.UTC), got.Cycle.Start)
+	assert.Equal(t, time.Date(2025, 4, 14, 0, 0, 0, 0, time.UTC), got.Cycle.End)
+
+	got, err = store.GetProjectInfo(ctx, 1, time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 2, 15, 0, 0, 0, 0, time.UTC), got.Cycle.Start)
+
+	require.NoError(t, store.SetProjectInfo(ctx, 1, nil))
+	_, err = store.GetProjectInfo(ctx, 1, time.Now())
+	assert.ErrorIs(t, err, proto.ErrProjectNotFound)
+}
+
+func TestProjectCycleEndOfMonth(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		anchor     time.Time
+		now        time.Time
+		start, end time.Time
+	}{
+		{date(2025, 1, 29), date(2025, 2, 15), date(2025, 1, 29), date(2025, 2, 27)},
+		{date(2025, 1, 29), date(2025, 3, 1), date(2025, 2, 28), date(2025, 3, 28)},
+		{date(2025, 1, 30), date(2025, 3, 1), date(2025, 2, 28), date(2025, 3, 29)},
+		{date(2025, 1, 30), date(2025, 4, 1), date(2025, 3, 30), date(2025, 4, 29)},
+		{date(2025, 1, 31), date(2025, 2, 15), date(2025, 1, 31), date(2025, 2, 27)},
+		{date(2025, 1, 31), date(2025, 3, 1), date(2025, 2, 28), date(2025, 3, 30)},
+		{date(2025, 1, 31), date(2025, 3, 31), date(2025, 3, 31), date(2025, 4, 29)},
+		{date(2025, 1, 31), date(2025, 5, 1), date(2025, 4, 30), date(2025, 5, 30)},
+		{date(2024, 1, 31), date(2024, 3, 1), date(2024, 2, 29), date(2024, 3, 30)},
+	}
+	for _, tt := range tests {
+		info := proto.ProjectInfo{ID: 1, Cycle: &proto.Cycle{Start: tt.anchor}}
+		require.NoError(t, store.SetProjectInfo(ctx, 1, &info))
+
+		got, err := store.GetProjectInfo(ctx, 1, tt.now)
+		require.NoError(t, err)
+		assert.Equal(t, tt.start, got.Cycle.Start, "anchor %s, now %s", tt.anchor, tt.now)
+		assert.Equal(t, tt.end, got.Cycle.End, "anchor %s, now %s", tt.anchor, tt.now)
+	}
+}
+
+func TestAccessLimit(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	_, err := store.GetAccessLimit(ctx, 1, nil)
+	assert.ErrorIs(t, err, proto.ErrProjectNotFound)
+
+	limit := proto.Limit{
+		RateLimit: 100,
+		FreeMax:   1000,
+		OverMax:   2000,
+		ServiceLimit: map[string]proto.ServiceLimit{
+			proto.Service_Indexer.String(): {RateLimit: 10, FreeMax: 100, OverMax: 200},
+		},
+	}
+	require.NoError(t, store.SetAccessLimit(ctx, 1, &limit))
+
+	got, err := store.GetAccessLimit(ctx, 1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, limit, *got)
+
+	// the project is created along with the limit
+	_, err = store.GetProjectInfo(ctx, 1, time.Now())
+	require.NoError(t, err)
+}
+
+func TestAccessKeys(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	key := proto.AccessKey{
+		ProjectID:       1,
+		DisplayName:     "key",
+		AccessKey:       "abc",
+		Active:          true,
+		Default:         true,
+		AllowedOrigins:  validation.Origins{},
+		AllowedServices: []proto.Service{proto.Service_Indexer},
+	}
+	require.NoError(t, store.InsertAccessKey(ctx, &key))
+	require.NotNil(t, key.CreatedAt)
+	assert.Error(t, store.InsertAccessKey(ctx, &key))
+
+	require.NoError(t, store.InsertAccessKey(ctx, &proto.AccessKey{ProjectID: 1, AccessKey: "def"}))
+	require.NoError(t, store.InsertAccessKey(ctx, &proto.AccessKey{ProjectID: 2, AccessKey: "ghi", Active: true}))
+
+	got, err := store.FindAccessKey(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, key, *got)
+
+	_, err = store.FindAccessKey(ctx, "xyz")
+	assert.ErrorIs(t, err, proto.ErrAccessKeyNotFound)
+
+	list, err := store.ListAccessKeys(ctx, 1, nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, list, 2)
+
+	list, err = store.ListAccessKeys(ctx, 1, proto.Ptr(true), nil)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "abc", list[0].AccessKey)
+
+	list, err = store.ListAccessKeys(ctx, 1, nil, proto.Ptr(proto.Service_NodeGateway))
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "def", list[0].AccessKey)
+
+	key.DisplayName = "renamed"
+	key.RequireOrigin = true
+	key.AllowedOrigins = validation.Origins{"http://localhost:8080"}
+	key.ExpiresAt = proto.Ptr(key.CreatedAt.Add(time.Hour))
+	key.SetSetting(proto.Service_Indexer, proto.ServiceLimit{RateLimit: 10, OverMax: 100})
+	key.AllowedChainIDs = []uint64{1, 137}
+	updated, err := store.UpdateAccessKey(ctx, &key)
+	require.NoError(t, err)
+	assert.Equal(t, key, *updated)
+
+	list, err = store.ListExpiredAccessKeys(ctx, key.ExpiresAt.Add(-time.Second))
+	require.NoError(t, err)
+	assert.Empty(t, list)
+	list, err = store.ListExpiredAccessKeys(ctx, *key.ExpiresAt)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "abc", list[0].AccessKey)
+
+	_, err = store.UpdateAccessKey(ctx, &proto.AccessKey{AccessKey: "xyz"})
+	assert.ErrorIs(t, err, proto.ErrAccessKeyNotFound)
+}
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	day := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	for i := range 10 {
+		now := day.AddDate(0, 0, i)
+		require.NoError(t, store.InsertAccessUsage(ctx, 1, "abc", proto.Service_Indexer, now, proto.UsageBreakdown{Free: 1}))
+		require.NoError(t, store.InsertAccessUsage(ctx, 1, "abc", proto.Service_Indexer, now.Add(time.Hour), proto.UsageBreakdown{Free: 1}))
+		require.NoError(t, store.InsertAccessUsage(ctx, 1, "abc", proto.Service_NodeGateway, now, proto.UsageBreakdown{Free: 10}))
+		require.NoError(t, store.InsertAccessUsage(ctx, 1, "", proto.Service_Indexer, now, proto.UsageBreakdown{Free: 100}))
+		require.NoError(t, store.InsertAccessUsage(ctx, 2, "def", proto.Service_Indexer, now, proto.UsageBreakdown{Free: 1000}))
+	}
+
+	min, max := day, day.AddDate(0, 0, 4)
+
+	usage, err := store.GetAccessKeyUsage(ctx, 1, "abc", proto.Ptr(proto.Service_Indexer), min, max)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5*2), usage)
+
+	usage, err = store.GetAccessKeyUsage(ctx, 1, "abc", nil, min, max)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5*12), usage)
+
+	usage, err = store.GetAccessKeyUsage(ctx, 1, "", nil, min, max)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5*100), usage)
+
+	usage, err = store.GetAccountUsage(ctx, 1, proto.Ptr(proto.Service_Indexer), min, max)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5*102), usage)
+
+	usage, err = store.GetAccountUsage(ctx, 1, nil, day.AddDate(0, -1, 0), day.AddDate(0, 1, 0))
+	require.NoError(t, err)
+	assert.Equal(t, int64(10*112), usage)
+
+	usage, err = store.GetAccountUsage(ctx, 3, nil, min, max)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usage)
+}
+
+func TestUsageBreakdown(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	require.NoError(t, store.InsertAccessUsage(ctx, 1, "abc", proto.Service_Indexer, now, proto.UsageBreakdown{Free: 10, Credit: 5}))
+	require.NoError(t, store.InsertAccessUsage(ctx, 1, "abc", proto.Service_Indexer, now, proto.UsageBreakdown{Overage: 3, Limited: 2}))
+	require.NoError(t, store.InsertAccessUsage(ctx, 1, "", proto.Service_Indexer, now, proto.UsageBreakdown{Free: 7, Limited: 1}))
+
+	// the limited usage is not part of the usage
+	usage, err := store.GetAccountUsage(ctx, 1, nil, now, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(25), usage)
+
+	breakdown, err := store.GetUsageBreakdown(ctx, 1, nil, nil, now, now)
+	require.NoError(t, err)
+	assert.Equal(t, proto.UsageBreakdown{Free: 17, Credit: 5, Overage: 3, Limited: 3}, breakdown)
+
+	breakdown, err = store.GetUsageBreakdown(ctx, 1, proto.Ptr("abc"), proto.Ptr(proto.Service_Indexer), now, now)
+	require.NoError(t, err)
+	assert.Equal(t, proto.UsageBreakdown{Free: 10, Credit: 5, Overage: 3, Limited: 2}, breakdown)
+
+	breakdown, err = store.GetUsageBreakdown(ctx, 1, proto.Ptr(""), nil, now, now)
+	require.NoError(t, err)
+	assert.Equal(t, proto.UsageBreakdown{Free: 7, Limited: 1}, breakdown)
+}
+
+func TestUsageHistory(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 3 {
+		now := day.AddDate(0, 0, i)
+		require.NoError(t, store.InsertAccessUsage(ctx, 1, "abc", proto.Service_Indexer, now.Add(time.Hour), proto.UsageBreakdown{Free: 1}))
+		require.NoError(t, store.InsertAccessUsage(ctx, 1, "abc", proto.Service_Indexer, now.Add(90*time.Minute), proto.UsageBreakdown{Free: 2}))
+		require.NoError(t, store.InsertAccessUsage(ctx, 1, "def", proto.Service_NodeGateway, now.Add(2*time.Hour), proto.UsageBreakdown{Overage: 4, Limited: 1}))
+		require.NoError(t, store.InsertAccessUsage(ctx, 2, "ghi", proto.Service_Indexer, now, proto.UsageBreakdown{Free: 100}))
+	}
+
+	history, err := store.GetUsageHistory(ctx, 1, nil, nil, day, day.AddDate(0, 0, 1), proto.UsageGranularity_Day, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []*proto.UsagePoint{
+		{Time: day, Usage: &proto.UsageBreakdown{Free: 3, Overage: 4, Limited: 1}},
+		{Time: day.AddDate(0, 0, 1), Usage: &proto.UsageBreakdown{Free: 3, Overage: 4, Limited: 1}},
+	}, history)
+
+	groupBy := []proto.UsageGroupBy{proto.UsageGroupBy_Service, proto.UsageGroupBy_AccessKey}
+	history, err = store.GetUsageHistory(ctx, 1, nil, nil, day, day.Add(23*time.Hour), proto.UsageGranularity_Hour, groupBy)
+	require.NoError(t, err)
+	assert.Equal(t, []*proto.UsagePoint{
+		{Time: day.Add(time.Hour), Service: proto.Ptr(proto.Service_Indexer), AccessKey: proto.Ptr("abc"), Usage: &proto.UsageBreakdown{Free: 3}},
+		{Time: day.Add(2 * time.Hour), Service: proto.Ptr(proto.Service_NodeGateway), AccessKey: proto.Ptr("def"), Usage: &proto.UsageBreakdown{Overage: 4, Limited: 1}},
+	}, history)
+
+	history, err = store.GetUsageHistory(ctx, 1, proto.Ptr("abc"), proto.Ptr(proto.Service_Indexer), day, day.AddDate(0, 0, 5), proto.UsageGranularity_Day, nil)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	assert.Nil(t, history[0].Service)
+	assert.Nil(t, history[0].AccessKey)
+
+	// the hourly usage can be pruned, the daily one is kept
+	n, err := store.PruneUsageHours(ctx, day.AddDate(0, 0, 1))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	history, err = store.GetUsageHistory(ctx, 1, nil, nil, day, day.Add(23*time.Hour), proto.UsageGranularity_Hour, nil)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+	history, err = store.GetUsageHistory(ctx, 1, nil, nil, day, day, proto.UsageGranularity_Day, nil)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestUsageHoursMigration(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "quotacontrol.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	store := sqlstore.New(db)
+	require.NoError(t, store.Migrate(ctx))
+
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, store.InsertAccessUsage(ctx, 1, "abc", proto.Service_Indexer, day.Add(time.Hour), proto.UsageBreakdown{Free: 1}))
+	require.NoError(t, store.InsertAccessUsage(ctx, 1, "abc", proto.Service_Indexer, day.Add(5*time.Hour), proto.UsageBreakdown{Overage: 2, Limited: 3}))
+
+	// the usage recorded before the hourly table is seeded in the first hour of its day
+	_, err = db.ExecContext(ctx, `DROP TABLE usage_hours`)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = '0005_usage_hours'`)
+	require.NoError(t, err)
+	require.NoError(t, store.Migrate(ctx))
+
+	history, err := store.GetUsageHistory(ctx, 1, nil, nil, day, day.Add(23*time.Hour), proto.UsageGranularity_Hour, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []*proto.UsagePoint{
+		{Time: day, Usage: &proto.UsageBreakdown{Free: 1, Overage: 2, Limited: 3}},
+	}, history)
+}
+
+func TestUsageBatch(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	now := time.Now()
+	ok, err := store.InsertBatchUsage(ctx, "batch", 1, "abc", proto.Service_Indexer, now, proto.UsageBreakdown{Free: 5})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = store.InsertBatchUsage(ctx, "batch", 1, "abc", proto.Service_Indexer, now, proto.UsageBreakdown{Free: 5})
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	usage, err := store.GetAccessKeyUsage(ctx, 1, "abc", nil, now, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), usage)
+
+	n, err := store.PruneUsageBatches(ctx, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestCredits(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	grant := proto.CreditGrant{
+		ProjectID:   1,
+		Service:     proto.Service_Indexer,
+		Amount:      100,
+		Description: "top-up",
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(24 * time.Hour),
+	}
+	require.NoError(t, store.InsertCreditGrant(ctx, &grant))
+	assert.NotZero(t, grant.ID)
+	other := proto.CreditGrant{ProjectID: 1, Service: proto.Service_NodeGateway, Amount: 50, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	require.NoError(t, store.InsertCreditGrant(ctx, &other))
+
+	spend := func(batchID string, projectID uint64, amount int64) (bool, error) {
+		usage := proto.UsageBreakdown{Free: 5, Credit: amount}
+		return store.InsertUsageWithCredits(ctx, batchID, projectID, "", grant.Service, now, usage, []quotacontrol.CreditSpend{{GrantID: grant.ID, Amount: amount}})
+	}
+	ok, err := spend("", 1, 30)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = spend("batch", 1, 10)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = spend("batch", 1, 10)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// the spends over the credits left, or of other projects, insert nothing
+	_, err = spend("", 1, 61)
+	require.ErrorIs(t, err, quotacontrol.ErrCreditsExhausted)
+	_, err = spend("", 2, 10)
+	require.ErrorIs(t, err, quotacontrol.ErrCreditsExhausted)
+	breakdown, err := store.GetUsageBreakdown(ctx, 1, nil, nil, now, now)
+	require.NoError(t, err)
+	assert.Equal(t, proto.UsageBreakdown{Free: 10, Credit: 40}, breakdown)
+
+	grants, err := store.ListCreditGrants(ctx, 1, &grant.Service)
+	require.NoError(t, err)
+	require.Len(t, grants, 1)
+	grant.Used = 40
+	assert.Equal(t, &grant, grants[0])
+
+	usage, err := store.GetCreditUsage(ctx, 1, nil, now, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(40), usage)
+	usage, err = store.GetCreditUsage(ctx, 1, &other.Service, now, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), usage)
+
+	ok, err = store.RevokeCreditGrant(ctx, 1, grant.ID, now)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = store.RevokeCreditGrant(ctx, 1, grant.ID, now)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	grants, err = store.ListCreditGrants(ctx, 1, nil)
+	require.NoError(t, err)
+	require.Len(t, grants, 2)
+	assert.Equal(t, &now, grants[0].RevokedAt)
+	assert.Nil(t, grants[1].RevokedAt)
+}
+
+func TestUserPermission(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	perm, access, err := store.GetUserPermission(ctx, 1, "user")
+	require.NoError(t, err)
+	assert.Equal(t, proto.UserPermission_UNAUTHORIZED, perm)
+	assert.Nil(t, access)
+
+	resource := proto.ResourceAccess{ProjectID: 1, Subscription: &proto.Subscription{Tier: "pro"}}
+	require.NoError(t, store.SetUserPermission(ctx, 1, "user", proto.UserPermission_READ_WRITE, resource))
+
+	perm, access, err = store.GetUserPermission(ctx, 1, "user")
+	require.NoError(t, err)
+	assert.Equal(t, proto.UserPermission_READ_WRITE, perm)
+	assert.Equal(t, resource, *access)
+}
+
+func TestAuditEvents(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	key := proto.AccessKey{AccessKey: "abc", ProjectID: 1, Active: true, CreatedAt: proto.Ptr(now)}
+	disabled := key
+	disabled.Active = false
+	grant := proto.CreditGrant{ID: 3, ProjectID: 1, Service: proto.Service_Indexer, Amount: 100, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+
+	events := []*proto.AuditEvent{
+		{ProjectID: 1, Actor: "Admin", RPC: "CreateAccessKey", After: &key, CreatedAt: now},
+		{ProjectID: 1, Actor: "Admin", RPC: "DisableAccessKey", Before: &key, After: &disabled, CreatedAt: now.Add(time.Minute)},
+		{ProjectID: 1, Actor: "Service:api", RPC: "GrantCredits", CreditGrant: &grant, CreatedAt: now.Add(2 * time.Minute)},
+		{ProjectID: 1, Actor: "Admin", RPC: "ClearUsage", Service: proto.Ptr(proto.Service_Indexer), CreatedAt: now.Add(3 * time.Minute)},
+		{ProjectID: 2, Actor: "Admin", RPC: "ClearUsage", CreatedAt: now},
+	}
+	for i, e := range events {
+		require.NoError(t, store.InsertAuditEvent(ctx, e))
+		assert.Equal(t, uint64(i+1), e.ID)
+	}
+
+	list, err := store.ListAuditEvents(ctx, 1, time.Time{}, now.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, list, 4)
+	for i, e := range list {
+		assert.Equal(t, *events[i], *e)
+	}
+
+	// both ends of the interval are included
+	list, err = store.ListAuditEvents(ctx, 1, now.Add(time.Minute), now.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "DisableAccessKey", list[0].RPC)
+	assert.Equal(t, "GrantCredits", list[1].RPC)
+}
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	cache := quotacontrol.NewRedisCache(redisClient, time.Minute)
+	qc := quotacontrol.NewServer(quotacontrol.RedisConfig{}, slog.Default(), quotacontrol.Cache{
+		QuotaCache:      cache,
+		UsageCache:      cache,
+		PermissionCache: cache,
+	}, store.Stores())
+
+	const projectID = 1
+	require.NoError(t, store.SetAccessLimit(ctx, projectID, &proto.Limit{RateLimit: 10, FreeMax: 100, OverMax: 200}))
+
+	key, err := qc.CreateAccessKey(ctx, projectID, "key", false, nil, nil, nil, nil)
+	require.NoError(t, err)
+	assert.True(t, key.Default)
+
+	now := time.Now()
+	quota, err := qc.GetAccessQuota(ctx, key.AccessKey, now)
+	require.NoError(t, err)
+	assert.Equal(t, key.AccessKey, quota.AccessKey.AccessKey)
+	assert.Equal(t, int64(200), quota.Limit.OverMax)
+
+	// the replay of a batch is ignored
+	for range 2 {
+		ok, err := qc.SyncAccessKeyUsage(ctx, proto.Service_Indexer, now, map[string]int64{key.AccessKey: 5}, proto.Ptr("batch"), nil)
+		require.NoError(t, err)
+		assert.True(t, ok[key.AccessKey])
+	}
+
+	from, to := now.Add(-time.Hour), now.Add(time.Hour)
+	usage, err := qc.GetUsage(ctx, projectID, nil, nil, &from, &to)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), usage)
+}
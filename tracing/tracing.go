@@ -0,0 +1,111 @@
+// Package tracing creates the OpenTelemetry spans of the quota control client, middlewares and server.
+package tracing
+
+import (
+	"net/http"
+
+	"github.com/0xsequence/quotacontrol/proto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TracerName is the instrumentation name of the tracers.
+const TracerName = "github.com/0xsequence/quotacontrol"
+
+// Attributes of the spans.
+const (
+	ProjectIDKey = attribute.Key("quotacontrol.project_id")
+	ServiceKey   = attribute.Key("quotacontrol.service")
+	DecisionKey  = attribute.Key("quotacontrol.decision")
+	CacheKey     = attribute.Key("quotacontrol.cache")
+	DegradedKey  = attribute.Key("quotacontrol.degraded")
+)
+
+// Decisions of the middlewares.
+const (
+	Allowed = "allowed"
+	Denied  = "denied"
+)
+
+func ProjectID(projectID uint64) attribute.KeyValue {
+	return ProjectIDKey.Int64(int64(projectID))
+}
+
+func Service(service proto.Service) attribute.KeyValue {
+	return ServiceKey.String(service.GetName())
+}
+
+func Decision(decision string) attribute.KeyValue {
+	return DecisionKey.String(decision)
+}
+
+// Noop returns a tracer that doesn't record anything.
+func Noop() trace.Tracer {
+	return noop.NewTracerProvider().Tracer(TracerName)
+}
+
+// Error records the error in the span and sets its status.
+func Error(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End records the error, if any, and ends the span.
+func End(span trace.Span, err error) {
+	if err != nil {
+		Error(span, err)
+	}
+	span.End()
+}
+
+// Transport wraps the calls to the quota server in a client span, and sends its context to the server.
+// A nil propagator uses the global one.
+func Transport(tracer trace.Tracer, propagator propagation.TextMapPropagator, next http.RoundTripper) http.RoundTripper {
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		ctx, span := tracer.Start(req.Context(), spanName(req), trace.WithSpanKind(trace.SpanKindClient))
+		req = req.Clone(ctx)
+		propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+		res, err := next.RoundTrip(req)
+		if err == nil && res.StatusCode >= http.StatusBadRequest {
+			span.SetStatus(codes.Error, res.Status)
+		}
+		End(span, err)
+		return res, err
+	})
+}
+
+// Handler wraps the calls handled by the quota server in a server span, continuing the trace of the client.
+// A nil propagator uses the global one.
+func Handler(tracer trace.Tracer, propagator propagation.TextMapPropagator, next http.Handler) http.Handler {
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, spanName(r), trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// spanName is the RPC method of the request, the unknown paths share a name.
+func spanName(r *http.Request) string {
+	if m, ok := proto.WebrpcMethods()[r.URL.Path]; ok {
+		return m.Service() + "/" + m.Name()
+	}
+	return "QuotaControl/unknown"
+}
+
+type roundTripper func(req *http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,231 @@
+package quotacontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// usageChannel is the redis channel where the keys of the usage that is set are published.
+const usageChannel = "quotacontrol:" + cacheVersion + ":usage"
+
+// usageLockPrefix is the prefix of the value of the usage keys that are being loaded, it's followed by the fence of the lock.
+const usageLockPrefix = "lock:"
+
+func isUsageLock(v string) bool {
+	return strings.HasPrefix(v, usageLockPrefix)
+}
+
+func (s *RedisCache) LockUsage(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	fence := usageLockPrefix + strconv.FormatUint(rand.Uint64(), 36)
+	ok, err := s.client.SetNX(ctx, usageKey(key), fence, ttl).Result()
+	if err != nil {
+		return "", fmt.Errorf("lock usage: %w", err)
+	}
+	if !ok {
+		return "", errCacheWait
+	}
+	return fence, nil
+}
+
+// initUsageScript sets the usage only if the lock is still held, and notifies the waiters.
+//
+// KEYS[1] usage key
+// ARGV[1] fence
+// ARGV[2] usage
+// ARGV[3] ttl in milliseconds
+// ARGV[4] channel
+// ARGV[5] key published
+var initUsageScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+redis.call("PUBLISH", ARGV[4], ARGV[5])
+return 1
+`)
+
+func (s *RedisCache) InitUsage(ctx context.Context, key, fence string, amount int64, ttl time.Duration) (bool, error) {
+	ok, err := initUsageScript.Run(ctx, s.client, []string{usageKey(key)}, fence, amount, s.usageTTL(ttl).Milliseconds(), usageChannel, key).Bool()
+	if err != nil {
+		return false, fmt.Errorf("init usage: %w", err)
+	}
+	return ok, nil
+}
+
+// unlockUsageScript deletes the lock only if it's still held, and notifies the waiters.
+//
+// KEYS[1] usage key
+// ARGV[1] fence
+// ARGV[2] channel
+// ARGV[3] key published
+var unlockUsageScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+redis.call("PUBLISH", ARGV[2], ARGV[3])
+return 1
+`)
+
+func (s *RedisCache) UnlockUsage(ctx context.Context, key, fence string) error {
+	if err := unlockUsageScript.Run(ctx, s.client, []string{usageKey(key)}, fence, usageChannel, key).Err(); err != nil {
+		return fmt.Errorf("unlock usage: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisCache) WaitUsage(ctx context.Context, key string) error {
+	wake, done, err := s.waiters.wait(ctx, key)
+	if err != nil {
+		return fmt.Errorf("wait usage - subscribe: %w", err)
+	}
+	defer done()
+
+	// the usage may have been set before the subscription, and the holder of the lock may be gone
+	pipe := s.client.Pipeline()
+	get := pipe.Get(ctx, usageKey(key))
+	pttl := pipe.PTTL(ctx, usageKey(key))
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("wait usage - get: %w", err)
+	}
+	ttl := pttl.Val()
+	if !isUsageLock(get.Val()) || ttl <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(ttl)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-wake:
+	case <-timer.C:
+	}
+	return nil
+}
+
+func newUsageWaiters(client redis.UniversalClient) *usageWaiters {
+	return &usageWaiters{client: client, keys: make(map[string][]chan struct{})}
+}
+
+// usageWaiters wakes the callers of WaitUsage when the key they're waiting for is published.
+// The subscription is active only while there are waiters, it's made in the background without holding the lock.
+type usageWaiters struct {
+	client redis.UniversalClient
+
+	mu   sync.Mutex
+	sub  *usageSubscription
+	keys map[string][]chan struct{}
+}
+
+// usageSubscription is a subscription to the usage channel, shared by the waiters that joined it.
+type usageSubscription struct {
+	// ready is closed once the subscription is confirmed, or has failed with err.
+	ready chan struct{}
+	err   error
+	// cancel stops the subscription when the last waiter is done, it doesn't depend on the context of any of them.
+	cancel context.CancelFunc
+	// pubsub and count, the number of waiters of the subscription, are guarded by the lock of usageWaiters.
+	pubsub *redis.PubSub
+	count  int
+}
+
+// wait returns a channel that is closed when the key is published, done must be called once the wait is over.
+func (w *usageWaiters) wait(ctx context.Context, key string) (wake <-chan struct{}, done func(), err error) {
+	ch := make(chan struct{})
+
+	w.mu.Lock()
+	sub, first := w.sub, w.sub == nil
+	var subCtx context.Context
+	if first {
+		sub = &usageSubscription{ready: make(chan struct{})}
+		subCtx, sub.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		w.sub = sub
+	}
+	sub.count++
+	w.keys[key] = append(w.keys[key], ch)
+	w.mu.Unlock()
+
+	done = func() { w.done(sub, key, ch) }
+	if first {
+		go w.subscribe(subCtx, sub)
+	}
+
+	select {
+	case <-sub.ready:
+	case <-ctx.Done():
+		done()
+		return nil, nil, ctx.Err()
+	}
+	if sub.err != nil {
+		done()
+		return nil, nil, sub.err
+	}
+	return ch, done, nil
+}
+
+// subscribe subscribes to the usage channel and marks sub as ready.
+// A failed subscription is dropped, so that the next waiter tries again, and so is the one that nobody waits for anymore.
+func (w *usageWaiters) subscribe(ctx context.Context, sub *usageSubscription) {
+	defer close(sub.ready)
+
+	pubsub := w.client.Subscribe(ctx, usageChannel)
+	_, err := pubsub.Receive(ctx)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil || sub.count == 0 {
+		pubsub.Close()
+		sub.err = err
+		if w.sub == sub {
+			w.sub = nil
+		}
+		return
+	}
+	sub.pubsub = pubsub
+	go w.run(pubsub.Channel())
+}
+
+func (w *usageWaiters) done(sub *usageSubscription, key string, ch chan struct{}) {
+	w.mu.Lock()
+	if list := slices.DeleteFunc(w.keys[key], func(c chan struct{}) bool { return c == ch }); len(list) > 0 {
+		w.keys[key] = list
+	} else {
+		delete(w.keys, key)
+	}
+	sub.count--
+	var pubsub *redis.PubSub
+	if sub.count == 0 {
+		if w.sub == sub {
+			w.sub = nil
+		}
+		// a subscription still in progress is dropped by subscribe
+		pubsub = sub.pubsub
+		sub.cancel()
+	}
+	w.mu.Unlock()
+
+	if pubsub != nil {
+		pubsub.Close()
+	}
+}
+
+func (w *usageWaiters) run(msgs <-chan *redis.Message) {
+	for msg := range msgs {
+		w.mu.Lock()
+		for _, ch := range w.keys[msg.Payload] {
+			close(ch)
+		}
+		delete(w.keys, msg.Payload)
+		w.mu.Unlock()
+	}
+}